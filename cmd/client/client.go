@@ -1,37 +1,283 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"time"
 
 	"github.com/FBreuer2/simple-sync/lib/net"
+	"github.com/FBreuer2/simple-sync/lib/sync"
 )
 
+// connectionFlags are shared by all subcommands.
+type connectionFlags struct {
+	serverURL   string
+	fingerprint string
+	username    string
+	password    string
+	tokenFile   string
+	tokenLabel  string
+	keyFile     string
+}
+
+func newConnectionFlags(flagSet *flag.FlagSet) *connectionFlags {
+	cF := &connectionFlags{}
+
+	hostname, _ := os.Hostname()
+
+	flagSet.StringVar(&cF.serverURL, "u", "127.0.0.1:8888", "URL of the server.")
+	flagSet.StringVar(&cF.fingerprint, "f", "2926ea1c1e4adefb2ecbc7bb58e3172752d36274fdf899aca1667debd292fb7b", "Fingerprint of the server's tls certificate.")
+	flagSet.StringVar(&cF.username, "n", "user", "Name of the user to log in as.")
+	flagSet.StringVar(&cF.password, "p", "", "Password of the user, only needed until a token is stored.")
+	flagSet.StringVar(&cF.tokenFile, "t", "./simple-sync.token", "Path of the file the login token is stored in.")
+	flagSet.StringVar(&cF.tokenLabel, "l", hostname, "Label of this device's token on the server.")
+	flagSet.StringVar(&cF.keyFile, "k", "", "Path of a file holding a passphrase to encrypt files with before they are sent. Files are stored unencrypted if empty.")
+
+	return cF
+}
+
+func (cF *connectionFlags) connect() (*net.ClientContext, error) {
+	client := net.NewClient(cF.serverURL, cF.fingerprint, net.Credentials{
+		Username:   []byte(cF.username),
+		Password:   []byte(cF.password),
+		TokenFile:  cF.tokenFile,
+		TokenLabel: cF.tokenLabel,
+	})
+
+	if len(cF.keyFile) > 0 {
+		passphrase, err := ioutil.ReadFile(cF.keyFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		keyring, err := sync.NewKeyring(bytes.TrimRight(passphrase, "\r\n"), []byte(cF.username))
+
+		if err != nil {
+			return nil, err
+		}
+
+		client.SetKeyring(keyring)
+	}
+
+	if err := client.Start(); err != nil {
+		if errors.Is(err, net.NO_CREDENTIALS) == true {
+			return nil, fmt.Errorf("No token is stored in \"%s\", log in with the password given by -p once.", cF.tokenFile)
+		}
+
+		return nil, err
+	}
+
+	return client, nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			restoreCommand(os.Args[2:])
+			return
+		case "history":
+			historyCommand(os.Args[2:])
+			return
+		}
+	}
 
-	var pathToInputFile, serverURL, fingerprint string
+	syncCommand(os.Args[1:])
+}
 
-	flag.StringVar(&serverURL, "u", "127.0.0.1:8888", "URL of the server.")
-	flag.StringVar(&pathToInputFile, "i", "./file.bmp", "Path to a file which should be version controlled.")
-	flag.StringVar(&fingerprint, "f", "2926ea1c1e4adefb2ecbc7bb58e3172752d36274fdf899aca1667debd292fb7b", "Fingerprint of the server's tls certificate.")
-	flag.Parse()
+// syncCommand backs up a file or directory and keeps watching it.
+func syncCommand(arguments []string) {
+	var pathToInputFile string
 
-	client := net.NewClient(serverURL, fingerprint)
-	err := client.Start(pathToInputFile)
+	flagSet := flag.NewFlagSet("sync", flag.ExitOnError)
+	connection := newConnectionFlags(flagSet)
+	flagSet.StringVar(&pathToInputFile, "i", "./file.bmp", "Path to a file or directory which should be version controlled.")
+	flagSet.Parse(arguments)
+
+	client, err := connection.connect()
 
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
+	changes := make(chan bool, 1)
+
+	syncInput, err := watchInput(client, pathToInputFile, func() {
+		// a sync that is already pending will see this change as well
+		select {
+		case changes <- true:
+		default:
+		}
+	})
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	go func() {
+		for {
+			if err := syncInput(); err != nil {
+				log.Println(err)
+			}
+
+			<-changes
+		}
+	}()
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 
-	select {
-	case <-c:
-		go client.Stop()
+	for {
+		select {
+		case err := <-client.Errors():
+			log.Println(err)
+		case <-c:
+			go client.Stop()
+			return
+		}
+	}
+}
+
+// restoreCommand downloads a backed up file, by default its newest version.
+func restoreCommand(arguments []string) {
+	var remotePath, outputPath, storedBefore string
+	var versionID uint64
+
+	flagSet := flag.NewFlagSet("restore", flag.ExitOnError)
+	connection := newConnectionFlags(flagSet)
+	flagSet.StringVar(&remotePath, "r", "file.bmp", "Path of the file in the backup.")
+	flagSet.StringVar(&outputPath, "o", "", "Path to write the file to, defaults to its name in the backup. An existing file there is updated with only the differences.")
+	flagSet.Uint64Var(&versionID, "v", 0, "Id of the version to restore, as listed by the history command.")
+	flagSet.StringVar(&storedBefore, "at", "", "Restore the version that was backed up at this time, formatted like 2006-01-02T15:04:05Z07:00.")
+	flagSet.Parse(arguments)
+
+	if len(outputPath) == 0 {
+		outputPath = path.Base(remotePath)
+	}
+
+	var at time.Time
+
+	if len(storedBefore) > 0 {
+		parsed, err := time.Parse(time.RFC3339, storedBefore)
+
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		at = parsed
+	}
+
+	client, err := connection.connect()
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	defer client.Stop()
+
+	switch {
+	case versionID != 0:
+		err = client.RestoreVersion(remotePath, versionID, outputPath)
+	case at.IsZero() == false:
+		err = client.RestoreVersionAt(remotePath, at, outputPath)
+	default:
+		err = client.Restore(remotePath, outputPath)
+	}
+
+	if err != nil {
+		log.Println(err)
 		return
 	}
+
+	log.Printf("Restored \"%s\" to \"%s\".\n", remotePath, outputPath)
+}
+
+// historyCommand lists the backed up versions of a file.
+func historyCommand(arguments []string) {
+	var remotePath string
+
+	flagSet := flag.NewFlagSet("history", flag.ExitOnError)
+	connection := newConnectionFlags(flagSet)
+	flagSet.StringVar(&remotePath, "r", "file.bmp", "Path of the file in the backup.")
+	flagSet.Parse(arguments)
+
+	client, err := connection.connect()
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	defer client.Stop()
+
+	versions, err := client.ListVersions(remotePath)
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, version := range versions {
+		fmt.Printf("%d\t%s\t%d bytes\tchanged %s\t%s\n",
+			version.ID,
+			version.StoredAt.Format(time.RFC3339),
+			version.Metadata.FileSize,
+			version.Metadata.LastChanged.Format(time.RFC3339),
+			hex.EncodeToString(version.Metadata.FileHash))
+	}
+}
+
+// watchInput watches a single file, backed up under its name, or every file
+// below a directory, backed up under its path relative to that directory.
+// changed is called whenever the returned function should sync again.
+func watchInput(client *net.ClientContext, inputPath string, changed func()) (func() error, error) {
+	inputInfo, err := os.Stat(inputPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if inputInfo.IsDir() == false {
+		fileWatcher, err := sync.NewFileWatcher(inputPath)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := fileWatcher.Watch(changed); err != nil {
+			return nil, err
+		}
+
+		return func() error {
+			return client.SyncFile(filepath.Base(inputPath), fileWatcher)
+		}, nil
+	}
+
+	treeWatcher, err := sync.NewTreeWatcher(inputPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := treeWatcher.Watch(changed); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return treeWatcher.Sync(client)
+	}, nil
 }
@@ -2,16 +2,58 @@ package main
 
 import (
 	"crypto/tls"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/FBreuer2/simple-sync/lib/db"
 	"github.com/FBreuer2/simple-sync/lib/net"
 )
 
+// userRetentionFlag collects the policies given as "user:rules".
+type userRetentionFlag map[string]*db.RetentionPolicy
+
+func (uRF userRetentionFlag) String() string {
+	return ""
+}
+
+func (uRF userRetentionFlag) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+
+	if len(parts) != 2 {
+		return fmt.Errorf("Expected \"user:rules\", got \"%s\".", value)
+	}
+
+	policy, err := db.ParseRetentionPolicy(parts[1])
+
+	if err != nil {
+		return err
+	}
+
+	uRF[parts[0]] = policy
+	return nil
+}
+
 func main() {
 
+	var backend, databasePath, retention string
+	var collectionInterval, scrubInterval time.Duration
+	var scrub bool
+	userRetention := make(userRetentionFlag)
+
+	flag.StringVar(&backend, "db", "memory", "Database backend to use, either \"memory\" or \"disk\".")
+	flag.StringVar(&databasePath, "d", "./data", "Directory of the disk database.")
+	flag.StringVar(&retention, "retention", "", "Versions to keep, e.g. \"last=10,daily=7,weekly=4,monthly=12,max-age=8760h\". All versions are kept if empty.")
+	flag.Var(userRetention, "user-retention", "Versions to keep for one user as \"user:rules\", may be repeated.")
+	flag.DurationVar(&collectionInterval, "gc", time.Hour, "Interval of applying retention and collecting unreferenced blocks, 0 disables it.")
+	flag.DurationVar(&scrubInterval, "scrub-interval", 24*time.Hour, "Interval of re-hashing all stored blocks and quarantining corrupted ones, 0 disables it.")
+	flag.BoolVar(&scrub, "scrub", false, "Re-hash all stored blocks once, quarantine corrupted ones and exit.")
+	flag.Parse()
+
 	cer, err := tls.LoadX509KeyPair("./certs/server.crt", "./certs/server.key")
 
 	if err != nil {
@@ -19,16 +61,76 @@ func main() {
 		return
 	}
 
-	memoryDB := db.NewMemoryDB()
-	memoryDB.Register([]byte("user"), []byte("password"))
+	var database db.FullDatabase
+
+	switch backend {
+	case "memory":
+		database = db.NewMemoryDB()
+		break
+
+	case "disk":
+		diskDB, err := db.NewDiskDB(databasePath)
+
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		defer diskDB.Close()
+		database = diskDB
+		break
+
+	default:
+		log.Printf("Unknown database backend \"%s\".\n", backend)
+		return
+	}
 
-	srv, err := net.NewServer("127.0.0.1", "8888", cer, memoryDB)
+	if scrub == true {
+		report, err := db.Scrub(database)
+
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		for _, hash := range report.CorruptedBlocks {
+			fmt.Printf("%x corrupted, quarantined\n", hash)
+		}
+
+		for _, damagedVersion := range report.DamagedVersions {
+			fmt.Printf("%s: \"%s\" version %d damaged\n", string(damagedVersion.User), damagedVersion.Path, damagedVersion.Version.ID)
+		}
+
+		fmt.Printf("Checked %d blocks, %d were corrupted.\n", report.CheckedBlocks, len(report.CorruptedBlocks))
+		return
+	}
+
+	if err := database.Register([]byte("user"), []byte("password")); err != nil {
+		log.Println(err)
+	}
+
+	srv, err := net.NewServer("127.0.0.1", "8888", cer, database)
 
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
+	if len(retention) > 0 {
+		policy, err := db.ParseRetentionPolicy(retention)
+
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		srv.Collector().SetRetention(policy)
+	}
+
+	for user, policy := range userRetention {
+		srv.Collector().SetUserRetention([]byte(user), policy)
+	}
+
 	err = srv.Start()
 
 	if err != nil {
@@ -36,6 +138,14 @@ func main() {
 		return
 	}
 
+	if collectionInterval > 0 {
+		srv.CollectEvery(collectionInterval)
+	}
+
+	if scrubInterval > 0 {
+		srv.ScrubEvery(scrubInterval)
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	select {
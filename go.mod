@@ -1,16 +1,19 @@
 module github.com/FBreuer2/simple-sync
 
-go 1.14
+go 1.18
 
 require (
 	github.com/FBreuer2/librsync-go v0.0.0-20200411195639-2b12584783b2
-	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20200406173513-056763e48d71
+	golang.org/x/sys v0.0.0-20200409092240-59c9f1ba88fa
+)
+
+require (
+	github.com/balena-os/circbuf v0.0.0-20171122095043-56e73111d0b2 // indirect
 	github.com/kr/text v0.2.0 // indirect
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
-	github.com/sirupsen/logrus v1.5.0
 	github.com/stretchr/testify v1.5.1 // indirect
-	golang.org/x/crypto v0.0.0-20200406173513-056763e48d71
-	golang.org/x/sys v0.0.0-20200409092240-59c9f1ba88fa // indirect
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
 	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
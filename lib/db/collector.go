@@ -0,0 +1,302 @@
+package db
+
+import (
+	"errors"
+	gosync "sync"
+	"time"
+
+	"github.com/FBreuer2/simple-sync/lib/sync"
+)
+
+// CollectionStats summarizes one run of a BlockCollector.
+type CollectionStats struct {
+	RemovedVersions int
+	RemovedBlocks   int
+	KeptBlocks      int
+}
+
+// BlockCollector applies the retention policies of all users and then
+// deletes every block no remaining version of any user references, while
+// peers keep using the database. Peers pin the blocks of a file while they
+// transfer it, so blocks are not deleted between a peer finding them in the
+// database and committing the metadata that references them: a block that
+// was pinned at any time during a collection survives that collection.
+type BlockCollector struct {
+	database     FullDatabase
+	policy       *RetentionPolicy
+	userPolicies map[string]*RetentionPolicy
+	collectLock  gosync.Mutex
+	pinLock      gosync.Mutex
+	pins         map[string]int
+	touched      map[string]bool
+}
+
+func NewBlockCollector(database FullDatabase) *BlockCollector {
+	return &BlockCollector{
+		database:     database,
+		userPolicies: make(map[string]*RetentionPolicy),
+		pins:         make(map[string]int),
+	}
+}
+
+// SetRetention sets the policy of all users without a policy of their own.
+// Without any policy, no versions are removed and only blocks that are not
+// referenced anymore are collected.
+func (bC *BlockCollector) SetRetention(policy *RetentionPolicy) {
+	bC.collectLock.Lock()
+	defer bC.collectLock.Unlock()
+
+	bC.policy = policy
+}
+
+func (bC *BlockCollector) SetUserRetention(user []byte, policy *RetentionPolicy) {
+	bC.collectLock.Lock()
+	defer bC.collectLock.Unlock()
+
+	bC.userPolicies[string(user)] = policy
+}
+
+// Pin protects blocks from collection until they are unpinned. Blocks have
+// to be pinned before checking whether the database has them.
+func (bC *BlockCollector) Pin(hashes [][]byte) {
+	bC.pinLock.Lock()
+	defer bC.pinLock.Unlock()
+
+	bC.pin(hashes)
+}
+
+// PinMetadata pins the blocks of the stored metadata lookup returns. No
+// block is removed between the lookup and the pin, so the blocks of metadata
+// that still exists when it is read stay available until they are unpinned.
+func (bC *BlockCollector) PinMetadata(lookup func() (*sync.ExtendedFileMetadata, error)) (*sync.ExtendedFileMetadata, error) {
+	bC.pinLock.Lock()
+	defer bC.pinLock.Unlock()
+
+	eFM, err := lookup()
+
+	if err != nil {
+		return nil, err
+	}
+
+	bC.pin(eFM.StrongBlockHashes)
+
+	return eFM, nil
+}
+
+func (bC *BlockCollector) pin(hashes [][]byte) {
+	for _, hash := range hashes {
+		bC.pins[string(hash)] += 1
+
+		if bC.touched != nil {
+			bC.touched[string(hash)] = true
+		}
+	}
+}
+
+func (bC *BlockCollector) Unpin(hashes [][]byte) {
+	bC.pinLock.Lock()
+	defer bC.pinLock.Unlock()
+
+	for _, hash := range hashes {
+		if bC.pins[string(hash)] <= 1 {
+			delete(bC.pins, string(hash))
+		} else {
+			bC.pins[string(hash)] -= 1
+		}
+	}
+}
+
+// Collect removes the versions the retention policies do not keep at the
+// given time and deletes the blocks that are not referenced anymore.
+func (bC *BlockCollector) Collect(now time.Time) (*CollectionStats, error) {
+	bC.collectLock.Lock()
+	defer bC.collectLock.Unlock()
+
+	bC.beginCollection()
+	defer bC.endCollection()
+
+	stats := &CollectionStats{}
+
+	users, err := bC.database.ListUsers()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		policy := bC.userPolicies[string(user)]
+
+		if policy == nil {
+			policy = bC.policy
+		}
+
+		if policy == nil {
+			continue
+		}
+
+		removedVersions, err := bC.applyRetention(user, policy, now)
+		stats.RemovedVersions += removedVersions
+
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	referencedBlocks, err := bC.mark(users)
+
+	if err != nil {
+		return stats, err
+	}
+
+	hashes, err := bC.database.ListBlocks()
+
+	if err != nil {
+		return stats, err
+	}
+
+	for _, hash := range hashes {
+		if referencedBlocks[string(hash)] == true {
+			stats.KeptBlocks += 1
+			continue
+		}
+
+		removed, err := bC.removeUnpinned(hash)
+
+		if err != nil {
+			return stats, err
+		}
+
+		if removed == true {
+			stats.RemovedBlocks += 1
+		} else {
+			stats.KeptBlocks += 1
+		}
+	}
+
+	return stats, nil
+}
+
+// beginCollection treats every block that is pinned right now, or gets
+// pinned until the collection ends, as referenced.
+func (bC *BlockCollector) beginCollection() {
+	bC.pinLock.Lock()
+	defer bC.pinLock.Unlock()
+
+	bC.touched = make(map[string]bool, len(bC.pins))
+
+	for hash := range bC.pins {
+		bC.touched[hash] = true
+	}
+}
+
+func (bC *BlockCollector) endCollection() {
+	bC.pinLock.Lock()
+	defer bC.pinLock.Unlock()
+
+	bC.touched = nil
+}
+
+func (bC *BlockCollector) applyRetention(user []byte, policy *RetentionPolicy, now time.Time) (int, error) {
+	files, err := bC.database.ListFiles(user)
+
+	if err != nil {
+		return 0, err
+	}
+
+	existingFiles := make(map[string]bool, len(files))
+
+	for _, path := range files {
+		existingFiles[path] = true
+	}
+
+	paths, err := bC.database.ListHistories(user)
+
+	if err != nil {
+		return 0, err
+	}
+
+	removedVersions := 0
+
+	for _, path := range paths {
+		versions, err := bC.database.ListVersions(user, path)
+
+		if errors.Is(err, FILE_NOT_AVAILABLE) {
+			continue
+		}
+
+		if err != nil {
+			return removedVersions, err
+		}
+
+		_, remove := policy.Select(versions, existingFiles[path], now)
+
+		for _, version := range remove {
+			err := bC.database.RemoveVersion(user, path, version.ID)
+
+			if errors.Is(err, VERSION_NOT_AVAILABLE) || errors.Is(err, FILE_NOT_AVAILABLE) {
+				continue
+			}
+
+			if err != nil {
+				return removedVersions, err
+			}
+
+			removedVersions += 1
+		}
+	}
+
+	return removedVersions, nil
+}
+
+// mark returns the blocks referenced by current metadata. Blocks of
+// versions are counted by the database, but metadata can be stored without
+// a version.
+func (bC *BlockCollector) mark(users [][]byte) (map[string]bool, error) {
+	referencedBlocks := make(map[string]bool)
+
+	for _, user := range users {
+		files, err := bC.database.ListFiles(user)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range files {
+			eFM, err := bC.database.RetrieveExtendedFileMetadata(user, path)
+
+			if errors.Is(err, FILE_NOT_AVAILABLE) {
+				continue
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			for _, strongHash := range eFM.StrongBlockHashes {
+				referencedBlocks[string(strongHash)] = true
+			}
+		}
+	}
+
+	return referencedBlocks, nil
+}
+
+// removeUnpinned deletes a block unless it is or was pinned during this
+// collection. Pinning waits until the deletion is done, so a peer either
+// sees the block gone or protects it in time.
+func (bC *BlockCollector) removeUnpinned(hash []byte) (bool, error) {
+	bC.pinLock.Lock()
+	defer bC.pinLock.Unlock()
+
+	if bC.pins[string(hash)] > 0 || bC.touched[string(hash)] == true {
+		return false, nil
+	}
+
+	err := bC.database.RemoveBlock(hash)
+
+	if errors.Is(err, BLOCK_NOT_AVAILABLE) || errors.Is(err, BLOCK_REFERENCED) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
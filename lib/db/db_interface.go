@@ -1,10 +1,17 @@
 package db
 
 import (
+	"bytes"
 	"errors"
 	"io"
+	"time"
 
 	"github.com/FBreuer2/simple-sync/lib/sync"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PASSWORD_HASH_COST = bcrypt.MaxCost / 2
 )
 
 type AuthenticatorDatabase interface {
@@ -12,35 +19,132 @@ type AuthenticatorDatabase interface {
 	Login(user []byte, password []byte) error
 	Rekey(user []byte, oldPassword []byte, newPassword []byte) error
 
-	GenerateToken(user []byte, password []byte) ([]byte, error)
+	// GenerateToken issues a token for the device with the given label,
+	// replacing an earlier token of the same label.
+	GenerateToken(user []byte, password []byte, label string) ([]byte, error)
 	ValidateToken(user []byte, token []byte) error
+	// RotateToken validates the token and returns its successor with the
+	// same label and a fresh expiry. The token is revoked once the successor
+	// is used, until then a client that lost the successor can rotate again.
+	RotateToken(user []byte, token []byte) ([]byte, error)
+	RevokeToken(user []byte, label string) error
+	ListTokens(user []byte) ([]TokenInfo, error)
+
+	ListUsers() ([][]byte, error)
+}
+
+// TokenInfo describes an issued token without the token itself.
+type TokenInfo struct {
+	Label     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
 }
 
+// FileDatabase stores metadata per user and file. Files are identified by a
+// slash separated path relative to the user's backup root, see
+// sync.NormalizePath.
 type FileDatabase interface {
-	RetrieveShortFileMetadata(user []byte) (*sync.ShortFileMetadata, error)
-	PutShortFileMetadata(user []byte, metadata *sync.ShortFileMetadata) error
+	RetrieveShortFileMetadata(user []byte, path string) (*sync.ShortFileMetadata, error)
+	PutShortFileMetadata(user []byte, path string, metadata *sync.ShortFileMetadata) error
 
-	RetrieveExtendedFileMetadata(user []byte) (*sync.ExtendedFileMetadata, error)
-	PutExtendedFileMetadata(user []byte, metadata *sync.ExtendedFileMetadata) error
+	RetrieveExtendedFileMetadata(user []byte, path string) (*sync.ExtendedFileMetadata, error)
+	PutExtendedFileMetadata(user []byte, path string, metadata *sync.ExtendedFileMetadata) error
 
-	RetrieveFile(user []byte, file string) (io.Reader, error)
+	// ListFiles returns the sorted paths of all files of the user.
+	ListFiles(user []byte) ([]string, error)
+	RetrieveFile(user []byte, path string) (io.Reader, error)
+
+	// RemoveFile forgets the metadata of a file. Its blocks stay in the
+	// block database, other files may still use them.
+	RemoveFile(user []byte, path string) error
+	// MoveFile moves the metadata of a file to newPath, replacing a file
+	// that might exist there. The moved metadata is stored as a new version
+	// of newPath, the versions of oldPath are kept.
+	MoveFile(user []byte, oldPath string, newPath string) error
+
+	// PutFileVersion stores the metadata of a completely transferred file
+	// as its newest version, which also becomes its current metadata.
+	PutFileVersion(user []byte, path string, shortMetadata *sync.ShortFileMetadata, extendedMetadata *sync.ExtendedFileMetadata) (*FileVersion, error)
+	// ListVersions returns all versions of a file, oldest first. Versions
+	// stay available after the file was removed.
+	ListVersions(user []byte, path string) ([]*FileVersion, error)
+	RetrieveVersion(user []byte, path string, id uint64) (*FileVersion, error)
+	// RetrieveVersionAt returns the newest version stored at or before at.
+	RetrieveVersionAt(user []byte, path string, at time.Time) (*FileVersion, error)
+	RetrieveVersionExtendedMetadata(user []byte, path string, id uint64) (*sync.ExtendedFileMetadata, error)
+	// ListHistories returns the sorted paths that have versions, including
+	// removed files.
+	ListHistories(user []byte) ([]string, error)
+	// RemoveVersion forgets a version. Its blocks stay in the block
+	// database until they are collected, see BlockCollector.
+	RemoveVersion(user []byte, path string, id uint64) error
+
+	// BlockReferences returns how many versions of all users contain the
+	// block. Referenced blocks can not be removed.
+	BlockReferences(hash []byte) (uint64, error)
+	UserDedupStats(user []byte) (*DedupStats, error)
+	DedupStats() (*DedupStats, error)
 }
 
+// BlockDatabase stores blocks by their hash, possibly compressed, see
+// sync.CompressBlock.
 type BlockDatabase interface {
 	HasBlock(hash []byte) bool
+	// RetrieveBlock returns the decompressed block.
 	RetrieveBlock(hash []byte) (io.Reader, error)
+	// RetrieveStoredBlock returns the block as it is stored, along with the
+	// algorithm it is compressed with.
+	RetrieveStoredBlock(hash []byte) (uint8, []byte, error)
 	PutBlock(hash []byte, block []byte) error
+	// PutStoredBlock stores a block compressed with the given algorithm.
+	PutStoredBlock(hash []byte, compression uint8, data []byte) error
+	// RemoveBlock fails with BLOCK_REFERENCED while a version contains the
+	// block.
+	RemoveBlock(hash []byte) error
+	ListBlocks() ([][]byte, error)
+	// QuarantineBlock moves a corrupted block out of the way, even if it is
+	// referenced. The block is not available anymore, so it is transferred
+	// again with the next upload of a file containing it.
+	QuarantineBlock(hash []byte) error
 }
 
+// FullDatabase is shared by all peers of a server, so every implementation
+// has to be safe for concurrent use by multiple goroutines.
 type FullDatabase interface {
 	AuthenticatorDatabase
 	FileDatabase
 	BlockDatabase
 }
 
+var USER_NOT_AVAILABLE = errors.New("User does not exist.")
 var FILE_NOT_AVAILABLE = errors.New("File is not available.")
 var BLOCK_NOT_AVAILABLE = errors.New("Block is not available.")
+var TOKEN_NOT_AVAILABLE = errors.New("Token is not available.")
+var TOKEN_EXPIRED = errors.New("Token has expired.")
+
+// MAX_STORED_BLOCK_LENGTH limits decompressing stored blocks. Blocks are
+// verified before they are stored, it only guards against a damaged store.
+const MAX_STORED_BLOCK_LENGTH = 64 * 1024 * 1024
+
+// retrieveBlock decompresses a stored block, the implementations share it
+// for RetrieveBlock.
+func retrieveBlock(blockStorage BlockDatabase, hash []byte) (io.Reader, error) {
+	compression, data, err := blockStorage.RetrieveStoredBlock(hash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := sync.DecompressBlock(compression, data, MAX_STORED_BLOCK_LENGTH)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(block), nil
+}
 
+// NewBlockFile reassembles a file from its decompressed blocks.
 func NewBlockFile(eFM *sync.ExtendedFileMetadata, blockStorage BlockDatabase) (io.Reader, error) {
 	readers := make([]io.Reader, len(eFM.StrongBlockHashes))
 	for index, strongHash := range eFM.StrongBlockHashes {
@@ -0,0 +1,1181 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/FBreuer2/simple-sync/lib/sync"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var usersBucket = []byte("users")
+var tokensBucket = []byte("tokens")
+var shortMetadataBucket = []byte("short_metadata")
+var extendedMetadataBucket = []byte("extended_metadata")
+var versionsBucket = []byte("versions")
+var versionMetadataBucket = []byte("version_extended_metadata")
+var blockReferencesBucket = []byte("block_references")
+var userReferencesBucket = []byte("user_block_references")
+var logicalBytesBucket = []byte("logical_bytes")
+
+// DiskDB keeps users, tokens and metadata in a bolt database and every block
+// as its own file named after its hash. Blocks are sharded into directories
+// by the first two bytes of their hash, so no directory grows too large.
+// Bolt serializes writers, blocks are renamed into place and the files of
+// a block are only changed under its block lock, which makes DiskDB safe
+// for concurrent use once the setters are done.
+type DiskDB struct {
+	metadata         *bolt.DB
+	blockPath        string
+	quarantinePath   string
+	tokenLifetime    time.Duration
+	passwordHashCost int
+	blockLocks       [DISK_DB_BLOCK_LOCKS]gosync.Mutex
+}
+
+const (
+	DISK_DB_METADATA_FILE  = "metadata.db"
+	DISK_DB_BLOCK_DIR      = "blocks"
+	DISK_DB_QUARANTINE_DIR = "quarantine"
+	DISK_DB_BLOCK_LOCKS    = 64
+)
+
+// blockFileExtensions are appended to the names of block files by their
+// compression, uncompressed blocks keep the plain hash as name.
+var blockFileExtensions = []string{
+	sync.COMPRESSION_NONE:    "",
+	sync.COMPRESSION_DEFLATE: ".deflate",
+}
+
+func NewDiskDB(path string) (*DiskDB, error) {
+	blockPath := filepath.Join(path, DISK_DB_BLOCK_DIR)
+	quarantinePath := filepath.Join(path, DISK_DB_QUARANTINE_DIR)
+
+	for _, directory := range []string{blockPath, quarantinePath} {
+		if err := os.MkdirAll(directory, os.FileMode(0700)); err != nil {
+			return nil, err
+		}
+	}
+
+	metadata, err := bolt.Open(filepath.Join(path, DISK_DB_METADATA_FILE), os.FileMode(0600), &bolt.Options{Timeout: time.Second})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = metadata.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{usersBucket, tokensBucket, shortMetadataBucket, extendedMetadataBucket, versionsBucket, versionMetadataBucket, blockReferencesBucket, userReferencesBucket, logicalBytesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		metadata.Close()
+		return nil, err
+	}
+
+	return &DiskDB{
+		metadata:         metadata,
+		blockPath:        blockPath,
+		quarantinePath:   quarantinePath,
+		tokenLifetime:    TOKEN_LIFETIME,
+		passwordHashCost: PASSWORD_HASH_COST,
+	}, nil
+}
+
+func (dDB *DiskDB) Close() error {
+	return dDB.metadata.Close()
+}
+
+func (dDB *DiskDB) ListUsers() ([][]byte, error) {
+	users := make([][]byte, 0)
+
+	err := dDB.metadata.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(user []byte, _ []byte) error {
+			users = append(users, append([]byte(nil), user...))
+			return nil
+		})
+	})
+
+	return users, err
+}
+
+func (dDB *DiskDB) SetTokenLifetime(lifetime time.Duration) {
+	dDB.tokenLifetime = lifetime
+}
+
+// SetPasswordHashCost sets the bcrypt cost used for new password hashes.
+func (dDB *DiskDB) SetPasswordHashCost(cost int) {
+	dDB.passwordHashCost = cost
+}
+
+func (dDB *DiskDB) Register(user []byte, password []byte) error {
+	hash, err := bcrypt.GenerateFromPassword(password, dDB.passwordHashCost)
+
+	if err != nil {
+		return err
+	}
+
+	return dDB.metadata.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(usersBucket)
+
+		if users.Get(user) != nil {
+			return errors.New("User already exists.")
+		}
+
+		return users.Put(user, hash)
+	})
+}
+
+func (dDB *DiskDB) Login(user []byte, password []byte) error {
+	hash, err := dDB.passwordHash(user)
+
+	if err != nil {
+		return err
+	}
+
+	return bcrypt.CompareHashAndPassword(hash, password)
+}
+
+func (dDB *DiskDB) Rekey(user []byte, oldPassword []byte, newPassword []byte) error {
+	if err := dDB.Login(user, oldPassword); err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword(newPassword, dDB.passwordHashCost)
+
+	if err != nil {
+		return err
+	}
+
+	return dDB.metadata.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).Put(user, hash)
+	})
+}
+
+func (dDB *DiskDB) GenerateToken(user []byte, password []byte, label string) ([]byte, error) {
+	if err := dDB.Login(user, password); err != nil {
+		return nil, err
+	}
+
+	token, newToken, err := newStoredToken(label, dDB.tokenLifetime)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = dDB.updateTokens(user, func(tokens []*storedToken) ([]*storedToken, error) {
+		return replaceToken(tokens, newToken), nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (dDB *DiskDB) ValidateToken(user []byte, token []byte) error {
+	return dDB.metadata.View(func(tx *bolt.Tx) error {
+		tokens, err := readTokens(tx, user)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = findToken(tokens, token)
+
+		return err
+	})
+}
+
+func (dDB *DiskDB) RotateToken(user []byte, token []byte) ([]byte, error) {
+	var rotatedToken []byte
+
+	err := dDB.updateTokens(user, func(tokens []*storedToken) ([]*storedToken, error) {
+		newToken, tokens, err := rotateToken(tokens, token, dDB.tokenLifetime)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rotatedToken = newToken
+
+		return tokens, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rotatedToken, nil
+}
+
+func (dDB *DiskDB) RevokeToken(user []byte, label string) error {
+	return dDB.updateTokens(user, func(tokens []*storedToken) ([]*storedToken, error) {
+		index, err := findTokenByLabel(tokens, label)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return removeToken(tokens, index), nil
+	})
+}
+
+func (dDB *DiskDB) ListTokens(user []byte) ([]TokenInfo, error) {
+	var infos []TokenInfo
+
+	err := dDB.metadata.View(func(tx *bolt.Tx) error {
+		tokens, err := readTokens(tx, user)
+
+		if err != nil {
+			return err
+		}
+
+		infos = tokenInfos(tokens)
+
+		return nil
+	})
+
+	return infos, err
+}
+
+func (dDB *DiskDB) RetrieveShortFileMetadata(user []byte, path string) (*sync.ShortFileMetadata, error) {
+	metadata := &sync.ShortFileMetadata{}
+
+	if err := dDB.retrieveMetadata(shortMetadataBucket, user, path, metadata); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+func (dDB *DiskDB) PutShortFileMetadata(user []byte, path string, metadata *sync.ShortFileMetadata) error {
+	return dDB.putMetadata(shortMetadataBucket, user, path, metadata)
+}
+
+func (dDB *DiskDB) RetrieveExtendedFileMetadata(user []byte, path string) (*sync.ExtendedFileMetadata, error) {
+	metadata := &sync.ExtendedFileMetadata{}
+
+	if err := dDB.retrieveMetadata(extendedMetadataBucket, user, path, metadata); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+func (dDB *DiskDB) PutExtendedFileMetadata(user []byte, path string, metadata *sync.ExtendedFileMetadata) error {
+	return dDB.putMetadata(extendedMetadataBucket, user, path, metadata)
+}
+
+func (dDB *DiskDB) ListFiles(user []byte) ([]string, error) {
+	paths := make([]string, 0)
+
+	err := dDB.metadata.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket).Get(user) == nil {
+			return USER_NOT_AVAILABLE
+		}
+
+		userFiles := tx.Bucket(shortMetadataBucket).Bucket(user)
+
+		if userFiles == nil {
+			return nil
+		}
+
+		// bolt iterates keys in byte order, so the paths are sorted
+		return userFiles.ForEach(func(path []byte, _ []byte) error {
+			paths = append(paths, string(path))
+			return nil
+		})
+	})
+
+	return paths, err
+}
+
+func (dDB *DiskDB) RemoveFile(user []byte, path string) error {
+	return dDB.metadata.Update(func(tx *bolt.Tx) error {
+		shortMetadata, extendedMetadata, err := userFileBuckets(tx, user, path)
+
+		if err != nil {
+			return err
+		}
+
+		if err := shortMetadata.Delete([]byte(path)); err != nil {
+			return err
+		}
+
+		if extendedMetadata == nil {
+			return nil
+		}
+
+		return extendedMetadata.Delete([]byte(path))
+	})
+}
+
+func (dDB *DiskDB) MoveFile(user []byte, oldPath string, newPath string) error {
+	return dDB.metadata.Update(func(tx *bolt.Tx) error {
+		shortMetadata, _, err := userFileBuckets(tx, user, oldPath)
+
+		if err != nil {
+			return err
+		}
+
+		extendedMetadata, err := tx.Bucket(extendedMetadataBucket).CreateBucketIfNotExists(user)
+
+		if err != nil {
+			return err
+		}
+
+		// values are only valid until the bucket is modified
+		encodedShortMetadata := append([]byte(nil), shortMetadata.Get([]byte(oldPath))...)
+		encodedExtendedMetadata := append([]byte(nil), extendedMetadata.Get([]byte(oldPath))...)
+
+		for index, bucket := range []*bolt.Bucket{shortMetadata, extendedMetadata} {
+			encodedMetadata := [][]byte{encodedShortMetadata, encodedExtendedMetadata}[index]
+
+			if err := bucket.Delete([]byte(newPath)); err != nil {
+				return err
+			}
+
+			if len(encodedMetadata) == 0 {
+				continue
+			}
+
+			if err := bucket.Delete([]byte(oldPath)); err != nil {
+				return err
+			}
+
+			if err := bucket.Put([]byte(newPath), encodedMetadata); err != nil {
+				return err
+			}
+		}
+
+		if oldPath == newPath || len(encodedExtendedMetadata) == 0 {
+			return nil
+		}
+
+		movedMetadata := &sync.ShortFileMetadata{}
+
+		if err := json.Unmarshal(encodedShortMetadata, movedMetadata); err != nil {
+			return err
+		}
+
+		movedExtendedMetadata := &sync.ExtendedFileMetadata{}
+
+		if err := json.Unmarshal(encodedExtendedMetadata, movedExtendedMetadata); err != nil {
+			return err
+		}
+
+		_, err = putVersion(tx, user, newPath, movedMetadata, movedExtendedMetadata)
+
+		return err
+	})
+}
+
+func (dDB *DiskDB) PutFileVersion(user []byte, path string, shortMetadata *sync.ShortFileMetadata, extendedMetadata *sync.ExtendedFileMetadata) (*FileVersion, error) {
+	encodedShortMetadata, err := json.Marshal(shortMetadata)
+
+	if err != nil {
+		return nil, err
+	}
+
+	encodedExtendedMetadata, err := json.Marshal(extendedMetadata)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var version *FileVersion
+
+	err = dDB.metadata.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket).Get(user) == nil {
+			return USER_NOT_AVAILABLE
+		}
+
+		if err := putUserFile(tx, shortMetadataBucket, user, path, encodedShortMetadata); err != nil {
+			return err
+		}
+
+		if err := putUserFile(tx, extendedMetadataBucket, user, path, encodedExtendedMetadata); err != nil {
+			return err
+		}
+
+		version, err = putVersion(tx, user, path, shortMetadata, extendedMetadata)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return version, nil
+}
+
+func (dDB *DiskDB) ListVersions(user []byte, path string) ([]*FileVersion, error) {
+	versions := make([]*FileVersion, 0)
+
+	err := dDB.metadata.View(func(tx *bolt.Tx) error {
+		pathVersions, err := versionBucket(tx, versionsBucket, user, path)
+
+		if err != nil {
+			return err
+		}
+
+		// keys are big endian ids, so bolt iterates them oldest first
+		return pathVersions.ForEach(func(_ []byte, encodedVersion []byte) error {
+			version := &FileVersion{}
+
+			if err := json.Unmarshal(encodedVersion, version); err != nil {
+				return err
+			}
+
+			versions = append(versions, version)
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(versions) == 0 {
+		return nil, FILE_NOT_AVAILABLE
+	}
+
+	return versions, nil
+}
+
+func (dDB *DiskDB) ListHistories(user []byte) ([]string, error) {
+	paths := make([]string, 0)
+
+	err := dDB.metadata.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket).Get(user) == nil {
+			return USER_NOT_AVAILABLE
+		}
+
+		userVersions := tx.Bucket(versionsBucket).Bucket(user)
+
+		if userVersions == nil {
+			return nil
+		}
+
+		// every path is a nested bucket, which is empty once all of its
+		// versions were removed
+		return userVersions.ForEach(func(path []byte, _ []byte) error {
+			if firstID, _ := userVersions.Bucket(path).Cursor().First(); firstID != nil {
+				paths = append(paths, string(path))
+			}
+
+			return nil
+		})
+	})
+
+	return paths, err
+}
+
+func (dDB *DiskDB) RemoveVersion(user []byte, path string, id uint64) error {
+	return dDB.metadata.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{versionsBucket, versionMetadataBucket} {
+			pathVersions, err := versionBucket(tx, bucket, user, path)
+
+			if err != nil {
+				return err
+			}
+
+			encodedVersion := pathVersions.Get(versionKey(id))
+
+			if encodedVersion == nil {
+				return VERSION_NOT_AVAILABLE
+			}
+
+			if bytes.Equal(bucket, versionMetadataBucket) == true {
+				extendedMetadata := &sync.ExtendedFileMetadata{}
+
+				if err := json.Unmarshal(encodedVersion, extendedMetadata); err != nil {
+					return err
+				}
+
+				if err := removeReferences(tx, user, extendedMetadata); err != nil {
+					return err
+				}
+			}
+
+			if err := pathVersions.Delete(versionKey(id)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (dDB *DiskDB) BlockReferences(hash []byte) (uint64, error) {
+	references := uint64(0)
+
+	err := dDB.metadata.View(func(tx *bolt.Tx) error {
+		references, _ = decodeBlockReference(tx.Bucket(blockReferencesBucket).Get(hash))
+		return nil
+	})
+
+	return references, err
+}
+
+func (dDB *DiskDB) UserDedupStats(user []byte) (*DedupStats, error) {
+	stats := &DedupStats{}
+
+	err := dDB.metadata.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket).Get(user) == nil {
+			return USER_NOT_AVAILABLE
+		}
+
+		stats.LogicalBytes = decodeUint64(tx.Bucket(logicalBytesBucket).Get(user))
+
+		userReferences := tx.Bucket(userReferencesBucket).Bucket(user)
+
+		if userReferences == nil {
+			return nil
+		}
+
+		blockReferences := tx.Bucket(blockReferencesBucket)
+
+		return userReferences.ForEach(func(hash []byte, _ []byte) error {
+			_, length := decodeBlockReference(blockReferences.Get(hash))
+			stats.PhysicalBytes += length
+			stats.Blocks += 1
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func (dDB *DiskDB) DedupStats() (*DedupStats, error) {
+	stats := &DedupStats{}
+
+	err := dDB.metadata.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(logicalBytesBucket).ForEach(func(_ []byte, logicalBytes []byte) error {
+			stats.LogicalBytes += decodeUint64(logicalBytes)
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(blockReferencesBucket).ForEach(func(_ []byte, encodedReference []byte) error {
+			_, length := decodeBlockReference(encodedReference)
+			stats.PhysicalBytes += length
+			stats.Blocks += 1
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func (dDB *DiskDB) RetrieveVersion(user []byte, path string, id uint64) (*FileVersion, error) {
+	version := &FileVersion{}
+
+	if err := dDB.retrieveVersion(versionsBucket, user, path, id, version); err != nil {
+		return nil, err
+	}
+
+	return version, nil
+}
+
+func (dDB *DiskDB) RetrieveVersionAt(user []byte, path string, at time.Time) (*FileVersion, error) {
+	versions, err := dDB.ListVersions(user, path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return versionAt(versions, at)
+}
+
+func (dDB *DiskDB) RetrieveVersionExtendedMetadata(user []byte, path string, id uint64) (*sync.ExtendedFileMetadata, error) {
+	metadata := &sync.ExtendedFileMetadata{}
+
+	if err := dDB.retrieveVersion(versionMetadataBucket, user, path, id, metadata); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+func (dDB *DiskDB) retrieveVersion(bucket []byte, user []byte, path string, id uint64, value interface{}) error {
+	return dDB.metadata.View(func(tx *bolt.Tx) error {
+		pathVersions, err := versionBucket(tx, bucket, user, path)
+
+		if err != nil {
+			return err
+		}
+
+		encodedValue := pathVersions.Get(versionKey(id))
+
+		if encodedValue == nil {
+			return VERSION_NOT_AVAILABLE
+		}
+
+		return json.Unmarshal(encodedValue, value)
+	})
+}
+
+func (dDB *DiskDB) RetrieveFile(user []byte, path string) (io.Reader, error) {
+	eFM, err := dDB.RetrieveExtendedFileMetadata(user, path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBlockFile(eFM, dDB)
+}
+
+func (dDB *DiskDB) HasBlock(hash []byte) bool {
+	_, _, err := dDB.storedBlockFilePath(hash)
+
+	return err == nil
+}
+
+func (dDB *DiskDB) RetrieveBlock(hash []byte) (io.Reader, error) {
+	return retrieveBlock(dDB, hash)
+}
+
+func (dDB *DiskDB) RetrieveStoredBlock(hash []byte) (uint8, []byte, error) {
+	blockFilePath, compression, err := dDB.storedBlockFilePath(hash)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	data, err := ioutil.ReadFile(blockFilePath)
+
+	if os.IsNotExist(err) {
+		return 0, nil, BLOCK_NOT_AVAILABLE
+	}
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return compression, data, nil
+}
+
+func (dDB *DiskDB) PutBlock(hash []byte, block []byte) error {
+	return dDB.PutStoredBlock(hash, sync.COMPRESSION_NONE, block)
+}
+
+// PutStoredBlock writes the block to a temporary file first and renames it
+// into place, so a crash never leaves a partially written block behind.
+// Blocks that are already stored are kept, blocks with the same hash have
+// the same content.
+func (dDB *DiskDB) PutStoredBlock(hash []byte, compression uint8, data []byte) error {
+	if int(compression) >= len(blockFileExtensions) {
+		return sync.UNKNOWN_COMPRESSION
+	}
+
+	// a block uploaded concurrently in another compression is kept
+	blockLock := dDB.blockLock(hash)
+	blockLock.Lock()
+	defer blockLock.Unlock()
+
+	if dDB.HasBlock(hash) == true {
+		return nil
+	}
+
+	blockFilePath := dDB.blockFilePath(hash) + blockFileExtensions[compression]
+
+	if err := os.MkdirAll(filepath.Dir(blockFilePath), os.FileMode(0700)); err != nil {
+		return err
+	}
+
+	blockFile, err := ioutil.TempFile(filepath.Dir(blockFilePath), ".block")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(blockFile.Name())
+
+	if _, err := blockFile.Write(data); err != nil {
+		blockFile.Close()
+		return err
+	}
+
+	if err := blockFile.Sync(); err != nil {
+		blockFile.Close()
+		return err
+	}
+
+	if err := blockFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(blockFile.Name(), blockFilePath)
+}
+
+// RemoveBlock deletes the block file within a write transaction, so no
+// version referencing the block can be committed between checking its
+// references and deleting it.
+func (dDB *DiskDB) RemoveBlock(hash []byte) error {
+	blockLock := dDB.blockLock(hash)
+	blockLock.Lock()
+	defer blockLock.Unlock()
+
+	return dDB.metadata.Update(func(tx *bolt.Tx) error {
+		if references, _ := decodeBlockReference(tx.Bucket(blockReferencesBucket).Get(hash)); references > 0 {
+			return BLOCK_REFERENCED
+		}
+
+		blockFilePath, _, err := dDB.storedBlockFilePath(hash)
+
+		if err != nil {
+			return err
+		}
+
+		err = os.Remove(blockFilePath)
+
+		if os.IsNotExist(err) {
+			return BLOCK_NOT_AVAILABLE
+		}
+
+		return err
+	})
+}
+
+// QuarantineBlock moves the block file into the quarantine directory, where
+// it can be inspected. The file keeps the extension of its compression.
+func (dDB *DiskDB) QuarantineBlock(hash []byte) error {
+	blockLock := dDB.blockLock(hash)
+	blockLock.Lock()
+	defer blockLock.Unlock()
+
+	blockFilePath, compression, err := dDB.storedBlockFilePath(hash)
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(blockFilePath, filepath.Join(dDB.quarantinePath, hex.EncodeToString(hash)+blockFileExtensions[compression]))
+
+	if os.IsNotExist(err) {
+		return BLOCK_NOT_AVAILABLE
+	}
+
+	return err
+}
+
+// ListBlocks walks the block directory, skipping temporary files of blocks
+// that are being written.
+func (dDB *DiskDB) ListBlocks() ([][]byte, error) {
+	hashes := make([][]byte, 0)
+	listedHashes := make(map[string]bool)
+
+	err := filepath.Walk(dDB.blockPath, func(blockFilePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			// blocks may be removed while we walk
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if fileInfo.Mode().IsRegular() == false || strings.HasPrefix(fileInfo.Name(), ".") == true {
+			return nil
+		}
+
+		encodedHash := strings.SplitN(fileInfo.Name(), ".", 2)[0]
+		hash, err := hex.DecodeString(encodedHash)
+
+		if err != nil || listedHashes[encodedHash] == true {
+			return nil
+		}
+
+		listedHashes[encodedHash] = true
+		hashes = append(hashes, hash)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+// blockLock returns the lock guarding the files of the block with the given
+// hash. Blocks share a few locks, spread by their hash.
+func (dDB *DiskDB) blockLock(hash []byte) *gosync.Mutex {
+	lockHash := fnv.New32a()
+	lockHash.Write(hash)
+
+	return &dDB.blockLocks[lockHash.Sum32()%DISK_DB_BLOCK_LOCKS]
+}
+
+func (dDB *DiskDB) blockFilePath(hash []byte) string {
+	encodedHash := hex.EncodeToString(hash)
+
+	if len(encodedHash) < 4 {
+		return filepath.Join(dDB.blockPath, encodedHash)
+	}
+
+	return filepath.Join(dDB.blockPath, encodedHash[:2], encodedHash[2:4], encodedHash)
+}
+
+// storedBlockFilePath finds the file of a block, whose extension tells how
+// it is compressed.
+func (dDB *DiskDB) storedBlockFilePath(hash []byte) (string, uint8, error) {
+	blockFilePath := dDB.blockFilePath(hash)
+
+	for compression, extension := range blockFileExtensions {
+		if _, err := os.Stat(blockFilePath + extension); err == nil {
+			return blockFilePath + extension, uint8(compression), nil
+		}
+	}
+
+	return "", 0, BLOCK_NOT_AVAILABLE
+}
+
+func (dDB *DiskDB) passwordHash(user []byte) ([]byte, error) {
+	var hash []byte
+
+	err := dDB.metadata.View(func(tx *bolt.Tx) error {
+		storedHash := tx.Bucket(usersBucket).Get(user)
+
+		if storedHash == nil {
+			return USER_NOT_AVAILABLE
+		}
+
+		// values are only valid inside the transaction
+		hash = append([]byte(nil), storedHash...)
+
+		return nil
+	})
+
+	return hash, err
+}
+
+func (dDB *DiskDB) updateTokens(user []byte, update func([]*storedToken) ([]*storedToken, error)) error {
+	return dDB.metadata.Update(func(tx *bolt.Tx) error {
+		tokens, err := readTokens(tx, user)
+
+		if err != nil {
+			return err
+		}
+
+		tokens, err = update(tokens)
+
+		if err != nil {
+			return err
+		}
+
+		encodedTokens, err := json.Marshal(tokens)
+
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(tokensBucket).Put(user, encodedTokens)
+	})
+}
+
+func readTokens(tx *bolt.Tx, user []byte) ([]*storedToken, error) {
+	if tx.Bucket(usersBucket).Get(user) == nil {
+		return nil, USER_NOT_AVAILABLE
+	}
+
+	tokens := make([]*storedToken, 0)
+	encodedTokens := tx.Bucket(tokensBucket).Get(user)
+
+	if encodedTokens == nil {
+		return tokens, nil
+	}
+
+	if err := json.Unmarshal(encodedTokens, &tokens); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// userFileBuckets returns the metadata buckets of the user and fails if the
+// file at path has no short metadata. The extended metadata bucket is nil if
+// the user never stored any.
+func userFileBuckets(tx *bolt.Tx, user []byte, path string) (*bolt.Bucket, *bolt.Bucket, error) {
+	if tx.Bucket(usersBucket).Get(user) == nil {
+		return nil, nil, USER_NOT_AVAILABLE
+	}
+
+	shortMetadata := tx.Bucket(shortMetadataBucket).Bucket(user)
+
+	if shortMetadata == nil || shortMetadata.Get([]byte(path)) == nil {
+		return nil, nil, FILE_NOT_AVAILABLE
+	}
+
+	return shortMetadata, tx.Bucket(extendedMetadataBucket).Bucket(user), nil
+}
+
+// retrieveMetadata and putMetadata keep one nested bucket per user inside
+// the given bucket, keyed by path.
+func (dDB *DiskDB) retrieveMetadata(bucket []byte, user []byte, path string, metadata interface{}) error {
+	return dDB.metadata.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(usersBucket).Get(user) == nil {
+			return USER_NOT_AVAILABLE
+		}
+
+		userFiles := tx.Bucket(bucket).Bucket(user)
+
+		if userFiles == nil {
+			return FILE_NOT_AVAILABLE
+		}
+
+		encodedMetadata := userFiles.Get([]byte(path))
+
+		if encodedMetadata == nil {
+			return FILE_NOT_AVAILABLE
+		}
+
+		return json.Unmarshal(encodedMetadata, metadata)
+	})
+}
+
+func (dDB *DiskDB) putMetadata(bucket []byte, user []byte, path string, metadata interface{}) error {
+	encodedMetadata, err := json.Marshal(metadata)
+
+	if err != nil {
+		return err
+	}
+
+	return dDB.metadata.Update(func(tx *bolt.Tx) error {
+		return putUserFile(tx, bucket, user, path, encodedMetadata)
+	})
+}
+
+func putUserFile(tx *bolt.Tx, bucket []byte, user []byte, path string, encodedMetadata []byte) error {
+	userFiles, err := tx.Bucket(bucket).CreateBucketIfNotExists(user)
+
+	if err != nil {
+		return err
+	}
+
+	return userFiles.Put([]byte(path), encodedMetadata)
+}
+
+// Versions are kept in one bucket per user and path inside versionsBucket,
+// keyed by id, and their extended metadata the same way inside
+// versionMetadataBucket.
+func versionBucket(tx *bolt.Tx, bucket []byte, user []byte, path string) (*bolt.Bucket, error) {
+	if tx.Bucket(usersBucket).Get(user) == nil {
+		return nil, USER_NOT_AVAILABLE
+	}
+
+	userVersions := tx.Bucket(bucket).Bucket(user)
+
+	if userVersions == nil || userVersions.Bucket([]byte(path)) == nil {
+		return nil, FILE_NOT_AVAILABLE
+	}
+
+	return userVersions.Bucket([]byte(path)), nil
+}
+
+func putVersion(tx *bolt.Tx, user []byte, path string, shortMetadata *sync.ShortFileMetadata, extendedMetadata *sync.ExtendedFileMetadata) (*FileVersion, error) {
+	encodedExtendedMetadata, err := json.Marshal(extendedMetadata)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pathBuckets := make([]*bolt.Bucket, 0, 2)
+
+	for _, bucket := range [][]byte{versionsBucket, versionMetadataBucket} {
+		userVersions, err := tx.Bucket(bucket).CreateBucketIfNotExists(user)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pathVersions, err := userVersions.CreateBucketIfNotExists([]byte(path))
+
+		if err != nil {
+			return nil, err
+		}
+
+		pathBuckets = append(pathBuckets, pathVersions)
+	}
+
+	id, err := pathBuckets[0].NextSequence()
+
+	if err != nil {
+		return nil, err
+	}
+
+	version := &FileVersion{
+		ID:       id,
+		StoredAt: time.Now(),
+		Metadata: shortMetadata,
+	}
+
+	encodedVersion, err := json.Marshal(version)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pathBuckets[0].Put(versionKey(id), encodedVersion); err != nil {
+		return nil, err
+	}
+
+	if err := pathBuckets[1].Put(versionKey(id), encodedExtendedMetadata); err != nil {
+		return nil, err
+	}
+
+	if err := addReferences(tx, user, extendedMetadata); err != nil {
+		return nil, err
+	}
+
+	return version, nil
+}
+
+// Every block has its reference count and length in blockReferencesBucket.
+// The reference counts of a user's blocks are kept in a bucket per user in
+// userReferencesBucket and the size of all versions of a user in
+// logicalBytesBucket.
+func addReferences(tx *bolt.Tx, user []byte, extendedMetadata *sync.ExtendedFileMetadata) error {
+	userReferences, err := tx.Bucket(userReferencesBucket).CreateBucketIfNotExists(user)
+
+	if err != nil {
+		return err
+	}
+
+	blockReferences := tx.Bucket(blockReferencesBucket)
+
+	for hash, length := range versionBlocks(extendedMetadata) {
+		references, _ := decodeBlockReference(blockReferences.Get([]byte(hash)))
+
+		if err := blockReferences.Put([]byte(hash), encodeBlockReference(references+1, length)); err != nil {
+			return err
+		}
+
+		if err := userReferences.Put([]byte(hash), encodeUint64(decodeUint64(userReferences.Get([]byte(hash)))+1)); err != nil {
+			return err
+		}
+	}
+
+	logicalBytes := tx.Bucket(logicalBytesBucket)
+
+	return logicalBytes.Put(user, encodeUint64(decodeUint64(logicalBytes.Get(user))+extendedMetadata.FileSize))
+}
+
+func removeReferences(tx *bolt.Tx, user []byte, extendedMetadata *sync.ExtendedFileMetadata) error {
+	userReferences, err := tx.Bucket(userReferencesBucket).CreateBucketIfNotExists(user)
+
+	if err != nil {
+		return err
+	}
+
+	blockReferences := tx.Bucket(blockReferencesBucket)
+
+	for hash := range versionBlocks(extendedMetadata) {
+		references, length := decodeBlockReference(blockReferences.Get([]byte(hash)))
+
+		if references <= 1 {
+			err = blockReferences.Delete([]byte(hash))
+		} else {
+			err = blockReferences.Put([]byte(hash), encodeBlockReference(references-1, length))
+		}
+
+		if err != nil {
+			return err
+		}
+
+		userBlockReferences := decodeUint64(userReferences.Get([]byte(hash)))
+
+		if userBlockReferences <= 1 {
+			err = userReferences.Delete([]byte(hash))
+		} else {
+			err = userReferences.Put([]byte(hash), encodeUint64(userBlockReferences-1))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	logicalBytes := tx.Bucket(logicalBytesBucket)
+	userLogicalBytes := decodeUint64(logicalBytes.Get(user))
+
+	if userLogicalBytes < extendedMetadata.FileSize {
+		userLogicalBytes = extendedMetadata.FileSize
+	}
+
+	return logicalBytes.Put(user, encodeUint64(userLogicalBytes-extendedMetadata.FileSize))
+}
+
+func encodeBlockReference(references uint64, length uint64) []byte {
+	encodedReference := make([]byte, 16)
+	binary.BigEndian.PutUint64(encodedReference[:8], references)
+	binary.BigEndian.PutUint64(encodedReference[8:], length)
+
+	return encodedReference
+}
+
+func decodeBlockReference(encodedReference []byte) (uint64, uint64) {
+	if len(encodedReference) != 16 {
+		return 0, 0
+	}
+
+	return binary.BigEndian.Uint64(encodedReference[:8]), binary.BigEndian.Uint64(encodedReference[8:])
+}
+
+func encodeUint64(value uint64) []byte {
+	encodedValue := make([]byte, 8)
+	binary.BigEndian.PutUint64(encodedValue, value)
+
+	return encodedValue
+}
+
+func decodeUint64(encodedValue []byte) uint64 {
+	if len(encodedValue) != 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(encodedValue)
+}
+
+func versionKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+
+	return key
+}
@@ -2,58 +2,105 @@ package db
 
 import (
 	"bytes"
-	"crypto/rand"
 	"errors"
 	"io"
+	"sort"
+	gosync "sync"
+	"time"
 
 	"github.com/FBreuer2/simple-sync/lib/sync"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// MemoryDB keeps everything in maps guarded by a single lock. Password
+// hashing happens outside of the lock, so slow logins do not block peers.
 type MemoryDB struct {
+	lock                  gosync.RWMutex
 	users                 map[string][]byte
-	tokens                map[string][]byte
-	shortMetadataStore    map[string]*sync.ShortFileMetadata
-	extendedMetadataStore map[string]*sync.ExtendedFileMetadata
-	blockStore            map[string][]byte
+	tokens                map[string][]*storedToken
+	tokenLifetime         time.Duration
+	passwordHashCost      int
+	shortMetadataStore    map[string]map[string]*sync.ShortFileMetadata
+	extendedMetadataStore map[string]map[string]*sync.ExtendedFileMetadata
+	versionStore          map[string]map[string]*versionHistory
+	references            *referenceCounter
+	blockStore            map[string]*storedBlock
+	quarantineStore       map[string]*storedBlock
 }
 
-const (
-	TOKEN_SIZE = 20
-)
+type storedBlock struct {
+	compression uint8
+	data        []byte
+}
+
+type storedVersion struct {
+	version          *FileVersion
+	extendedMetadata *sync.ExtendedFileMetadata
+}
+
+// versionHistory remembers the last id, so ids of removed versions are not
+// handed out again.
+type versionHistory struct {
+	lastID   uint64
+	versions []*storedVersion
+}
 
 func NewMemoryDB() *MemoryDB {
 	return &MemoryDB{
 		users:                 make(map[string][]byte),
-		tokens:                make(map[string][]byte),
-		shortMetadataStore:    make(map[string]*sync.ShortFileMetadata),
-		extendedMetadataStore: make(map[string]*sync.ExtendedFileMetadata),
-		blockStore:            make(map[string][]byte),
+		tokens:                make(map[string][]*storedToken),
+		tokenLifetime:         TOKEN_LIFETIME,
+		passwordHashCost:      PASSWORD_HASH_COST,
+		shortMetadataStore:    make(map[string]map[string]*sync.ShortFileMetadata),
+		extendedMetadataStore: make(map[string]map[string]*sync.ExtendedFileMetadata),
+		versionStore:          make(map[string]map[string]*versionHistory),
+		references:            newReferenceCounter(),
+		blockStore:            make(map[string]*storedBlock),
+		quarantineStore:       make(map[string]*storedBlock),
 	}
 }
 
+// SetPasswordHashCost sets the bcrypt cost used for new password hashes.
+func (mDB *MemoryDB) SetPasswordHashCost(cost int) {
+	mDB.lock.Lock()
+	defer mDB.lock.Unlock()
+
+	mDB.passwordHashCost = cost
+}
+
 func (mDB *MemoryDB) Register(user []byte, password []byte) error {
-	if mDB.users[string(user)] != nil {
-		return errors.New("User already exists.")
-	}
+	mDB.lock.RLock()
+	cost := mDB.passwordHashCost
+	mDB.lock.RUnlock()
 
-	hash, err := bcrypt.GenerateFromPassword(password, bcrypt.MaxCost/2)
+	hash, err := bcrypt.GenerateFromPassword(password, cost)
 
 	if err != nil {
 		return err
 	}
 
+	mDB.lock.Lock()
+	defer mDB.lock.Unlock()
+
+	if mDB.users[string(user)] != nil {
+		return errors.New("User already exists.")
+	}
+
 	mDB.users[string(user)] = hash
 
 	return nil
 }
 
 func (mDB *MemoryDB) Login(user []byte, password []byte) error {
-	if mDB.users[string(user)] == nil {
-		return errors.New("User does not exist.")
+	mDB.lock.RLock()
+	hash := mDB.users[string(user)]
+	mDB.lock.RUnlock()
+
+	if hash == nil {
+		return USER_NOT_AVAILABLE
 	}
 
-	return bcrypt.CompareHashAndPassword(mDB.users[string(user)], password)
+	return bcrypt.CompareHashAndPassword(hash, password)
 }
 
 func (mDB *MemoryDB) Rekey(user []byte, oldPassword []byte, newPassword []byte) error {
@@ -61,91 +108,462 @@ func (mDB *MemoryDB) Rekey(user []byte, oldPassword []byte, newPassword []byte)
 		return err
 	}
 
-	hash, err := bcrypt.GenerateFromPassword(newPassword, bcrypt.MaxCost/2)
+	mDB.lock.RLock()
+	cost := mDB.passwordHashCost
+	mDB.lock.RUnlock()
+
+	hash, err := bcrypt.GenerateFromPassword(newPassword, cost)
 
 	if err != nil {
 		return err
 	}
 
+	mDB.lock.Lock()
+	defer mDB.lock.Unlock()
+
 	mDB.users[string(user)] = hash
 
 	return nil
 }
 
-func (mDB *MemoryDB) GenerateToken(user []byte, password []byte) ([]byte, error) {
+func (mDB *MemoryDB) ListUsers() ([][]byte, error) {
+	mDB.lock.RLock()
+	defer mDB.lock.RUnlock()
+
+	users := make([][]byte, 0, len(mDB.users))
+
+	for user := range mDB.users {
+		users = append(users, []byte(user))
+	}
+
+	sort.Slice(users, func(i, j int) bool { return bytes.Compare(users[i], users[j]) < 0 })
+
+	return users, nil
+}
+
+func (mDB *MemoryDB) SetTokenLifetime(lifetime time.Duration) {
+	mDB.lock.Lock()
+	defer mDB.lock.Unlock()
+
+	mDB.tokenLifetime = lifetime
+}
+
+func (mDB *MemoryDB) GenerateToken(user []byte, password []byte, label string) ([]byte, error) {
 	if err := mDB.Login(user, password); err != nil {
 		return nil, err
 	}
 
-	if token := mDB.tokens[string(user)]; token != nil {
-		return token, nil
+	mDB.lock.Lock()
+	defer mDB.lock.Unlock()
+
+	return mDB.issueToken(user, label)
+}
+
+func (mDB *MemoryDB) ValidateToken(user []byte, token []byte) error {
+	mDB.lock.RLock()
+	defer mDB.lock.RUnlock()
+
+	if mDB.users[string(user)] == nil {
+		return USER_NOT_AVAILABLE
 	}
 
-	newTokenBytes := make([]byte, TOKEN_SIZE)
+	_, err := findToken(mDB.tokens[string(user)], token)
+
+	return err
+}
+
+func (mDB *MemoryDB) RotateToken(user []byte, token []byte) ([]byte, error) {
+	mDB.lock.Lock()
+	defer mDB.lock.Unlock()
 
-	readBytes, err := rand.Read(newTokenBytes)
+	if mDB.users[string(user)] == nil {
+		return nil, USER_NOT_AVAILABLE
+	}
+
+	newToken, tokens, err := rotateToken(mDB.tokens[string(user)], token, mDB.tokenLifetime)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if readBytes < TOKEN_SIZE {
-		return nil, errors.New("Could not read enough random bytes to generate the token.")
+	mDB.tokens[string(user)] = tokens
+
+	return newToken, nil
+}
+
+func (mDB *MemoryDB) RevokeToken(user []byte, label string) error {
+	mDB.lock.Lock()
+	defer mDB.lock.Unlock()
+
+	if mDB.users[string(user)] == nil {
+		return USER_NOT_AVAILABLE
+	}
+
+	index, err := findTokenByLabel(mDB.tokens[string(user)], label)
+
+	if err != nil {
+		return err
 	}
 
-	mDB.tokens[string(user)] = newTokenBytes
+	mDB.tokens[string(user)] = removeToken(mDB.tokens[string(user)], index)
 
-	return newTokenBytes, nil
+	return nil
 }
 
-func (mDB *MemoryDB) ValidateToken(user []byte, token []byte) error {
+func (mDB *MemoryDB) ListTokens(user []byte) ([]TokenInfo, error) {
+	mDB.lock.RLock()
+	defer mDB.lock.RUnlock()
+
 	if mDB.users[string(user)] == nil {
-		return errors.New("User does not exist.")
+		return nil, USER_NOT_AVAILABLE
 	}
 
-	if bytes.Equal(token, mDB.tokens[string(user)]) == false {
-		return errors.New("Wrong token for this user.")
+	return tokenInfos(mDB.tokens[string(user)]), nil
+}
+
+// issueToken expects the caller to hold the write lock.
+func (mDB *MemoryDB) issueToken(user []byte, label string) ([]byte, error) {
+	token, newToken, err := newStoredToken(label, mDB.tokenLifetime)
+
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	mDB.tokens[string(user)] = replaceToken(mDB.tokens[string(user)], newToken)
+
+	return token, nil
 }
 
-func (mDB *MemoryDB) RetrieveShortFileMetadata(user []byte) (*sync.ShortFileMetadata, error) {
+func (mDB *MemoryDB) RetrieveShortFileMetadata(user []byte, path string) (*sync.ShortFileMetadata, error) {
+	mDB.lock.RLock()
+	defer mDB.lock.RUnlock()
+
 	if mDB.users[string(user)] == nil {
-		return nil, errors.New("User does not exist.")
+		return nil, USER_NOT_AVAILABLE
 	}
 
-	if store := mDB.shortMetadataStore[string(user)]; store == nil {
+	if store := mDB.shortMetadataStore[string(user)][path]; store == nil {
 		return nil, FILE_NOT_AVAILABLE
 	} else {
 		return store, nil
 	}
 }
 
-func (mDB *MemoryDB) PutShortFileMetadata(user []byte, metadata *sync.ShortFileMetadata) error {
-	mDB.shortMetadataStore[string(user)] = metadata
+func (mDB *MemoryDB) PutShortFileMetadata(user []byte, path string, metadata *sync.ShortFileMetadata) error {
+	mDB.lock.Lock()
+	defer mDB.lock.Unlock()
+
+	if mDB.shortMetadataStore[string(user)] == nil {
+		mDB.shortMetadataStore[string(user)] = make(map[string]*sync.ShortFileMetadata)
+	}
+
+	mDB.shortMetadataStore[string(user)][path] = metadata
 	return nil
 }
 
-func (mDB *MemoryDB) RetrieveExtendedFileMetadata(user []byte) (*sync.ExtendedFileMetadata, error) {
+func (mDB *MemoryDB) RetrieveExtendedFileMetadata(user []byte, path string) (*sync.ExtendedFileMetadata, error) {
+	mDB.lock.RLock()
+	defer mDB.lock.RUnlock()
+
 	if mDB.users[string(user)] == nil {
-		return nil, errors.New("User does not exist.")
+		return nil, USER_NOT_AVAILABLE
 	}
 
-	if store := mDB.extendedMetadataStore[string(user)]; store == nil {
+	if store := mDB.extendedMetadataStore[string(user)][path]; store == nil {
 		return nil, FILE_NOT_AVAILABLE
 	} else {
 		return store, nil
 	}
 }
 
-func (mDB *MemoryDB) PutExtendedFileMetadata(user []byte, metadata *sync.ExtendedFileMetadata) error {
-	mDB.extendedMetadataStore[string(user)] = metadata
+func (mDB *MemoryDB) PutExtendedFileMetadata(user []byte, path string, metadata *sync.ExtendedFileMetadata) error {
+	mDB.lock.Lock()
+	defer mDB.lock.Unlock()
+
+	if mDB.extendedMetadataStore[string(user)] == nil {
+		mDB.extendedMetadataStore[string(user)] = make(map[string]*sync.ExtendedFileMetadata)
+	}
+
+	mDB.extendedMetadataStore[string(user)][path] = metadata
+	return nil
+}
+
+func (mDB *MemoryDB) ListFiles(user []byte) ([]string, error) {
+	mDB.lock.RLock()
+	defer mDB.lock.RUnlock()
+
+	if mDB.users[string(user)] == nil {
+		return nil, USER_NOT_AVAILABLE
+	}
+
+	paths := make([]string, 0, len(mDB.shortMetadataStore[string(user)]))
+
+	for path := range mDB.shortMetadataStore[string(user)] {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+func (mDB *MemoryDB) RemoveFile(user []byte, path string) error {
+	mDB.lock.Lock()
+	defer mDB.lock.Unlock()
+
+	if mDB.users[string(user)] == nil {
+		return USER_NOT_AVAILABLE
+	}
+
+	if mDB.shortMetadataStore[string(user)][path] == nil {
+		return FILE_NOT_AVAILABLE
+	}
+
+	delete(mDB.shortMetadataStore[string(user)], path)
+	delete(mDB.extendedMetadataStore[string(user)], path)
+
+	return nil
+}
+
+func (mDB *MemoryDB) MoveFile(user []byte, oldPath string, newPath string) error {
+	mDB.lock.Lock()
+	defer mDB.lock.Unlock()
+
+	if mDB.users[string(user)] == nil {
+		return USER_NOT_AVAILABLE
+	}
+
+	shortMetadata := mDB.shortMetadataStore[string(user)][oldPath]
+
+	if shortMetadata == nil {
+		return FILE_NOT_AVAILABLE
+	}
+
+	if oldPath == newPath {
+		return nil
+	}
+
+	delete(mDB.shortMetadataStore[string(user)], oldPath)
+	mDB.shortMetadataStore[string(user)][newPath] = shortMetadata
+
+	// a file might have been moved before its extended metadata arrived
+	delete(mDB.extendedMetadataStore[string(user)], newPath)
+
+	if extendedMetadata := mDB.extendedMetadataStore[string(user)][oldPath]; extendedMetadata != nil {
+		delete(mDB.extendedMetadataStore[string(user)], oldPath)
+		mDB.extendedMetadataStore[string(user)][newPath] = extendedMetadata
+		mDB.appendVersion(user, newPath, shortMetadata, extendedMetadata)
+	}
+
+	return nil
+}
+
+func (mDB *MemoryDB) PutFileVersion(user []byte, path string, shortMetadata *sync.ShortFileMetadata, extendedMetadata *sync.ExtendedFileMetadata) (*FileVersion, error) {
+	mDB.lock.Lock()
+	defer mDB.lock.Unlock()
+
+	if mDB.users[string(user)] == nil {
+		return nil, USER_NOT_AVAILABLE
+	}
+
+	if mDB.shortMetadataStore[string(user)] == nil {
+		mDB.shortMetadataStore[string(user)] = make(map[string]*sync.ShortFileMetadata)
+	}
+
+	if mDB.extendedMetadataStore[string(user)] == nil {
+		mDB.extendedMetadataStore[string(user)] = make(map[string]*sync.ExtendedFileMetadata)
+	}
+
+	mDB.shortMetadataStore[string(user)][path] = shortMetadata
+	mDB.extendedMetadataStore[string(user)][path] = extendedMetadata
+
+	version := mDB.appendVersion(user, path, shortMetadata, extendedMetadata)
+
+	return &version, nil
+}
+
+// appendVersion has to be called with the write lock held.
+func (mDB *MemoryDB) appendVersion(user []byte, path string, shortMetadata *sync.ShortFileMetadata, extendedMetadata *sync.ExtendedFileMetadata) FileVersion {
+	if mDB.versionStore[string(user)] == nil {
+		mDB.versionStore[string(user)] = make(map[string]*versionHistory)
+	}
+
+	history := mDB.versionStore[string(user)][path]
+
+	if history == nil {
+		history = &versionHistory{}
+		mDB.versionStore[string(user)][path] = history
+	}
+
+	history.lastID += 1
+
+	version := &FileVersion{
+		ID:       history.lastID,
+		StoredAt: time.Now(),
+		Metadata: shortMetadata,
+	}
+
+	history.versions = append(history.versions, &storedVersion{version, extendedMetadata})
+	mDB.references.add(user, extendedMetadata)
+
+	return *version
+}
+
+func (mDB *MemoryDB) ListVersions(user []byte, path string) ([]*FileVersion, error) {
+	mDB.lock.RLock()
+	defer mDB.lock.RUnlock()
+
+	if mDB.users[string(user)] == nil {
+		return nil, USER_NOT_AVAILABLE
+	}
+
+	history := mDB.versionStore[string(user)][path]
+
+	if history == nil || len(history.versions) == 0 {
+		return nil, FILE_NOT_AVAILABLE
+	}
+
+	versions := make([]*FileVersion, len(history.versions))
+
+	for index, stored := range history.versions {
+		version := *stored.version
+		versions[index] = &version
+	}
+
+	return versions, nil
+}
+
+func (mDB *MemoryDB) ListHistories(user []byte) ([]string, error) {
+	mDB.lock.RLock()
+	defer mDB.lock.RUnlock()
+
+	if mDB.users[string(user)] == nil {
+		return nil, USER_NOT_AVAILABLE
+	}
+
+	paths := make([]string, 0, len(mDB.versionStore[string(user)]))
+
+	for path, history := range mDB.versionStore[string(user)] {
+		if len(history.versions) > 0 {
+			paths = append(paths, path)
+		}
+	}
+
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+func (mDB *MemoryDB) RemoveVersion(user []byte, path string, id uint64) error {
+	mDB.lock.Lock()
+	defer mDB.lock.Unlock()
+
+	index, err := mDB.versionIndex(user, path, id)
+
+	if err != nil {
+		return err
+	}
+
+	history := mDB.versionStore[string(user)][path]
+	mDB.references.remove(user, history.versions[index].extendedMetadata)
+	history.versions = append(history.versions[:index], history.versions[index+1:]...)
+
 	return nil
 }
 
-func (mDB *MemoryDB) RetrieveFile(user []byte, file string) (io.Reader, error) {
-	eFM, err := mDB.RetrieveExtendedFileMetadata(user)
+func (mDB *MemoryDB) BlockReferences(hash []byte) (uint64, error) {
+	mDB.lock.RLock()
+	defer mDB.lock.RUnlock()
+
+	return mDB.references.references(hash), nil
+}
+
+func (mDB *MemoryDB) UserDedupStats(user []byte) (*DedupStats, error) {
+	mDB.lock.RLock()
+	defer mDB.lock.RUnlock()
+
+	if mDB.users[string(user)] == nil {
+		return nil, USER_NOT_AVAILABLE
+	}
+
+	return mDB.references.userStats(user), nil
+}
+
+func (mDB *MemoryDB) DedupStats() (*DedupStats, error) {
+	mDB.lock.RLock()
+	defer mDB.lock.RUnlock()
+
+	return mDB.references.stats(), nil
+}
+
+func (mDB *MemoryDB) RetrieveVersion(user []byte, path string, id uint64) (*FileVersion, error) {
+	stored, err := mDB.storedVersion(user, path, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	version := *stored.version
+
+	return &version, nil
+}
+
+func (mDB *MemoryDB) RetrieveVersionAt(user []byte, path string, at time.Time) (*FileVersion, error) {
+	versions, err := mDB.ListVersions(user, path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return versionAt(versions, at)
+}
+
+func (mDB *MemoryDB) RetrieveVersionExtendedMetadata(user []byte, path string, id uint64) (*sync.ExtendedFileMetadata, error) {
+	stored, err := mDB.storedVersion(user, path, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stored.extendedMetadata, nil
+}
+
+func (mDB *MemoryDB) storedVersion(user []byte, path string, id uint64) (*storedVersion, error) {
+	mDB.lock.RLock()
+	defer mDB.lock.RUnlock()
+
+	index, err := mDB.versionIndex(user, path, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mDB.versionStore[string(user)][path].versions[index], nil
+}
+
+// versionIndex has to be called with the lock held.
+func (mDB *MemoryDB) versionIndex(user []byte, path string, id uint64) (int, error) {
+	if mDB.users[string(user)] == nil {
+		return 0, USER_NOT_AVAILABLE
+	}
+
+	history := mDB.versionStore[string(user)][path]
+
+	if history == nil || len(history.versions) == 0 {
+		return 0, FILE_NOT_AVAILABLE
+	}
+
+	for index, stored := range history.versions {
+		if stored.version.ID == id {
+			return index, nil
+		}
+	}
+
+	return 0, VERSION_NOT_AVAILABLE
+}
+
+func (mDB *MemoryDB) RetrieveFile(user []byte, path string) (io.Reader, error) {
+	eFM, err := mDB.RetrieveExtendedFileMetadata(user, path)
 
 	if err != nil {
 		return nil, err
@@ -157,6 +575,9 @@ func (mDB *MemoryDB) RetrieveFile(user []byte, file string) (io.Reader, error) {
 }
 
 func (mDB *MemoryDB) HasBlock(hash []byte) bool {
+	mDB.lock.RLock()
+	defer mDB.lock.RUnlock()
+
 	if block := mDB.blockStore[string(hash)]; block == nil {
 		return false
 	} else {
@@ -165,14 +586,88 @@ func (mDB *MemoryDB) HasBlock(hash []byte) bool {
 }
 
 func (mDB *MemoryDB) RetrieveBlock(hash []byte) (io.Reader, error) {
-	if block := mDB.blockStore[string(hash)]; block == nil {
-		return nil, BLOCK_NOT_AVAILABLE
-	} else {
-		return bytes.NewReader(block), nil
+	return retrieveBlock(mDB, hash)
+}
+
+func (mDB *MemoryDB) RetrieveStoredBlock(hash []byte) (uint8, []byte, error) {
+	mDB.lock.RLock()
+	defer mDB.lock.RUnlock()
+
+	block := mDB.blockStore[string(hash)]
+
+	if block == nil {
+		return 0, nil, BLOCK_NOT_AVAILABLE
 	}
+
+	return block.compression, block.data, nil
 }
 
 func (mDB *MemoryDB) PutBlock(hash []byte, block []byte) error {
-	mDB.blockStore[string(hash)] = block
+	return mDB.PutStoredBlock(hash, sync.COMPRESSION_NONE, block)
+}
+
+// PutStoredBlock keeps an already stored block instead of overwriting it,
+// blocks with the same hash have the same content.
+func (mDB *MemoryDB) PutStoredBlock(hash []byte, compression uint8, data []byte) error {
+	if compression != sync.COMPRESSION_NONE && compression != sync.COMPRESSION_DEFLATE {
+		return sync.UNKNOWN_COMPRESSION
+	}
+
+	storedData := make([]byte, len(data))
+	copy(storedData, data)
+
+	mDB.lock.Lock()
+	defer mDB.lock.Unlock()
+
+	if mDB.blockStore[string(hash)] == nil {
+		mDB.blockStore[string(hash)] = &storedBlock{compression, storedData}
+	}
+
 	return nil
 }
+
+func (mDB *MemoryDB) RemoveBlock(hash []byte) error {
+	mDB.lock.Lock()
+	defer mDB.lock.Unlock()
+
+	if mDB.blockStore[string(hash)] == nil {
+		return BLOCK_NOT_AVAILABLE
+	}
+
+	if mDB.references.references(hash) > 0 {
+		return BLOCK_REFERENCED
+	}
+
+	delete(mDB.blockStore, string(hash))
+
+	return nil
+}
+
+func (mDB *MemoryDB) QuarantineBlock(hash []byte) error {
+	mDB.lock.Lock()
+	defer mDB.lock.Unlock()
+
+	block := mDB.blockStore[string(hash)]
+
+	if block == nil {
+		return BLOCK_NOT_AVAILABLE
+	}
+
+	mDB.quarantineStore[string(hash)] = block
+	delete(mDB.blockStore, string(hash))
+
+	return nil
+}
+
+func (mDB *MemoryDB) ListBlocks() ([][]byte, error) {
+	mDB.lock.RLock()
+	defer mDB.lock.RUnlock()
+
+	hashes := make([][]byte, 0, len(mDB.blockStore))
+
+	for hash := range mDB.blockStore {
+		hashes = append(hashes, []byte(hash))
+	}
+
+	return hashes, nil
+}
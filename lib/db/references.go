@@ -0,0 +1,142 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/FBreuer2/simple-sync/lib/sync"
+)
+
+var BLOCK_REFERENCED = errors.New("Block is still referenced by a version.")
+
+// DedupStats compares the size of all stored versions, LogicalBytes, with
+// the size of the distinct blocks they consist of, PhysicalBytes.
+type DedupStats struct {
+	LogicalBytes  uint64
+	PhysicalBytes uint64
+	Blocks        uint64
+}
+
+// Ratio returns how many logical bytes are stored per physical byte.
+func (dS *DedupStats) Ratio() float64 {
+	if dS.PhysicalBytes == 0 {
+		return 1
+	}
+
+	return float64(dS.LogicalBytes) / float64(dS.PhysicalBytes)
+}
+
+// versionBlocks returns the distinct blocks of a version with their lengths.
+// A block contained twice in a version is referenced by it once.
+func versionBlocks(eFM *sync.ExtendedFileMetadata) map[string]uint64 {
+	blocks := make(map[string]uint64, len(eFM.StrongBlockHashes))
+	offset := uint64(0)
+
+	for index, strongHash := range eFM.StrongBlockHashes {
+		blockLength := uint64(eFM.BlockLength)
+
+		if eFM.IsChunked() == true && index < len(eFM.BlockLengths) {
+			blockLength = uint64(eFM.BlockLengths[index])
+		}
+
+		if offset+blockLength > eFM.FileSize {
+			blockLength = eFM.FileSize - offset
+		}
+
+		blocks[string(strongHash)] = blockLength
+		offset += blockLength
+	}
+
+	return blocks
+}
+
+type blockReference struct {
+	references uint64
+	length     uint64
+}
+
+// referenceCounter counts the versions referencing every block, in total and
+// per user. It is not safe for concurrent use.
+type referenceCounter struct {
+	blocks       map[string]*blockReference
+	userBlocks   map[string]map[string]uint64
+	logicalBytes map[string]uint64
+}
+
+func newReferenceCounter() *referenceCounter {
+	return &referenceCounter{
+		blocks:       make(map[string]*blockReference),
+		userBlocks:   make(map[string]map[string]uint64),
+		logicalBytes: make(map[string]uint64),
+	}
+}
+
+func (rC *referenceCounter) add(user []byte, eFM *sync.ExtendedFileMetadata) {
+	if rC.userBlocks[string(user)] == nil {
+		rC.userBlocks[string(user)] = make(map[string]uint64)
+	}
+
+	for hash, length := range versionBlocks(eFM) {
+		if rC.blocks[hash] == nil {
+			rC.blocks[hash] = &blockReference{length: length}
+		}
+
+		rC.blocks[hash].references += 1
+		rC.userBlocks[string(user)][hash] += 1
+	}
+
+	rC.logicalBytes[string(user)] += eFM.FileSize
+}
+
+func (rC *referenceCounter) remove(user []byte, eFM *sync.ExtendedFileMetadata) {
+	for hash := range versionBlocks(eFM) {
+		if reference := rC.blocks[hash]; reference != nil {
+			reference.references -= 1
+
+			if reference.references == 0 {
+				delete(rC.blocks, hash)
+			}
+		}
+
+		if rC.userBlocks[string(user)][hash] <= 1 {
+			delete(rC.userBlocks[string(user)], hash)
+		} else {
+			rC.userBlocks[string(user)][hash] -= 1
+		}
+	}
+
+	rC.logicalBytes[string(user)] -= eFM.FileSize
+}
+
+func (rC *referenceCounter) references(hash []byte) uint64 {
+	if reference := rC.blocks[string(hash)]; reference != nil {
+		return reference.references
+	}
+
+	return 0
+}
+
+func (rC *referenceCounter) userStats(user []byte) *DedupStats {
+	stats := &DedupStats{LogicalBytes: rC.logicalBytes[string(user)]}
+
+	for hash := range rC.userBlocks[string(user)] {
+		stats.PhysicalBytes += rC.blocks[hash].length
+		stats.Blocks += 1
+	}
+
+	return stats
+}
+
+func (rC *referenceCounter) stats() *DedupStats {
+	stats := &DedupStats{}
+
+	for _, logicalBytes := range rC.logicalBytes {
+		stats.LogicalBytes += logicalBytes
+	}
+
+	for _, reference := range rC.blocks {
+		stats.PhysicalBytes += reference.length
+		stats.Blocks += 1
+	}
+
+	return stats
+}
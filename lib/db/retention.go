@@ -0,0 +1,150 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var INVALID_RETENTION_POLICY = errors.New("Retention policy is invalid.")
+
+// RetentionPolicy decides which versions of a file are kept. KeepLast keeps
+// the newest versions, the other Keep rules keep the newest version of each
+// of the given number of most recent hours, days, ISO weeks and months that
+// have versions. A version is kept if any rule keeps it; without rules all
+// versions are kept. MaxAge, if set, removes versions stored longer ago even
+// if a rule keeps them. The newest version of a file that was not removed is
+// always kept, because it is the current state of the file.
+type RetentionPolicy struct {
+	KeepLast    int
+	KeepHourly  int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	MaxAge      time.Duration
+}
+
+// ParseRetentionPolicy reads a policy from a comma separated list of rules
+// like "last=10,daily=7,weekly=4,max-age=8760h". The rules are last, hourly,
+// daily, weekly, monthly and max-age, which takes a Go duration.
+func ParseRetentionPolicy(spec string) (*RetentionPolicy, error) {
+	policy := &RetentionPolicy{}
+
+	for _, rule := range strings.Split(spec, ",") {
+		rule = strings.TrimSpace(rule)
+
+		if len(rule) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(rule, "=", 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%w Rule \"%s\" has no value.", INVALID_RETENTION_POLICY, rule)
+		}
+
+		if parts[0] == "max-age" {
+			maxAge, err := time.ParseDuration(parts[1])
+
+			if err != nil || maxAge < 0 {
+				return nil, fmt.Errorf("%w Max age \"%s\" is not a duration.", INVALID_RETENTION_POLICY, parts[1])
+			}
+
+			policy.MaxAge = maxAge
+			continue
+		}
+
+		amount, err := strconv.Atoi(parts[1])
+
+		if err != nil || amount < 0 {
+			return nil, fmt.Errorf("%w Rule \"%s\" needs a positive amount.", INVALID_RETENTION_POLICY, rule)
+		}
+
+		switch parts[0] {
+		case "last":
+			policy.KeepLast = amount
+		case "hourly":
+			policy.KeepHourly = amount
+		case "daily":
+			policy.KeepDaily = amount
+		case "weekly":
+			policy.KeepWeekly = amount
+		case "monthly":
+			policy.KeepMonthly = amount
+		default:
+			return nil, fmt.Errorf("%w Rule \"%s\" is unknown.", INVALID_RETENTION_POLICY, parts[0])
+		}
+	}
+
+	return policy, nil
+}
+
+func (rP *RetentionPolicy) hasKeepRules() bool {
+	return rP.KeepLast > 0 || rP.KeepHourly > 0 || rP.KeepDaily > 0 || rP.KeepWeekly > 0 || rP.KeepMonthly > 0
+}
+
+// Select splits versions, which are sorted oldest first, into the ones to
+// keep and the ones to remove at the given time. Periods are evaluated in
+// UTC.
+func (rP *RetentionPolicy) Select(versions []*FileVersion, fileExists bool, now time.Time) ([]*FileVersion, []*FileVersion) {
+	keepVersion := make([]bool, len(versions))
+
+	periodRules := []struct {
+		amount int
+		period func(time.Time) string
+	}{
+		{rP.KeepHourly, func(stored time.Time) string { return stored.Format("2006-01-02T15") }},
+		{rP.KeepDaily, func(stored time.Time) string { return stored.Format("2006-01-02") }},
+		{rP.KeepWeekly, func(stored time.Time) string {
+			year, week := stored.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{rP.KeepMonthly, func(stored time.Time) string { return stored.Format("2006-01") }},
+	}
+
+	for _, rule := range periodRules {
+		if rule.amount <= 0 {
+			continue
+		}
+
+		seenPeriods := make(map[string]bool)
+
+		for index := len(versions) - 1; index >= 0 && len(seenPeriods) < rule.amount; index-- {
+			period := rule.period(versions[index].StoredAt.UTC())
+
+			if seenPeriods[period] == false {
+				seenPeriods[period] = true
+				keepVersion[index] = true
+			}
+		}
+	}
+
+	for index := len(versions) - 1; index >= 0 && index >= len(versions)-rP.KeepLast; index-- {
+		keepVersion[index] = true
+	}
+
+	keep := make([]*FileVersion, 0, len(versions))
+	remove := make([]*FileVersion, 0)
+
+	for index, version := range versions {
+		kept := keepVersion[index] || rP.hasKeepRules() == false
+
+		if rP.MaxAge > 0 && now.Sub(version.StoredAt) > rP.MaxAge {
+			kept = false
+		}
+
+		if fileExists == true && index == len(versions)-1 {
+			kept = true
+		}
+
+		if kept == true {
+			keep = append(keep, version)
+		} else {
+			remove = append(remove, version)
+		}
+	}
+
+	return keep, remove
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+
+	"github.com/FBreuer2/simple-sync/lib/sync"
+)
+
+// ScrubReport lists the blocks a scrub found not matching their hash and
+// the versions that can not be restored until they are uploaded again.
+type ScrubReport struct {
+	CheckedBlocks   int
+	CorruptedBlocks [][]byte
+	DamagedVersions []*DamagedVersion
+}
+
+// DamagedVersion is a version that references a quarantined block.
+type DamagedVersion struct {
+	User    []byte
+	Path    string
+	Version *FileVersion
+}
+
+// Scrub decompresses and re-hashes every stored block and quarantines the
+// ones that do not match their hash anymore. Scrubbing is safe while peers
+// keep working, blocks removed in the meantime are skipped.
+func Scrub(database FullDatabase) (*ScrubReport, error) {
+	hashes, err := database.ListBlocks()
+
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ScrubReport{CorruptedBlocks: make([][]byte, 0)}
+
+	for _, hash := range hashes {
+		blockReader, err := database.RetrieveBlock(hash)
+
+		if errors.Is(err, BLOCK_NOT_AVAILABLE) == true {
+			continue
+		}
+
+		// blocks that do not decompress are corrupted as well
+		compressionFailed := errors.Is(err, sync.INVALID_COMPRESSED_BLOCK) || errors.Is(err, sync.UNKNOWN_COMPRESSION)
+
+		if err != nil && compressionFailed == false {
+			return report, err
+		}
+
+		report.CheckedBlocks += 1
+
+		if compressionFailed == false {
+			block, err := ioutil.ReadAll(blockReader)
+
+			if err != nil {
+				return report, err
+			}
+
+			if sync.VerifyBlock(block, hash) == nil {
+				continue
+			}
+		}
+
+		err = database.QuarantineBlock(hash)
+
+		if err != nil && errors.Is(err, BLOCK_NOT_AVAILABLE) == false {
+			return report, err
+		}
+
+		report.CorruptedBlocks = append(report.CorruptedBlocks, hash)
+	}
+
+	if len(report.CorruptedBlocks) == 0 {
+		return report, nil
+	}
+
+	report.DamagedVersions, err = findDamagedVersions(database, report.CorruptedBlocks)
+
+	return report, err
+}
+
+// findDamagedVersions returns the versions of all users that reference one
+// of the quarantined blocks. Versions removed in the meantime are skipped.
+func findDamagedVersions(database FullDatabase, quarantinedBlocks [][]byte) ([]*DamagedVersion, error) {
+	quarantined := make(map[string]bool, len(quarantinedBlocks))
+
+	for _, hash := range quarantinedBlocks {
+		quarantined[string(hash)] = true
+	}
+
+	damagedVersions := make([]*DamagedVersion, 0)
+
+	users, err := database.ListUsers()
+
+	if err != nil {
+		return damagedVersions, err
+	}
+
+	for _, user := range users {
+		paths, err := database.ListHistories(user)
+
+		if err != nil {
+			return damagedVersions, err
+		}
+
+		for _, path := range paths {
+			versions, err := database.ListVersions(user, path)
+
+			if errors.Is(err, FILE_NOT_AVAILABLE) {
+				continue
+			}
+
+			if err != nil {
+				return damagedVersions, err
+			}
+
+			for _, version := range versions {
+				eFM, err := database.RetrieveVersionExtendedMetadata(user, path, version.ID)
+
+				if errors.Is(err, VERSION_NOT_AVAILABLE) || errors.Is(err, FILE_NOT_AVAILABLE) {
+					continue
+				}
+
+				if err != nil {
+					return damagedVersions, err
+				}
+
+				for _, strongHash := range eFM.StrongBlockHashes {
+					if quarantined[string(strongHash)] == true {
+						damagedVersions = append(damagedVersions, &DamagedVersion{user, path, version})
+						break
+					}
+				}
+			}
+		}
+	}
+
+	return damagedVersions, nil
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	TOKEN_SIZE     = 20
+	TOKEN_LIFETIME = 30 * 24 * time.Hour
+)
+
+// storedToken keeps only the hash of a token, the token itself is only
+// known to the client it was issued to. The token a rotated token replaced
+// stays valid until the new one is used, in case the client could not
+// store the new one.
+type storedToken struct {
+	Hash              []byte
+	Info              TokenInfo
+	PreviousHash      []byte `json:",omitempty"`
+	PreviousExpiresAt time.Time
+}
+
+// newStoredToken creates a random token for the label and returns it along
+// with the entry to store for it.
+func newStoredToken(label string, lifetime time.Duration) ([]byte, *storedToken, error) {
+	newTokenBytes := make([]byte, TOKEN_SIZE)
+
+	readBytes, err := rand.Read(newTokenBytes)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if readBytes < TOKEN_SIZE {
+		return nil, nil, errors.New("Could not read enough random bytes to generate the token.")
+	}
+
+	now := time.Now()
+	tokenHash := blake2b.Sum256(newTokenBytes)
+
+	return newTokenBytes, &storedToken{
+		Hash: tokenHash[:],
+		Info: TokenInfo{
+			Label:     label,
+			IssuedAt:  now,
+			ExpiresAt: now.Add(lifetime),
+		},
+	}, nil
+}
+
+// replaceToken adds newToken to tokens, dropping the previous token of the
+// same label and every expired one.
+func replaceToken(tokens []*storedToken, newToken *storedToken) []*storedToken {
+	remainingTokens := make([]*storedToken, 0, len(tokens)+1)
+
+	for _, token := range tokens {
+		if token.Info.Label != newToken.Info.Label && newToken.Info.IssuedAt.Before(token.Info.ExpiresAt) {
+			remainingTokens = append(remainingTokens, token)
+		}
+	}
+
+	return append(remainingTokens, newToken)
+}
+
+// findToken returns the index of the entry token belongs to, either as the
+// current or as the previous token.
+func findToken(tokens []*storedToken, token []byte) (int, error) {
+	index, _, err := findTokenExpiry(tokens, token)
+
+	return index, err
+}
+
+func findTokenExpiry(tokens []*storedToken, token []byte) (int, time.Time, error) {
+	tokenHash := blake2b.Sum256(token)
+
+	for index, storedToken := range tokens {
+		expiresAt := storedToken.Info.ExpiresAt
+
+		if subtle.ConstantTimeCompare(storedToken.Hash, tokenHash[:]) != 1 {
+			if subtle.ConstantTimeCompare(storedToken.PreviousHash, tokenHash[:]) != 1 {
+				continue
+			}
+
+			expiresAt = storedToken.PreviousExpiresAt
+		}
+
+		if time.Now().Before(expiresAt) == false {
+			return -1, time.Time{}, TOKEN_EXPIRED
+		}
+
+		return index, expiresAt, nil
+	}
+
+	return -1, time.Time{}, TOKEN_NOT_AVAILABLE
+}
+
+// rotateToken replaces the entry of token with a new token of the same
+// label. The token stays valid as the previous one until the new token is
+// used in turn, so logging in with it again discards an unused successor.
+func rotateToken(tokens []*storedToken, token []byte, lifetime time.Duration) ([]byte, []*storedToken, error) {
+	index, expiresAt, err := findTokenExpiry(tokens, token)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newTokenBytes, newToken, err := newStoredToken(tokens[index].Info.Label, lifetime)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tokenHash := blake2b.Sum256(token)
+	newToken.PreviousHash = tokenHash[:]
+	newToken.PreviousExpiresAt = expiresAt
+
+	return newTokenBytes, replaceToken(tokens, newToken), nil
+}
+
+func findTokenByLabel(tokens []*storedToken, label string) (int, error) {
+	for index, storedToken := range tokens {
+		if storedToken.Info.Label == label {
+			return index, nil
+		}
+	}
+
+	return -1, TOKEN_NOT_AVAILABLE
+}
+
+func removeToken(tokens []*storedToken, index int) []*storedToken {
+	return append(tokens[:index:index], tokens[index+1:]...)
+}
+
+func tokenInfos(tokens []*storedToken) []TokenInfo {
+	infos := make([]TokenInfo, 0, len(tokens))
+
+	for _, token := range tokens {
+		infos = append(infos, token.Info)
+	}
+
+	return infos
+}
@@ -0,0 +1,30 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/FBreuer2/simple-sync/lib/sync"
+)
+
+var VERSION_NOT_AVAILABLE = errors.New("Version is not available.")
+
+// FileVersion describes one stored state of a file. Versions are numbered
+// from 1 per path in the order they were stored and never change afterwards.
+type FileVersion struct {
+	ID       uint64
+	StoredAt time.Time
+	Metadata *sync.ShortFileMetadata
+}
+
+// versionAt returns the newest of the versions, which are sorted oldest
+// first, that was stored at or before the given time.
+func versionAt(versions []*FileVersion, at time.Time) (*FileVersion, error) {
+	for index := len(versions) - 1; index >= 0; index-- {
+		if versions[index].StoredAt.After(at) == false {
+			return versions[index], nil
+		}
+	}
+
+	return nil, VERSION_NOT_AVAILABLE
+}
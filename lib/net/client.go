@@ -1,33 +1,166 @@
 package net
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
 	"errors"
-
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"time"
 
+	"github.com/FBreuer2/librsync-go"
+	"github.com/FBreuer2/simple-sync/lib/db"
 	"github.com/FBreuer2/simple-sync/lib/sync"
+	"golang.org/x/crypto/blake2b"
 	"golang.org/x/crypto/sha3"
 )
 
+// Credentials describe how a client authenticates. If TokenFile is set, a
+// token stored there is preferred over the password, and a token obtained
+// after a password login is written there for the next start. The server
+// keeps one token per TokenLabel, so every device should use its own label.
+type Credentials struct {
+	Username   []byte
+	Password   []byte
+	TokenFile  string
+	TokenLabel string
+}
+
+// fileSource is what the server pulls the blocks of a file from, either a
+// watched file or its encrypted form.
+type fileSource interface {
+	GetShortFileMetadata() (*sync.ShortFileMetadata, error)
+	GetCompleteFileInformation(blockLength uint32, strongChecksumLength uint32) (*sync.ExtendedFileMetadata, error)
+	GetChunkedFileInformation(lengths sync.ChunkLengths, strongChecksumLength uint32) (*sync.ExtendedFileMetadata, error)
+	ReadBlock(strongHash []byte) ([]byte, error)
+}
+
 type ClientContext struct {
-	url           string
-	shouldStop    chan bool
-	conn          net.Conn
-	authenticated bool
-	fileWatcher   *sync.FileWatcher
-	serverHash    string
+	url            string
+	conn           net.Conn
+	codec          *Codec
+	handlers       *Dispatcher
+	authenticated  bool
+	version        uint16
+	capabilities   uint16
+	maxFrameLength uint32
+	files          map[string]fileSource
+	filesLock      gosync.RWMutex
+	serverHash     string
+	credentials    Credentials
+	requestLock    gosync.Mutex
+	replies        chan *ReplyPacket
+	responses      chan EncapsulatablePacket
+	stream         chan EncapsulatablePacket
+	activity       chan bool
+	syncErrors     chan error
+	keyring        *sync.Keyring
 }
 
-func NewClient(url string, serverCertificateHash string) *ClientContext {
-	return &ClientContext{
-		url:        url,
-		serverHash: serverCertificateHash,
+const (
+	CLIENT_REPLY_TIMEOUT = 30 * time.Second
+
+	// a server busy with another transfer of ours is asked again
+	CLIENT_BUSY_RETRIES = 5
+	CLIENT_BUSY_DELAY   = time.Second
+)
+
+func NewClient(url string, serverCertificateHash string, credentials Credentials) *ClientContext {
+	client := &ClientContext{
+		url:         url,
+		files:       make(map[string]fileSource),
+		serverHash:  serverCertificateHash,
+		credentials: credentials,
+		replies:     make(chan *ReplyPacket, 8),
+		responses:   make(chan EncapsulatablePacket, 1),
+		stream:      make(chan EncapsulatablePacket),
+		activity:    make(chan bool, 1),
+		syncErrors:  make(chan error, 8),
+		handlers:    NewDispatcher(),
+	}
+
+	client.handlers.Handle(REPLY, func(packet EncapsulatablePacket) {
+		replyPacket := packet.(*ReplyPacket)
+
+		select {
+		case client.replies <- replyPacket:
+		default:
+			log.Printf("Dropped unexpected reply: %s\n", replyPacket.Error())
+		}
+	})
+
+	client.handlers.Handle(HELLO, func(packet EncapsulatablePacket) {
+		helloPacket := packet.(*HelloPacket)
+
+		// the server splits packets from its hello on, servers without
+		// framing send every packet as one frame
+		if helloPacket.HasCapability(CAPABILITY_FRAMING) == true {
+			client.codec.SetReadFrameLength(NegotiateMaxFrameLength(DEFAULT_MAX_FRAME_LENGTH, helloPacket.MaxFrameLength))
+		} else {
+			client.codec.SetReadFrameLength(0)
+		}
+
+		// and sends them in the layout of the negotiated version
+		if version, err := NegotiateVersion(helloPacket.Version); err == nil {
+			client.codec.SetReadVersion(version)
+		}
+
+		client.deliverResponse(helloPacket)
+	})
+
+	for _, packetType := range []uint16{TOKEN, SHORT_FILE_METADATA, VERSIONS} {
+		client.handlers.Handle(packetType, client.deliverResponse)
 	}
+
+	for _, packetType := range []uint16{BLOCK_PACKET, COMPRESSED_BLOCK_PACKET, DELTA} {
+		client.handlers.Handle(packetType, client.deliverStream)
+	}
+
+	// answering requests reads and hashes files, which must not keep the
+	// read loop from delivering further packets
+	client.handlers.Handle(REQUEST_EXTENDED_FILE_METADATA, func(packet EncapsulatablePacket) {
+		go client.HandleRequestExtendedFileMetadataPacket(packet.(*RequestExtendedFileMetadataPacket))
+	})
+	client.handlers.Handle(REQUEST_CHUNKED_FILE_METADATA, func(packet EncapsulatablePacket) {
+		go client.HandleRequestChunkedFileMetadataPacket(packet.(*RequestChunkedFileMetadataPacket))
+	})
+	client.handlers.Handle(REQUEST_BLOCK_PACKET, func(packet EncapsulatablePacket) {
+		go client.HandleRequestBlockPacket(packet.(*RequestBlockPacket))
+	})
+
+	return client
+}
+
+// Handle registers handler for packets of packetType the server sends,
+// replacing the one registered before. Handlers run on the goroutine that
+// reads packets and must not wait for further packets. Packet types of
+// extensions have to be registered with RegisterPacket as well.
+func (client *ClientContext) Handle(packetType uint16, handler PacketHandler) {
+	client.handlers.Handle(packetType, handler)
+}
+
+// SendPacket sends a packet of an extension to the server, it is safe for
+// concurrent use. Answers arrive at the handler registered with Handle, the
+// server must not answer with a reply, which would be taken as the answer
+// to a pending request.
+func (client *ClientContext) SendPacket(packet EncapsulatablePacket) error {
+	return client.sendPacket(packet)
+}
+
+// Errors delivers the errors that happen in the background after Start
+// returned. Replies of the server are *ReplyError values.
+func (client *ClientContext) Errors() <-chan error {
+	return client.syncErrors
 }
 
 func (client *ClientContext) checkFingerprint(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
@@ -50,14 +183,28 @@ func (client *ClientContext) checkFingerprint(rawCerts [][]byte, verifiedChains
 	return errors.New("No matching server fingerprint.")
 }
 
-func (client *ClientContext) Start(filePath string) error {
-	fileWatcher, err := sync.NewFileWatcher(filePath)
-	if err != nil {
-		log.Fatal(err)
-		return err
-	}
+// SetKeyring enables client side encryption of file contents and names,
+// see sync.Keyring. It has to be set before files are synced or restored,
+// files stored without encryption are not readable with it.
+func (client *ClientContext) SetKeyring(keyring *sync.Keyring) {
+	client.keyring = keyring
+}
+
+// Start connects to the server and authenticates. Files are synchronized
+// with SyncFile afterwards.
+func (client *ClientContext) Start() error {
+	// without a password a stored token is the only way to log in
+	if len(client.credentials.Password) == 0 {
+		token, err := client.loadToken()
+
+		if err != nil {
+			return err
+		}
 
-	client.fileWatcher = fileWatcher
+		if token == nil {
+			return NO_CREDENTIALS
+		}
+	}
 
 	conf := &tls.Config{
 		InsecureSkipVerify:    true,
@@ -71,84 +218,1052 @@ func (client *ClientContext) Start(filePath string) error {
 	}
 
 	client.conn = newConnection
+	client.codec = NewCodec(newConnection, DEFAULT_PACKET_REGISTRY)
+
+	// the server is authenticated by its certificate
+	client.codec.SetReadPacketLength(MAX_PACKET_LENGTH)
 
-	go client.mainLoop()
+	go client.readLoop()
+
+	if err := client.sendHello(); err != nil {
+		client.conn.Close()
+		return err
+	}
+
+	if err := client.authenticate(); err != nil {
+		client.conn.Close()
+		return err
+	}
+
+	client.authenticated = true
 
 	return nil
 }
 
+// Stop closes the connection, pending requests fail with CONNECTION_CLOSED.
 func (client *ClientContext) Stop() {
-	client.shouldStop <- true
+	if client.conn != nil {
+		client.conn.Close()
+	}
 }
 
-func (client *ClientContext) mainLoop() {
-	client.sendHello()
-	client.sendLoginPacket()
-	client.sendShortFileMetadata()
+// SyncFile sends the metadata of the file watched by fileWatcher under the
+// given path, relative to the backup root, and waits until the server stored
+// every block it was missing. The server requests blocks by path, so the
+// watcher stays registered for later syncs.
+func (client *ClientContext) SyncFile(relativePath string, fileWatcher *sync.FileWatcher) error {
+	path, err := client.remotePath(relativePath)
 
-	for {
-		select {
-		case <-client.shouldStop:
-			client.conn.Close()
-			return
-		}
+	if err != nil {
+		return err
+	}
+
+	client.filesLock.Lock()
+	source, err := client.fileSourceFor(path, fileWatcher)
 
+	if err == nil {
+		client.files[path] = source
 	}
+	client.filesLock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return client.sendShortFileMetadata(path, source)
 }
 
-func (client *ClientContext) sendHello() {
-	helloPacket := NewHelloPacket()
-	err := client.sendPacket(helloPacket)
+// remotePath normalizes a path and encrypts it if a keyring is set.
+func (client *ClientContext) remotePath(relativePath string) (string, error) {
+	path, err := sync.NormalizePath(relativePath)
 
 	if err != nil {
-		log.Println(err.Error())
-		return
+		return "", err
 	}
+
+	if client.keyring == nil {
+		return path, nil
+	}
+
+	return client.keyring.EncryptPath(path), nil
+}
+
+// fileSourceFor returns what the server pulls the file watched by
+// fileWatcher from. The encrypted form of a file is kept between syncs, so
+// it is only encrypted again once the file changed. The caller holds the
+// files lock.
+func (client *ClientContext) fileSourceFor(path string, fileWatcher *sync.FileWatcher) (fileSource, error) {
+	if client.keyring == nil {
+		return fileWatcher, nil
+	}
+
+	// the server has to request chunks, which the file is encrypted in
+	if client.hasCapability(CAPABILITY_CHUNKING) == false {
+		return nil, CAPABILITY_MISSING
+	}
+
+	if encryptedFile, ok := client.files[path].(*sync.EncryptedFile); ok == true && encryptedFile.FileWatcher() == fileWatcher {
+		return encryptedFile, nil
+	}
+
+	return sync.NewEncryptedFile(fileWatcher, client.keyring, DEFAULT_CHUNK_LENGTHS)
 }
 
-func (client *ClientContext) sendShortFileMetadata() {
-	shortFileMetadata, err := client.fileWatcher.GetShortFileMetadata()
+// RemoveFile removes the file at the given path from the backup.
+func (client *ClientContext) RemoveFile(relativePath string) error {
+	path, err := client.remotePath(relativePath)
 
 	if err != nil {
-		log.Println(err.Error())
-		return
+		return err
 	}
 
-	shortFileMetadataPacket := NewShortFileMetaDataPacket(shortFileMetadata)
+	if client.hasCapability(CAPABILITY_TREE) == false {
+		return CAPABILITY_MISSING
+	}
 
-	err = client.sendPacket(shortFileMetadataPacket)
+	removeFilePacket, err := NewRemoveFilePacket(path)
 
 	if err != nil {
-		log.Println(err.Error())
-		return
+		return err
+	}
+
+	if err := client.request(removeFilePacket); err != nil {
+		return err
 	}
 
-	return
+	client.filesLock.Lock()
+	delete(client.files, path)
+	client.filesLock.Unlock()
+
+	return nil
 }
 
-func (client *ClientContext) sendLoginPacket() {
-	loginPacket := NewLoginPacket([]byte("user"), []byte("password"))
+// MoveFile moves a file in the backup without transferring it again. The
+// fileWatcher watches the file at its new location.
+func (client *ClientContext) MoveFile(oldRelativePath string, newRelativePath string, fileWatcher *sync.FileWatcher) error {
+	oldPath, err := client.remotePath(oldRelativePath)
+
+	if err != nil {
+		return err
+	}
 
-	err := client.sendPacket(loginPacket)
+	newPath, err := client.remotePath(newRelativePath)
 
 	if err != nil {
-		log.Println(err.Error())
-		return
+		return err
 	}
-}
 
-func (client *ClientContext) sendPacket(packetToSend EncapsulatablePacket) error {
-	newPacket, err := NewEncapsulatedPacket(packetToSend)
+	if client.hasCapability(CAPABILITY_TREE) == false {
+		return CAPABILITY_MISSING
+	}
+
+	moveFilePacket, err := NewMoveFilePacket(oldPath, newPath)
+
 	if err != nil {
 		return err
 	}
 
-	data, err := newPacket.MarshalBinary()
+	if err := client.request(moveFilePacket); err != nil {
+		return err
+	}
+
+	client.filesLock.Lock()
+	defer client.filesLock.Unlock()
+
+	source, err := client.fileSourceFor(oldPath, fileWatcher)
+
 	if err != nil {
 		return err
 	}
 
-	client.conn.Write(data)
+	delete(client.files, oldPath)
+	client.files[newPath] = source
 
 	return nil
 }
+
+// Restore downloads the stored file at the given path to targetPath. The
+// file is written to a temporary file next to targetPath and only renamed
+// into place once every block and the whole file matched their hashes. If
+// targetPath already holds an older copy, only the differences are
+// downloaded and applied to it.
+func (client *ClientContext) Restore(relativePath string, targetPath string) error {
+	path, err := client.remotePath(relativePath)
+
+	if err != nil {
+		return err
+	}
+
+	if client.hasCapability(CAPABILITY_RESTORE) == false {
+		return CAPABILITY_MISSING
+	}
+
+	// an older copy at the target only has to be patched, unless the
+	// server only knows the encrypted file
+	if fileInfo, err := os.Stat(targetPath); err == nil && fileInfo.Mode().IsRegular() == true && client.hasCapability(CAPABILITY_DELTA) == true && client.keyring == nil {
+		return client.restoreDelta(path, targetPath)
+	}
+
+	requestPacket, err := NewRequestRestorePacket(path)
+
+	if err != nil {
+		return err
+	}
+
+	return client.restore(targetPath, requestPacket, client.blockReceiver())
+}
+
+// ListVersions returns the stored versions of the file at the given path,
+// oldest first.
+func (client *ClientContext) ListVersions(relativePath string) ([]*db.FileVersion, error) {
+	path, err := client.remotePath(relativePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if client.hasCapability(CAPABILITY_HISTORY) == false {
+		return nil, CAPABILITY_MISSING
+	}
+
+	requestPacket, err := NewRequestVersionsPacket(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client.requestLock.Lock()
+	defer client.requestLock.Unlock()
+
+	if err := client.sendPacket(requestPacket); err != nil {
+		return nil, err
+	}
+
+	responsePacket, err := client.awaitResponse(CLIENT_REPLY_TIMEOUT)
+
+	if err != nil {
+		return nil, err
+	}
+
+	versionsPacket, ok := responsePacket.(*VersionsPacket)
+
+	if ok == false {
+		return nil, errors.New("Server did not answer with versions.")
+	}
+
+	return versionsPacket.Versions, nil
+}
+
+// RestoreVersion downloads the version with the given id of a stored file
+// to targetPath, like Restore does with the current version.
+func (client *ClientContext) RestoreVersion(relativePath string, versionID uint64, targetPath string) error {
+	return client.restoreVersion(relativePath, versionID, time.Time{}, targetPath)
+}
+
+// RestoreVersionAt downloads the newest version of a stored file that the
+// server stored at or before the given time.
+func (client *ClientContext) RestoreVersionAt(relativePath string, storedBefore time.Time, targetPath string) error {
+	return client.restoreVersion(relativePath, 0, storedBefore, targetPath)
+}
+
+func (client *ClientContext) restoreVersion(relativePath string, versionID uint64, storedBefore time.Time, targetPath string) error {
+	path, err := client.remotePath(relativePath)
+
+	if err != nil {
+		return err
+	}
+
+	if client.hasCapability(CAPABILITY_HISTORY) == false {
+		return CAPABILITY_MISSING
+	}
+
+	requestPacket, err := NewRequestVersionRestorePacket(path, versionID, storedBefore)
+
+	if err != nil {
+		return err
+	}
+
+	return client.restore(targetPath, requestPacket, client.blockReceiver())
+}
+
+// restoreDelta sends the signature of the copy at targetPath, so the server
+// only has to send what changed, and patches that copy.
+func (client *ClientContext) restoreDelta(path string, targetPath string) error {
+	basisWatcher, err := sync.NewFileWatcher(targetPath)
+
+	if err != nil {
+		return err
+	}
+
+	signature, err := basisWatcher.GetCompleteFileInformation(DEFAULT_BLOCK_LENGTH, DEFAULT_STRONG_CHECKSUM_LENGTH)
+
+	if err != nil {
+		return err
+	}
+
+	requestPacket, err := NewRequestDeltaRestorePacket(path, signature)
+
+	if err != nil {
+		return err
+	}
+
+	basisFile, err := os.Open(targetPath)
+
+	if err != nil {
+		return err
+	}
+
+	defer basisFile.Close()
+
+	return client.restore(targetPath, requestPacket, func(writer io.Writer) (*sync.ShortFileMetadata, error) {
+		deltaFile, err := ioutil.TempFile(filepath.Dir(targetPath), ".delta")
+
+		if err != nil {
+			client.receiveStream(nil)
+			return nil, err
+		}
+
+		defer os.Remove(deltaFile.Name())
+		defer deltaFile.Close()
+
+		if err := client.receiveDelta(deltaFile); err != nil {
+			return nil, err
+		}
+
+		if _, err := deltaFile.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		return nil, librsync.Patch(basisFile, bufio.NewReader(deltaFile), writer)
+	})
+}
+
+// restore sends requestPacket and writes the file the server answers with
+// to targetPath, once its size and hash match the metadata sent first.
+// receive has to consume the answer up to the final reply. It returns the
+// metadata the written file has to match instead, or nil.
+func (client *ClientContext) restore(targetPath string, requestPacket EncapsulatablePacket, receive func(writer io.Writer) (*sync.ShortFileMetadata, error)) error {
+	client.requestLock.Lock()
+	defer client.requestLock.Unlock()
+
+	if err := client.sendPacket(requestPacket); err != nil {
+		return err
+	}
+
+	responsePacket, err := client.awaitResponse(CLIENT_REPLY_TIMEOUT)
+
+	if err != nil {
+		return err
+	}
+
+	sFMPacket, ok := responsePacket.(*ShortFileMetadataPacket)
+
+	if ok == false {
+		return errors.New("Server did not answer with file metadata.")
+	}
+
+	restoreFile, err := ioutil.TempFile(filepath.Dir(targetPath), ".restore")
+
+	if err != nil {
+		client.receiveStream(nil)
+		return err
+	}
+
+	defer os.Remove(restoreFile.Name())
+
+	hasher, err := blake2b.New256(nil)
+
+	if err != nil {
+		restoreFile.Close()
+		client.receiveStream(nil)
+		return err
+	}
+
+	expectedSFM, err := receive(io.MultiWriter(restoreFile, hasher))
+
+	if err == nil {
+		err = restoreFile.Sync()
+	}
+
+	if closeErr := restoreFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	sFM, err := sFMPacket.GetData()
+
+	if err != nil {
+		return err
+	}
+
+	if expectedSFM != nil {
+		sFM = expectedSFM
+	}
+
+	if fileInfo, err := os.Stat(restoreFile.Name()); err != nil || uint64(fileInfo.Size()) != sFM.FileSize || bytes.Equal(hasher.Sum(nil), sFM.FileHash) == false {
+		return RESTORE_MISMATCH
+	}
+
+	if err := os.Chtimes(restoreFile.Name(), sFM.LastChanged, sFM.LastChanged); err != nil {
+		return err
+	}
+
+	return os.Rename(restoreFile.Name(), targetPath)
+}
+
+// blockReceiver returns how the blocks of a restore are received.
+func (client *ClientContext) blockReceiver() func(writer io.Writer) (*sync.ShortFileMetadata, error) {
+	if client.keyring != nil {
+		return client.receiveEncryptedBlocks
+	}
+
+	return client.receiveBlocks
+}
+
+// receiveBlocks writes the verified blocks of a restore to writer until the
+// server ends the restore with a reply.
+func (client *ClientContext) receiveBlocks(writer io.Writer) (*sync.ShortFileMetadata, error) {
+	return nil, client.receiveStream(func(streamPacket EncapsulatablePacket) error {
+		blockPacket, err := streamBlock(streamPacket)
+
+		if err != nil {
+			return err
+		}
+
+		if err := sync.VerifyBlock(blockPacket.Data, blockPacket.StrongChecksum); err != nil {
+			return err
+		}
+
+		_, err = writer.Write(blockPacket.Data)
+
+		return err
+	})
+}
+
+// streamBlock returns the decompressed block of a streamed packet.
+func streamBlock(streamPacket EncapsulatablePacket) (*BlockPacket, error) {
+	switch packet := streamPacket.(type) {
+	case *BlockPacket:
+		return packet, nil
+
+	case *CompressedBlockPacket:
+		return packet.Decompress()
+	}
+
+	return nil, errors.New("Server sent a delta instead of a block.")
+}
+
+// receiveEncryptedBlocks decrypts the verified blocks of a restore to writer
+// and returns the metadata stored in the encrypted header, as the server
+// only knows the metadata of the encrypted file.
+func (client *ClientContext) receiveEncryptedBlocks(writer io.Writer) (*sync.ShortFileMetadata, error) {
+	fileDecrypter := sync.NewFileDecrypter(client.keyring, writer)
+
+	err := client.receiveStream(func(streamPacket EncapsulatablePacket) error {
+		blockPacket, err := streamBlock(streamPacket)
+
+		if err != nil {
+			return err
+		}
+
+		if err := sync.VerifyBlock(blockPacket.Data, blockPacket.StrongChecksum); err != nil {
+			return err
+		}
+
+		return fileDecrypter.WriteBlock(blockPacket.Data)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if fileDecrypter.Metadata() == nil {
+		return nil, RESTORE_MISMATCH
+	}
+
+	return fileDecrypter.Metadata(), nil
+}
+
+// receiveDelta writes the delta of a restore to writer until the server ends
+// the restore with a reply.
+func (client *ClientContext) receiveDelta(writer io.Writer) error {
+	return client.receiveStream(func(streamPacket EncapsulatablePacket) error {
+		deltaPacket, ok := streamPacket.(*DeltaPacket)
+
+		if ok == false {
+			return errors.New("Server sent a block instead of a delta.")
+		}
+
+		_, err := writer.Write(deltaPacket.Data)
+
+		return err
+	})
+}
+
+// receiveStream hands the packets of a restore to handle until the server
+// ends the restore with a reply. After an error, or if handle is nil, the
+// remaining packets are still received, so they do not end up in the next
+// request.
+func (client *ClientContext) receiveStream(handle func(streamPacket EncapsulatablePacket) error) error {
+	var streamError error
+
+	for {
+		select {
+		case streamPacket := <-client.stream:
+			if streamError != nil || handle == nil {
+				continue
+			}
+
+			streamError = handle(streamPacket)
+
+		case replyPacket, ok := <-client.replies:
+			if ok == false {
+				return CONNECTION_CLOSED
+			}
+
+			if err := replyPacket.Error(); err != nil {
+				return err
+			}
+
+			return streamError
+
+		case <-time.After(CLIENT_REPLY_TIMEOUT):
+			return REPLY_TIMEOUT
+		}
+	}
+}
+
+// request sends a packet the server answers with a ReplyPacket and waits
+// for that reply.
+func (client *ClientContext) request(packetToSend EncapsulatablePacket) error {
+	client.requestLock.Lock()
+	defer client.requestLock.Unlock()
+
+	if err := client.sendPacket(packetToSend); err != nil {
+		return err
+	}
+
+	return client.awaitReply(CLIENT_REPLY_TIMEOUT)
+}
+
+func (client *ClientContext) fileSource(path string) (fileSource, error) {
+	client.filesLock.RLock()
+	defer client.filesLock.RUnlock()
+
+	source := client.files[path]
+
+	if source == nil {
+		return nil, errors.New("Server requested unknown file \"" + path + "\".")
+	}
+
+	return source, nil
+}
+
+func (client *ClientContext) reportError(err error) {
+	select {
+	case client.syncErrors <- err:
+	default:
+		log.Println(err.Error())
+	}
+}
+
+func (client *ClientContext) deliverResponse(responsePacket EncapsulatablePacket) {
+	select {
+	case client.responses <- responsePacket:
+	default:
+		log.Printf("Dropped unexpected packet of type %d\n", responsePacket.Type())
+	}
+}
+
+// deliverStream hands a block or delta to a running restore. It blocks
+// until the packet was taken, so all of them are consumed before the reply
+// that ends the restore is read.
+func (client *ClientContext) deliverStream(streamPacket EncapsulatablePacket) {
+	select {
+	case client.stream <- streamPacket:
+	case <-time.After(CLIENT_REPLY_TIMEOUT):
+		log.Printf("Dropped unexpected packet of type %d\n", streamPacket.Type())
+	}
+}
+
+// awaitResponse waits for a packet answering a request, or the reply that
+// rejected the request.
+func (client *ClientContext) awaitResponse(timeout time.Duration) (EncapsulatablePacket, error) {
+	select {
+	case responsePacket := <-client.responses:
+		return responsePacket, nil
+
+	case replyPacket, ok := <-client.replies:
+		if ok == false {
+			return nil, CONNECTION_CLOSED
+		}
+
+		if err := replyPacket.Error(); err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New("Server replied without the requested data.")
+
+	case <-time.After(timeout):
+		return nil, REPLY_TIMEOUT
+	}
+}
+
+// awaitReply waits for the next ReplyPacket and converts it to an error.
+func (client *ClientContext) awaitReply(timeout time.Duration) error {
+	select {
+	case replyPacket, ok := <-client.replies:
+		if ok == false {
+			return CONNECTION_CLOSED
+		}
+
+		return replyPacket.Error()
+
+	case <-time.After(timeout):
+		return REPLY_TIMEOUT
+	}
+}
+
+// awaitTransferReply waits for the reply that ends a transfer. The timeout
+// starts again whenever the server requested metadata or a block, so it
+// only expires once the server stopped working on the transfer.
+func (client *ClientContext) awaitTransferReply(timeout time.Duration) error {
+	// activity of an earlier transfer does not count
+	select {
+	case <-client.activity:
+	default:
+	}
+
+	for {
+		select {
+		case replyPacket, ok := <-client.replies:
+			if ok == false {
+				return CONNECTION_CLOSED
+			}
+
+			return replyPacket.Error()
+
+		case <-client.activity:
+
+		case <-time.After(timeout):
+			return REPLY_TIMEOUT
+		}
+	}
+}
+
+// noteActivity tells a waiting transfer that the server is still working
+// on it.
+func (client *ClientContext) noteActivity() {
+	select {
+	case client.activity <- true:
+	default:
+	}
+}
+
+func (client *ClientContext) readLoop() {
+	defer close(client.replies)
+
+	for {
+		packet, err := client.codec.ReadPacket()
+
+		if errors.Is(err, UNKNOWN_PACKET_TYPE) == true {
+			client.reportError(err)
+			continue
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				log.Println(err)
+			}
+			return
+		}
+
+		if err := client.handlers.Dispatch(packet); err != nil {
+			client.reportError(err)
+		}
+	}
+}
+
+func (client *ClientContext) HandleRequestExtendedFileMetadataPacket(requestPacket *RequestExtendedFileMetadataPacket) {
+	client.noteActivity()
+
+	source, err := client.fileSource(string(requestPacket.Path))
+
+	if err != nil {
+		client.rejectRequest(REPLY_FILE_NOT_AVAILABLE, err)
+		return
+	}
+
+	extendedFileMetadata, err := source.GetCompleteFileInformation(requestPacket.BlockLength, requestPacket.StrongChecksumLength)
+
+	if err != nil {
+		client.rejectRequest(requestFailureCode(err), err)
+		return
+	}
+
+	extendedFileMetadataPacket, err := NewExtendedFileMetadataPacket(string(requestPacket.Path), extendedFileMetadata)
+
+	if err != nil {
+		client.rejectRequest(REPLY_INTERNAL_ERROR, err)
+		return
+	}
+
+	if err := client.sendPacket(extendedFileMetadataPacket); err != nil {
+		log.Println(err.Error())
+		return
+	}
+}
+
+func (client *ClientContext) HandleRequestChunkedFileMetadataPacket(requestPacket *RequestChunkedFileMetadataPacket) {
+	client.noteActivity()
+
+	source, err := client.fileSource(string(requestPacket.Path))
+
+	if err != nil {
+		client.rejectRequest(REPLY_FILE_NOT_AVAILABLE, err)
+		return
+	}
+
+	chunkedFileMetadata, err := source.GetChunkedFileInformation(requestPacket.GetChunkLengths(), requestPacket.StrongChecksumLength)
+
+	if err != nil {
+		client.rejectRequest(requestFailureCode(err), err)
+		return
+	}
+
+	chunkedFileMetadataPacket, err := NewChunkedFileMetadataPacket(string(requestPacket.Path), chunkedFileMetadata)
+
+	if err != nil {
+		client.rejectRequest(REPLY_INTERNAL_ERROR, err)
+		return
+	}
+
+	if err := client.sendPacket(chunkedFileMetadataPacket); err != nil {
+		log.Println(err.Error())
+		return
+	}
+}
+
+func (client *ClientContext) HandleRequestBlockPacket(requestPacket *RequestBlockPacket) {
+	client.noteActivity()
+
+	source, err := client.fileSource(string(requestPacket.Path))
+
+	if err != nil {
+		client.rejectRequest(REPLY_FILE_NOT_AVAILABLE, err)
+		return
+	}
+
+	block, err := source.ReadBlock(requestPacket.StrongChecksum)
+
+	if err != nil {
+		client.rejectRequest(requestFailureCode(err), err)
+		return
+	}
+
+	compression, data := uint8(sync.COMPRESSION_NONE), block
+
+	// blocks are compressed whenever that saves bandwidth
+	if client.hasCapability(CAPABILITY_COMPRESSION) == true {
+		compression, data = sync.CompressBlock(block)
+	}
+
+	var blockPacket EncapsulatablePacket
+
+	if compression != sync.COMPRESSION_NONE {
+		blockPacket, err = NewCompressedBlockPacket(requestPacket.StrongChecksum, compression, data)
+	} else {
+		blockPacket, err = NewBlockPacket(requestPacket.StrongChecksum, block)
+	}
+
+	if err != nil {
+		client.rejectRequest(REPLY_INTERNAL_ERROR, err)
+		return
+	}
+
+	if err := client.sendPacket(blockPacket); err != nil {
+		log.Println(err.Error())
+		return
+	}
+}
+
+// rejectRequest answers a request of the server that can not be answered
+// with a reply, so the server aborts the transfer instead of waiting for
+// the answer until it times out.
+func (client *ClientContext) rejectRequest(code uint16, err error) {
+	client.reportError(err)
+
+	if err := client.sendPacket(NewReplyPacket(code, err.Error())); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// requestFailureCode tells files that are gone and blocks that changed
+// since their metadata was sent apart from other errors.
+func requestFailureCode(err error) uint16 {
+	if os.IsNotExist(err) == true {
+		return REPLY_FILE_NOT_AVAILABLE
+	}
+
+	if err == sync.BLOCK_NOT_FOUND || err == sync.BLOCK_CHANGED {
+		return REPLY_BLOCK_NOT_AVAILABLE
+	}
+
+	return REPLY_INTERNAL_ERROR
+}
+
+// sendHello announces our version and capabilities and adopts what the
+// server answers with, which is either its own hello or an error reply.
+func (client *ClientContext) sendHello() error {
+	helloPacket := NewHelloPacket()
+
+	if err := client.sendPacket(helloPacket); err != nil {
+		return err
+	}
+
+	responsePacket, err := client.awaitResponse(CLIENT_REPLY_TIMEOUT)
+
+	if err != nil {
+		return err
+	}
+
+	serverHello, ok := responsePacket.(*HelloPacket)
+
+	if ok == false {
+		return errors.New("Server did not answer with a hello.")
+	}
+
+	version, err := NegotiateVersion(serverHello.Version)
+
+	if err != nil {
+		return err
+	}
+
+	// servers of VERSION_0_1 keep a single file and can not tell the files
+	// of the client apart
+	if version < VERSION_0_2 {
+		return VERSION_UNSUPPORTED
+	}
+
+	client.version = version
+	client.capabilities = NegotiateCapabilities(SUPPORTED_CAPABILITIES, serverHello.Capabilities)
+	client.maxFrameLength = 0
+
+	if client.hasCapability(CAPABILITY_FRAMING) == true {
+		client.maxFrameLength = NegotiateMaxFrameLength(DEFAULT_MAX_FRAME_LENGTH, serverHello.MaxFrameLength)
+	}
+
+	client.codec.SetWriteFrameLength(client.maxFrameLength)
+	client.codec.SetWriteVersion(client.version)
+
+	if client.hasCapability(CAPABILITY_LOGIN|CAPABILITY_SYNC) == false {
+		return CAPABILITY_MISSING
+	}
+
+	return nil
+}
+
+func (client *ClientContext) hasCapability(capability uint16) bool {
+	return client.capabilities&capability == capability
+}
+
+// sendShortFileMetadata holds the request lock until the server replied, as
+// replies carry no path and are matched to requests by their order.
+func (client *ClientContext) sendShortFileMetadata(path string, source fileSource) error {
+	shortFileMetadata, err := source.GetShortFileMetadata()
+
+	if err != nil {
+		return err
+	}
+
+	shortFileMetadataPacket, err := NewShortFileMetaDataPacket(path, shortFileMetadata)
+
+	if err != nil {
+		return err
+	}
+
+	client.requestLock.Lock()
+	defer client.requestLock.Unlock()
+
+	for retries := 0; ; retries++ {
+		if err := client.sendPacket(shortFileMetadataPacket); err != nil {
+			return err
+		}
+
+		// the server only replies once it pulled all blocks it needs, which
+		// may take longer than the timeout as long as it keeps requesting
+		// them
+		err = client.awaitTransferReply(CLIENT_REPLY_TIMEOUT)
+
+		if errors.Is(err, BUSY) == false || retries == CLIENT_BUSY_RETRIES {
+			return err
+		}
+
+		time.Sleep(CLIENT_BUSY_DELAY)
+	}
+}
+
+// authenticate logs in with the stored token if there is one and falls back
+// to the password. After a password login a new token is requested and
+// stored, so later starts do not need the password anymore.
+func (client *ClientContext) authenticate() error {
+	if client.hasCapability(CAPABILITY_TOKEN) == true {
+		token, err := client.loadToken()
+
+		if err != nil {
+			log.Printf("Could not load token: %s\n", err.Error())
+		}
+
+		if token != nil {
+			newToken, err := client.sendTokenLoginPacket(token)
+
+			if err == nil {
+				// the old token stays valid until the new one is used, so
+				// failing to store it does not lock us out
+				return client.saveToken(newToken)
+			}
+
+			if errors.Is(err, AUTH_FAILED) == false || len(client.credentials.Password) == 0 {
+				return err
+			}
+
+			log.Println("Stored token was rejected, falling back to the password.")
+		}
+	}
+
+	if len(client.credentials.Password) == 0 {
+		return NO_CREDENTIALS
+	}
+
+	if err := client.sendLoginPacket(); err != nil {
+		return err
+	}
+
+	if len(client.credentials.TokenFile) == 0 || client.hasCapability(CAPABILITY_TOKEN) == false {
+		return nil
+	}
+
+	token, err := client.requestToken()
+
+	if err != nil {
+		log.Printf("Could not obtain a token: %s\n", err.Error())
+		return nil
+	}
+
+	return client.saveToken(token)
+}
+
+func (client *ClientContext) sendLoginPacket() error {
+	loginPacket, err := NewLoginPacket(client.credentials.Username, client.credentials.Password)
+
+	if err != nil {
+		return err
+	}
+
+	if err := client.sendPacket(loginPacket); err != nil {
+		return err
+	}
+
+	return client.awaitReply(CLIENT_REPLY_TIMEOUT)
+}
+
+func (client *ClientContext) sendTokenLoginPacket(token []byte) ([]byte, error) {
+	tokenLoginPacket, err := NewTokenLoginPacket(client.credentials.Username, token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.sendPacket(tokenLoginPacket); err != nil {
+		return nil, err
+	}
+
+	return client.awaitToken()
+}
+
+func (client *ClientContext) requestToken() ([]byte, error) {
+	requestTokenPacket, err := NewRequestTokenPacket(client.credentials.Username, client.credentials.Password, client.credentials.TokenLabel)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.sendPacket(requestTokenPacket); err != nil {
+		return nil, err
+	}
+
+	return client.awaitToken()
+}
+
+func (client *ClientContext) awaitToken() ([]byte, error) {
+	responsePacket, err := client.awaitResponse(CLIENT_REPLY_TIMEOUT)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tokenPacket, ok := responsePacket.(*TokenPacket)
+
+	if ok == false {
+		return nil, errors.New("Server did not answer with a token.")
+	}
+
+	return tokenPacket.Token, nil
+}
+
+// loadToken returns the hex encoded token in the token file, or nil if no
+// token file is configured or it does not exist yet.
+func (client *ClientContext) loadToken() ([]byte, error) {
+	if len(client.credentials.TokenFile) == 0 {
+		return nil, nil
+	}
+
+	encodedToken, err := ioutil.ReadFile(client.credentials.TokenFile)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(strings.TrimSpace(string(encodedToken)))
+}
+
+// saveToken replaces the token file atomically, readable only by the owner.
+func (client *ClientContext) saveToken(token []byte) error {
+	if err := client.writeTokenFile(token); err != nil {
+		return fmt.Errorf("Could not store the token in \"%s\": %w", client.credentials.TokenFile, err)
+	}
+
+	return nil
+}
+
+func (client *ClientContext) writeTokenFile(token []byte) error {
+	tokenFile, err := ioutil.TempFile(filepath.Dir(client.credentials.TokenFile), ".token")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tokenFile.Name())
+
+	if _, err := tokenFile.WriteString(hex.EncodeToString(token) + "\n"); err != nil {
+		tokenFile.Close()
+		return err
+	}
+
+	if err := tokenFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tokenFile.Name(), client.credentials.TokenFile)
+}
+
+func (client *ClientContext) sendPacket(packetToSend EncapsulatablePacket) error {
+	return client.codec.WritePacket(packetToSend)
+}
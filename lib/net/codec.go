@@ -0,0 +1,315 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	gosync "sync"
+)
+
+var UNKNOWN_PACKET_TYPE = errors.New("Packet type is unknown.")
+var PACKET_TYPE_REGISTERED = errors.New("Packet type is already registered.")
+
+// PacketRegistry maps packet types to constructors of empty packets, which
+// the Codec unmarshals received packets into, and to the length received
+// packets of the type are limited to. It is safe for concurrent use.
+type PacketRegistry struct {
+	lock         gosync.RWMutex
+	constructors map[uint16]func() EncapsulatablePacket
+	maxLengths   map[uint16]uint64
+}
+
+func NewPacketRegistry() *PacketRegistry {
+	return &PacketRegistry{
+		constructors: make(map[uint16]func() EncapsulatablePacket),
+		maxLengths:   make(map[uint16]uint64),
+	}
+}
+
+// Register adds a packet type. Types can not be registered twice, so an
+// extension can not replace the packets handlers rely on.
+func (pR *PacketRegistry) Register(packetType uint16, newPacket func() EncapsulatablePacket) error {
+	if packetType&FRAME_CONTINUED != 0 {
+		return fmt.Errorf("Packet type %d collides with the frame flags.", packetType)
+	}
+
+	pR.lock.Lock()
+	defer pR.lock.Unlock()
+
+	if pR.constructors[packetType] != nil {
+		return fmt.Errorf("%w (%d)", PACKET_TYPE_REGISTERED, packetType)
+	}
+
+	pR.constructors[packetType] = newPacket
+
+	return nil
+}
+
+// New returns an empty packet of the given type.
+func (pR *PacketRegistry) New(packetType uint16) (EncapsulatablePacket, error) {
+	pR.lock.RLock()
+	newPacket := pR.constructors[packetType]
+	pR.lock.RUnlock()
+
+	if newPacket == nil {
+		return nil, fmt.Errorf("%w (%d)", UNKNOWN_PACKET_TYPE, packetType)
+	}
+
+	return newPacket(), nil
+}
+
+// SetMaxLength limits received packets of packetType to maxLength bytes,
+// which can not exceed MAX_PACKET_LENGTH.
+func (pR *PacketRegistry) SetMaxLength(packetType uint16, maxLength uint64) {
+	pR.lock.Lock()
+	defer pR.lock.Unlock()
+
+	pR.maxLengths[packetType] = maxLength
+}
+
+// MaxLength returns the limit of received packets of packetType, packets
+// without one are limited to MAX_PACKET_LENGTH.
+func (pR *PacketRegistry) MaxLength(packetType uint16) uint64 {
+	pR.lock.RLock()
+	maxLength := pR.maxLengths[packetType]
+	pR.lock.RUnlock()
+
+	if maxLength == 0 || maxLength > MAX_PACKET_LENGTH {
+		return MAX_PACKET_LENGTH
+	}
+
+	return maxLength
+}
+
+// DEFAULT_PACKET_REGISTRY knows every packet of the protocol, extensions
+// add theirs with RegisterPacket.
+var DEFAULT_PACKET_REGISTRY = newDefaultPacketRegistry()
+
+func newDefaultPacketRegistry() *PacketRegistry {
+	registry := NewPacketRegistry()
+
+	for packetType, newPacket := range map[uint16]func() EncapsulatablePacket{
+		REPLY:                          func() EncapsulatablePacket { return &ReplyPacket{} },
+		HELLO:                          func() EncapsulatablePacket { return &HelloPacket{} },
+		LOGIN:                          func() EncapsulatablePacket { return &LoginPacket{} },
+		SHORT_FILE_METADATA:            func() EncapsulatablePacket { return &ShortFileMetadataPacket{} },
+		EXTENDED_FILE_METADATA:         func() EncapsulatablePacket { return &ExtendedFileMetadataPacket{} },
+		REQUEST_BLOCK_PACKET:           func() EncapsulatablePacket { return &RequestBlockPacket{} },
+		BLOCK_PACKET:                   func() EncapsulatablePacket { return &BlockPacket{} },
+		REQUEST_EXTENDED_FILE_METADATA: func() EncapsulatablePacket { return &RequestExtendedFileMetadataPacket{} },
+		REQUEST_TOKEN:                  func() EncapsulatablePacket { return &RequestTokenPacket{} },
+		TOKEN:                          func() EncapsulatablePacket { return &TokenPacket{} },
+		TOKEN_LOGIN:                    func() EncapsulatablePacket { return &TokenLoginPacket{} },
+		REMOVE_FILE:                    func() EncapsulatablePacket { return &RemoveFilePacket{} },
+		MOVE_FILE:                      func() EncapsulatablePacket { return &MoveFilePacket{} },
+		REQUEST_RESTORE:                func() EncapsulatablePacket { return &RequestRestorePacket{} },
+		REQUEST_DELTA_RESTORE:          func() EncapsulatablePacket { return &RequestDeltaRestorePacket{} },
+		DELTA:                          func() EncapsulatablePacket { return &DeltaPacket{} },
+		REQUEST_VERSIONS:               func() EncapsulatablePacket { return &RequestVersionsPacket{} },
+		VERSIONS:                       func() EncapsulatablePacket { return &VersionsPacket{} },
+		REQUEST_VERSION_RESTORE:        func() EncapsulatablePacket { return &RequestVersionRestorePacket{} },
+		REQUEST_CHUNKED_FILE_METADATA:  func() EncapsulatablePacket { return &RequestChunkedFileMetadataPacket{} },
+		CHUNKED_FILE_METADATA:          func() EncapsulatablePacket { return &ChunkedFileMetadataPacket{} },
+		COMPRESSED_BLOCK_PACKET:        func() EncapsulatablePacket { return &CompressedBlockPacket{} },
+	} {
+		registry.Register(packetType, newPacket)
+	}
+
+	// packets without blocks or their metadata only carry paths, credentials
+	// and tokens
+	for _, packetType := range []uint16{
+		REPLY, HELLO, LOGIN, SHORT_FILE_METADATA, REQUEST_BLOCK_PACKET,
+		REQUEST_EXTENDED_FILE_METADATA, REQUEST_TOKEN, TOKEN, TOKEN_LOGIN,
+		REMOVE_FILE, MOVE_FILE, REQUEST_RESTORE, REQUEST_VERSIONS,
+		REQUEST_VERSION_RESTORE, REQUEST_CHUNKED_FILE_METADATA,
+	} {
+		registry.SetMaxLength(packetType, MAX_CONTROL_PACKET_LENGTH)
+	}
+
+	return registry
+}
+
+// RegisterPacket adds a packet type to DEFAULT_PACKET_REGISTRY. Extensions
+// should pick types far above the ones of the protocol.
+func RegisterPacket(packetType uint16, newPacket func() EncapsulatablePacket) error {
+	return DEFAULT_PACKET_REGISTRY.Register(packetType, newPacket)
+}
+
+// Codec reads and writes the packets of a connection in frames, in the
+// layout of the negotiated protocol version. Writing is safe for concurrent
+// use, reading is left to one goroutine.
+type Codec struct {
+	conn             net.Conn
+	registry         *PacketRegistry
+	reader           *FrameReader
+	writer           *FrameWriter
+	readVersion      uint16
+	writeVersion     uint16
+	readPacketLength uint64
+	writeLock        gosync.Mutex
+}
+
+// NewCodec limits received packets to MAX_CONTROL_PACKET_LENGTH, until the
+// peer is authenticated and SetReadPacketLength raises the limit.
+func NewCodec(conn net.Conn, registry *PacketRegistry) *Codec {
+	return &Codec{
+		conn:             conn,
+		registry:         registry,
+		reader:           NewFrameReader(conn),
+		writer:           NewFrameWriter(conn),
+		readVersion:      MIN_SUPPORTED_VERSION,
+		writeVersion:     MIN_SUPPORTED_VERSION,
+		readPacketLength: MAX_CONTROL_PACKET_LENGTH,
+	}
+}
+
+// ReadPacket reads and unmarshals the next packet. Packets of unknown types
+// are skipped with an error wrapping UNKNOWN_PACKET_TYPE, after which the
+// next packet can be read. The packets of the protocol are decoded while
+// their frames arrive, so memory is only allocated for data that arrived.
+func (codec *Codec) ReadPacket() (EncapsulatablePacket, error) {
+	packetType, packetReader, err := codec.reader.Next()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the rest of the packet is skipped by the next read
+	packet, err := codec.registry.New(packetType)
+
+	if err != nil {
+		return nil, err
+	}
+
+	maxLength := codec.registry.MaxLength(packetType)
+
+	if codec.readPacketLength < maxLength {
+		maxLength = codec.readPacketLength
+	}
+
+	if versionedPacket, ok := packet.(VersionedPacket); ok == true {
+		versionedPacket.SetVersion(codec.readVersion)
+	}
+
+	if decodable, ok := packet.(decodablePacket); ok == true {
+		if err := decodable.decode(newStreamSource(packetReader, maxLength)); err != nil {
+			return nil, err
+		}
+
+		return packet, nil
+	}
+
+	// packets of extensions are read first
+	data, err := ioutil.ReadAll(io.LimitReader(packetReader, int64(maxLength)+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(data)) > maxLength {
+		return nil, fmt.Errorf("%w (%d)", PACKET_TOO_LARGE, packetType)
+	}
+
+	if err := packet.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
+
+// WritePacket writes packet, a VersionedPacket is set to the version of the
+// Codec first. The packets of the protocol are encoded into frames while
+// they are sent, so only a frame of them is buffered.
+func (codec *Codec) WritePacket(packet EncapsulatablePacket) error {
+	codec.writeLock.Lock()
+	defer codec.writeLock.Unlock()
+
+	if versionedPacket, ok := packet.(VersionedPacket); ok == true {
+		versionedPacket.SetVersion(codec.writeVersion)
+	}
+
+	return codec.writer.WritePacket(packet)
+}
+
+// SetReadFrameLength limits received frames, it has to be called by the
+// goroutine reading packets.
+func (codec *Codec) SetReadFrameLength(maxFrameLength uint32) {
+	codec.reader.SetMaxFrameLength(maxFrameLength)
+}
+
+// SetWriteFrameLength splits sent packets into frames of maxFrameLength.
+func (codec *Codec) SetWriteFrameLength(maxFrameLength uint32) {
+	codec.writeLock.Lock()
+	defer codec.writeLock.Unlock()
+
+	codec.writer.SetMaxFrameLength(maxFrameLength)
+}
+
+// SetReadPacketLength limits received packets to maxPacketLength, packet
+// types with a lower limit keep it. It has to be called by the goroutine
+// reading packets.
+func (codec *Codec) SetReadPacketLength(maxPacketLength uint64) {
+	codec.readPacketLength = maxPacketLength
+}
+
+// SetReadVersion reads packets in the layout of version from now on, it has
+// to be called by the goroutine reading packets.
+func (codec *Codec) SetReadVersion(version uint16) {
+	codec.readVersion = version
+}
+
+// SetWriteVersion writes packets in the layout of version from now on.
+func (codec *Codec) SetWriteVersion(version uint16) {
+	codec.writeLock.Lock()
+	defer codec.writeLock.Unlock()
+
+	codec.writeVersion = version
+}
+
+func (codec *Codec) Close() error {
+	return codec.conn.Close()
+}
+
+// PacketHandler handles a received packet, which has the type it was
+// registered for.
+type PacketHandler func(packet EncapsulatablePacket)
+
+// Dispatcher hands received packets to the handler registered for their
+// type. It is safe for concurrent use.
+type Dispatcher struct {
+	lock     gosync.RWMutex
+	handlers map[uint16]PacketHandler
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		handlers: make(map[uint16]PacketHandler),
+	}
+}
+
+// Handle registers handler for packets of packetType, replacing the one
+// registered before.
+func (dispatcher *Dispatcher) Handle(packetType uint16, handler PacketHandler) {
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+
+	dispatcher.handlers[packetType] = handler
+}
+
+// Dispatch calls the handler of the packet, or returns an error wrapping
+// UNKNOWN_PACKET_TYPE if there is none.
+func (dispatcher *Dispatcher) Dispatch(packet EncapsulatablePacket) error {
+	dispatcher.lock.RLock()
+	handler := dispatcher.handlers[packet.Type()]
+	dispatcher.lock.RUnlock()
+
+	if handler == nil {
+		return fmt.Errorf("%w (%d)", UNKNOWN_PACKET_TYPE, packet.Type())
+	}
+
+	handler(packet)
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ReplyError is the Go representation of a ReplyPacket with a non-zero
+// error code. Two ReplyErrors match with errors.Is when their codes are equal,
+// so callers can compare against the exported values below.
+type ReplyError struct {
+	Code    uint16
+	Message string
+}
+
+func (rE *ReplyError) Error() string {
+	if len(rE.Message) == 0 {
+		return fmt.Sprintf("Server replied with error code %d.", rE.Code)
+	}
+
+	return fmt.Sprintf("Server replied with error code %d: %s", rE.Code, rE.Message)
+}
+
+func (rE *ReplyError) Is(target error) bool {
+	targetReplyError, ok := target.(*ReplyError)
+
+	return ok && targetReplyError.Code == rE.Code
+}
+
+var AUTH_FAILED = &ReplyError{Code: REPLY_AUTH_FAILED, Message: "Authentication failed."}
+var NOT_AUTHENTICATED = &ReplyError{Code: REPLY_NOT_AUTHENTICATED, Message: "Not authenticated."}
+var STALE_METADATA = &ReplyError{Code: REPLY_STALE_METADATA, Message: "Metadata is older than the stored one."}
+var UNKNOWN_PACKET = &ReplyError{Code: REPLY_UNKNOWN_PACKET, Message: "Unknown packet type."}
+var VERSION_UNSUPPORTED = &ReplyError{Code: REPLY_VERSION_UNSUPPORTED, Message: "Protocol version is not supported."}
+var QUOTA_EXCEEDED = &ReplyError{Code: REPLY_QUOTA_EXCEEDED, Message: "Quota exceeded."}
+var INTERNAL_ERROR = &ReplyError{Code: REPLY_INTERNAL_ERROR, Message: "Internal server error."}
+var MALFORMED_PACKET = &ReplyError{Code: REPLY_MALFORMED_PACKET, Message: "Malformed packet."}
+var CAPABILITY_MISSING = &ReplyError{Code: REPLY_CAPABILITY_MISSING, Message: "Capability was not negotiated."}
+var FILE_NOT_AVAILABLE = &ReplyError{Code: REPLY_FILE_NOT_AVAILABLE, Message: "File is not available."}
+var FILE_VERSION_NOT_AVAILABLE = &ReplyError{Code: REPLY_FILE_VERSION_NOT_AVAILABLE, Message: "Version of the file is not available."}
+var BLOCK_CORRUPTED = &ReplyError{Code: REPLY_BLOCK_CORRUPTED, Message: "Block does not match its hash."}
+var BUSY = &ReplyError{Code: REPLY_BUSY, Message: "Server is busy with another transfer."}
+var BLOCK_NOT_AVAILABLE = &ReplyError{Code: REPLY_BLOCK_NOT_AVAILABLE, Message: "Block is not available."}
+
+var NO_CREDENTIALS = errors.New("Neither a stored token nor a password is available.")
+var CONNECTION_CLOSED = errors.New("Connection to the server was closed.")
+var REPLY_TIMEOUT = errors.New("Server did not reply in time.")
+var RESTORE_MISMATCH = errors.New("Restored file does not match its stored hash.")
@@ -0,0 +1,73 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// encodablePacket is implemented by the packets of the protocol, which the
+// FrameWriter encodes into frames while they are sent instead of marshalling
+// them first.
+type encodablePacket interface {
+	encode(writer io.Writer) error
+}
+
+// marshalPacket encodes packet into memory, for MarshalBinary.
+func marshalPacket(packet encodablePacket) ([]byte, error) {
+	var data bytes.Buffer
+
+	if err := packet.encode(&data); err != nil {
+		return nil, err
+	}
+
+	return data.Bytes(), nil
+}
+
+// packetEncoder writes the fields of a packet in order. After the first
+// write that fails every write is skipped, so encoders only have to check
+// the error once at the end.
+type packetEncoder struct {
+	writer io.Writer
+	buffer [8]byte
+	err    error
+}
+
+func newPacketEncoder(writer io.Writer) *packetEncoder {
+	return &packetEncoder{
+		writer: writer,
+	}
+}
+
+func (pE *packetEncoder) bytes(data []byte) {
+	if pE.err != nil || len(data) == 0 {
+		return
+	}
+
+	_, pE.err = pE.writer.Write(data)
+}
+
+func (pE *packetEncoder) uint8(value uint8) {
+	pE.buffer[0] = value
+	pE.bytes(pE.buffer[:1])
+}
+
+func (pE *packetEncoder) uint16(value uint16) {
+	binary.BigEndian.PutUint16(pE.buffer[:2], value)
+	pE.bytes(pE.buffer[:2])
+}
+
+func (pE *packetEncoder) uint32(value uint32) {
+	binary.BigEndian.PutUint32(pE.buffer[:4], value)
+	pE.bytes(pE.buffer[:4])
+}
+
+func (pE *packetEncoder) uint64(value uint64) {
+	binary.BigEndian.PutUint64(pE.buffer[:8], value)
+	pE.bytes(pE.buffer[:8])
+}
+
+// finish returns the error of the first write that failed.
+func (pE *packetEncoder) finish() error {
+	return pE.err
+}
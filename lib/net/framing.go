@@ -0,0 +1,364 @@
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var FRAME_TOO_LARGE = errors.New("Frame is larger than the negotiated maximum frame length.")
+var PACKET_TOO_LARGE = errors.New("Packet is larger than the maximum packet length.")
+var INVALID_FRAME = errors.New("Frame continues a packet of another type.")
+
+const (
+	FRAME_HEADER_LENGTH = 10
+
+	// FRAME_CONTINUED is set in the packet type of every frame of a packet
+	// but the last one.
+	FRAME_CONTINUED = 1 << 15
+
+	// DEFAULT_MAX_FRAME_LENGTH is the longest frame we accept once
+	// CAPABILITY_FRAMING is negotiated, frames shorter than
+	// MIN_MAX_FRAME_LENGTH are not negotiated.
+	DEFAULT_MAX_FRAME_LENGTH = 64 * 1024
+	MIN_MAX_FRAME_LENGTH     = 1024
+
+	// MAX_PACKET_LENGTH limits packets of all frames together. It fits the
+	// extended metadata of files beyond 100 GB.
+	MAX_PACKET_LENGTH = 64 * 1024 * 1024
+
+	// MAX_CONTROL_PACKET_LENGTH limits packets that carry neither blocks nor
+	// metadata of blocks, it fits the longest paths, credentials and tokens.
+	// Before authentication every packet is limited to it.
+	MAX_CONTROL_PACKET_LENGTH = 256 * 1024
+)
+
+// NegotiateMaxFrameLength returns the longest frame both sides accept, or
+// 0 if the peer did not announce a usable one.
+func NegotiateMaxFrameLength(ownMaxFrameLength uint32, peerMaxFrameLength uint32) uint32 {
+	if peerMaxFrameLength < MIN_MAX_FRAME_LENGTH {
+		return 0
+	}
+
+	if peerMaxFrameLength < ownMaxFrameLength {
+		return peerMaxFrameLength
+	}
+
+	return ownMaxFrameLength
+}
+
+// FrameWriter writes packets as frames of a 10 byte header, the packet type
+// and the frame length, followed by the frame. Packets are split into frames
+// of at most the negotiated length, until then every packet is one frame.
+// The packets of the protocol are encoded into frames while they are sent,
+// only one frame of them is kept in memory once a length is negotiated.
+// FrameWriter is not safe for concurrent use.
+type FrameWriter struct {
+	writer         *bufio.Writer
+	maxFrameLength uint32
+	frame          []byte
+}
+
+func NewFrameWriter(writer io.Writer) *FrameWriter {
+	return &FrameWriter{
+		writer: bufio.NewWriterSize(writer, FRAME_HEADER_LENGTH+DEFAULT_MAX_FRAME_LENGTH),
+	}
+}
+
+// SetMaxFrameLength splits packets into frames of at most maxFrameLength
+// bytes, 0 sends every packet as one frame.
+func (fW *FrameWriter) SetMaxFrameLength(maxFrameLength uint32) {
+	fW.maxFrameLength = maxFrameLength
+}
+
+func (fW *FrameWriter) WritePacket(packet EncapsulatablePacket) error {
+	packetWriter := fW.next(packet.Type())
+
+	if encodable, ok := packet.(encodablePacket); ok == true {
+		if err := encodable.encode(packetWriter); err != nil {
+			packetWriter.fail(err)
+		}
+
+		return packetWriter.Close()
+	}
+
+	// packets of extensions are marshalled first
+	data, err := packet.MarshalBinary()
+
+	if err != nil {
+		return err
+	}
+
+	packetWriter.Write(data)
+
+	return packetWriter.Close()
+}
+
+// next returns a writer of the data of a packet of packetType, which splits
+// it into frames while it is written.
+func (fW *FrameWriter) next(packetType uint16) *packetWriter {
+	if cap(fW.frame) < int(fW.maxFrameLength) {
+		fW.frame = make([]byte, 0, fW.maxFrameLength)
+	}
+
+	packetWriter := &packetWriter{
+		frameWriter: fW,
+		packetType:  packetType,
+	}
+
+	// without a negotiated length the packet is one frame of any length,
+	// which is not kept beyond the packet
+	if fW.maxFrameLength > 0 {
+		packetWriter.frame = fW.frame[:0]
+	}
+
+	return packetWriter
+}
+
+// packetWriter writes the frames of one packet. A full frame is only sent
+// once more data shows that it is not the last one, Close sends the last
+// frame.
+type packetWriter struct {
+	frameWriter *FrameWriter
+	packetType  uint16
+	header      [FRAME_HEADER_LENGTH]byte
+	frame       []byte
+	written     uint64
+	sent        bool
+	err         error
+}
+
+func (pW *packetWriter) Write(data []byte) (int, error) {
+	written := 0
+	maxFrameLength := int(pW.frameWriter.maxFrameLength)
+
+	for pW.err == nil && len(data) > 0 {
+		if pW.written+uint64(len(data)) > MAX_PACKET_LENGTH {
+			pW.err = PACKET_TOO_LARGE
+			break
+		}
+
+		if maxFrameLength > 0 && len(pW.frame) == maxFrameLength {
+			pW.err = pW.writeFrame(FRAME_CONTINUED)
+			continue
+		}
+
+		length := len(data)
+
+		if maxFrameLength > 0 && length > maxFrameLength-len(pW.frame) {
+			length = maxFrameLength - len(pW.frame)
+		}
+
+		pW.frame = append(pW.frame, data[:length]...)
+		pW.written += uint64(length)
+		written += length
+		data = data[length:]
+	}
+
+	return written, pW.err
+}
+
+// fail stops writing the packet with err.
+func (pW *packetWriter) fail(err error) {
+	if pW.err == nil {
+		pW.err = err
+	}
+}
+
+// Close sends the last frame and returns the first error. A packet that
+// failed before a frame was sent is dropped, otherwise what was written ends
+// it, so the peer fails to decode it but reads the next packet.
+func (pW *packetWriter) Close() error {
+	if pW.err != nil && pW.sent == false {
+		return pW.err
+	}
+
+	err := pW.writeFrame(0)
+
+	if err == nil {
+		err = pW.frameWriter.writer.Flush()
+	}
+
+	if pW.err != nil {
+		return pW.err
+	}
+
+	return err
+}
+
+func (pW *packetWriter) writeFrame(flags uint16) error {
+	binary.BigEndian.PutUint16(pW.header[:2], pW.packetType|flags)
+	binary.BigEndian.PutUint64(pW.header[2:], uint64(len(pW.frame)))
+
+	pW.sent = true
+
+	if _, err := pW.frameWriter.writer.Write(pW.header[:]); err != nil {
+		return err
+	}
+
+	if _, err := pW.frameWriter.writer.Write(pW.frame); err != nil {
+		return err
+	}
+
+	pW.frame = pW.frame[:0]
+
+	return nil
+}
+
+// FrameReader reads the packets a FrameWriter wrote. Memory is only
+// allocated as frames arrive, a header announcing a long frame can not
+// exhaust it. FrameReader is not safe for concurrent use.
+type FrameReader struct {
+	reader         io.Reader
+	maxFrameLength uint64
+	current        *packetReader
+}
+
+// NewFrameReader accepts frames of up to DEFAULT_MAX_FRAME_LENGTH, until
+// the negotiated length is set.
+func NewFrameReader(reader io.Reader) *FrameReader {
+	return &FrameReader{
+		reader:         reader,
+		maxFrameLength: DEFAULT_MAX_FRAME_LENGTH,
+	}
+}
+
+// SetMaxFrameLength rejects longer frames from now on, 0 accepts frames up
+// to MAX_PACKET_LENGTH.
+func (fR *FrameReader) SetMaxFrameLength(maxFrameLength uint32) {
+	if maxFrameLength == 0 || maxFrameLength > MAX_PACKET_LENGTH {
+		fR.maxFrameLength = MAX_PACKET_LENGTH
+		return
+	}
+
+	fR.maxFrameLength = uint64(maxFrameLength)
+}
+
+// Next returns the type of the next packet and a reader of its data, which
+// reads on through all of its frames. What is left of the previous packet
+// is skipped.
+func (fR *FrameReader) Next() (uint16, io.Reader, error) {
+	if fR.current != nil {
+		if _, err := io.Copy(ioutil.Discard, fR.current); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	packetType, frameLength, err := fR.readHeader()
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	fR.current = &packetReader{
+		frameReader: fR,
+		packetType:  packetType &^ FRAME_CONTINUED,
+		continued:   packetType&FRAME_CONTINUED != 0,
+		frame:       &io.LimitedReader{R: fR.reader, N: int64(frameLength)},
+		remaining:   MAX_PACKET_LENGTH - frameLength,
+	}
+
+	return fR.current.packetType, fR.current, nil
+}
+
+// ReadPacket reads the type and the data of the next packet.
+func (fR *FrameReader) ReadPacket() (uint16, []byte, error) {
+	packetType, packetReader, err := fR.Next()
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var data bytes.Buffer
+
+	if _, err := data.ReadFrom(packetReader); err != nil {
+		return 0, nil, err
+	}
+
+	return packetType, data.Bytes(), nil
+}
+
+func (fR *FrameReader) readHeader() (uint16, uint64, error) {
+	header := make([]byte, FRAME_HEADER_LENGTH)
+
+	if _, err := io.ReadFull(fR.reader, header); err != nil {
+		return 0, 0, err
+	}
+
+	frameLength := binary.BigEndian.Uint64(header[2:])
+
+	if frameLength > fR.maxFrameLength {
+		return 0, 0, FRAME_TOO_LARGE
+	}
+
+	return binary.BigEndian.Uint16(header[:2]), frameLength, nil
+}
+
+// packetReader reads the frames of one packet.
+type packetReader struct {
+	frameReader *FrameReader
+	packetType  uint16
+	continued   bool
+	frame       *io.LimitedReader
+	remaining   uint64
+	err         error
+}
+
+func (pR *packetReader) Read(data []byte) (int, error) {
+	for pR.err == nil {
+		readNow, err := pR.frame.Read(data)
+
+		if readNow > 0 {
+			return readNow, nil
+		}
+
+		if err != io.EOF {
+			pR.err = err
+			break
+		}
+
+		// the frame is complete
+		if pR.frame.N > 0 {
+			pR.err = io.ErrUnexpectedEOF
+			break
+		}
+
+		if pR.continued == false {
+			pR.err = io.EOF
+			break
+		}
+
+		pR.err = pR.nextFrame()
+	}
+
+	return 0, pR.err
+}
+
+func (pR *packetReader) nextFrame() error {
+	packetType, frameLength, err := pR.frameReader.readHeader()
+
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if packetType&^FRAME_CONTINUED != pR.packetType {
+		return INVALID_FRAME
+	}
+
+	if frameLength > pR.remaining {
+		return PACKET_TOO_LARGE
+	}
+
+	pR.continued = packetType&FRAME_CONTINUED != 0
+	pR.frame = &io.LimitedReader{R: pR.frameReader.reader, N: int64(frameLength)}
+	pR.remaining -= frameLength
+
+	return nil
+}
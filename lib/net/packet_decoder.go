@@ -0,0 +1,263 @@
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var INVALID_PACKET = errors.New("Packet could not be decoded.")
+
+// packetSource is what is left of the data of a packet. Complete data has a
+// known length, a stream is read while the frames of the packet arrive and
+// is only known not to exceed its maximum length.
+type packetSource struct {
+	reader   *bufio.Reader
+	offset   uint64
+	length   uint64
+	complete bool
+}
+
+func newDataSource(data []byte) *packetSource {
+	return &packetSource{
+		reader:   bufio.NewReaderSize(bytes.NewReader(data), 16),
+		length:   uint64(len(data)),
+		complete: true,
+	}
+}
+
+func newStreamSource(reader io.Reader, maxLength uint64) *packetSource {
+	return &packetSource{
+		reader: bufio.NewReaderSize(reader, 16),
+		length: maxLength,
+	}
+}
+
+// read returns the next length bytes, or io.EOF along with the ones that
+// arrived if the data ends before. Memory for a stream is only allocated as
+// its bytes arrive, a long length announced by a peer can not exhaust it.
+func (pS *packetSource) read(length uint64) ([]byte, error) {
+	if pS.complete == true {
+		data := make([]byte, length)
+		readBytes, err := io.ReadFull(pS.reader, data)
+		pS.offset += uint64(readBytes)
+
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+
+		return data[:readBytes], err
+	}
+
+	var data bytes.Buffer
+
+	readBytes, err := io.CopyN(&data, pS.reader, int64(length))
+	pS.offset += uint64(readBytes)
+
+	return data.Bytes(), err
+}
+
+// exceeded returns the error of a field that does not fit the length. A
+// stream may still hold it, but not within its maximum length.
+func (pS *packetSource) exceeded() error {
+	if pS.complete == true {
+		return INVALID_PACKET
+	}
+
+	return PACKET_TOO_LARGE
+}
+
+// decodablePacket is implemented by the packets of the protocol, which the
+// Codec decodes while their frames arrive instead of reading them first.
+type decodablePacket interface {
+	decode(source *packetSource) error
+}
+
+// MAX_PREALLOCATED_ELEMENTS caps the room decoders allocate up front for
+// the amount of elements a packet announces. A stream is only known not to
+// exceed its maximum length, further elements are appended as they arrive.
+const MAX_PREALLOCATED_ELEMENTS = 1024
+
+// packetDecoder reads the fields of a packet in order. After the first field
+// that does not fit the data every read returns the zero value, so decoders
+// only have to check the error once at the end.
+type packetDecoder struct {
+	packet string
+	source *packetSource
+	err    error
+}
+
+func newPacketDecoder(packet string, source *packetSource) *packetDecoder {
+	return &packetDecoder{
+		packet: packet,
+		source: source,
+	}
+}
+
+// remaining returns how many bytes are left, or at most left for streams.
+func (pD *packetDecoder) remaining() uint64 {
+	return pD.source.length - pD.source.offset
+}
+
+// take returns the next length bytes.
+func (pD *packetDecoder) take(length uint64, field string) []byte {
+	if pD.err != nil {
+		return nil
+	}
+
+	offset := pD.source.offset
+
+	if length > pD.remaining() {
+		pD.err = fmt.Errorf("%s needs %d bytes for its %s at offset %d, but only %d are left: %w", pD.packet, length, field, offset, pD.remaining(), pD.source.exceeded())
+		return nil
+	}
+
+	if length == 0 {
+		return []byte{}
+	}
+
+	data, err := pD.source.read(length)
+
+	if err == io.EOF {
+		pD.err = fmt.Errorf("%s needs %d bytes for its %s at offset %d, but only %d are left: %w", pD.packet, length, field, offset, len(data), INVALID_PACKET)
+		return nil
+	}
+
+	if err != nil {
+		pD.err = err
+		return nil
+	}
+
+	return data
+}
+
+func (pD *packetDecoder) uint8(field string) uint8 {
+	data := pD.take(1, field)
+
+	if data == nil {
+		return 0
+	}
+
+	return data[0]
+}
+
+func (pD *packetDecoder) uint16(field string) uint16 {
+	data := pD.take(2, field)
+
+	if data == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint16(data)
+}
+
+func (pD *packetDecoder) uint32(field string) uint32 {
+	data := pD.take(4, field)
+
+	if data == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(data)
+}
+
+func (pD *packetDecoder) uint64(field string) uint64 {
+	data := pD.take(8, field)
+
+	if data == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(data)
+}
+
+// invalid fails decoding for a reason other than the length of the data.
+func (pD *packetDecoder) invalid(format string, arguments ...interface{}) {
+	if pD.err != nil {
+		return
+	}
+
+	pD.err = fmt.Errorf("%s is invalid, %s: %w", pD.packet, fmt.Sprintf(format, arguments...), INVALID_PACKET)
+}
+
+// bytes returns the next length bytes, nothing is allocated for lengths the
+// data can not hold.
+func (pD *packetDecoder) bytes(length uint64, field string) []byte {
+	return pD.take(length, field)
+}
+
+// fits checks that amount elements of at least elementLength bytes each can
+// be left in the data, before a decoder allocates room for them.
+func (pD *packetDecoder) fits(amount uint64, elementLength uint64, field string) bool {
+	if pD.err != nil {
+		return false
+	}
+
+	if elementLength > 0 && amount > pD.remaining()/elementLength {
+		pD.err = fmt.Errorf("%s announces %d %s of %d bytes, but only %d bytes are left: %w", pD.packet, amount, field, elementLength, pD.remaining(), pD.source.exceeded())
+		return false
+	}
+
+	return true
+}
+
+// capacity returns the room to allocate up front for amount elements that
+// fit the data.
+func (pD *packetDecoder) capacity(amount uint64) int {
+	if amount > MAX_PREALLOCATED_ELEMENTS {
+		return MAX_PREALLOCATED_ELEMENTS
+	}
+
+	return int(amount)
+}
+
+// more reports whether at least length more bytes are left, for fields
+// that only later versions append.
+func (pD *packetDecoder) more(length uint64) bool {
+	if pD.err != nil || length > pD.remaining() {
+		return false
+	}
+
+	if pD.source.complete == true {
+		return true
+	}
+
+	peeked, _ := pD.source.reader.Peek(int(length))
+
+	return uint64(len(peeked)) == length
+}
+
+// finish returns the error of the first field that did not fit, or an error
+// if data is left after the last field.
+func (pD *packetDecoder) finish() error {
+	if pD.err != nil {
+		return pD.err
+	}
+
+	if pD.source.complete == true {
+		if pD.remaining() > 0 {
+			return fmt.Errorf("%s has %d bytes left after its last field: %w", pD.packet, pD.remaining(), INVALID_PACKET)
+		}
+
+		return nil
+	}
+
+	_, err := pD.source.reader.Peek(1)
+
+	if err == io.EOF {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if pD.remaining() == 0 {
+		return fmt.Errorf("%s has data left after its last field at offset %d: %w", pD.packet, pD.source.offset, PACKET_TOO_LARGE)
+	}
+
+	return fmt.Errorf("%s has data left after its last field at offset %d: %w", pD.packet, pD.source.offset, INVALID_PACKET)
+}
@@ -2,12 +2,17 @@ package net
 
 import (
 	"encoding/binary"
-	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/FBreuer2/simple-sync/lib/db"
+	"github.com/FBreuer2/simple-sync/lib/sync"
 )
 
 func PacketFromHeader(data []byte) (*Packet, error) {
 	if len(data) < 10 {
-		return nil, errors.New("PacketFromHeader: Data not long enough")
+		return nil, fmt.Errorf("PacketFromHeader: Data not long enough: %w", INVALID_PACKET)
 	}
 
 	return &Packet{
@@ -17,213 +22,858 @@ func PacketFromHeader(data []byte) (*Packet, error) {
 }
 
 func (packet *Packet) MarshalBinary() (data []byte, err error) {
-	marshalledData := make([]byte, 10+len(packet.Data))
+	return marshalPacket(packet)
+}
 
-	binary.BigEndian.PutUint16(marshalledData[:2], packet.PacketType)
-	binary.BigEndian.PutUint64(marshalledData[2:10], packet.PacketLength)
-	copy(marshalledData[10:], packet.Data)
+func (packet *Packet) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
 
-	return marshalledData, nil
+	encoder.uint16(packet.PacketType)
+	encoder.uint64(packet.PacketLength)
+	encoder.bytes(packet.Data)
+
+	return encoder.finish()
 }
 
 func (packet *Packet) UnmarshalBinary(data []byte) error {
-	packet.PacketType = binary.BigEndian.Uint16(data[:2])
-	packet.PacketLength = binary.BigEndian.Uint64(data[2:10])
+	return packet.decode(newDataSource(data))
+}
 
-	copy(packet.Data, data[10:])
+func (packet *Packet) decode(source *packetSource) error {
+	decoder := newPacketDecoder("Packet", source)
 
-	return nil
+	packet.PacketType = decoder.uint16("type")
+	packet.PacketLength = decoder.uint64("length")
+	packet.Data = decoder.bytes(packet.PacketLength, "data")
+
+	return decoder.finish()
 }
 
 func (rP *ReplyPacket) MarshalBinary() (data []byte, err error) {
-	marshalledData := make([]byte, 10+rP.ErrorStringLength)
+	return marshalPacket(rP)
+}
 
-	binary.BigEndian.PutUint16(marshalledData[:2], rP.ErrorCode)
-	binary.BigEndian.PutUint64(marshalledData[2:10], rP.ErrorStringLength)
+func (rP *ReplyPacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
 
-	copy(marshalledData[10:10+rP.ErrorStringLength], rP.ErrorString)
+	encoder.uint16(rP.ErrorCode)
+	encoder.uint64(rP.ErrorStringLength)
+	encoder.bytes(rP.ErrorString)
 
-	return marshalledData, nil
+	return encoder.finish()
 }
 
 func (rP *ReplyPacket) UnmarshalBinary(data []byte) error {
-	rP.ErrorCode = binary.BigEndian.Uint16(data[:2])
-	rP.ErrorStringLength = binary.BigEndian.Uint64(data[2:10])
+	return rP.decode(newDataSource(data))
+}
+
+func (rP *ReplyPacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("ReplyPacket", source)
 
-	rP.ErrorString = make([]byte, rP.ErrorStringLength)
-	copy(rP.ErrorString, data[10:10+rP.ErrorStringLength])
-	return nil
+	rP.ErrorCode = decoder.uint16("error code")
+	rP.ErrorStringLength = decoder.uint64("error string length")
+	rP.ErrorString = decoder.bytes(rP.ErrorStringLength, "error string")
+
+	return decoder.finish()
 }
 
 func (helloPacket *HelloPacket) MarshalBinary() (data []byte, err error) {
-	marshalledData := make([]byte, 4)
+	return marshalPacket(helloPacket)
+}
 
-	binary.BigEndian.PutUint16(marshalledData[:2], helloPacket.Version)
-	binary.BigEndian.PutUint16(marshalledData[2:], helloPacket.Capabilities)
+func (helloPacket *HelloPacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
 
-	return marshalledData, nil
+	encoder.uint16(helloPacket.Version)
+	encoder.uint16(helloPacket.Capabilities)
+	encoder.uint32(helloPacket.MaxFrameLength)
+
+	return encoder.finish()
 }
 
+// UnmarshalBinary accepts hellos of later versions, which may append fields.
 func (helloPacket *HelloPacket) UnmarshalBinary(data []byte) error {
-	helloPacket.Version = binary.BigEndian.Uint16(data[:2])
-	helloPacket.Capabilities = binary.BigEndian.Uint16(data[2:])
+	return helloPacket.decode(newDataSource(data))
+}
+
+func (helloPacket *HelloPacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("HelloPacket", source)
+
+	helloPacket.Version = decoder.uint16("version")
+	helloPacket.Capabilities = decoder.uint16("capabilities")
+
+	// hellos of peers without framing end here
+	helloPacket.MaxFrameLength = 0
+
+	if decoder.more(4) == true {
+		helloPacket.MaxFrameLength = decoder.uint32("maximum frame length")
+	}
 
-	return nil
+	return decoder.err
 }
 
 func (loginPacket *LoginPacket) MarshalBinary() (data []byte, err error) {
-	marshalledData := make([]byte, 4+loginPacket.UsernameLength+loginPacket.PasswordLength)
+	return marshalPacket(loginPacket)
+}
 
-	binary.BigEndian.PutUint16(marshalledData[:2], loginPacket.UsernameLength)
-	copy(marshalledData[2:2+loginPacket.UsernameLength], loginPacket.Username)
+func (loginPacket *LoginPacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
 
-	binary.BigEndian.PutUint16(marshalledData[2+loginPacket.UsernameLength:], loginPacket.PasswordLength)
-	copy(marshalledData[4+loginPacket.UsernameLength:], loginPacket.Password)
+	encoder.uint16(loginPacket.UsernameLength)
+	encoder.bytes(loginPacket.Username)
+	encoder.uint16(loginPacket.PasswordLength)
+	encoder.bytes(loginPacket.Password)
 
-	return marshalledData, nil
+	return encoder.finish()
 }
 
 func (loginPacket *LoginPacket) UnmarshalBinary(data []byte) error {
-	loginPacket.UsernameLength = binary.BigEndian.Uint16(data[:2])
+	return loginPacket.decode(newDataSource(data))
+}
+
+func (loginPacket *LoginPacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("LoginPacket", source)
+
+	loginPacket.UsernameLength = decoder.uint16("username length")
+	loginPacket.Username = decoder.bytes(uint64(loginPacket.UsernameLength), "username")
+	loginPacket.PasswordLength = decoder.uint16("password length")
+	loginPacket.Password = decoder.bytes(uint64(loginPacket.PasswordLength), "password")
+
+	return decoder.finish()
+}
+
+func (rTP *RequestTokenPacket) MarshalBinary() (data []byte, err error) {
+	return marshalPacket(rTP)
+}
+
+func (rTP *RequestTokenPacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
+
+	encoder.uint16(rTP.UsernameLength)
+	encoder.bytes(rTP.Username)
+	encoder.uint16(rTP.PasswordLength)
+	encoder.bytes(rTP.Password)
+	encoder.uint16(rTP.LabelLength)
+	encoder.bytes(rTP.Label)
+
+	return encoder.finish()
+}
+
+func (rTP *RequestTokenPacket) UnmarshalBinary(data []byte) error {
+	return rTP.decode(newDataSource(data))
+}
+
+func (rTP *RequestTokenPacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("RequestTokenPacket", source)
 
-	loginPacket.Username = make([]byte, loginPacket.UsernameLength)
-	copy(loginPacket.Username, data[2:2+loginPacket.UsernameLength])
+	rTP.UsernameLength = decoder.uint16("username length")
+	rTP.Username = decoder.bytes(uint64(rTP.UsernameLength), "username")
+	rTP.PasswordLength = decoder.uint16("password length")
+	rTP.Password = decoder.bytes(uint64(rTP.PasswordLength), "password")
+	rTP.LabelLength = decoder.uint16("label length")
+	rTP.Label = decoder.bytes(uint64(rTP.LabelLength), "label")
 
-	loginPacket.PasswordLength = binary.BigEndian.Uint16(data[2+loginPacket.UsernameLength:])
+	return decoder.finish()
+}
+
+func (tP *TokenPacket) MarshalBinary() (data []byte, err error) {
+	return marshalPacket(tP)
+}
+
+func (tP *TokenPacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
+
+	encoder.uint16(tP.TokenLength)
+	encoder.bytes(tP.Token)
+
+	return encoder.finish()
+}
+
+func (tP *TokenPacket) UnmarshalBinary(data []byte) error {
+	return tP.decode(newDataSource(data))
+}
+
+func (tP *TokenPacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("TokenPacket", source)
+
+	tP.TokenLength = decoder.uint16("token length")
+	tP.Token = decoder.bytes(uint64(tP.TokenLength), "token")
+
+	return decoder.finish()
+}
+
+func (tLP *TokenLoginPacket) MarshalBinary() (data []byte, err error) {
+	return marshalPacket(tLP)
+}
+
+func (tLP *TokenLoginPacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
 
-	loginPacket.Password = make([]byte, loginPacket.PasswordLength)
-	copy(loginPacket.Password, data[4+loginPacket.UsernameLength:])
+	encoder.uint16(tLP.UsernameLength)
+	encoder.bytes(tLP.Username)
+	encoder.uint16(tLP.TokenLength)
+	encoder.bytes(tLP.Token)
 
-	return nil
+	return encoder.finish()
+}
+
+func (tLP *TokenLoginPacket) UnmarshalBinary(data []byte) error {
+	return tLP.decode(newDataSource(data))
+}
+
+func (tLP *TokenLoginPacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("TokenLoginPacket", source)
+
+	tLP.UsernameLength = decoder.uint16("username length")
+	tLP.Username = decoder.bytes(uint64(tLP.UsernameLength), "username")
+	tLP.TokenLength = decoder.uint16("token length")
+	tLP.Token = decoder.bytes(uint64(tLP.TokenLength), "token")
+
+	return decoder.finish()
 }
 
 func (sFM *ShortFileMetadataPacket) MarshalBinary() (data []byte, err error) {
-	marshalledData := make([]byte, 8+8+8+len(sFM.FileHash)+len(sFM.LastChanged))
+	return marshalPacket(sFM)
+}
+
+func (sFM *ShortFileMetadataPacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
 
-	binary.BigEndian.PutUint64(marshalledData[:8], sFM.FileSize)
-	binary.BigEndian.PutUint64(marshalledData[8:16], sFM.FileHashLength)
+	encoder.uint64(sFM.FileSize)
+	encoder.uint64(sFM.FileHashLength)
+	encoder.bytes(sFM.FileHash)
 
-	copy(marshalledData[16:16+sFM.FileHashLength], sFM.FileHash)
+	// a formatted modification time up to VERSION_0_2
+	if sFM.version < VERSION_0_3 {
+		encoder.uint64(sFM.LastChangedLength)
+		encoder.bytes(sFM.LastChanged)
+	} else {
+		encoder.uint64(uint64(sFM.LastChangedNanoseconds))
+		encoder.uint32(uint32(sFM.TimezoneOffset))
+	}
 
-	binary.BigEndian.PutUint64(marshalledData[16+sFM.FileHashLength:24+sFM.FileHashLength], sFM.LastChangedLength)
-	copy(marshalledData[24+sFM.FileHashLength:24+sFM.FileHashLength+sFM.LastChangedLength], sFM.LastChanged)
+	encodeVersionedPath(encoder, sFM.version, sFM.PathLength, sFM.Path)
 
-	return marshalledData, nil
+	return encoder.finish()
 }
 
 func (sFM *ShortFileMetadataPacket) UnmarshalBinary(data []byte) error {
-	sFM.FileSize = binary.BigEndian.Uint64(data[:8])
+	return sFM.decode(newDataSource(data))
+}
+
+func (sFM *ShortFileMetadataPacket) decode(source *packetSource) error {
+	if sFM.version < VERSION_0_3 {
+		return sFM.decodeFormattedTime(source)
+	}
 
-	sFM.FileHashLength = binary.BigEndian.Uint64(data[8:16])
+	decoder := newPacketDecoder("ShortFileMetadataPacket", source)
 
-	sFM.FileHash = make([]byte, sFM.FileHashLength)
-	copy(sFM.FileHash, data[16:16+sFM.FileHashLength])
+	sFM.FileSize = decoder.uint64("file size")
+	sFM.FileHashLength = decoder.uint64("file hash length")
+	sFM.FileHash = decoder.bytes(sFM.FileHashLength, "file hash")
+	sFM.LastChangedLength = 0
+	sFM.LastChanged = nil
+	sFM.LastChangedNanoseconds = int64(decoder.uint64("modification time"))
+	sFM.TimezoneOffset = int32(decoder.uint32("time zone offset"))
+	sFM.PathLength = decoder.uint16("path length")
+	sFM.Path = decoder.bytes(uint64(sFM.PathLength), "path")
 
-	sFM.LastChangedLength = binary.BigEndian.Uint64(data[16+sFM.FileHashLength : 24+sFM.FileHashLength])
+	return decoder.finish()
+}
+
+// decodeFormattedTime reads the layouts up to VERSION_0_2.
+func (sFM *ShortFileMetadataPacket) decodeFormattedTime(source *packetSource) error {
+	decoder := newPacketDecoder("ShortFileMetadataPacket", source)
 
-	sFM.LastChanged = make([]byte, sFM.LastChangedLength)
-	copy(sFM.LastChanged, data[24+sFM.FileHashLength:])
+	sFM.FileSize = decoder.uint64("file size")
+	sFM.FileHashLength = decoder.uint64("file hash length")
+	sFM.FileHash = decoder.bytes(sFM.FileHashLength, "file hash")
+	sFM.LastChangedLength = decoder.uint64("modification time length")
+	sFM.LastChanged = decoder.bytes(sFM.LastChangedLength, "modification time")
+	sFM.LastChangedNanoseconds = 0
+	sFM.TimezoneOffset = 0
+	sFM.PathLength, sFM.Path = decodeVersionedPath(decoder, sFM.version)
 
-	return nil
+	return decoder.finish()
 }
 
 func (eFM *ExtendedFileMetadataPacket) MarshalBinary() (data []byte, err error) {
-	marshalledData := make([]byte, 8+4+4+8+eFM.BlockAmount*(4+8)+eFM.BlockAmount*uint64(eFM.StrongChecksumLength))
+	return marshalPacket(eFM)
+}
 
-	binary.BigEndian.PutUint64(marshalledData[:8], eFM.FileSize)
-	binary.BigEndian.PutUint32(marshalledData[8:12], eFM.StrongChecksumLength)
-	binary.BigEndian.PutUint32(marshalledData[12:16], eFM.BlockLength)
-	binary.BigEndian.PutUint64(marshalledData[16:24], eFM.BlockAmount)
+func (eFM *ExtendedFileMetadataPacket) encode(writer io.Writer) error {
+	if uint64(len(eFM.WeakBlockSums)) != eFM.BlockAmount || uint64(len(eFM.StrongBlockHashes)) != eFM.BlockAmount {
+		return sync.INVALID_BLOCKS
+	}
 
-	offset := 0
-	for key, value := range eFM.WeakBlockHashes {
-		binary.BigEndian.PutUint32(marshalledData[24+(offset*12):28+(offset*12)], key)
-		binary.BigEndian.PutUint64(marshalledData[28+(offset*12):36+(offset*12)], uint64(value))
-		offset += 1
+	// nothing is written before every block is known to fit its record
+	for _, strongHash := range eFM.StrongBlockHashes {
+		if len(strongHash) != int(eFM.StrongChecksumLength) {
+			return sync.INVALID_BLOCKS
+		}
 	}
 
-	currentOffset := uint32(36 + ((offset - 1) * 12))
+	encoder := newPacketEncoder(writer)
+
+	encoder.uint64(eFM.FileSize)
+	encoder.uint32(eFM.StrongChecksumLength)
+	encoder.uint32(eFM.BlockLength)
+	encoder.uint64(eFM.BlockAmount)
+
+	// one record of index, weak checksum and strong hash per block
 	for index := range eFM.StrongBlockHashes {
-		copy(marshalledData[currentOffset:currentOffset+eFM.StrongChecksumLength], eFM.StrongBlockHashes[index])
-		currentOffset += eFM.StrongChecksumLength
+		encoder.uint64(uint64(index))
+		encoder.uint32(eFM.WeakBlockSums[index])
+		encoder.bytes(eFM.StrongBlockHashes[index])
 	}
 
-	return marshalledData, nil
+	encodeVersionedPath(encoder, eFM.version, eFM.PathLength, eFM.Path)
+
+	return encoder.finish()
 }
 
 func (eFM *ExtendedFileMetadataPacket) UnmarshalBinary(data []byte) error {
-	eFM.FileSize = binary.BigEndian.Uint64(data[:8])
-	eFM.StrongChecksumLength = binary.BigEndian.Uint32(data[8:12])
-	eFM.BlockLength = binary.BigEndian.Uint32(data[12:16])
-	eFM.BlockAmount = binary.BigEndian.Uint64(data[16:24])
-
-	eFM.WeakBlockHashes = make(map[uint32]int64)
+	return eFM.decode(newDataSource(data))
+}
 
-	offset := uint64(0)
+func (eFM *ExtendedFileMetadataPacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("ExtendedFileMetadataPacket", source)
 
-	for offset < eFM.BlockAmount {
-		key := binary.BigEndian.Uint32(data[24+(offset*12) : 28+(offset*12)])
-		value := binary.BigEndian.Uint64(data[28+(offset*12) : 36+(offset*12)])
+	eFM.FileSize = decoder.uint64("file size")
+	eFM.StrongChecksumLength = decoder.uint32("strong checksum length")
+	eFM.BlockLength = decoder.uint32("block length")
+	eFM.BlockAmount = decoder.uint64("block amount")
 
-		eFM.WeakBlockHashes[key] = int64(value)
-		offset += 1
+	checkStrongChecksumLength(decoder, eFM.StrongChecksumLength)
 
+	if decoder.fits(eFM.BlockAmount, 8+4+uint64(eFM.StrongChecksumLength), "blocks") == false {
+		return decoder.err
 	}
 
-	eFM.StrongBlockHashes = make([][]byte, eFM.BlockAmount)
+	eFM.WeakBlockSums = make([]uint32, 0, decoder.capacity(eFM.BlockAmount))
+	eFM.StrongBlockHashes = make([][]byte, 0, decoder.capacity(eFM.BlockAmount))
 
-	currentOffset := uint32(36 + ((offset - 1) * 12))
+	for index := uint64(0); index < eFM.BlockAmount && decoder.err == nil; index++ {
+		if recordIndex := decoder.uint64("block index"); recordIndex != index {
+			decoder.invalid("block %d is in the place of block %d", recordIndex, index)
+		}
 
-	for index := range eFM.StrongBlockHashes {
-		eFM.StrongBlockHashes[index] = make([]byte, eFM.StrongChecksumLength)
-		copy(eFM.StrongBlockHashes[index], data[currentOffset:currentOffset+eFM.StrongChecksumLength])
-		currentOffset += eFM.StrongChecksumLength
+		eFM.WeakBlockSums = append(eFM.WeakBlockSums, decoder.uint32("weak checksum"))
+		eFM.StrongBlockHashes = append(eFM.StrongBlockHashes, decoder.bytes(uint64(eFM.StrongChecksumLength), "strong hash"))
 	}
 
-	return nil
+	eFM.PathLength, eFM.Path = decodeVersionedPath(decoder, eFM.version)
+
+	return decoder.finish()
 }
 
 func (bP *BlockPacket) MarshalBinary() (data []byte, err error) {
-	marshalledData := make([]byte, 4+8+len(bP.StrongChecksum)+len(bP.Data))
-
-	binary.BigEndian.PutUint32(marshalledData[:4], bP.StrongChecksumLength)
+	return marshalPacket(bP)
+}
 
-	copy(marshalledData[4:4+bP.StrongChecksumLength], bP.StrongChecksum)
+func (bP *BlockPacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
 
-	binary.BigEndian.PutUint64(marshalledData[4+bP.StrongChecksumLength:12+bP.StrongChecksumLength], bP.BlockLength)
-	copy(marshalledData[12+bP.StrongChecksumLength:], bP.Data)
+	encoder.uint32(bP.StrongChecksumLength)
+	encoder.bytes(bP.StrongChecksum)
+	encoder.uint64(bP.BlockLength)
+	encoder.bytes(bP.Data)
 
-	return marshalledData, nil
+	return encoder.finish()
 }
 
 func (bP *BlockPacket) UnmarshalBinary(data []byte) error {
-	bP.StrongChecksumLength = binary.BigEndian.Uint32(data[:4])
+	return bP.decode(newDataSource(data))
+}
+
+func (bP *BlockPacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("BlockPacket", source)
+
+	bP.StrongChecksumLength = decoder.uint32("strong checksum length")
+	bP.StrongChecksum = decoder.bytes(uint64(bP.StrongChecksumLength), "strong checksum")
+	bP.BlockLength = decoder.uint64("block length")
+	bP.Data = decoder.bytes(bP.BlockLength, "block")
+
+	return decoder.finish()
+}
+
+func (cBP *CompressedBlockPacket) MarshalBinary() (data []byte, err error) {
+	return marshalPacket(cBP)
+}
 
-	bP.StrongChecksum = make([]byte, bP.StrongChecksumLength)
-	copy(bP.StrongChecksum, data[4:4+bP.StrongChecksumLength])
+func (cBP *CompressedBlockPacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
 
-	bP.BlockLength = binary.BigEndian.Uint64(data[4+bP.StrongChecksumLength : 12+bP.StrongChecksumLength])
+	encoder.uint8(cBP.Compression)
+	encoder.uint32(cBP.StrongChecksumLength)
+	encoder.bytes(cBP.StrongChecksum)
+	encoder.uint64(cBP.DataLength)
+	encoder.bytes(cBP.Data)
 
-	bP.Data = make([]byte, bP.BlockLength)
-	copy(bP.Data, data[12+bP.StrongChecksumLength:])
+	return encoder.finish()
+}
+
+func (cBP *CompressedBlockPacket) UnmarshalBinary(data []byte) error {
+	return cBP.decode(newDataSource(data))
+}
+
+func (cBP *CompressedBlockPacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("CompressedBlockPacket", source)
 
-	return nil
+	cBP.Compression = decoder.uint8("compression")
+	cBP.StrongChecksumLength = decoder.uint32("strong checksum length")
+	cBP.StrongChecksum = decoder.bytes(uint64(cBP.StrongChecksumLength), "strong checksum")
+	cBP.DataLength = decoder.uint64("data length")
+	cBP.Data = decoder.bytes(cBP.DataLength, "data")
+
+	return decoder.finish()
 }
 
 func (rBP *RequestBlockPacket) MarshalBinary() (data []byte, err error) {
-	marshalledData := make([]byte, 4+len(rBP.StrongChecksum))
+	return marshalPacket(rBP)
+}
 
-	binary.BigEndian.PutUint32(marshalledData[:4], rBP.StrongChecksumLength)
-	copy(marshalledData[4:4+rBP.StrongChecksumLength], rBP.StrongChecksum)
+func (rBP *RequestBlockPacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
 
-	return marshalledData, nil
+	encoder.uint32(rBP.StrongChecksumLength)
+	encoder.bytes(rBP.StrongChecksum)
+	encodeVersionedPath(encoder, rBP.version, rBP.PathLength, rBP.Path)
+
+	return encoder.finish()
 }
 
 func (rBP *RequestBlockPacket) UnmarshalBinary(data []byte) error {
-	rBP.StrongChecksumLength = binary.BigEndian.Uint32(data[:4])
+	return rBP.decode(newDataSource(data))
+}
+
+func (rBP *RequestBlockPacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("RequestBlockPacket", source)
+
+	rBP.StrongChecksumLength = decoder.uint32("strong checksum length")
+	rBP.StrongChecksum = decoder.bytes(uint64(rBP.StrongChecksumLength), "strong checksum")
+	rBP.PathLength, rBP.Path = decodeVersionedPath(decoder, rBP.version)
+
+	return decoder.finish()
+}
+
+func (rEFM *RequestExtendedFileMetadataPacket) MarshalBinary() (data []byte, err error) {
+	return marshalPacket(rEFM)
+}
+
+func (rEFM *RequestExtendedFileMetadataPacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
+
+	encoder.uint32(rEFM.BlockLength)
+	encoder.uint32(rEFM.StrongChecksumLength)
+	encoder.uint16(rEFM.PathLength)
+	encoder.bytes(rEFM.Path)
+
+	return encoder.finish()
+}
+
+func (rEFM *RequestExtendedFileMetadataPacket) UnmarshalBinary(data []byte) error {
+	return rEFM.decode(newDataSource(data))
+}
+
+func (rEFM *RequestExtendedFileMetadataPacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("RequestExtendedFileMetadataPacket", source)
+
+	rEFM.BlockLength = decoder.uint32("block length")
+	rEFM.StrongChecksumLength = decoder.uint32("strong checksum length")
+	rEFM.PathLength = decoder.uint16("path length")
+	rEFM.Path = decoder.bytes(uint64(rEFM.PathLength), "path")
+
+	return decoder.finish()
+}
+
+func (rFP *RemoveFilePacket) MarshalBinary() (data []byte, err error) {
+	return marshalPacket(rFP)
+}
+
+func (rFP *RemoveFilePacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
+
+	encoder.uint16(rFP.PathLength)
+	encoder.bytes(rFP.Path)
+
+	return encoder.finish()
+}
+
+func (rFP *RemoveFilePacket) UnmarshalBinary(data []byte) error {
+	return rFP.decode(newDataSource(data))
+}
+
+func (rFP *RemoveFilePacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("RemoveFilePacket", source)
+
+	rFP.PathLength = decoder.uint16("path length")
+	rFP.Path = decoder.bytes(uint64(rFP.PathLength), "path")
+
+	return decoder.finish()
+}
+
+func (mFP *MoveFilePacket) MarshalBinary() (data []byte, err error) {
+	return marshalPacket(mFP)
+}
+
+func (mFP *MoveFilePacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
+
+	encoder.uint16(mFP.OldPathLength)
+	encoder.bytes(mFP.OldPath)
+	encoder.uint16(mFP.NewPathLength)
+	encoder.bytes(mFP.NewPath)
+
+	return encoder.finish()
+}
+
+func (mFP *MoveFilePacket) UnmarshalBinary(data []byte) error {
+	return mFP.decode(newDataSource(data))
+}
+
+func (mFP *MoveFilePacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("MoveFilePacket", source)
+
+	mFP.OldPathLength = decoder.uint16("old path length")
+	mFP.OldPath = decoder.bytes(uint64(mFP.OldPathLength), "old path")
+	mFP.NewPathLength = decoder.uint16("new path length")
+	mFP.NewPath = decoder.bytes(uint64(mFP.NewPathLength), "new path")
+
+	return decoder.finish()
+}
 
-	rBP.StrongChecksum = make([]byte, rBP.StrongChecksumLength)
-	copy(rBP.StrongChecksum, data[4:4+rBP.StrongChecksumLength])
+func (rRP *RequestRestorePacket) MarshalBinary() (data []byte, err error) {
+	return marshalPacket(rRP)
+}
+
+func (rRP *RequestRestorePacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
+
+	encoder.uint16(rRP.PathLength)
+	encoder.bytes(rRP.Path)
+
+	return encoder.finish()
+}
+
+func (rRP *RequestRestorePacket) UnmarshalBinary(data []byte) error {
+	return rRP.decode(newDataSource(data))
+}
+
+func (rRP *RequestRestorePacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("RequestRestorePacket", source)
+
+	rRP.PathLength = decoder.uint16("path length")
+	rRP.Path = decoder.bytes(uint64(rRP.PathLength), "path")
+
+	return decoder.finish()
+}
+
+func (rDRP *RequestDeltaRestorePacket) MarshalBinary() (data []byte, err error) {
+	return marshalPacket(rDRP)
+}
+
+func (rDRP *RequestDeltaRestorePacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
+
+	encoder.uint16(rDRP.PathLength)
+	encoder.bytes(rDRP.Path)
+
+	if encoder.err != nil {
+		return encoder.err
+	}
+
+	// the signature takes up the rest
+	return rDRP.Signature.encode(writer)
+}
+
+func (rDRP *RequestDeltaRestorePacket) UnmarshalBinary(data []byte) error {
+	return rDRP.decode(newDataSource(data))
+}
+
+func (rDRP *RequestDeltaRestorePacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("RequestDeltaRestorePacket", source)
+
+	rDRP.PathLength = decoder.uint16("path length")
+	rDRP.Path = decoder.bytes(uint64(rDRP.PathLength), "path")
+
+	if decoder.err != nil {
+		return decoder.err
+	}
+
+	// the signature takes up the rest, restores came after paths so it
+	// always has one
+	rDRP.Signature = &ExtendedFileMetadataPacket{version: VERSION_0_2}
+
+	return rDRP.Signature.decode(source)
+}
+
+func (dP *DeltaPacket) MarshalBinary() (data []byte, err error) {
+	return marshalPacket(dP)
+}
+
+func (dP *DeltaPacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
+
+	encoder.uint64(dP.DataLength)
+	encoder.bytes(dP.Data)
+
+	return encoder.finish()
+}
+
+func (dP *DeltaPacket) UnmarshalBinary(data []byte) error {
+	return dP.decode(newDataSource(data))
+}
+
+func (dP *DeltaPacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("DeltaPacket", source)
+
+	dP.DataLength = decoder.uint64("data length")
+	dP.Data = decoder.bytes(dP.DataLength, "data")
+
+	return decoder.finish()
+}
+
+func (rVP *RequestVersionsPacket) MarshalBinary() (data []byte, err error) {
+	return marshalPacket(rVP)
+}
+
+func (rVP *RequestVersionsPacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
+
+	encoder.uint16(rVP.PathLength)
+	encoder.bytes(rVP.Path)
+
+	return encoder.finish()
+}
+
+func (rVP *RequestVersionsPacket) UnmarshalBinary(data []byte) error {
+	return rVP.decode(newDataSource(data))
+}
+
+func (rVP *RequestVersionsPacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("RequestVersionsPacket", source)
+
+	rVP.PathLength = decoder.uint16("path length")
+	rVP.Path = decoder.bytes(uint64(rVP.PathLength), "path")
+
+	return decoder.finish()
+}
+
+// Every version is encoded as its id, the time it was stored, the file size,
+// the modification time, the length of the file hash and the hash. Times are
+// nanoseconds since the epoch.
+func (vP *VersionsPacket) MarshalBinary() (data []byte, err error) {
+	return marshalPacket(vP)
+}
+
+func (vP *VersionsPacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
+
+	encoder.uint16(vP.PathLength)
+	encoder.bytes(vP.Path)
+	encoder.uint32(vP.VersionAmount)
+
+	for _, version := range vP.Versions {
+		encoder.uint64(version.ID)
+		encoder.uint64(uint64(version.StoredAt.UnixNano()))
+		encoder.uint64(version.Metadata.FileSize)
+		encoder.uint64(uint64(version.Metadata.LastChanged.UnixNano()))
+		encoder.uint16(uint16(len(version.Metadata.FileHash)))
+		encoder.bytes(version.Metadata.FileHash)
+	}
+
+	return encoder.finish()
+}
+
+func (vP *VersionsPacket) UnmarshalBinary(data []byte) error {
+	return vP.decode(newDataSource(data))
+}
+
+func (vP *VersionsPacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("VersionsPacket", source)
+
+	vP.PathLength = decoder.uint16("path length")
+	vP.Path = decoder.bytes(uint64(vP.PathLength), "path")
+	vP.VersionAmount = decoder.uint32("version amount")
 
-	return nil
+	// versions without a file hash are the shortest
+	if decoder.fits(uint64(vP.VersionAmount), 34, "versions") == false {
+		return decoder.err
+	}
+
+	vP.Versions = make([]*db.FileVersion, 0, decoder.capacity(uint64(vP.VersionAmount)))
+
+	for index := uint32(0); index < vP.VersionAmount && decoder.err == nil; index++ {
+		id := decoder.uint64("version id")
+		storedAt := decoder.uint64("storage time")
+		fileSize := decoder.uint64("file size")
+		lastChanged := decoder.uint64("modification time")
+		fileHash := decoder.bytes(uint64(decoder.uint16("file hash length")), "file hash")
+
+		vP.Versions = append(vP.Versions, &db.FileVersion{
+			ID:       id,
+			StoredAt: time.Unix(0, int64(storedAt)),
+			Metadata: &sync.ShortFileMetadata{
+				FileSize:    fileSize,
+				FileHash:    fileHash,
+				LastChanged: time.Unix(0, int64(lastChanged)),
+			},
+		})
+	}
+
+	return decoder.finish()
+}
+
+func (rVRP *RequestVersionRestorePacket) MarshalBinary() (data []byte, err error) {
+	return marshalPacket(rVRP)
+}
+
+func (rVRP *RequestVersionRestorePacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
+
+	encoder.uint16(rVRP.PathLength)
+	encoder.bytes(rVRP.Path)
+	encoder.uint64(rVRP.VersionID)
+	encoder.uint64(uint64(rVRP.StoredBefore))
+
+	return encoder.finish()
+}
+
+func (rVRP *RequestVersionRestorePacket) UnmarshalBinary(data []byte) error {
+	return rVRP.decode(newDataSource(data))
+}
+
+func (rVRP *RequestVersionRestorePacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("RequestVersionRestorePacket", source)
+
+	rVRP.PathLength = decoder.uint16("path length")
+	rVRP.Path = decoder.bytes(uint64(rVRP.PathLength), "path")
+	rVRP.VersionID = decoder.uint64("version id")
+	rVRP.StoredBefore = int64(decoder.uint64("storage time"))
+
+	return decoder.finish()
+}
+
+func (rCFM *RequestChunkedFileMetadataPacket) MarshalBinary() (data []byte, err error) {
+	return marshalPacket(rCFM)
+}
+
+func (rCFM *RequestChunkedFileMetadataPacket) encode(writer io.Writer) error {
+	encoder := newPacketEncoder(writer)
+
+	encoder.uint32(rCFM.MinChunkLength)
+	encoder.uint32(rCFM.AverageChunkLength)
+	encoder.uint32(rCFM.MaxChunkLength)
+	encoder.uint32(rCFM.StrongChecksumLength)
+	encoder.uint16(rCFM.PathLength)
+	encoder.bytes(rCFM.Path)
+
+	return encoder.finish()
+}
+
+func (rCFM *RequestChunkedFileMetadataPacket) UnmarshalBinary(data []byte) error {
+	return rCFM.decode(newDataSource(data))
+}
+
+func (rCFM *RequestChunkedFileMetadataPacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("RequestChunkedFileMetadataPacket", source)
+
+	rCFM.MinChunkLength = decoder.uint32("minimum chunk length")
+	rCFM.AverageChunkLength = decoder.uint32("average chunk length")
+	rCFM.MaxChunkLength = decoder.uint32("maximum chunk length")
+	rCFM.StrongChecksumLength = decoder.uint32("strong checksum length")
+	rCFM.PathLength = decoder.uint16("path length")
+	rCFM.Path = decoder.bytes(uint64(rCFM.PathLength), "path")
+
+	return decoder.finish()
+}
+
+// Every chunk is encoded as its length followed by its strong hash.
+func (cFM *ChunkedFileMetadataPacket) MarshalBinary() (data []byte, err error) {
+	return marshalPacket(cFM)
+}
+
+func (cFM *ChunkedFileMetadataPacket) encode(writer io.Writer) error {
+	if uint64(len(cFM.BlockLengths)) != cFM.BlockAmount || uint64(len(cFM.StrongBlockHashes)) != cFM.BlockAmount {
+		return sync.INVALID_CHUNKS
+	}
+
+	encoder := newPacketEncoder(writer)
+
+	encoder.uint64(cFM.FileSize)
+	encoder.uint32(cFM.StrongChecksumLength)
+	encoder.uint64(cFM.BlockAmount)
+
+	for index := range cFM.BlockLengths {
+		encoder.uint32(cFM.BlockLengths[index])
+		encoder.bytes(cFM.StrongBlockHashes[index])
+	}
+
+	encoder.uint16(cFM.PathLength)
+	encoder.bytes(cFM.Path)
+
+	return encoder.finish()
+}
+
+func (cFM *ChunkedFileMetadataPacket) UnmarshalBinary(data []byte) error {
+	return cFM.decode(newDataSource(data))
+}
+
+func (cFM *ChunkedFileMetadataPacket) decode(source *packetSource) error {
+	decoder := newPacketDecoder("ChunkedFileMetadataPacket", source)
+
+	cFM.FileSize = decoder.uint64("file size")
+	cFM.StrongChecksumLength = decoder.uint32("strong checksum length")
+	cFM.BlockAmount = decoder.uint64("chunk amount")
+
+	checkStrongChecksumLength(decoder, cFM.StrongChecksumLength)
+
+	if decoder.fits(cFM.BlockAmount, 4+uint64(cFM.StrongChecksumLength), "chunks") == false {
+		return decoder.err
+	}
+
+	cFM.BlockLengths = make([]uint32, 0, decoder.capacity(cFM.BlockAmount))
+	cFM.StrongBlockHashes = make([][]byte, 0, decoder.capacity(cFM.BlockAmount))
+
+	for index := uint64(0); index < cFM.BlockAmount && decoder.err == nil; index++ {
+		cFM.BlockLengths = append(cFM.BlockLengths, decoder.uint32("chunk length"))
+		cFM.StrongBlockHashes = append(cFM.StrongBlockHashes, decoder.bytes(uint64(cFM.StrongChecksumLength), "strong hash"))
+	}
+
+	cFM.PathLength = decoder.uint16("path length")
+	cFM.Path = decoder.bytes(uint64(cFM.PathLength), "path")
+
+	return decoder.finish()
+}
+
+// encodeVersionedPath writes the path that follows metadata from
+// VERSION_0_2 on.
+func encodeVersionedPath(encoder *packetEncoder, version uint16, pathLength uint16, path []byte) {
+	if version < VERSION_0_2 {
+		return
+	}
+
+	encoder.uint16(pathLength)
+	encoder.bytes(path)
+}
+
+// decodeVersionedPath reads the path that follows metadata from
+// VERSION_0_2 on, metadata of VERSION_0_1 belongs to DEFAULT_FILE_PATH.
+func decodeVersionedPath(decoder *packetDecoder, version uint16) (uint16, []byte) {
+	if version < VERSION_0_2 {
+		return uint16(len(DEFAULT_FILE_PATH)), []byte(DEFAULT_FILE_PATH)
+	}
+
+	pathLength := decoder.uint16("path length")
+
+	return pathLength, decoder.bytes(uint64(pathLength), "path")
+}
+
+// checkStrongChecksumLength rejects metadata whose strong hashes are not of
+// the length peers request, before room for its blocks is allocated.
+func checkStrongChecksumLength(decoder *packetDecoder, strongChecksumLength uint32) {
+	if strongChecksumLength != DEFAULT_STRONG_CHECKSUM_LENGTH {
+		decoder.invalid("strong hashes have %d bytes instead of %d", strongChecksumLength, DEFAULT_STRONG_CHECKSUM_LENGTH)
+	}
 }
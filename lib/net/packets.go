@@ -3,8 +3,12 @@ package net
 import (
 	"bytes"
 	"encoding"
+	"errors"
+	"fmt"
+	"math"
 	"time"
 
+	"github.com/FBreuer2/simple-sync/lib/db"
 	"github.com/FBreuer2/simple-sync/lib/sync"
 )
 
@@ -16,18 +20,159 @@ const (
 	EXTENDED_FILE_METADATA = 4
 	REQUEST_BLOCK_PACKET   = 5
 	BLOCK_PACKET           = 6
+
+	REQUEST_EXTENDED_FILE_METADATA = 7
+	REQUEST_TOKEN                  = 8
+	TOKEN                          = 9
+	TOKEN_LOGIN                    = 10
+	REMOVE_FILE                    = 11
+	MOVE_FILE                      = 12
+	REQUEST_RESTORE                = 13
+	REQUEST_DELTA_RESTORE          = 14
+	DELTA                          = 15
+	REQUEST_VERSIONS               = 16
+	VERSIONS                       = 17
+	REQUEST_VERSION_RESTORE        = 18
+	REQUEST_CHUNKED_FILE_METADATA  = 19
+	CHUNKED_FILE_METADATA          = 20
+	COMPRESSED_BLOCK_PACKET        = 21
 )
 
 const (
+	// VERSION_0_1 is the first protocol, its metadata carries no path and
+	// always describes the file at DEFAULT_FILE_PATH.
 	VERSION_0_1 = 0
+	// VERSION_0_2 carries the path of a file in its metadata.
+	VERSION_0_2 = 1
+	// VERSION_0_3 sends modification times as binary timestamps.
+	VERSION_0_3 = 2
+
+	MIN_SUPPORTED_VERSION = VERSION_0_1
+	CURRENT_VERSION       = VERSION_0_3
+)
+
+// DEFAULT_FILE_PATH is the path of the single file peers of VERSION_0_1
+// back up, their metadata does not name it.
+const DEFAULT_FILE_PATH = "file"
+
+const (
+	REPLY_OK                  = 0
+	REPLY_AUTH_FAILED         = 1
+	REPLY_NOT_AUTHENTICATED   = 2
+	REPLY_STALE_METADATA      = 3
+	REPLY_UNKNOWN_PACKET      = 4
+	REPLY_VERSION_UNSUPPORTED = 5
+	REPLY_QUOTA_EXCEEDED      = 6
+	REPLY_INTERNAL_ERROR      = 7
+	REPLY_MALFORMED_PACKET    = 8
+	REPLY_CAPABILITY_MISSING  = 9
+	REPLY_FILE_NOT_AVAILABLE  = 10
+
+	REPLY_FILE_VERSION_NOT_AVAILABLE = 11
+	REPLY_BLOCK_CORRUPTED            = 12
+	REPLY_BUSY                       = 13
+	REPLY_BLOCK_NOT_AVAILABLE        = 14
 )
 
 const (
-	CAPABILITY_LOGIN = 0
-	CAPABILITY_SYNC  = 1
-	CAPABILITY_TOKEN = 2
+	DEFAULT_BLOCK_LENGTH           = 64 * 1024
+	DEFAULT_STRONG_CHECKSUM_LENGTH = 32
+
+	DEFAULT_MIN_CHUNK_LENGTH     = 16 * 1024
+	DEFAULT_AVERAGE_CHUNK_LENGTH = 64 * 1024
+	DEFAULT_MAX_CHUNK_LENGTH     = 256 * 1024
+
+	// MAX_BLOCK_LENGTH limits decompressed blocks, no block is longer than
+	// the longest chunk.
+	MAX_BLOCK_LENGTH = DEFAULT_MAX_CHUNK_LENGTH
 )
 
+// DEFAULT_CHUNK_LENGTHS are the lengths the server requests chunks in.
+// Clients encrypting their files chunk them in advance with these lengths.
+var DEFAULT_CHUNK_LENGTHS = sync.ChunkLengths{
+	Minimum: DEFAULT_MIN_CHUNK_LENGTH,
+	Average: DEFAULT_AVERAGE_CHUNK_LENGTH,
+	Maximum: DEFAULT_MAX_CHUNK_LENGTH,
+}
+
+// Capabilities are bit flags, the capabilities of a connection are the
+// intersection of what both sides announced in their HelloPacket.
+const (
+	CAPABILITY_LOGIN       = 1 << 0
+	CAPABILITY_SYNC        = 1 << 1
+	CAPABILITY_TOKEN       = 1 << 2
+	CAPABILITY_TREE        = 1 << 3
+	CAPABILITY_RESTORE     = 1 << 4
+	CAPABILITY_DELTA       = 1 << 5
+	CAPABILITY_HISTORY     = 1 << 6
+	CAPABILITY_CHUNKING    = 1 << 7
+	CAPABILITY_COMPRESSION = 1 << 8
+	CAPABILITY_FRAMING     = 1 << 9
+
+	SUPPORTED_CAPABILITIES = CAPABILITY_LOGIN | CAPABILITY_SYNC | CAPABILITY_TOKEN | CAPABILITY_TREE | CAPABILITY_RESTORE | CAPABILITY_DELTA | CAPABILITY_HISTORY | CAPABILITY_CHUNKING | CAPABILITY_COMPRESSION | CAPABILITY_FRAMING
+)
+
+// packetCapabilities lists the capability a packet type needs to be accepted.
+// Packet types that are not listed are always accepted.
+var packetCapabilities = map[uint16]uint16{
+	LOGIN:                          CAPABILITY_LOGIN,
+	SHORT_FILE_METADATA:            CAPABILITY_SYNC,
+	EXTENDED_FILE_METADATA:         CAPABILITY_SYNC,
+	REQUEST_BLOCK_PACKET:           CAPABILITY_SYNC,
+	BLOCK_PACKET:                   CAPABILITY_SYNC,
+	REQUEST_EXTENDED_FILE_METADATA: CAPABILITY_SYNC,
+	REQUEST_TOKEN:                  CAPABILITY_TOKEN,
+	TOKEN:                          CAPABILITY_TOKEN,
+	TOKEN_LOGIN:                    CAPABILITY_TOKEN,
+	REMOVE_FILE:                    CAPABILITY_TREE,
+	MOVE_FILE:                      CAPABILITY_TREE,
+	REQUEST_RESTORE:                CAPABILITY_RESTORE,
+	REQUEST_DELTA_RESTORE:          CAPABILITY_DELTA,
+	DELTA:                          CAPABILITY_DELTA,
+	REQUEST_VERSIONS:               CAPABILITY_HISTORY,
+	VERSIONS:                       CAPABILITY_HISTORY,
+	REQUEST_VERSION_RESTORE:        CAPABILITY_HISTORY,
+	REQUEST_CHUNKED_FILE_METADATA:  CAPABILITY_CHUNKING,
+	CHUNKED_FILE_METADATA:          CAPABILITY_CHUNKING,
+	COMPRESSED_BLOCK_PACKET:        CAPABILITY_COMPRESSION,
+}
+
+// RequiredCapability returns the capability bit that has to be negotiated
+// before a packet of the given type may be sent, or 0 if there is none.
+func RequiredCapability(packetType uint16) uint16 {
+	return packetCapabilities[packetType]
+}
+
+// NegotiateVersion returns the version to speak with a peer announcing
+// peerVersion, which is the lower of both sides' current version.
+func NegotiateVersion(peerVersion uint16) (uint16, error) {
+	if peerVersion < MIN_SUPPORTED_VERSION {
+		return 0, VERSION_UNSUPPORTED
+	}
+
+	if peerVersion > CURRENT_VERSION {
+		return CURRENT_VERSION, nil
+	}
+
+	return peerVersion, nil
+}
+
+func NegotiateCapabilities(ownCapabilities uint16, peerCapabilities uint16) uint16 {
+	return ownCapabilities & peerCapabilities
+}
+
+var FIELD_TOO_LONG = errors.New("Field is too long to be sent.")
+
+// checkFieldLength makes sure value fits behind a uint16 length prefix, so
+// constructors reject it instead of sending a truncated length.
+func checkFieldLength(field string, value string) error {
+	if len(value) > math.MaxUint16 {
+		return fmt.Errorf("%s has %d bytes, but at most %d can be sent: %w", field, len(value), math.MaxUint16, FIELD_TOO_LONG)
+	}
+
+	return nil
+}
+
 type Packet struct {
 	PacketType   uint16
 	PacketLength uint64
@@ -50,6 +195,13 @@ type EncapsulatablePacket interface {
 	encoding.BinaryUnmarshaler
 }
 
+// VersionedPacket is a packet whose layout depends on the protocol version.
+// The Codec sets the negotiated version before marshalling or unmarshalling.
+type VersionedPacket interface {
+	EncapsulatablePacket
+	SetVersion(version uint16)
+}
+
 type ReplyPacket struct {
 	ErrorCode         uint16
 	ErrorStringLength uint64
@@ -64,13 +216,35 @@ func (rp *ReplyPacket) Type() uint16 {
 	return REPLY
 }
 
+// Error returns nil for REPLY_OK and a *ReplyError carrying the code and
+// the server's message otherwise.
+func (rp *ReplyPacket) Error() error {
+	if rp.ErrorCode == REPLY_OK {
+		return nil
+	}
+
+	return &ReplyError{Code: rp.ErrorCode, Message: string(rp.ErrorString)}
+}
+
+// HelloPacket announces the version and capabilities of a side, and with
+// CAPABILITY_FRAMING the longest frame it accepts. Peers that predate
+// framing send no frame length and ignore it.
 type HelloPacket struct {
-	Version      uint16
-	Capabilities uint16
+	Version        uint16
+	Capabilities   uint16
+	MaxFrameLength uint32
 }
 
 func NewHelloPacket() *HelloPacket {
-	return &HelloPacket{VERSION_0_1, CAPABILITY_LOGIN | CAPABILITY_SYNC | CAPABILITY_TOKEN}
+	return &HelloPacket{CURRENT_VERSION, SUPPORTED_CAPABILITIES, DEFAULT_MAX_FRAME_LENGTH}
+}
+
+func NewNegotiatedHelloPacket(version uint16, capabilities uint16, maxFrameLength uint32) *HelloPacket {
+	return &HelloPacket{version, capabilities, maxFrameLength}
+}
+
+func (hP *HelloPacket) HasCapability(capability uint16) bool {
+	return hP.Capabilities&capability == capability
 }
 
 func (hP *HelloPacket) Type() uint16 {
@@ -84,39 +258,165 @@ type LoginPacket struct {
 	Password       []byte
 }
 
-func NewLoginPacket(username, password []byte) *LoginPacket {
+func NewLoginPacket(username, password []byte) (*LoginPacket, error) {
+	if err := checkFieldLength("Username", string(username)); err != nil {
+		return nil, err
+	}
+
+	if err := checkFieldLength("Password", string(password)); err != nil {
+		return nil, err
+	}
+
 	return &LoginPacket{
 		UsernameLength: uint16(len(username)),
 		Username:       username,
 		PasswordLength: uint16(len(password)),
 		Password:       password,
-	}
+	}, nil
 }
 
 func (lP *LoginPacket) Type() uint16 {
 	return LOGIN
 }
 
+type RequestTokenPacket struct {
+	UsernameLength uint16
+	Username       []byte
+	PasswordLength uint16
+	Password       []byte
+	LabelLength    uint16
+	Label          []byte
+}
+
+func NewRequestTokenPacket(username, password []byte, label string) (*RequestTokenPacket, error) {
+	if err := checkFieldLength("Username", string(username)); err != nil {
+		return nil, err
+	}
+
+	if err := checkFieldLength("Password", string(password)); err != nil {
+		return nil, err
+	}
+
+	if err := checkFieldLength("Label", label); err != nil {
+		return nil, err
+	}
+
+	return &RequestTokenPacket{
+		UsernameLength: uint16(len(username)),
+		Username:       username,
+		PasswordLength: uint16(len(password)),
+		Password:       password,
+		LabelLength:    uint16(len([]byte(label))),
+		Label:          []byte(label),
+	}, nil
+}
+
+func (rTP *RequestTokenPacket) Type() uint16 {
+	return REQUEST_TOKEN
+}
+
+type TokenPacket struct {
+	TokenLength uint16
+	Token       []byte
+}
+
+func NewTokenPacket(token []byte) (*TokenPacket, error) {
+	if err := checkFieldLength("Token", string(token)); err != nil {
+		return nil, err
+	}
+
+	return &TokenPacket{
+		TokenLength: uint16(len(token)),
+		Token:       token,
+	}, nil
+}
+
+func (tP *TokenPacket) Type() uint16 {
+	return TOKEN
+}
+
+type TokenLoginPacket struct {
+	UsernameLength uint16
+	Username       []byte
+	TokenLength    uint16
+	Token          []byte
+}
+
+func NewTokenLoginPacket(username, token []byte) (*TokenLoginPacket, error) {
+	if err := checkFieldLength("Username", string(username)); err != nil {
+		return nil, err
+	}
+
+	if err := checkFieldLength("Token", string(token)); err != nil {
+		return nil, err
+	}
+
+	return &TokenLoginPacket{
+		UsernameLength: uint16(len(username)),
+		Username:       username,
+		TokenLength:    uint16(len(token)),
+		Token:          token,
+	}, nil
+}
+
+func (tLP *TokenLoginPacket) Type() uint16 {
+	return TOKEN_LOGIN
+}
+
+// ShortFileMetadataPacket carries the modification time as a formatted
+// string up to VERSION_0_2, later versions send the nanoseconds since the
+// Unix epoch and the offset of the time zone in seconds east of UTC. From
+// VERSION_0_2 on it ends with the path of the file.
 type ShortFileMetadataPacket struct {
-	FileSize          uint64
-	FileHashLength    uint64
-	FileHash          []byte
-	LastChangedLength uint64
-	LastChanged       []byte // String() string
+	FileSize               uint64
+	FileHashLength         uint64
+	FileHash               []byte
+	LastChangedLength      uint64
+	LastChanged            []byte // String() string
+	LastChangedNanoseconds int64
+	TimezoneOffset         int32
+	PathLength             uint16
+	Path                   []byte
+	version                uint16
 }
 
-func NewShortFileMetaDataPacket(sFM *sync.ShortFileMetadata) *ShortFileMetadataPacket {
-	return &ShortFileMetadataPacket{
-		FileSize:          sFM.FileSize,
-		FileHashLength:    uint64(len(sFM.FileHash)),
-		FileHash:          sFM.FileHash,
-		LastChangedLength: uint64(len([]byte(sFM.LastChanged.Format("2006-01-02 15:04:05.999999999 -0700 MST")))),
-		LastChanged:       []byte(sFM.LastChanged.Format("2006-01-02 15:04:05.999999999 -0700 MST")),
+const LAST_CHANGED_FORMAT = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+func NewShortFileMetaDataPacket(path string, sFM *sync.ShortFileMetadata) (*ShortFileMetadataPacket, error) {
+	if err := checkFieldLength("Path", path); err != nil {
+		return nil, err
 	}
+
+	_, timezoneOffset := sFM.LastChanged.Zone()
+
+	return &ShortFileMetadataPacket{
+		FileSize:               sFM.FileSize,
+		FileHashLength:         uint64(len(sFM.FileHash)),
+		FileHash:               sFM.FileHash,
+		LastChangedLength:      uint64(len([]byte(sFM.LastChanged.Format(LAST_CHANGED_FORMAT)))),
+		LastChanged:            []byte(sFM.LastChanged.Format(LAST_CHANGED_FORMAT)),
+		LastChangedNanoseconds: sFM.LastChanged.UnixNano(),
+		TimezoneOffset:         int32(timezoneOffset),
+		PathLength:             uint16(len([]byte(path))),
+		Path:                   []byte(path),
+		version:                CURRENT_VERSION,
+	}, nil
+}
+
+func (sFM *ShortFileMetadataPacket) SetVersion(version uint16) {
+	sFM.version = version
 }
 
 func (sFM *ShortFileMetadataPacket) GetData() (*sync.ShortFileMetadata, error) {
-	timeObject, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", string(sFM.LastChanged))
+	if sFM.version >= VERSION_0_3 {
+		return &sync.ShortFileMetadata{
+			FileSize:    sFM.FileSize,
+			FileHash:    sFM.FileHash,
+			LastChanged: time.Unix(0, sFM.LastChangedNanoseconds).In(time.FixedZone("", int(sFM.TimezoneOffset))),
+		}, nil
+	}
+
+	timeObject, err := time.Parse(LAST_CHANGED_FORMAT, string(sFM.LastChanged))
 
 	if err != nil {
 		return nil, err
@@ -133,33 +433,55 @@ func (sFM *ShortFileMetadataPacket) Type() uint16 {
 	return SHORT_FILE_METADATA
 }
 
+// ExtendedFileMetadataPacket carries the blocks of a file as records of
+// their index, weak checksum and strong hash, in the order of the file.
+// From VERSION_0_2 on they are followed by the path of the file.
 type ExtendedFileMetadataPacket struct {
 	FileSize             uint64
 	StrongChecksumLength uint32
 	BlockLength          uint32
 	BlockAmount          uint64
-	WeakBlockHashes      map[uint32]int64
+	WeakBlockSums        []uint32
 	StrongBlockHashes    [][]byte
+	PathLength           uint16
+	Path                 []byte
+	version              uint16
 }
 
-func NewExtendedFileMetadataPacket(eFM *sync.ExtendedFileMetadata) (*ExtendedFileMetadataPacket, error) {
+func NewExtendedFileMetadataPacket(path string, eFM *sync.ExtendedFileMetadata) (*ExtendedFileMetadataPacket, error) {
+	if err := eFM.CheckBlocks(); err != nil {
+		return nil, err
+	}
+
+	if err := checkFieldLength("Path", path); err != nil {
+		return nil, err
+	}
+
 	return &ExtendedFileMetadataPacket{
 		FileSize:             eFM.FileSize,
 		StrongChecksumLength: eFM.StrongChecksumLength,
 		BlockLength:          eFM.BlockLength,
 		BlockAmount:          eFM.BlockAmount,
-		WeakBlockHashes:      eFM.WeakBlockHashes,
+		WeakBlockSums:        eFM.WeakBlockSums,
 		StrongBlockHashes:    eFM.StrongBlockHashes,
+		PathLength:           uint16(len([]byte(path))),
+		Path:                 []byte(path),
+		version:              CURRENT_VERSION,
 	}, nil
 }
 
+func (eFM *ExtendedFileMetadataPacket) SetVersion(version uint16) {
+	eFM.version = version
+}
+
 func (eFM *ExtendedFileMetadataPacket) GetData() (*sync.ExtendedFileMetadata, error) {
 	return &sync.ExtendedFileMetadata{
 		FileSize:             eFM.FileSize,
 		StrongChecksumLength: eFM.StrongChecksumLength,
 		BlockLength:          eFM.BlockLength,
 		BlockAmount:          eFM.BlockAmount,
-		WeakBlockHashes:      eFM.WeakBlockHashes,
+		WeakBlockSums:        eFM.WeakBlockSums,
+		WeakBlockHashes:      sync.IndexWeakBlockSums(eFM.WeakBlockSums),
 		StrongBlockHashes:    eFM.StrongBlockHashes,
 	}, nil
 }
@@ -195,23 +517,412 @@ func (bP *BlockPacket) Type() uint16 {
 	return BLOCK_PACKET
 }
 
+// CompressedBlockPacket carries a block compressed with the algorithm in
+// Compression, see sync.CompressBlock. The strong checksum is the one of the
+// decompressed block.
+type CompressedBlockPacket struct {
+	Compression          uint8
+	StrongChecksumLength uint32
+	StrongChecksum       []byte
+	DataLength           uint64
+	Data                 []byte
+}
+
+func NewCompressedBlockPacket(strongChecksum []byte, compression uint8, data []byte) (*CompressedBlockPacket, error) {
+	return &CompressedBlockPacket{
+		Compression:          compression,
+		StrongChecksumLength: uint32(len(strongChecksum)),
+		StrongChecksum:       strongChecksum,
+		DataLength:           uint64(len(data)),
+		Data:                 data,
+	}, nil
+}
+
+func (cBP *CompressedBlockPacket) Equals(otherCBP *CompressedBlockPacket) bool {
+	return (cBP.Compression == otherCBP.Compression &&
+		cBP.StrongChecksumLength == otherCBP.StrongChecksumLength &&
+		cBP.DataLength == otherCBP.DataLength &&
+		bytes.Equal(cBP.StrongChecksum, otherCBP.StrongChecksum) == true &&
+		bytes.Equal(cBP.Data, otherCBP.Data) == true)
+}
+
+// Decompress returns the block as a BlockPacket. Blocks longer than
+// MAX_BLOCK_LENGTH are rejected.
+func (cBP *CompressedBlockPacket) Decompress() (*BlockPacket, error) {
+	block, err := sync.DecompressBlock(cBP.Compression, cBP.Data, MAX_BLOCK_LENGTH)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBlockPacket(cBP.StrongChecksum, block)
+}
+
+func (cBP *CompressedBlockPacket) Type() uint16 {
+	return COMPRESSED_BLOCK_PACKET
+}
+
+// RequestBlockPacket asks for the block with a strong checksum, from
+// VERSION_0_2 on followed by the path of the file it belongs to.
 type RequestBlockPacket struct {
 	StrongChecksumLength uint32
 	StrongChecksum       []byte
+	PathLength           uint16
+	Path                 []byte
+	version              uint16
 }
 
-func NewRequestBlockPacket(strongChecksum []byte) (*RequestBlockPacket, error) {
+func NewRequestBlockPacket(path string, strongChecksum []byte) (*RequestBlockPacket, error) {
+	if err := checkFieldLength("Path", path); err != nil {
+		return nil, err
+	}
+
 	return &RequestBlockPacket{
 		StrongChecksumLength: uint32(len(strongChecksum)),
 		StrongChecksum:       strongChecksum,
+		PathLength:           uint16(len([]byte(path))),
+		Path:                 []byte(path),
+		version:              CURRENT_VERSION,
 	}, nil
 }
 
+func (rBP *RequestBlockPacket) SetVersion(version uint16) {
+	rBP.version = version
+}
+
 func (rBP *RequestBlockPacket) Equals(otherRBP *RequestBlockPacket) bool {
 	return (rBP.StrongChecksumLength == otherRBP.StrongChecksumLength &&
-		bytes.Equal(rBP.StrongChecksum, otherRBP.StrongChecksum) == true)
+		bytes.Equal(rBP.StrongChecksum, otherRBP.StrongChecksum) == true &&
+		bytes.Equal(rBP.Path, otherRBP.Path) == true)
 }
 
 func (rBP *RequestBlockPacket) Type() uint16 {
 	return REQUEST_BLOCK_PACKET
 }
+
+type RequestExtendedFileMetadataPacket struct {
+	BlockLength          uint32
+	StrongChecksumLength uint32
+	PathLength           uint16
+	Path                 []byte
+}
+
+func NewRequestExtendedFileMetadataPacket(path string, blockLength uint32, strongChecksumLength uint32) (*RequestExtendedFileMetadataPacket, error) {
+	if err := checkFieldLength("Path", path); err != nil {
+		return nil, err
+	}
+
+	return &RequestExtendedFileMetadataPacket{
+		BlockLength:          blockLength,
+		StrongChecksumLength: strongChecksumLength,
+		PathLength:           uint16(len([]byte(path))),
+		Path:                 []byte(path),
+	}, nil
+}
+
+func (rEFM *RequestExtendedFileMetadataPacket) Type() uint16 {
+	return REQUEST_EXTENDED_FILE_METADATA
+}
+
+type RemoveFilePacket struct {
+	PathLength uint16
+	Path       []byte
+}
+
+func NewRemoveFilePacket(path string) (*RemoveFilePacket, error) {
+	if err := checkFieldLength("Path", path); err != nil {
+		return nil, err
+	}
+
+	return &RemoveFilePacket{
+		PathLength: uint16(len([]byte(path))),
+		Path:       []byte(path),
+	}, nil
+}
+
+func (rFP *RemoveFilePacket) Type() uint16 {
+	return REMOVE_FILE
+}
+
+type MoveFilePacket struct {
+	OldPathLength uint16
+	OldPath       []byte
+	NewPathLength uint16
+	NewPath       []byte
+}
+
+func NewMoveFilePacket(oldPath string, newPath string) (*MoveFilePacket, error) {
+	if err := checkFieldLength("Old path", oldPath); err != nil {
+		return nil, err
+	}
+
+	if err := checkFieldLength("New path", newPath); err != nil {
+		return nil, err
+	}
+
+	return &MoveFilePacket{
+		OldPathLength: uint16(len([]byte(oldPath))),
+		OldPath:       []byte(oldPath),
+		NewPathLength: uint16(len([]byte(newPath))),
+		NewPath:       []byte(newPath),
+	}, nil
+}
+
+func (mFP *MoveFilePacket) Type() uint16 {
+	return MOVE_FILE
+}
+
+// RequestRestorePacket asks for a stored file. The server answers with the
+// ShortFileMetadataPacket of the file, a BlockPacket for every block in
+// order and a final ReplyPacket, or only with a ReplyPacket on errors.
+type RequestRestorePacket struct {
+	PathLength uint16
+	Path       []byte
+}
+
+func NewRequestRestorePacket(path string) (*RequestRestorePacket, error) {
+	if err := checkFieldLength("Path", path); err != nil {
+		return nil, err
+	}
+
+	return &RequestRestorePacket{
+		PathLength: uint16(len([]byte(path))),
+		Path:       []byte(path),
+	}, nil
+}
+
+func (rRP *RequestRestorePacket) Type() uint16 {
+	return REQUEST_RESTORE
+}
+
+// RequestDeltaRestorePacket asks for a stored file the client has an older
+// copy of. Signature describes that copy, the server answers like it does a
+// RequestRestorePacket but sends DeltaPackets instead of BlockPackets, which
+// together form a librsync delta from the old copy to the stored file.
+type RequestDeltaRestorePacket struct {
+	PathLength uint16
+	Path       []byte
+	Signature  *ExtendedFileMetadataPacket
+}
+
+func NewRequestDeltaRestorePacket(path string, signature *sync.ExtendedFileMetadata) (*RequestDeltaRestorePacket, error) {
+	if err := checkFieldLength("Path", path); err != nil {
+		return nil, err
+	}
+
+	signaturePacket, err := NewExtendedFileMetadataPacket("", signature)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &RequestDeltaRestorePacket{
+		PathLength: uint16(len([]byte(path))),
+		Path:       []byte(path),
+		Signature:  signaturePacket,
+	}, nil
+}
+
+func (rDRP *RequestDeltaRestorePacket) GetSignature() (*sync.ExtendedFileMetadata, error) {
+	return rDRP.Signature.GetData()
+}
+
+func (rDRP *RequestDeltaRestorePacket) Type() uint16 {
+	return REQUEST_DELTA_RESTORE
+}
+
+type DeltaPacket struct {
+	DataLength uint64
+	Data       []byte
+}
+
+func NewDeltaPacket(data []byte) *DeltaPacket {
+	return &DeltaPacket{
+		DataLength: uint64(len(data)),
+		Data:       data,
+	}
+}
+
+func (dP *DeltaPacket) Type() uint16 {
+	return DELTA
+}
+
+// RequestVersionsPacket asks for the version history of a file. The server
+// answers with a VersionsPacket, or with a ReplyPacket on errors.
+type RequestVersionsPacket struct {
+	PathLength uint16
+	Path       []byte
+}
+
+func NewRequestVersionsPacket(path string) (*RequestVersionsPacket, error) {
+	if err := checkFieldLength("Path", path); err != nil {
+		return nil, err
+	}
+
+	return &RequestVersionsPacket{
+		PathLength: uint16(len([]byte(path))),
+		Path:       []byte(path),
+	}, nil
+}
+
+func (rVP *RequestVersionsPacket) Type() uint16 {
+	return REQUEST_VERSIONS
+}
+
+type VersionsPacket struct {
+	PathLength    uint16
+	Path          []byte
+	VersionAmount uint32
+	Versions      []*db.FileVersion
+}
+
+func NewVersionsPacket(path string, versions []*db.FileVersion) (*VersionsPacket, error) {
+	if err := checkFieldLength("Path", path); err != nil {
+		return nil, err
+	}
+
+	if len(versions) > math.MaxUint32 {
+		return nil, fmt.Errorf("%d versions do not fit into a packet: %w", len(versions), FIELD_TOO_LONG)
+	}
+
+	for _, version := range versions {
+		if err := checkFieldLength("File hash", string(version.Metadata.FileHash)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &VersionsPacket{
+		PathLength:    uint16(len([]byte(path))),
+		Path:          []byte(path),
+		VersionAmount: uint32(len(versions)),
+		Versions:      versions,
+	}, nil
+}
+
+func (vP *VersionsPacket) Type() uint16 {
+	return VERSIONS
+}
+
+// RequestVersionRestorePacket asks for a version of a stored file, either
+// by VersionID or, if that is 0, the newest version stored at or before
+// StoredBefore in nanoseconds since the epoch. The server answers like it
+// does a RequestRestorePacket.
+type RequestVersionRestorePacket struct {
+	PathLength   uint16
+	Path         []byte
+	VersionID    uint64
+	StoredBefore int64
+}
+
+func NewRequestVersionRestorePacket(path string, versionID uint64, storedBefore time.Time) (*RequestVersionRestorePacket, error) {
+	if err := checkFieldLength("Path", path); err != nil {
+		return nil, err
+	}
+
+	requestPacket := &RequestVersionRestorePacket{
+		PathLength: uint16(len([]byte(path))),
+		Path:       []byte(path),
+		VersionID:  versionID,
+	}
+
+	if storedBefore.IsZero() == false {
+		requestPacket.StoredBefore = storedBefore.UnixNano()
+	}
+
+	return requestPacket, nil
+}
+
+func (rVRP *RequestVersionRestorePacket) GetStoredBefore() time.Time {
+	return time.Unix(0, rVRP.StoredBefore)
+}
+
+func (rVRP *RequestVersionRestorePacket) Type() uint16 {
+	return REQUEST_VERSION_RESTORE
+}
+
+// RequestChunkedFileMetadataPacket asks for the metadata of a file split into
+// content defined chunks with the given lengths instead of fixed blocks. The
+// client answers with a ChunkedFileMetadataPacket.
+type RequestChunkedFileMetadataPacket struct {
+	MinChunkLength       uint32
+	AverageChunkLength   uint32
+	MaxChunkLength       uint32
+	StrongChecksumLength uint32
+	PathLength           uint16
+	Path                 []byte
+}
+
+func NewRequestChunkedFileMetadataPacket(path string, lengths sync.ChunkLengths, strongChecksumLength uint32) (*RequestChunkedFileMetadataPacket, error) {
+	if err := checkFieldLength("Path", path); err != nil {
+		return nil, err
+	}
+
+	return &RequestChunkedFileMetadataPacket{
+		MinChunkLength:       lengths.Minimum,
+		AverageChunkLength:   lengths.Average,
+		MaxChunkLength:       lengths.Maximum,
+		StrongChecksumLength: strongChecksumLength,
+		PathLength:           uint16(len([]byte(path))),
+		Path:                 []byte(path),
+	}, nil
+}
+
+func (rCFM *RequestChunkedFileMetadataPacket) GetChunkLengths() sync.ChunkLengths {
+	return sync.ChunkLengths{
+		Minimum: rCFM.MinChunkLength,
+		Average: rCFM.AverageChunkLength,
+		Maximum: rCFM.MaxChunkLength,
+	}
+}
+
+func (rCFM *RequestChunkedFileMetadataPacket) Type() uint16 {
+	return REQUEST_CHUNKED_FILE_METADATA
+}
+
+// ChunkedFileMetadataPacket carries the length and the strong hash of every
+// chunk of a file. Weak hashes are not sent, they are only needed to find
+// fixed length blocks in a changed file.
+type ChunkedFileMetadataPacket struct {
+	FileSize             uint64
+	StrongChecksumLength uint32
+	BlockAmount          uint64
+	BlockLengths         []uint32
+	StrongBlockHashes    [][]byte
+	PathLength           uint16
+	Path                 []byte
+}
+
+func NewChunkedFileMetadataPacket(path string, eFM *sync.ExtendedFileMetadata) (*ChunkedFileMetadataPacket, error) {
+	if eFM.IsChunked() == false || len(eFM.BlockLengths) != len(eFM.StrongBlockHashes) {
+		return nil, sync.INVALID_CHUNKS
+	}
+
+	if err := checkFieldLength("Path", path); err != nil {
+		return nil, err
+	}
+
+	return &ChunkedFileMetadataPacket{
+		FileSize:             eFM.FileSize,
+		StrongChecksumLength: eFM.StrongChecksumLength,
+		BlockAmount:          uint64(len(eFM.StrongBlockHashes)),
+		BlockLengths:         eFM.BlockLengths,
+		StrongBlockHashes:    eFM.StrongBlockHashes,
+		PathLength:           uint16(len([]byte(path))),
+		Path:                 []byte(path),
+	}, nil
+}
+
+func (cFM *ChunkedFileMetadataPacket) GetData() (*sync.ExtendedFileMetadata, error) {
+	return &sync.ExtendedFileMetadata{
+		FileSize:             cFM.FileSize,
+		StrongChecksumLength: cFM.StrongChecksumLength,
+		BlockAmount:          cFM.BlockAmount,
+		WeakBlockHashes:      make(map[uint32]int64),
+		StrongBlockHashes:    cFM.StrongBlockHashes,
+		BlockLengths:         cFM.BlockLengths,
+	}, nil
+}
+
+func (cFM *ChunkedFileMetadataPacket) Type() uint16 {
+	return CHUNKED_FILE_METADATA
+}
@@ -1,31 +1,157 @@
 package net
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	gosync "sync"
+	"time"
 
 	"github.com/FBreuer2/simple-sync/lib/db"
+	"github.com/FBreuer2/simple-sync/lib/sync"
 )
 
+const (
+	TRANSFER_TIMEOUT               = 30 * time.Second
+	MAX_OUTSTANDING_BLOCK_REQUESTS = 8
+)
+
+var TRANSFER_IN_PROGRESS = errors.New("Another transfer is already in progress.")
+var INVALID_METADATA = errors.New("Extended metadata does not describe the announced file.")
+
+// blockTransfer hands packets belonging to a running RetrieveBlocks from the
+// main loop to the goroutine doing the transfer, including the replies of a
+// client that could not answer a request.
+type blockTransfer struct {
+	extendedMetadata chan *receivedMetadata
+	blocks           chan *CompressedBlockPacket
+	replies          chan *ReplyPacket
+	done             chan bool
+}
+
+func newBlockTransfer() *blockTransfer {
+	return &blockTransfer{
+		extendedMetadata: make(chan *receivedMetadata, 1),
+		blocks:           make(chan *CompressedBlockPacket, MAX_OUTSTANDING_BLOCK_REQUESTS),
+		replies:          make(chan *ReplyPacket, 1),
+		done:             make(chan bool),
+	}
+}
+
+// receivedMetadata is the answer of the client to a metadata request, with
+// either fixed length blocks or content defined chunks, or the error of
+// metadata that could not be read.
+type receivedMetadata struct {
+	path     string
+	metadata *sync.ExtendedFileMetadata
+	err      error
+}
+
 type Peer struct {
-	conn          net.Conn
-	version       uint16
-	capabilities  uint16
-	authenticated bool
-	username      []byte
-	shouldStop    chan bool
-	closed        chan string
-	db            db.FullDatabase
-}
-
-func NewPeer(conn net.Conn, closed chan string, db db.FullDatabase) *Peer {
-	return &Peer{
+	conn           net.Conn
+	codec          *Codec
+	handlers       *Dispatcher
+	version        uint16
+	capabilities   uint16
+	capabilityLock gosync.RWMutex
+	maxFrameLength uint32
+	authenticated  bool
+	username       []byte
+	shouldStop     chan bool
+	closed         chan string
+	db             db.FullDatabase
+	collector      *db.BlockCollector
+	transferLock   gosync.Mutex
+	transfer       *blockTransfer
+}
+
+func NewPeer(conn net.Conn, closed chan string, database db.FullDatabase, collector *db.BlockCollector) *Peer {
+	peer := &Peer{
 		conn:       conn,
+		codec:      NewCodec(conn, DEFAULT_PACKET_REGISTRY),
+		handlers:   NewDispatcher(),
 		shouldStop: make(chan bool),
 		closed:     closed,
-		db:         db,
+		db:         database,
+		collector:  collector,
 	}
+
+	peer.handlers.Handle(HELLO, func(packet EncapsulatablePacket) { peer.HandleHelloPacket(packet.(*HelloPacket)) })
+	peer.handlers.Handle(LOGIN, func(packet EncapsulatablePacket) { peer.HandleLoginPacket(packet.(*LoginPacket)) })
+	peer.handlers.Handle(REQUEST_TOKEN, func(packet EncapsulatablePacket) { peer.HandleRequestTokenPacket(packet.(*RequestTokenPacket)) })
+	peer.handlers.Handle(TOKEN_LOGIN, func(packet EncapsulatablePacket) { peer.HandleTokenLoginPacket(packet.(*TokenLoginPacket)) })
+
+	peer.HandleAuthenticated(REPLY, func(packet EncapsulatablePacket) {
+		peer.HandleReplyPacket(packet.(*ReplyPacket))
+	})
+	peer.HandleAuthenticated(SHORT_FILE_METADATA, func(packet EncapsulatablePacket) {
+		peer.HandleShortFileMetadataPacketPacket(packet.(*ShortFileMetadataPacket))
+	})
+	peer.HandleAuthenticated(EXTENDED_FILE_METADATA, func(packet EncapsulatablePacket) {
+		peer.HandleExtendedFileMetadataPacket(packet.(*ExtendedFileMetadataPacket))
+	})
+	peer.HandleAuthenticated(CHUNKED_FILE_METADATA, func(packet EncapsulatablePacket) {
+		peer.HandleChunkedFileMetadataPacket(packet.(*ChunkedFileMetadataPacket))
+	})
+	peer.HandleAuthenticated(BLOCK_PACKET, func(packet EncapsulatablePacket) {
+		peer.HandleBlockPacket(packet.(*BlockPacket))
+	})
+	peer.HandleAuthenticated(COMPRESSED_BLOCK_PACKET, func(packet EncapsulatablePacket) {
+		peer.HandleCompressedBlockPacket(packet.(*CompressedBlockPacket))
+	})
+	peer.HandleAuthenticated(REMOVE_FILE, func(packet EncapsulatablePacket) {
+		peer.HandleRemoveFilePacket(packet.(*RemoveFilePacket))
+	})
+	peer.HandleAuthenticated(MOVE_FILE, func(packet EncapsulatablePacket) {
+		peer.HandleMoveFilePacket(packet.(*MoveFilePacket))
+	})
+	peer.HandleAuthenticated(REQUEST_RESTORE, func(packet EncapsulatablePacket) {
+		peer.HandleRequestRestorePacket(packet.(*RequestRestorePacket))
+	})
+	peer.HandleAuthenticated(REQUEST_DELTA_RESTORE, func(packet EncapsulatablePacket) {
+		peer.HandleRequestDeltaRestorePacket(packet.(*RequestDeltaRestorePacket))
+	})
+	peer.HandleAuthenticated(REQUEST_VERSIONS, func(packet EncapsulatablePacket) {
+		peer.HandleRequestVersionsPacket(packet.(*RequestVersionsPacket))
+	})
+	peer.HandleAuthenticated(REQUEST_VERSION_RESTORE, func(packet EncapsulatablePacket) {
+		peer.HandleRequestVersionRestorePacket(packet.(*RequestVersionRestorePacket))
+	})
+
+	return peer
+}
+
+// Handle registers handler for packets of packetType, which may be sent
+// before the peer authenticated. Packet types of extensions have to be
+// registered with RegisterPacket as well.
+func (peer *Peer) Handle(packetType uint16, handler PacketHandler) {
+	peer.handlers.Handle(packetType, handler)
+}
+
+// HandleAuthenticated registers handler for packets of packetType, which
+// are answered with REPLY_NOT_AUTHENTICATED until the peer authenticated.
+func (peer *Peer) HandleAuthenticated(packetType uint16, handler PacketHandler) {
+	peer.handlers.Handle(packetType, func(packet EncapsulatablePacket) {
+		if peer.requireAuthentication() == false {
+			return
+		}
+
+		handler(packet)
+	})
+}
+
+// Username returns the user the peer authenticated as, or nil.
+func (peer *Peer) Username() []byte {
+	return peer.username
+}
+
+// SendPacket sends a packet to the peer, it is safe for concurrent use.
+func (peer *Peer) SendPacket(packet EncapsulatablePacket) error {
+	return peer.sendPacket(packet)
 }
 
 func (peer *Peer) GetUniqueIdentifier() string {
@@ -37,7 +163,7 @@ func (peer *Peer) Start() {
 
 	select {
 	case _ = <-peer.shouldStop:
-		peer.conn.Close()
+		peer.codec.Close()
 		return
 	}
 }
@@ -47,124 +173,180 @@ func (peer *Peer) Stop() {
 }
 
 func (peer *Peer) mainLoop() {
-	peekBuf := make([]byte, 10)
-	currentAmountOfBytes := 0
-
 	for {
-		readNow, err := peer.conn.Read(peekBuf[currentAmountOfBytes:])
+		packet, err := peer.codec.ReadPacket()
+
+		if errors.Is(err, UNKNOWN_PACKET_TYPE) == true {
+			log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent unknown packet: %s\n", err.Error())
+			peer.sendReply(REPLY_UNKNOWN_PACKET, "")
+			continue
+		}
+
 		if err != nil {
-			if err == io.EOF {
-				peer.closed <- peer.GetUniqueIdentifier()
-				return
+			if err != io.EOF {
+				log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" is disconnected: %s\n", err.Error())
+			}
+
+			// packets that do not fit the limits can not be skipped, and a
+			// peer that sends undecodable ones is not trusted further
+			if errors.Is(err, FRAME_TOO_LARGE) == true || errors.Is(err, PACKET_TOO_LARGE) == true || errors.Is(err, INVALID_FRAME) == true || errors.Is(err, INVALID_PACKET) == true {
+				peer.sendReply(REPLY_MALFORMED_PACKET, err.Error())
 			}
 
-			log.Println(err)
 			peer.closed <- peer.GetUniqueIdentifier()
 			return
 		}
 
-		currentAmountOfBytes += readNow
-
-		// Not enough information to parse a packet yet
-		if currentAmountOfBytes < 10 {
+		if peer.requireCapability(packet.Type()) == false {
 			continue
-		} else {
-			// enough to start parsing
-			currentAmountOfBytes = 0
-			newPacket, err := PacketFromHeader(peekBuf)
-
-			if err != nil {
-				if err == io.EOF {
-					peer.closed <- peer.GetUniqueIdentifier()
-					return
-				}
+		}
 
-				log.Println(err)
-				peer.closed <- peer.GetUniqueIdentifier()
-				return
-			}
+		// packets only the server sends have no handler
+		if err := peer.handlers.Dispatch(packet); err != nil {
+			log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent unexpected packet: %s\n", err.Error())
+			peer.sendReply(REPLY_UNKNOWN_PACKET, "")
+		}
+	}
+}
 
-			packetBuf := make([]byte, newPacket.PacketLength)
-			currentPacketAmountOfBytes := uint64(0)
+// negotiatedCapabilities returns the capabilities of the connection to
+// goroutines other than the one reading packets.
+func (peer *Peer) negotiatedCapabilities() uint16 {
+	peer.capabilityLock.RLock()
+	defer peer.capabilityLock.RUnlock()
 
-			for {
+	return peer.capabilities
+}
 
-				readNowPacket, err := peer.conn.Read(packetBuf[currentPacketAmountOfBytes:])
+func (peer *Peer) requireAuthentication() bool {
+	if peer.authenticated == true {
+		return true
+	}
 
-				if err != nil {
-					if err == io.EOF {
-						peer.closed <- peer.GetUniqueIdentifier()
-						return
-					}
+	log.Printf("Peer on " + peer.conn.RemoteAddr().String() + " sent packet without authentication\n")
+	peer.sendReply(REPLY_NOT_AUTHENTICATED, "")
 
-					log.Println(err)
-					peer.closed <- peer.GetUniqueIdentifier()
-					return
-				}
+	return false
+}
 
-				currentPacketAmountOfBytes += uint64(readNowPacket)
-
-				if currentPacketAmountOfBytes < newPacket.PacketLength {
-					continue
-				} else {
-					currentPacketAmountOfBytes = 0
-
-					// we can decide which packet it is
-					switch newPacket.PacketType {
-					case HELLO:
-						helloPacket := HelloPacket{}
-						helloPacket.UnmarshalBinary(packetBuf)
-						peer.HandleHelloPacket(&helloPacket)
-						break
-
-					case LOGIN:
-						loginPacket := LoginPacket{}
-						loginPacket.UnmarshalBinary(packetBuf)
-						peer.HandleLoginPacket(&loginPacket)
-						break
-
-					case SHORT_FILE_METADATA:
-						if peer.authenticated == false {
-							// XXX: send error
-							log.Printf("Peer on " + peer.conn.RemoteAddr().String() + " sent packet without authentication\n")
-							break
-						}
-
-						sFMPPacket := ShortFileMetadataPacket{}
-						sFMPPacket.UnmarshalBinary(packetBuf)
-						peer.HandleShortFileMetadataPacketPacket(&sFMPPacket)
-						break
-					}
-
-					break
-				}
-			}
-		}
+func (peer *Peer) requireCapability(packetType uint16) bool {
+	requiredCapability := RequiredCapability(packetType)
 
+	if peer.capabilities&requiredCapability == requiredCapability {
+		return true
 	}
 
+	log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent packet type %d without negotiating capability %d\n", packetType, requiredCapability)
+	peer.sendReply(REPLY_CAPABILITY_MISSING, "")
+
+	return false
 }
 
 func (peer *Peer) HandleHelloPacket(helloPacket *HelloPacket) {
-	peer.version = helloPacket.Version
-	peer.capabilities = helloPacket.Capabilities
+	version, err := NegotiateVersion(helloPacket.Version)
 
-	log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent hello with capability: %d \n", peer.capabilities)
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent hello with unsupported version %d\n", helloPacket.Version)
+		peer.sendReply(REPLY_VERSION_UNSUPPORTED, "")
+		return
+	}
+
+	capabilities := NegotiateCapabilities(SUPPORTED_CAPABILITIES, helloPacket.Capabilities)
+
+	peer.version = version
+	peer.maxFrameLength = 0
+
+	if capabilities&CAPABILITY_FRAMING == CAPABILITY_FRAMING {
+		peer.maxFrameLength = NegotiateMaxFrameLength(DEFAULT_MAX_FRAME_LENGTH, helloPacket.MaxFrameLength)
+	}
+
+	// without a usable frame length packets are not split
+	if peer.maxFrameLength == 0 {
+		capabilities &^= CAPABILITY_FRAMING
+	}
+
+	// transfers running in their own goroutines read the capabilities
+	peer.capabilityLock.Lock()
+	peer.capabilities = capabilities
+	peer.capabilityLock.Unlock()
+
+	log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent hello, negotiated version %d with capability: %d \n", peer.version, peer.capabilities)
+
+	if err := peer.sendPacket(NewNegotiatedHelloPacket(peer.version, peer.capabilities, peer.maxFrameLength)); err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" could not be sent a hello: %s\n", err.Error())
+	}
+
+	// the hello is the last packet sent in one frame, later packets are laid
+	// out for the negotiated version
+	peer.codec.SetReadFrameLength(peer.maxFrameLength)
+	peer.codec.SetWriteFrameLength(peer.maxFrameLength)
+	peer.codec.SetReadVersion(peer.version)
+	peer.codec.SetWriteVersion(peer.version)
 }
 
 func (peer *Peer) HandleLoginPacket(loginPacket *LoginPacket) {
 	err := peer.db.Login(loginPacket.Username, loginPacket.Password)
 
 	if err != nil {
-		// XXX: send error
 		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" tried to authenticate for \"%s\" with error: %s\n", string(loginPacket.Username), err.Error())
+		peer.sendReply(REPLY_AUTH_FAILED, "")
 		return
 	}
 
 	peer.authenticated = true
 	peer.username = loginPacket.Username
+	peer.codec.SetReadPacketLength(MAX_PACKET_LENGTH)
 
 	log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" authenticated for \"%s\" \n", string(loginPacket.Username))
+	peer.sendReply(REPLY_OK, "")
+}
+
+func (peer *Peer) HandleRequestTokenPacket(requestTokenPacket *RequestTokenPacket) {
+	token, err := peer.db.GenerateToken(requestTokenPacket.Username, requestTokenPacket.Password, string(requestTokenPacket.Label))
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" requested a token for \"%s\" with error: %s\n", string(requestTokenPacket.Username), err.Error())
+		peer.sendReply(REPLY_AUTH_FAILED, "")
+		return
+	}
+
+	log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" received a token for \"%s\" labeled \"%s\" \n", string(requestTokenPacket.Username), string(requestTokenPacket.Label))
+
+	peer.sendToken(token)
+}
+
+// HandleTokenLoginPacket authenticates with a token. The peer answers with
+// its successor, which replaces the token once the client used it.
+func (peer *Peer) HandleTokenLoginPacket(tokenLoginPacket *TokenLoginPacket) {
+	newToken, err := peer.db.RotateToken(tokenLoginPacket.Username, tokenLoginPacket.Token)
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" tried to authenticate with a token for \"%s\" with error: %s\n", string(tokenLoginPacket.Username), err.Error())
+		peer.sendReply(REPLY_AUTH_FAILED, "")
+		return
+	}
+
+	peer.authenticated = true
+	peer.username = tokenLoginPacket.Username
+	peer.codec.SetReadPacketLength(MAX_PACKET_LENGTH)
+
+	log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" authenticated with a token for \"%s\" \n", string(tokenLoginPacket.Username))
+
+	peer.sendToken(newToken)
+}
+
+func (peer *Peer) sendToken(token []byte) {
+	tokenPacket, err := NewTokenPacket(token)
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" could not be sent a token: %s\n", err.Error())
+		peer.sendReply(REPLY_INTERNAL_ERROR, "")
+		return
+	}
+
+	if err := peer.sendPacket(tokenPacket); err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" could not be sent a token: %s\n", err.Error())
+	}
 }
 
 func (peer *Peer) HandleShortFileMetadataPacketPacket(shortFileMetadataPacket *ShortFileMetadataPacket) {
@@ -172,31 +354,744 @@ func (peer *Peer) HandleShortFileMetadataPacketPacket(shortFileMetadataPacket *S
 
 	if err != nil {
 		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" has error \"%s\" \n", err.Error())
+		peer.sendReply(REPLY_MALFORMED_PACKET, err.Error())
+		return
+	}
+
+	path, err := sync.NormalizePath(string(shortFileMetadataPacket.Path))
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent invalid path \"%s\" \n", string(shortFileMetadataPacket.Path))
+		peer.sendReply(REPLY_MALFORMED_PACKET, err.Error())
 		return
 	}
 
-	currentSFM, err := peer.db.RetrieveShortFileMetadata(peer.username)
+	currentSFM, err := peer.db.RetrieveShortFileMetadata(peer.username, path)
 
 	if err != nil || newSFM.ShouldOverwrite(currentSFM) == true {
-		// SFM not saved yet
-		peer.db.PutShortFileMetadata(peer.username, newSFM)
-		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent new metadata with file size %d and time %s\n", newSFM.FileSize, newSFM.LastChanged.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
-		go peer.RetrieveBlocks()
+		// SFM not saved yet, it is committed once all blocks arrived and the
+		// reply is sent when the transfer is done
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent new metadata for \"%s\" with file size %d and time %s\n", path, newSFM.FileSize, newSFM.LastChanged.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
+
+		go peer.retrieveFile(path, newSFM)
 		return
 	}
 
 	// stale metadata
 	if newSFM.Equals(currentSFM) == false {
-		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" has stale file with file size %d and time %s\n", newSFM.FileSize, newSFM.LastChanged.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" has stale file \"%s\" with file size %d and time %s\n", path, newSFM.FileSize, newSFM.LastChanged.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
+		peer.sendReply(REPLY_STALE_METADATA, "")
+		return
+	}
+
+	// blocks quarantined by a scrub are transferred again with the file
+	if peer.hasAllBlocks(path) == false {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent same metadata for \"%s\" with missing blocks, transferring it again\n", path)
+
+		go peer.retrieveFile(path, newSFM)
 		return
 	}
 
-	log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent same metadata with file size %d and time %s\n", newSFM.FileSize, newSFM.LastChanged.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
+	log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent same metadata for \"%s\" with file size %d and time %s\n", path, newSFM.FileSize, newSFM.LastChanged.Format("2006-01-02 15:04:05.999999999 -0700 MST"))
+	peer.sendReply(REPLY_OK, "")
 	return
 }
 
-func (peer *Peer) RetrieveBlocks() {
-	// Check which blocks we have
+// retrieveFile transfers the blocks of a file and replies once they are
+// committed.
+func (peer *Peer) retrieveFile(path string, newSFM *sync.ShortFileMetadata) {
+	if err := peer.RetrieveBlocks(path, newSFM); err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" failed to transfer blocks: %s\n", err.Error())
+
+		if err == TRANSFER_IN_PROGRESS {
+			peer.sendReply(REPLY_BUSY, "")
+			return
+		}
+
+		if errors.Is(err, sync.BLOCK_HASH_MISMATCH) == true || errors.Is(err, sync.INVALID_COMPRESSED_BLOCK) == true || errors.Is(err, sync.UNKNOWN_COMPRESSION) == true {
+			peer.sendReply(REPLY_BLOCK_CORRUPTED, err.Error())
+			return
+		}
+
+		if errors.Is(err, INVALID_METADATA) == true {
+			peer.sendReply(REPLY_MALFORMED_PACKET, err.Error())
+			return
+		}
+
+		// the client is told why its own reply ended the transfer
+		var replyError *ReplyError
+
+		if errors.As(err, &replyError) == true {
+			peer.sendReply(replyError.Code, replyError.Message)
+			return
+		}
+
+		peer.sendReply(REPLY_INTERNAL_ERROR, err.Error())
+		return
+	}
+
+	peer.sendReply(REPLY_OK, "")
+}
+
+// hasAllBlocks reports whether every block the stored metadata of a file
+// references is available.
+func (peer *Peer) hasAllBlocks(path string) bool {
+	eFM, err := peer.db.RetrieveExtendedFileMetadata(peer.username, path)
+
+	if err != nil {
+		return false
+	}
+
+	for _, strongHash := range eFM.StrongBlockHashes {
+		if peer.db.HasBlock(strongHash) == false {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (peer *Peer) HandleExtendedFileMetadataPacket(extendedFileMetadataPacket *ExtendedFileMetadataPacket) {
+	eFM, err := extendedFileMetadataPacket.GetData()
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent invalid extended metadata: %s\n", err.Error())
+	}
+
+	peer.deliverMetadata(&receivedMetadata{string(extendedFileMetadataPacket.Path), eFM, err})
+}
+
+func (peer *Peer) HandleChunkedFileMetadataPacket(chunkedFileMetadataPacket *ChunkedFileMetadataPacket) {
+	eFM, err := chunkedFileMetadataPacket.GetData()
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent invalid chunked metadata: %s\n", err.Error())
+	}
+
+	peer.deliverMetadata(&receivedMetadata{string(chunkedFileMetadataPacket.Path), eFM, err})
+}
+
+// deliverMetadata hands metadata to the running RetrieveBlocks, which fails
+// the transfer and replies if the metadata could not be read. Invalid
+// metadata nobody waits for is answered right away.
+func (peer *Peer) deliverMetadata(received *receivedMetadata) {
+	transfer := peer.currentTransfer()
+
+	if transfer == nil {
+		log.Printf("Peer on " + peer.conn.RemoteAddr().String() + " sent extended metadata that was not requested\n")
+
+		if received.err != nil {
+			peer.sendReply(REPLY_MALFORMED_PACKET, received.err.Error())
+		}
+
+		return
+	}
+
+	select {
+	case transfer.extendedMetadata <- received:
+	case <-transfer.done:
+	}
+}
+
+// HandleReplyPacket hands the reply of a client that could not answer a
+// request to the running transfer, which fails with it.
+func (peer *Peer) HandleReplyPacket(replyPacket *ReplyPacket) {
+	transfer := peer.currentTransfer()
+
+	if transfer == nil || replyPacket.Error() == nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent reply %d that was not expected\n", replyPacket.ErrorCode)
+		return
+	}
+
+	select {
+	case transfer.replies <- replyPacket:
+	case <-transfer.done:
+	}
+}
+
+// HandleBlockPacket hands an uncompressed block to the running transfer.
+func (peer *Peer) HandleBlockPacket(blockPacket *BlockPacket) {
+	compressedBlockPacket, err := NewCompressedBlockPacket(blockPacket.StrongChecksum, sync.COMPRESSION_NONE, blockPacket.Data)
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent a block that could not be handled: %s\n", err.Error())
+		peer.sendReply(REPLY_INTERNAL_ERROR, "")
+		return
+	}
+
+	peer.HandleCompressedBlockPacket(compressedBlockPacket)
+}
+
+func (peer *Peer) HandleCompressedBlockPacket(compressedBlockPacket *CompressedBlockPacket) {
+	transfer := peer.currentTransfer()
+
+	if transfer == nil {
+		log.Printf("Peer on " + peer.conn.RemoteAddr().String() + " sent block that was not requested\n")
+		return
+	}
+
+	select {
+	case transfer.blocks <- compressedBlockPacket:
+	case <-transfer.done:
+	}
+}
+
+func (peer *Peer) HandleRemoveFilePacket(removeFilePacket *RemoveFilePacket) {
+	path, err := sync.NormalizePath(string(removeFilePacket.Path))
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent invalid path \"%s\" \n", string(removeFilePacket.Path))
+		peer.sendReply(REPLY_MALFORMED_PACKET, err.Error())
+		return
+	}
+
+	if err := peer.db.RemoveFile(peer.username, path); err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" could not remove \"%s\": %s\n", path, err.Error())
+		peer.sendFileReply(err)
+		return
+	}
+
+	log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" removed \"%s\" \n", path)
+	peer.sendReply(REPLY_OK, "")
+}
+
+func (peer *Peer) HandleMoveFilePacket(moveFilePacket *MoveFilePacket) {
+	oldPath, err := sync.NormalizePath(string(moveFilePacket.OldPath))
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent invalid path \"%s\" \n", string(moveFilePacket.OldPath))
+		peer.sendReply(REPLY_MALFORMED_PACKET, err.Error())
+		return
+	}
+
+	newPath, err := sync.NormalizePath(string(moveFilePacket.NewPath))
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent invalid path \"%s\" \n", string(moveFilePacket.NewPath))
+		peer.sendReply(REPLY_MALFORMED_PACKET, err.Error())
+		return
+	}
+
+	if err := peer.db.MoveFile(peer.username, oldPath, newPath); err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" could not move \"%s\" to \"%s\": %s\n", oldPath, newPath, err.Error())
+		peer.sendFileReply(err)
+		return
+	}
+
+	log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" moved \"%s\" to \"%s\" \n", oldPath, newPath)
+	peer.sendReply(REPLY_OK, "")
+}
+
+// HandleRequestRestorePacket streams a stored file to the client: its short
+// metadata first, then every block in order, and a final reply.
+func (peer *Peer) HandleRequestRestorePacket(requestRestorePacket *RequestRestorePacket) {
+	path, err := sync.NormalizePath(string(requestRestorePacket.Path))
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent invalid path \"%s\" \n", string(requestRestorePacket.Path))
+		peer.sendReply(REPLY_MALFORMED_PACKET, err.Error())
+		return
+	}
+
+	sFM, err := peer.db.RetrieveShortFileMetadata(peer.username, path)
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" requested unavailable file \"%s\": %s\n", path, err.Error())
+		peer.sendFileReply(err)
+		return
+	}
+
+	eFM, err := peer.collector.PinMetadata(func() (*sync.ExtendedFileMetadata, error) {
+		return peer.db.RetrieveExtendedFileMetadata(peer.username, path)
+	})
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" requested unavailable file \"%s\": %s\n", path, err.Error())
+		peer.sendFileReply(err)
+		return
+	}
+
+	defer peer.collector.Unpin(eFM.StrongBlockHashes)
+
+	peer.sendFile(path, sFM, eFM)
+}
+
+func (peer *Peer) HandleRequestVersionsPacket(requestVersionsPacket *RequestVersionsPacket) {
+	path, err := sync.NormalizePath(string(requestVersionsPacket.Path))
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent invalid path \"%s\" \n", string(requestVersionsPacket.Path))
+		peer.sendReply(REPLY_MALFORMED_PACKET, err.Error())
+		return
+	}
+
+	versions, err := peer.db.ListVersions(peer.username, path)
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" requested versions of unavailable file \"%s\": %s\n", path, err.Error())
+		peer.sendFileReply(err)
+		return
+	}
+
+	versionsPacket, err := NewVersionsPacket(path, versions)
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" could not be sent versions: %s\n", err.Error())
+		peer.sendReply(REPLY_INTERNAL_ERROR, "")
+		return
+	}
+
+	if err := peer.sendPacket(versionsPacket); err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" could not be sent versions: %s\n", err.Error())
+	}
+}
+
+func (peer *Peer) HandleRequestVersionRestorePacket(requestVersionRestorePacket *RequestVersionRestorePacket) {
+	path, err := sync.NormalizePath(string(requestVersionRestorePacket.Path))
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent invalid path \"%s\" \n", string(requestVersionRestorePacket.Path))
+		peer.sendReply(REPLY_MALFORMED_PACKET, err.Error())
+		return
+	}
+
+	var version *db.FileVersion
+
+	if requestVersionRestorePacket.VersionID != 0 {
+		version, err = peer.db.RetrieveVersion(peer.username, path, requestVersionRestorePacket.VersionID)
+	} else {
+		version, err = peer.db.RetrieveVersionAt(peer.username, path, requestVersionRestorePacket.GetStoredBefore())
+	}
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" requested unavailable version of \"%s\": %s\n", path, err.Error())
+		peer.sendFileReply(err)
+		return
+	}
+
+	eFM, err := peer.collector.PinMetadata(func() (*sync.ExtendedFileMetadata, error) {
+		return peer.db.RetrieveVersionExtendedMetadata(peer.username, path, version.ID)
+	})
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" requested unavailable version of \"%s\": %s\n", path, err.Error())
+		peer.sendFileReply(err)
+		return
+	}
+
+	defer peer.collector.Unpin(eFM.StrongBlockHashes)
+
+	peer.sendFile(path, version.Metadata, eFM)
+}
+
+// sendFile answers a restore with the metadata of the file, all of its
+// blocks in order and a final reply. The blocks have to be pinned.
+func (peer *Peer) sendFile(path string, sFM *sync.ShortFileMetadata, eFM *sync.ExtendedFileMetadata) {
+	shortFileMetadataPacket, err := NewShortFileMetaDataPacket(path, sFM)
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" could not be sent metadata: %s\n", err.Error())
+		peer.sendReply(REPLY_INTERNAL_ERROR, "")
+		return
+	}
+
+	if err := peer.sendPacket(shortFileMetadataPacket); err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" could not be sent metadata: %s\n", err.Error())
+		return
+	}
+
+	for _, strongHash := range eFM.StrongBlockHashes {
+		if err := peer.sendBlock(strongHash); err != nil {
+			log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" could not be sent a block of \"%s\": %s\n", path, err.Error())
+			peer.sendReply(REPLY_INTERNAL_ERROR, "")
+			return
+		}
+	}
+
+	log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" restored \"%s\" with %d blocks\n", path, len(eFM.StrongBlockHashes))
+	peer.sendReply(REPLY_OK, "")
+}
+
+// HandleRequestDeltaRestorePacket reassembles the stored file and sends the
+// librsync delta from the client's copy described by the signature to it.
+func (peer *Peer) HandleRequestDeltaRestorePacket(requestDeltaRestorePacket *RequestDeltaRestorePacket) {
+	path, err := sync.NormalizePath(string(requestDeltaRestorePacket.Path))
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" sent invalid path \"%s\" \n", string(requestDeltaRestorePacket.Path))
+		peer.sendReply(REPLY_MALFORMED_PACKET, err.Error())
+		return
+	}
+
+	signature, err := requestDeltaRestorePacket.GetSignature()
+
+	if err != nil || signature.BlockLength == 0 {
+		log.Printf("Peer on " + peer.conn.RemoteAddr().String() + " sent an invalid signature\n")
+		peer.sendReply(REPLY_MALFORMED_PACKET, "")
+		return
+	}
+
+	sFM, err := peer.db.RetrieveShortFileMetadata(peer.username, path)
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" requested unavailable file \"%s\": %s\n", path, err.Error())
+		peer.sendFileReply(err)
+		return
+	}
+
+	eFM, err := peer.collector.PinMetadata(func() (*sync.ExtendedFileMetadata, error) {
+		return peer.db.RetrieveExtendedFileMetadata(peer.username, path)
+	})
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" requested unavailable file \"%s\": %s\n", path, err.Error())
+		peer.sendFileReply(err)
+		return
+	}
+
+	defer peer.collector.Unpin(eFM.StrongBlockHashes)
+
+	blockFile, err := db.NewBlockFile(eFM, peer.db)
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" requested \"%s\" with missing blocks: %s\n", path, err.Error())
+		peer.sendReply(REPLY_INTERNAL_ERROR, "")
+		return
+	}
+
+	shortFileMetadataPacket, err := NewShortFileMetaDataPacket(path, sFM)
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" could not be sent metadata: %s\n", err.Error())
+		peer.sendReply(REPLY_INTERNAL_ERROR, "")
+		return
+	}
+
+	if err := peer.sendPacket(shortFileMetadataPacket); err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" could not be sent metadata: %s\n", err.Error())
+		return
+	}
+
+	deltaWriter := bufio.NewWriterSize(&deltaPacketWriter{peer}, DEFAULT_BLOCK_LENGTH)
+
+	err = sync.Delta(signature, blockFile, deltaWriter)
+
+	if err == nil {
+		err = deltaWriter.Flush()
+	}
+
+	if err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" could not be sent the delta of \"%s\": %s\n", path, err.Error())
+		peer.sendReply(REPLY_INTERNAL_ERROR, "")
+		return
+	}
+
+	log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" restored \"%s\" with a delta\n", path)
+	peer.sendReply(REPLY_OK, "")
+}
+
+// deltaPacketWriter sends everything written to it as DeltaPackets of at
+// most DEFAULT_BLOCK_LENGTH bytes.
+type deltaPacketWriter struct {
+	peer *Peer
+}
+
+func (dPW *deltaPacketWriter) Write(data []byte) (int, error) {
+	written := 0
+
+	for written < len(data) {
+		chunkLength := len(data) - written
+
+		if chunkLength > DEFAULT_BLOCK_LENGTH {
+			chunkLength = DEFAULT_BLOCK_LENGTH
+		}
+
+		if err := dPW.peer.sendPacket(NewDeltaPacket(data[written : written+chunkLength])); err != nil {
+			return written, err
+		}
+
+		written += chunkLength
+	}
+
+	return written, nil
+}
+
+// sendBlock sends a block the way it is stored if the client understands
+// compressed blocks, compressing blocks that are stored uncompressed.
+func (peer *Peer) sendBlock(strongHash []byte) error {
+	if peer.capabilities&CAPABILITY_COMPRESSION == CAPABILITY_COMPRESSION {
+		compression, data, err := peer.db.RetrieveStoredBlock(strongHash)
+
+		if err != nil {
+			return err
+		}
+
+		if compression == sync.COMPRESSION_NONE {
+			compression, data = sync.CompressBlock(data)
+		}
+
+		if compression != sync.COMPRESSION_NONE {
+			compressedBlockPacket, err := NewCompressedBlockPacket(strongHash, compression, data)
+
+			if err != nil {
+				return err
+			}
+
+			return peer.sendPacket(compressedBlockPacket)
+		}
+	}
+
+	blockReader, err := peer.db.RetrieveBlock(strongHash)
+
+	if err != nil {
+		return err
+	}
+
+	block, err := ioutil.ReadAll(blockReader)
+
+	if err != nil {
+		return err
+	}
+
+	blockPacket, err := NewBlockPacket(strongHash, block)
+
+	if err != nil {
+		return err
+	}
+
+	return peer.sendPacket(blockPacket)
+}
+
+// sendFileReply answers a failed file operation, telling missing files
+// apart from database errors.
+func (peer *Peer) sendFileReply(err error) {
+	if err == db.FILE_NOT_AVAILABLE {
+		peer.sendReply(REPLY_FILE_NOT_AVAILABLE, "")
+		return
+	}
+
+	if err == db.VERSION_NOT_AVAILABLE {
+		peer.sendReply(REPLY_FILE_VERSION_NOT_AVAILABLE, "")
+		return
+	}
+
+	peer.sendReply(REPLY_INTERNAL_ERROR, "")
+}
+
+// RetrieveBlocks pulls the extended metadata of the file at path described by
+// newSFM from the client, requests every block the database does not have yet
+// and commits the metadata once all of them are stored.
+func (peer *Peer) RetrieveBlocks(path string, newSFM *sync.ShortFileMetadata) error {
+	transfer, err := peer.beginTransfer()
+
+	if err != nil {
+		return err
+	}
+
+	defer peer.endTransfer(transfer)
+
+	// a hello arriving during the transfer does not change how it is done
+	capabilities := peer.negotiatedCapabilities()
+
+	// content defined chunks keep unchanged parts of a file deduplicated
+	// when bytes are inserted or removed before them
+	chunkLengths := DEFAULT_CHUNK_LENGTHS
+
+	var requestPacket EncapsulatablePacket
+
+	if capabilities&CAPABILITY_CHUNKING == CAPABILITY_CHUNKING {
+		requestPacket, err = NewRequestChunkedFileMetadataPacket(path, chunkLengths, DEFAULT_STRONG_CHECKSUM_LENGTH)
+	} else {
+		requestPacket, err = NewRequestExtendedFileMetadataPacket(path, DEFAULT_BLOCK_LENGTH, DEFAULT_STRONG_CHECKSUM_LENGTH)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := peer.sendPacket(requestPacket); err != nil {
+		return err
+	}
+
+	var received *receivedMetadata
+
+	select {
+	case received = <-transfer.extendedMetadata:
+	case replyPacket := <-transfer.replies:
+		return fmt.Errorf("Extended metadata of \"%s\" is not available: %w", path, replyPacket.Error())
+	case <-time.After(TRANSFER_TIMEOUT):
+		return errors.New("Extended metadata did not arrive in time.")
+	}
+
+	if received.err != nil {
+		return fmt.Errorf("%w: %s", INVALID_METADATA, received.err.Error())
+	}
+
+	newEFM := received.metadata
+
+	// the client may send the path in another form than it was requested
+	receivedPath, err := sync.NormalizePath(received.path)
+
+	if err != nil || receivedPath != path {
+		return fmt.Errorf("%w: it is for \"%s\", but \"%s\" was requested", INVALID_METADATA, received.path, path)
+	}
+
+	if newEFM.IsChunked() == true {
+		if err := newEFM.CheckChunks(chunkLengths); err != nil {
+			return fmt.Errorf("%w: %s", INVALID_METADATA, err.Error())
+		}
+	} else {
+		// metadata that does not cover the file would store a version that
+		// can not be restored completely
+		if err := newEFM.CheckFixedBlocks(); err != nil {
+			return fmt.Errorf("%w: %s", INVALID_METADATA, err.Error())
+		}
+	}
+
+	if newEFM.FileSize != newSFM.FileSize {
+		return fmt.Errorf("%w: it has file size %d, but %d was announced", INVALID_METADATA, newEFM.FileSize, newSFM.FileSize)
+	}
+
+	// shorter hashes would make it easy to store a block under the hash of
+	// another one
+	for _, strongHash := range newEFM.StrongBlockHashes {
+		if len(strongHash) != DEFAULT_STRONG_CHECKSUM_LENGTH {
+			return fmt.Errorf("%w: it has a strong hash of %d bytes, but %d were requested", INVALID_METADATA, len(strongHash), DEFAULT_STRONG_CHECKSUM_LENGTH)
+		}
+	}
+
+	// Check which blocks we have, protecting them from collection until the
+	// metadata referencing them is committed
+	peer.collector.Pin(newEFM.StrongBlockHashes)
+	defer peer.collector.Unpin(newEFM.StrongBlockHashes)
+
+	missingBlocks := make([][]byte, 0)
+	seenBlocks := make(map[string]bool)
+
+	for _, strongHash := range newEFM.StrongBlockHashes {
+		if seenBlocks[string(strongHash)] == true {
+			continue
+		}
+
+		seenBlocks[string(strongHash)] = true
+
+		if peer.db.HasBlock(strongHash) == false {
+			missingBlocks = append(missingBlocks, strongHash)
+		}
+	}
+
+	// Request the missing ones, keeping only a few requests in flight so
+	// neither side blocks on a full connection
+	pendingBlocks := make(map[string]bool)
+	requested := 0
+
+	for requested < len(missingBlocks) && requested < MAX_OUTSTANDING_BLOCK_REQUESTS {
+		if err := peer.requestBlock(path, missingBlocks[requested]); err != nil {
+			return err
+		}
+
+		pendingBlocks[string(missingBlocks[requested])] = true
+		requested += 1
+	}
+
+	for len(pendingBlocks) > 0 {
+		select {
+		case compressedBlockPacket := <-transfer.blocks:
+			if pendingBlocks[string(compressedBlockPacket.StrongChecksum)] == false {
+				log.Printf("Peer on " + peer.conn.RemoteAddr().String() + " sent block that was not requested\n")
+				continue
+			}
+
+			// the hash is chosen by the client, so the block is only
+			// stored under it if it really matches
+			blockPacket, err := compressedBlockPacket.Decompress()
+
+			if err != nil {
+				return fmt.Errorf("Block %x of \"%s\" was rejected: %w", compressedBlockPacket.StrongChecksum, path, err)
+			}
+
+			if err := sync.VerifyBlock(blockPacket.Data, blockPacket.StrongChecksum); err != nil {
+				return fmt.Errorf("Block %x of \"%s\" was rejected: %w", blockPacket.StrongChecksum, path, err)
+			}
+
+			// blocks are stored the way the client compressed them
+			if err := peer.db.PutStoredBlock(compressedBlockPacket.StrongChecksum, compressedBlockPacket.Compression, compressedBlockPacket.Data); err != nil {
+				return err
+			}
+
+			delete(pendingBlocks, string(compressedBlockPacket.StrongChecksum))
+
+			if requested < len(missingBlocks) {
+				if err := peer.requestBlock(path, missingBlocks[requested]); err != nil {
+					return err
+				}
+
+				pendingBlocks[string(missingBlocks[requested])] = true
+				requested += 1
+			}
+
+		case replyPacket := <-transfer.replies:
+			return fmt.Errorf("Blocks of \"%s\" are not available: %w", path, replyPacket.Error())
+
+		case <-time.After(TRANSFER_TIMEOUT):
+			return fmt.Errorf("%d requested blocks did not arrive in time.", len(pendingBlocks)+len(missingBlocks)-requested)
+		}
+	}
+
+	// All blocks are stored, now the new version can be committed
+	if _, err := peer.db.PutFileVersion(peer.username, path, newSFM, newEFM); err != nil {
+		return err
+	}
+
+	log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" transferred %d of %d blocks for \"%s\"\n", len(missingBlocks), newEFM.BlockAmount, path)
+
+	return nil
+}
+
+func (peer *Peer) requestBlock(path string, strongHash []byte) error {
+	requestBlockPacket, err := NewRequestBlockPacket(path, strongHash)
+
+	if err != nil {
+		return err
+	}
+
+	return peer.sendPacket(requestBlockPacket)
+}
+
+func (peer *Peer) beginTransfer() (*blockTransfer, error) {
+	peer.transferLock.Lock()
+	defer peer.transferLock.Unlock()
+
+	if peer.transfer != nil {
+		return nil, TRANSFER_IN_PROGRESS
+	}
+
+	peer.transfer = newBlockTransfer()
+
+	return peer.transfer, nil
+}
+
+func (peer *Peer) endTransfer(transfer *blockTransfer) {
+	peer.transferLock.Lock()
+	defer peer.transferLock.Unlock()
+
+	close(transfer.done)
+	peer.transfer = nil
+}
+
+func (peer *Peer) currentTransfer() *blockTransfer {
+	peer.transferLock.Lock()
+	defer peer.transferLock.Unlock()
+
+	return peer.transfer
+}
+
+func (peer *Peer) sendReply(code uint16, message string) {
+	if err := peer.sendPacket(NewReplyPacket(code, message)); err != nil {
+		log.Printf("Peer on "+peer.conn.RemoteAddr().String()+" could not be sent a reply: %s\n", err.Error())
+	}
+}
 
-	// Send them to the client
+func (peer *Peer) sendPacket(packetToSend EncapsulatablePacket) error {
+	return peer.codec.WritePacket(packetToSend)
 }
@@ -5,6 +5,8 @@ import (
 	"encoding/hex"
 	"log"
 	"net"
+	gosync "sync"
+	"time"
 
 	"github.com/FBreuer2/simple-sync/lib/db"
 	"golang.org/x/crypto/sha3"
@@ -16,21 +18,30 @@ type ServerContext struct {
 	cert            tls.Certificate
 	shouldStop      chan bool
 	closed          chan string
+	accepted        chan net.Conn
 	acceptingServer net.Listener
 	peerList        map[string]*Peer
+	stopMaintenance chan bool
+	handlers        map[uint16]PeerHandler
+	handlersLock    gosync.Mutex
 
-	db db.FullDatabase
+	db        db.FullDatabase
+	collector *db.BlockCollector
 }
 
-func NewServer(interfaceToBind string, port string, cert tls.Certificate, db db.FullDatabase) (*ServerContext, error) {
+func NewServer(interfaceToBind string, port string, cert tls.Certificate, database db.FullDatabase) (*ServerContext, error) {
 	newServerContext := &ServerContext{
 		interfaceToBind: interfaceToBind,
 		port:            port,
 		cert:            cert,
 		shouldStop:      make(chan bool),
 		closed:          make(chan string),
+		accepted:        make(chan net.Conn),
 		peerList:        make(map[string]*Peer),
-		db:              db,
+		stopMaintenance: make(chan bool),
+		handlers:        make(map[uint16]PeerHandler),
+		db:              database,
+		collector:       db.NewBlockCollector(database),
 	}
 
 	return newServerContext, nil
@@ -68,19 +79,108 @@ func (srv *ServerContext) Start() error {
 	return nil
 }
 
+// PeerHandler handles a packet an authenticated peer sent.
+type PeerHandler func(peer *Peer, packet EncapsulatablePacket)
+
+// Handle registers handler for packets of packetType from peers that
+// connect afterwards, so extensions can add packets without changing the
+// peer. The packet type has to be registered with RegisterPacket.
+func (srv *ServerContext) Handle(packetType uint16, handler PeerHandler) {
+	srv.handlersLock.Lock()
+	defer srv.handlersLock.Unlock()
+
+	srv.handlers[packetType] = handler
+}
+
 func (srv *ServerContext) Stop() {
 	srv.shouldStop <- true
 }
 
+// Collector returns the block collector of the server, which is used to
+// configure the retention policies.
+func (srv *ServerContext) Collector() *db.BlockCollector {
+	return srv.collector
+}
+
+// CollectEvery applies the retention policies and collects unreferenced
+// blocks in the given interval until the server is stopped. Peers keep
+// working during a collection.
+func (srv *ServerContext) CollectEvery(interval time.Duration) {
+	srv.runEvery(interval, func() {
+		stats, err := srv.collector.Collect(time.Now())
+
+		if err != nil {
+			log.Printf("Collection failed: %s\n", err.Error())
+			return
+		}
+
+		log.Printf("Collection removed %d versions and %d blocks, kept %d blocks.\n", stats.RemovedVersions, stats.RemovedBlocks, stats.KeptBlocks)
+
+		if dedupStats, err := srv.db.DedupStats(); err == nil {
+			log.Printf("Versions of %d bytes are stored in %d blocks of %d bytes, a deduplication ratio of %.2f.\n", dedupStats.LogicalBytes, dedupStats.Blocks, dedupStats.PhysicalBytes, dedupStats.Ratio())
+		}
+	})
+}
+
+// ScrubEvery re-hashes all stored blocks in the given interval until the
+// server is stopped and quarantines corrupted ones, see db.Scrub.
+func (srv *ServerContext) ScrubEvery(interval time.Duration) {
+	srv.runEvery(interval, func() {
+		report, err := db.Scrub(srv.db)
+
+		if err != nil {
+			log.Printf("Scrub failed: %s\n", err.Error())
+			return
+		}
+
+		for _, hash := range report.CorruptedBlocks {
+			log.Printf("Scrub quarantined corrupted block %x.\n", hash)
+		}
+
+		for _, damagedVersion := range report.DamagedVersions {
+			log.Printf("Scrub found version %d of \"%s\" of \"%s\" damaged until it is uploaded again.\n", damagedVersion.Version.ID, damagedVersion.Path, string(damagedVersion.User))
+		}
+
+		log.Printf("Scrub checked %d blocks, %d were corrupted.\n", report.CheckedBlocks, len(report.CorruptedBlocks))
+	})
+}
+
+// runEvery runs task in the given interval until the server is stopped.
+func (srv *ServerContext) runEvery(interval time.Duration, task func()) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				task()
+			case <-srv.stopMaintenance:
+				return
+			}
+		}
+	}()
+}
+
 func (srv *ServerContext) mainLoop() {
 	log.Println("Started main loop.")
 
 	go srv.runAccept()
 
+	// peerList is only touched by this goroutine
 	for {
 		select {
+		case newConnection := <-srv.accepted:
+			srv.newClient(newConnection)
+			break
 		case peerID := <-srv.closed:
-			srv.peerList[peerID] = nil
+			// stopping the peer closes its connection, which is still open
+			// when the peer gave up on a malformed packet
+			if peer := srv.peerList[peerID]; peer != nil {
+				peer.Stop()
+			}
+
+			delete(srv.peerList, peerID)
 			log.Println("Peer with id " + peerID + " disconnected.")
 			break
 		case <-srv.shouldStop:
@@ -88,6 +188,7 @@ func (srv *ServerContext) mainLoop() {
 				peer.Stop()
 			}
 
+			close(srv.stopMaintenance)
 			srv.acceptingServer.Close()
 			return
 		}
@@ -103,12 +204,12 @@ func (srv *ServerContext) runAccept() {
 			continue
 		}
 
-		srv.newClient(conn)
+		srv.accepted <- conn
 	}
 }
 
 func (srv *ServerContext) newClient(newClient net.Conn) {
-	newPeer := NewPeer(newClient, srv.closed, srv.db)
+	newPeer := NewPeer(newClient, srv.closed, srv.db, srv.collector)
 
 	exists := srv.peerList[newPeer.GetUniqueIdentifier()]
 
@@ -117,6 +218,18 @@ func (srv *ServerContext) newClient(newClient net.Conn) {
 		return
 	}
 
+	srv.handlersLock.Lock()
+
+	for packetType, handler := range srv.handlers {
+		handler := handler
+
+		newPeer.HandleAuthenticated(packetType, func(packet EncapsulatablePacket) {
+			handler(newPeer, packet)
+		})
+	}
+
+	srv.handlersLock.Unlock()
+
 	srv.peerList[newPeer.GetUniqueIdentifier()] = newPeer
 	go newPeer.Start()
 }
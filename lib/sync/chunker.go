@@ -0,0 +1,176 @@
+package sync
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/FBreuer2/librsync-go"
+)
+
+var INVALID_CHUNK_LENGTHS = errors.New("Chunk lengths have to satisfy 0 < minimum < average <= maximum.")
+var INVALID_CHUNKS = errors.New("Chunks do not describe the file.")
+
+// ChunkLengths configures content defined chunking. Chunks are at least
+// Minimum and at most Maximum bytes long and Average bytes long on average,
+// unless Maximum cuts them.
+type ChunkLengths struct {
+	Minimum uint32
+	Average uint32
+	Maximum uint32
+}
+
+func (cL ChunkLengths) Validate() error {
+	if cL.Minimum == 0 || cL.Minimum >= cL.Average || cL.Average > cL.Maximum {
+		return INVALID_CHUNK_LENGTHS
+	}
+
+	return nil
+}
+
+// gearTable maps every byte to a random value for the gear hash. It has to
+// stay the same forever, otherwise the chunks of unchanged files change and
+// are not deduplicated anymore.
+var gearTable = newGearTable(0x73696d706c652d73)
+
+// newGearTable fills the table with splitmix64 from the given seed.
+func newGearTable(seed uint64) [256]uint64 {
+	var table [256]uint64
+
+	for index := range table {
+		seed += 0x9e3779b97f4a7c15
+		value := seed
+		value = (value ^ (value >> 30)) * 0xbf58476d1ce4e5b9
+		value = (value ^ (value >> 27)) * 0x94d049bb133111eb
+		table[index] = value ^ (value >> 31)
+	}
+
+	return table
+}
+
+// Chunker splits a stream at positions chosen by its content, so inserting
+// or removing bytes only changes the chunks around the edit. A chunk ends
+// where the gear hash of the last 64 bytes falls below a threshold, which
+// happens on average every Average-Minimum bytes after Minimum.
+type Chunker struct {
+	input     *bufio.Reader
+	lengths   ChunkLengths
+	threshold uint64
+}
+
+func NewChunker(input io.Reader, lengths ChunkLengths) (*Chunker, error) {
+	if err := lengths.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &Chunker{
+		input:     bufio.NewReader(input),
+		lengths:   lengths,
+		threshold: math.MaxUint64 / uint64(lengths.Average-lengths.Minimum),
+	}, nil
+}
+
+// Next returns the next chunk, or io.EOF after the last one.
+func (chunker *Chunker) Next() ([]byte, error) {
+	chunk := make([]byte, 0, chunker.lengths.Average)
+	hash := uint64(0)
+
+	for uint32(len(chunk)) < chunker.lengths.Maximum {
+		nextByte, err := chunker.input.ReadByte()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		chunk = append(chunk, nextByte)
+		hash = (hash << 1) + gearTable[nextByte]
+
+		if uint32(len(chunk)) >= chunker.lengths.Minimum && hash < chunker.threshold {
+			break
+		}
+	}
+
+	if len(chunk) == 0 {
+		return nil, io.EOF
+	}
+
+	return chunk, nil
+}
+
+// ChunkFile computes the metadata of input split into content defined
+// chunks. The metadata has no BlockLength, BlockLengths holds the length of
+// every chunk instead.
+func ChunkFile(input io.Reader, lengths ChunkLengths, strongChecksumLength uint32) (*ExtendedFileMetadata, error) {
+	chunker, err := NewChunker(input, lengths)
+
+	if err != nil {
+		return nil, err
+	}
+
+	eFM := &ExtendedFileMetadata{
+		StrongChecksumLength: strongChecksumLength,
+		WeakBlockSums:        make([]uint32, 0),
+		WeakBlockHashes:      make(map[uint32]int64),
+		StrongBlockHashes:    make([][]byte, 0),
+		BlockLengths:         make([]uint32, 0),
+	}
+
+	for {
+		chunk, err := chunker.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		strongHash, err := librsync.CalcStrongSum(chunk, librsync.BLAKE2_SIG_MAGIC, strongChecksumLength)
+
+		if err != nil {
+			return nil, err
+		}
+
+		weakBlockSum := librsync.WeakChecksum(chunk)
+
+		eFM.WeakBlockHashes[weakBlockSum] = int64(len(eFM.StrongBlockHashes))
+		eFM.WeakBlockSums = append(eFM.WeakBlockSums, weakBlockSum)
+		eFM.StrongBlockHashes = append(eFM.StrongBlockHashes, strongHash)
+		eFM.BlockLengths = append(eFM.BlockLengths, uint32(len(chunk)))
+		eFM.FileSize += uint64(len(chunk))
+	}
+
+	eFM.BlockAmount = uint64(len(eFM.StrongBlockHashes))
+
+	return eFM, nil
+}
+
+// CheckChunks verifies that the chunk lengths of the metadata fit the given
+// lengths and add up to the file size.
+func (eFM *ExtendedFileMetadata) CheckChunks(lengths ChunkLengths) error {
+	if len(eFM.BlockLengths) != len(eFM.StrongBlockHashes) || uint64(len(eFM.BlockLengths)) != eFM.BlockAmount {
+		return INVALID_CHUNKS
+	}
+
+	fileSize := uint64(0)
+
+	for _, blockLength := range eFM.BlockLengths {
+		if blockLength == 0 || blockLength > lengths.Maximum {
+			return INVALID_CHUNKS
+		}
+
+		fileSize += uint64(blockLength)
+	}
+
+	if fileSize != eFM.FileSize {
+		return INVALID_CHUNKS
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package sync
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	gosync "sync"
+)
+
+var UNKNOWN_COMPRESSION = errors.New("Block is compressed with an unknown algorithm.")
+var INVALID_COMPRESSED_BLOCK = errors.New("Compressed block is invalid or too long.")
+
+// Compression algorithms of blocks. The values are sent on the wire and
+// stored, so they must not change.
+const (
+	COMPRESSION_NONE    = 0
+	COMPRESSION_DEFLATE = 1
+)
+
+// deflateWriters are reused, every writer allocates its tables once.
+var deflateWriters = gosync.Pool{
+	New: func() interface{} {
+		writer, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return writer
+	},
+}
+
+// CompressBlock compresses the block with deflate. Blocks that do not get
+// smaller, like encrypted ones, are returned as they are with
+// COMPRESSION_NONE.
+func CompressBlock(block []byte) (uint8, []byte) {
+	var compressedBlock bytes.Buffer
+
+	writer := deflateWriters.Get().(*flate.Writer)
+	defer deflateWriters.Put(writer)
+
+	writer.Reset(&compressedBlock)
+
+	if _, err := writer.Write(block); err != nil {
+		return COMPRESSION_NONE, block
+	}
+
+	if err := writer.Close(); err != nil || compressedBlock.Len() >= len(block) {
+		return COMPRESSION_NONE, block
+	}
+
+	return COMPRESSION_DEFLATE, compressedBlock.Bytes()
+}
+
+// DecompressBlock reverses CompressBlock. It stops once the block would get
+// longer than maxLength, so a small compressed block can not exhaust the
+// memory.
+func DecompressBlock(compression uint8, data []byte, maxLength int) ([]byte, error) {
+	switch compression {
+	case COMPRESSION_NONE:
+		if len(data) > maxLength {
+			return nil, INVALID_COMPRESSED_BLOCK
+		}
+
+		return data, nil
+
+	case COMPRESSION_DEFLATE:
+		reader := flate.NewReader(bytes.NewReader(data))
+		defer reader.Close()
+
+		block, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxLength)+1))
+
+		if err != nil || len(block) > maxLength {
+			return nil, INVALID_COMPRESSED_BLOCK
+		}
+
+		return block, nil
+	}
+
+	return nil, UNKNOWN_COMPRESSION
+}
@@ -0,0 +1,207 @@
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/FBreuer2/librsync-go"
+)
+
+var INVALID_SIGNATURE = errors.New("Signature has no block length.")
+
+// Delta writes a librsync delta that turns the file described by signature
+// into the content of input, so it can be applied with librsync.Patch. The
+// signature is the metadata of the basis file as computed by
+// GetCompleteFileInformation, blocks of the basis are found with a rolling
+// weak checksum and confirmed with the strong one.
+func Delta(signature *ExtendedFileMetadata, input io.Reader, output io.Writer) error {
+	if signature.BlockLength == 0 {
+		return INVALID_SIGNATURE
+	}
+
+	if err := binary.Write(output, binary.BigEndian, librsync.DELTA_MAGIC); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(input)
+	blockLength := int(signature.BlockLength)
+	window := make([]byte, 0, 2*blockLength)
+	weakSum := librsync.NewRollsum()
+	encoder := &deltaEncoder{output: output, literal: make([]byte, 0, blockLength), maxLiteral: blockLength}
+
+	for {
+		nextByte, err := reader.ReadByte()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if len(window) == blockLength {
+			// the window moves on by one byte, which becomes a literal
+			if err := encoder.addLiteral(window[0]); err != nil {
+				return err
+			}
+
+			weakSum.Rotate(window[0], nextByte)
+			window = append(window[1:], nextByte)
+		} else {
+			weakSum.Rollin(nextByte)
+			window = append(window, nextByte)
+		}
+
+		if len(window) < blockLength {
+			continue
+		}
+
+		if blockIndex, found := findBlock(signature, weakSum.Digest(), window); found == true {
+			if err := encoder.addCopy(uint64(blockIndex)*uint64(blockLength), uint64(len(window))); err != nil {
+				return err
+			}
+
+			window = window[:0]
+			weakSum.Reset()
+		}
+	}
+
+	// the last block of the basis may be shorter than the block length
+	if len(window) > 0 {
+		if blockIndex, found := findBlock(signature, librsync.WeakChecksum(window), window); found == true {
+			if err := encoder.addCopy(uint64(blockIndex)*uint64(blockLength), uint64(len(window))); err != nil {
+				return err
+			}
+
+			window = window[:0]
+		}
+	}
+
+	for _, remainingByte := range window {
+		if err := encoder.addLiteral(remainingByte); err != nil {
+			return err
+		}
+	}
+
+	if err := encoder.flush(); err != nil {
+		return err
+	}
+
+	return binary.Write(output, binary.BigEndian, librsync.OP_END)
+}
+
+func findBlock(signature *ExtendedFileMetadata, weakHash uint32, window []byte) (int64, bool) {
+	blockIndex, found := signature.WeakBlockHashes[weakHash]
+
+	if found == false || blockIndex < 0 || blockIndex >= int64(len(signature.StrongBlockHashes)) {
+		return 0, false
+	}
+
+	strongHash, err := librsync.CalcStrongSum(window, librsync.BLAKE2_SIG_MAGIC, signature.StrongChecksumLength)
+
+	if err != nil || bytes.Equal(strongHash, signature.StrongBlockHashes[blockIndex]) == false {
+		return 0, false
+	}
+
+	return blockIndex, true
+}
+
+// deltaEncoder collects literal bytes and merges copies of consecutive
+// blocks, so they are written as few commands as possible.
+type deltaEncoder struct {
+	output       io.Writer
+	literal      []byte
+	maxLiteral   int
+	copyPosition uint64
+	copyLength   uint64
+}
+
+func (dE *deltaEncoder) addLiteral(literalByte byte) error {
+	if err := dE.flushCopy(); err != nil {
+		return err
+	}
+
+	dE.literal = append(dE.literal, literalByte)
+
+	if len(dE.literal) >= dE.maxLiteral {
+		return dE.flushLiteral()
+	}
+
+	return nil
+}
+
+func (dE *deltaEncoder) addCopy(position uint64, length uint64) error {
+	if err := dE.flushLiteral(); err != nil {
+		return err
+	}
+
+	if dE.copyLength > 0 && dE.copyPosition+dE.copyLength == position {
+		dE.copyLength += length
+		return nil
+	}
+
+	if err := dE.flushCopy(); err != nil {
+		return err
+	}
+
+	dE.copyPosition = position
+	dE.copyLength = length
+
+	return nil
+}
+
+func (dE *deltaEncoder) flush() error {
+	if err := dE.flushLiteral(); err != nil {
+		return err
+	}
+
+	return dE.flushCopy()
+}
+
+func (dE *deltaEncoder) flushLiteral() error {
+	if len(dE.literal) == 0 {
+		return nil
+	}
+
+	if err := binary.Write(dE.output, binary.BigEndian, librsync.OP_LITERAL_N8); err != nil {
+		return err
+	}
+
+	if err := binary.Write(dE.output, binary.BigEndian, uint64(len(dE.literal))); err != nil {
+		return err
+	}
+
+	if _, err := dE.output.Write(dE.literal); err != nil {
+		return err
+	}
+
+	dE.literal = dE.literal[:0]
+
+	return nil
+}
+
+func (dE *deltaEncoder) flushCopy() error {
+	if dE.copyLength == 0 {
+		return nil
+	}
+
+	if err := binary.Write(dE.output, binary.BigEndian, librsync.OP_COPY_N8_N8); err != nil {
+		return err
+	}
+
+	if err := binary.Write(dE.output, binary.BigEndian, dE.copyPosition); err != nil {
+		return err
+	}
+
+	if err := binary.Write(dE.output, binary.BigEndian, dE.copyLength); err != nil {
+		return err
+	}
+
+	dE.copyLength = 0
+
+	return nil
+}
@@ -0,0 +1,355 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	gosync "sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var ENCRYPTION_NEEDS_CHUNKING = errors.New("Encrypted files can only be transferred in content defined chunks.")
+var INVALID_ENCRYPTED_HEADER = errors.New("Encrypted file does not start with a valid header.")
+
+const (
+	ENCRYPTED_HEADER_VERSION = 1
+	ENCRYPTED_HEADER_LENGTH  = 1 + 8 + 8 + blake2b.Size256
+
+	// ENCRYPTED_CHECKSUM_LENGTH is the length of the identifiers of
+	// encrypted blocks, the whole BLAKE2b hash of their ciphertext.
+	ENCRYPTED_CHECKSUM_LENGTH = blake2b.Size256
+)
+
+var headerAdditionalData = []byte("header")
+
+// EncryptedFile presents a watched file the way it is stored with client
+// side encryption: a header block holding the size, hash and modification
+// time of the file, followed by its content defined chunks, every block
+// encrypted on its own. The metadata describes these encrypted blocks, the
+// size in the short metadata is the one of the encrypted file and its hash
+// is computed from the block identifiers. Only the modification time is
+// sent in the clear, the server needs it to reject outdated metadata.
+type EncryptedFile struct {
+	lock         gosync.Mutex
+	fileWatcher  *FileWatcher
+	keyring      *Keyring
+	lengths      ChunkLengths
+	source       *ShortFileMetadata
+	shortState   *ShortFileMetadata
+	fullState    *ExtendedFileMetadata
+	header       []byte
+	chunkOffsets []int64
+}
+
+// NewEncryptedFile encrypts the file of fileWatcher in chunks of the given
+// lengths, which are the lengths of the encrypted chunks.
+func NewEncryptedFile(fileWatcher *FileWatcher, keyring *Keyring, lengths ChunkLengths) (*EncryptedFile, error) {
+	if err := lengths.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := plaintextChunkLengths(lengths).Validate(); err != nil {
+		return nil, err
+	}
+
+	return &EncryptedFile{
+		fileWatcher: fileWatcher,
+		keyring:     keyring,
+		lengths:     lengths,
+	}, nil
+}
+
+// plaintextChunkLengths shortens the maximum by the encryption overhead, so
+// encrypted chunks still fit into lengths.
+func plaintextChunkLengths(lengths ChunkLengths) ChunkLengths {
+	if lengths.Maximum < ENCRYPTION_OVERHEAD {
+		return ChunkLengths{}
+	}
+
+	return ChunkLengths{
+		Minimum: lengths.Minimum,
+		Average: lengths.Average,
+		Maximum: lengths.Maximum - ENCRYPTION_OVERHEAD,
+	}
+}
+
+func (eF *EncryptedFile) FileWatcher() *FileWatcher {
+	return eF.fileWatcher
+}
+
+func (eF *EncryptedFile) GetShortFileMetadata() (*ShortFileMetadata, error) {
+	eF.lock.Lock()
+	defer eF.lock.Unlock()
+
+	if err := eF.update(); err != nil {
+		return nil, err
+	}
+
+	return eF.shortState, nil
+}
+
+func (eF *EncryptedFile) GetCompleteFileInformation(blockLength uint32, strongChecksumLength uint32) (*ExtendedFileMetadata, error) {
+	return nil, ENCRYPTION_NEEDS_CHUNKING
+}
+
+// GetChunkedFileInformation returns the metadata of the encrypted blocks.
+// The chunks are fixed when the short metadata is computed, so lengths have
+// to be the ones the EncryptedFile was created with.
+func (eF *EncryptedFile) GetChunkedFileInformation(lengths ChunkLengths, strongChecksumLength uint32) (*ExtendedFileMetadata, error) {
+	if lengths != eF.lengths || strongChecksumLength != ENCRYPTED_CHECKSUM_LENGTH {
+		return nil, INVALID_CHUNK_LENGTHS
+	}
+
+	eF.lock.Lock()
+	defer eF.lock.Unlock()
+
+	if err := eF.update(); err != nil {
+		return nil, err
+	}
+
+	return eF.fullState, nil
+}
+
+// ReadBlock reads and encrypts the chunk with the given identifier.
+func (eF *EncryptedFile) ReadBlock(strongHash []byte) ([]byte, error) {
+	eF.lock.Lock()
+	fullState := eF.fullState
+	header := eF.header
+	chunkOffsets := eF.chunkOffsets
+	eF.lock.Unlock()
+
+	if fullState == nil {
+		return nil, BLOCK_NOT_FOUND
+	}
+
+	blockIndex := -1
+	for index := range fullState.StrongBlockHashes {
+		if bytes.Equal(fullState.StrongBlockHashes[index], strongHash) == true {
+			blockIndex = index
+			break
+		}
+	}
+
+	if blockIndex < 0 {
+		return nil, BLOCK_NOT_FOUND
+	}
+
+	if blockIndex == 0 {
+		return header, nil
+	}
+
+	inputFile, err := os.Open(eF.fileWatcher.filePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer inputFile.Close()
+
+	chunk := make([]byte, fullState.BlockLengths[blockIndex]-ENCRYPTION_OVERHEAD)
+
+	if _, err := inputFile.ReadAt(chunk, chunkOffsets[blockIndex]); err != nil {
+		if err == io.EOF {
+			return nil, BLOCK_CHANGED
+		}
+
+		return nil, err
+	}
+
+	encryptedChunk := eF.keyring.EncryptBlock(chunk)
+
+	if err := VerifyBlock(encryptedChunk, strongHash); err != nil {
+		if err == BLOCK_HASH_MISMATCH {
+			return nil, BLOCK_CHANGED
+		}
+
+		return nil, err
+	}
+
+	return encryptedChunk, nil
+}
+
+// update encrypts the file again once the FileWatcher noticed a change.
+func (eF *EncryptedFile) update() error {
+	source, err := eF.fileWatcher.GetShortFileMetadata()
+
+	if err != nil {
+		return err
+	}
+
+	if source == eF.source && eF.shortState != nil {
+		return nil
+	}
+
+	inputFile, err := os.Open(eF.fileWatcher.filePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer inputFile.Close()
+
+	fileInfo, err := inputFile.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	hasher, err := blake2b.New256(nil)
+
+	if err != nil {
+		return err
+	}
+
+	chunker, err := NewChunker(io.TeeReader(inputFile, hasher), plaintextChunkLengths(eF.lengths))
+
+	if err != nil {
+		return err
+	}
+
+	// the header is the first block, its place is filled in below
+	fullState := &ExtendedFileMetadata{
+		StrongChecksumLength: ENCRYPTED_CHECKSUM_LENGTH,
+		WeakBlockHashes:      make(map[uint32]int64),
+		StrongBlockHashes:    [][]byte{nil},
+		BlockLengths:         []uint32{0},
+	}
+
+	chunkOffsets := []int64{0}
+	fileSize := int64(0)
+
+	for {
+		chunk, err := chunker.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		encryptedChunk := eF.keyring.EncryptBlock(chunk)
+		strongHash := blake2b.Sum256(encryptedChunk)
+
+		fullState.StrongBlockHashes = append(fullState.StrongBlockHashes, strongHash[:])
+		fullState.BlockLengths = append(fullState.BlockLengths, uint32(len(encryptedChunk)))
+		chunkOffsets = append(chunkOffsets, fileSize)
+		fileSize += int64(len(chunk))
+	}
+
+	header := eF.keyring.encryptHeader(&ShortFileMetadata{
+		FileSize:    uint64(fileSize),
+		FileHash:    hasher.Sum(nil),
+		LastChanged: fileInfo.ModTime(),
+	})
+
+	headerHash := blake2b.Sum256(header)
+	fullState.StrongBlockHashes[0] = headerHash[:]
+	fullState.BlockLengths[0] = uint32(len(header))
+
+	fileHasher, err := blake2b.New256(nil)
+
+	if err != nil {
+		return err
+	}
+
+	for index, strongHash := range fullState.StrongBlockHashes {
+		fullState.FileSize += uint64(fullState.BlockLengths[index])
+		fileHasher.Write(strongHash)
+	}
+
+	fullState.BlockAmount = uint64(len(fullState.StrongBlockHashes))
+
+	eF.source = source
+	eF.fullState = fullState
+	eF.header = header
+	eF.chunkOffsets = chunkOffsets
+	eF.shortState = &ShortFileMetadata{
+		FileSize:    fullState.FileSize,
+		FileHash:    fileHasher.Sum(nil),
+		LastChanged: fileInfo.ModTime(),
+	}
+
+	return nil
+}
+
+// encryptHeader encrypts the metadata of a file. It is sealed apart from
+// blocks, so the server can not swap it with a block of the file.
+func (keyring *Keyring) encryptHeader(metadata *ShortFileMetadata) []byte {
+	header := make([]byte, ENCRYPTED_HEADER_LENGTH)
+
+	header[0] = ENCRYPTED_HEADER_VERSION
+	binary.BigEndian.PutUint64(header[1:9], metadata.FileSize)
+	binary.BigEndian.PutUint64(header[9:17], uint64(metadata.LastChanged.UnixNano()))
+	copy(header[17:], metadata.FileHash)
+
+	return sealDeterministic(keyring.blockCipher, keyring.blockNonce, header, headerAdditionalData)
+}
+
+func (keyring *Keyring) decryptHeader(encryptedHeader []byte) (*ShortFileMetadata, error) {
+	header, err := openDeterministic(keyring.blockCipher, encryptedHeader, headerAdditionalData)
+
+	if err != nil {
+		return nil, INVALID_ENCRYPTED_HEADER
+	}
+
+	if len(header) != ENCRYPTED_HEADER_LENGTH || header[0] != ENCRYPTED_HEADER_VERSION {
+		return nil, INVALID_ENCRYPTED_HEADER
+	}
+
+	return &ShortFileMetadata{
+		FileSize:    binary.BigEndian.Uint64(header[1:9]),
+		LastChanged: time.Unix(0, int64(binary.BigEndian.Uint64(header[9:17]))),
+		FileHash:    header[17:],
+	}, nil
+}
+
+// FileDecrypter decrypts the blocks of an EncryptedFile, which have to be
+// written in their order, and writes the file to output.
+type FileDecrypter struct {
+	keyring  *Keyring
+	output   io.Writer
+	metadata *ShortFileMetadata
+}
+
+func NewFileDecrypter(keyring *Keyring, output io.Writer) *FileDecrypter {
+	return &FileDecrypter{
+		keyring: keyring,
+		output:  output,
+	}
+}
+
+func (fD *FileDecrypter) WriteBlock(encryptedBlock []byte) error {
+	if fD.metadata == nil {
+		metadata, err := fD.keyring.decryptHeader(encryptedBlock)
+
+		if err != nil {
+			return err
+		}
+
+		fD.metadata = metadata
+		return nil
+	}
+
+	block, err := fD.keyring.DecryptBlock(encryptedBlock)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = fD.output.Write(block)
+
+	return err
+}
+
+// Metadata returns the size, hash and modification time the decrypted file
+// has to match, as stored in its header. It is nil until the header was
+// written.
+func (fD *FileDecrypter) Metadata() *ShortFileMetadata {
+	return fD.metadata
+}
@@ -0,0 +1,147 @@
+package sync
+
+import (
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/poly1305"
+)
+
+var DECRYPTION_FAILED = errors.New("Data could not be decrypted, the passphrase is wrong or the data was modified.")
+
+const (
+	KEY_DERIVATION_TIME    = 3
+	KEY_DERIVATION_MEMORY  = 64 * 1024
+	KEY_DERIVATION_THREADS = 4
+
+	// ENCRYPTION_OVERHEAD is the number of bytes an encrypted block is
+	// longer than the block.
+	ENCRYPTION_OVERHEAD = chacha20poly1305.NonceSizeX + poly1305.TagSize
+)
+
+// Keyring holds the keys derived from a passphrase for encrypting blocks and
+// file names on the client, so the server only stores ciphertext.
+//
+// Encryption is deterministic: the nonce of a block is a keyed hash of its
+// content. Equal blocks of one user encrypt to equal ciphertexts and are
+// stored once, while the server can not confirm a guessed content without
+// the keys. Block identifiers are hashes of the ciphertext, which the server
+// can verify.
+type Keyring struct {
+	blockCipher cipher.AEAD
+	blockNonce  []byte
+	nameCipher  cipher.AEAD
+	nameNonce   []byte
+}
+
+// NewKeyring derives the keys from passphrase with Argon2id. The user name
+// salts the derivation, so every device of a user derives the same keys and
+// can restore what the others stored.
+func NewKeyring(passphrase []byte, user []byte) (*Keyring, error) {
+	salt := blake2b.Sum256(append([]byte("simple-sync keyring "), user...))
+	masterKey := argon2.IDKey(passphrase, salt[:], KEY_DERIVATION_TIME, KEY_DERIVATION_MEMORY, KEY_DERIVATION_THREADS, chacha20poly1305.KeySize)
+
+	blockCipher, err := chacha20poly1305.NewX(deriveKey(masterKey, "block"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	nameCipher, err := chacha20poly1305.NewX(deriveKey(masterKey, "name"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Keyring{
+		blockCipher: blockCipher,
+		blockNonce:  deriveKey(masterKey, "block nonce"),
+		nameCipher:  nameCipher,
+		nameNonce:   deriveKey(masterKey, "name nonce"),
+	}, nil
+}
+
+// deriveKey derives an independent key for purpose from the master key.
+func deriveKey(masterKey []byte, purpose string) []byte {
+	hasher, _ := blake2b.New256(masterKey)
+	hasher.Write([]byte(purpose))
+
+	return hasher.Sum(nil)
+}
+
+// sealDeterministic encrypts data with a nonce derived from its content and
+// prepends the nonce. additionalData tells apart what was sealed with the
+// same key.
+func sealDeterministic(aead cipher.AEAD, nonceKey []byte, data []byte, additionalData []byte) []byte {
+	hasher, _ := blake2b.New256(nonceKey)
+	hasher.Write(additionalData)
+	hasher.Write(data)
+	nonce := hasher.Sum(nil)[:chacha20poly1305.NonceSizeX]
+
+	return aead.Seal(nonce, nonce, data, additionalData)
+}
+
+func openDeterministic(aead cipher.AEAD, sealed []byte, additionalData []byte) ([]byte, error) {
+	if len(sealed) < ENCRYPTION_OVERHEAD {
+		return nil, DECRYPTION_FAILED
+	}
+
+	nonce := sealed[:chacha20poly1305.NonceSizeX]
+	data, err := aead.Open(nil, nonce, sealed[chacha20poly1305.NonceSizeX:], additionalData)
+
+	if err != nil {
+		return nil, DECRYPTION_FAILED
+	}
+
+	return data, nil
+}
+
+// EncryptBlock returns the encrypted block, which is ENCRYPTION_OVERHEAD
+// bytes longer.
+func (keyring *Keyring) EncryptBlock(block []byte) []byte {
+	return sealDeterministic(keyring.blockCipher, keyring.blockNonce, block, nil)
+}
+
+func (keyring *Keyring) DecryptBlock(encryptedBlock []byte) ([]byte, error) {
+	return openDeterministic(keyring.blockCipher, encryptedBlock, nil)
+}
+
+// EncryptPath encrypts every element of a normalized path on its own, so
+// files of one directory stay in one directory and can be moved and listed
+// by the server. The encrypted elements are base64 encoded.
+func (keyring *Keyring) EncryptPath(path string) string {
+	elements := strings.Split(path, "/")
+
+	for index, element := range elements {
+		elements[index] = base64.RawURLEncoding.EncodeToString(sealDeterministic(keyring.nameCipher, keyring.nameNonce, []byte(element), nil))
+	}
+
+	return strings.Join(elements, "/")
+}
+
+func (keyring *Keyring) DecryptPath(encryptedPath string) (string, error) {
+	elements := strings.Split(encryptedPath, "/")
+
+	for index, encryptedElement := range elements {
+		sealed, err := base64.RawURLEncoding.DecodeString(encryptedElement)
+
+		if err != nil {
+			return "", DECRYPTION_FAILED
+		}
+
+		element, err := openDeterministic(keyring.nameCipher, sealed, nil)
+
+		if err != nil {
+			return "", err
+		}
+
+		elements[index] = string(element)
+	}
+
+	return strings.Join(elements, "/"), nil
+}
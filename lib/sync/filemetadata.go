@@ -2,16 +2,95 @@ package sync
 
 import (
 	"bytes"
+	"errors"
 	"time"
 )
 
+var INVALID_BLOCKS = errors.New("Block hashes do not describe the blocks.")
+
+// ExtendedFileMetadata describes the blocks of a file. Blocks are either
+// BlockLength bytes long, except for the last one, or content defined chunks
+// with the lengths in BlockLengths and a BlockLength of 0. WeakBlockSums
+// holds the weak checksum of every block, WeakBlockHashes indexes them.
 type ExtendedFileMetadata struct {
 	FileSize             uint64
 	StrongChecksumLength uint32
 	BlockLength          uint32
 	BlockAmount          uint64
+	WeakBlockSums        []uint32
 	WeakBlockHashes      map[uint32]int64
 	StrongBlockHashes    [][]byte
+	BlockLengths         []uint32
+}
+
+// IndexWeakBlockSums maps every weak checksum to the index of its block.
+// Blocks with the same weak checksum map to the last of them, like in the
+// signatures of librsync, their strong hashes tell them apart.
+func IndexWeakBlockSums(weakBlockSums []uint32) map[uint32]int64 {
+	weakBlockHashes := make(map[uint32]int64, len(weakBlockSums))
+
+	for index, weakBlockSum := range weakBlockSums {
+		weakBlockHashes[weakBlockSum] = int64(index)
+	}
+
+	return weakBlockHashes
+}
+
+// CheckBlocks verifies that there is a weak checksum and a strong hash of
+// StrongChecksumLength bytes for every block.
+func (eFM *ExtendedFileMetadata) CheckBlocks() error {
+	if uint64(len(eFM.WeakBlockSums)) != eFM.BlockAmount || uint64(len(eFM.StrongBlockHashes)) != eFM.BlockAmount {
+		return INVALID_BLOCKS
+	}
+
+	for _, strongHash := range eFM.StrongBlockHashes {
+		if len(strongHash) != int(eFM.StrongChecksumLength) {
+			return INVALID_BLOCKS
+		}
+	}
+
+	return nil
+}
+
+// CheckFixedBlocks verifies that blocks of BlockLength bytes cover the file
+// size, with only the last block being shorter.
+func (eFM *ExtendedFileMetadata) CheckFixedBlocks() error {
+	if eFM.BlockLength == 0 {
+		return INVALID_BLOCKS
+	}
+
+	blockAmount := eFM.FileSize / uint64(eFM.BlockLength)
+
+	if eFM.FileSize%uint64(eFM.BlockLength) != 0 {
+		blockAmount += 1
+	}
+
+	if eFM.BlockAmount != blockAmount {
+		return INVALID_BLOCKS
+	}
+
+	return nil
+}
+
+// IsChunked reports whether the file was split into content defined chunks.
+func (eFM *ExtendedFileMetadata) IsChunked() bool {
+	return eFM.BlockLengths != nil
+}
+
+// BlockRange returns the offset and the length of the block at index. The
+// last fixed length block may be shorter than the returned length.
+func (eFM *ExtendedFileMetadata) BlockRange(index int) (int64, uint32) {
+	if eFM.IsChunked() == false {
+		return int64(index) * int64(eFM.BlockLength), eFM.BlockLength
+	}
+
+	offset := int64(0)
+
+	for _, blockLength := range eFM.BlockLengths[:index] {
+		offset += int64(blockLength)
+	}
+
+	return offset, eFM.BlockLengths[index]
 }
 
 func (eFM *ExtendedFileMetadata) Equals(otherEFM *ExtendedFileMetadata) bool {
@@ -25,6 +104,26 @@ func (eFM *ExtendedFileMetadata) Equals(otherEFM *ExtendedFileMetadata) bool {
 		}
 	}
 
+	if len(otherEFM.BlockLengths) != len(eFM.BlockLengths) {
+		return false
+	}
+
+	for index := range eFM.BlockLengths {
+		if eFM.BlockLengths[index] != otherEFM.BlockLengths[index] {
+			return false
+		}
+	}
+
+	if len(otherEFM.WeakBlockSums) != len(eFM.WeakBlockSums) {
+		return false
+	}
+
+	for index := range eFM.WeakBlockSums {
+		if eFM.WeakBlockSums[index] != otherEFM.WeakBlockSums[index] {
+			return false
+		}
+	}
+
 	if len(otherEFM.WeakBlockHashes) != len(eFM.WeakBlockHashes) {
 		return false
 	}
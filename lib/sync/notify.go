@@ -0,0 +1,291 @@
+package sync
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	gosync "sync"
+	"time"
+)
+
+const (
+	DEBOUNCE_INTERVAL = 500 * time.Millisecond
+	POLL_INTERVAL     = 2 * time.Second
+)
+
+var NOTIFY_UNSUPPORTED = errors.New("Change notification is not supported on this system.")
+var NOTIFIER_CLOSED = errors.New("Notifier is closed.")
+
+// notifyBackend watches paths and sends the path of every change to the
+// channel it was created with. Changes inside a watched directory are
+// reported with the path of the changed entry.
+type notifyBackend interface {
+	add(path string) error
+	close() error
+}
+
+// Notifier reports changes of watched files and directories. Directories
+// are watched non-recursively. A burst of changes is reported once, after
+// nothing changed for the debounce interval, as the sorted list of paths
+// that changed.
+type Notifier struct {
+	backend  notifyBackend
+	debounce time.Duration
+	changes  chan string
+	events   chan []string
+	done     chan bool
+	lock     gosync.Mutex
+	closed   bool
+}
+
+// NewNotifier uses the change notification of the operating system and
+// falls back to polling every POLL_INTERVAL where there is none.
+func NewNotifier(debounce time.Duration) *Notifier {
+	notifier := newNotifier(debounce)
+
+	backend, err := newNativeBackend(notifier.changes, notifier.done)
+
+	if err != nil {
+		backend = newPollingBackend(POLL_INTERVAL, notifier.changes, notifier.done)
+	}
+
+	notifier.backend = backend
+
+	go notifier.debounceLoop()
+
+	return notifier
+}
+
+// NewPollingNotifier always polls, which also works on network file systems
+// that do not deliver change notifications.
+func NewPollingNotifier(interval time.Duration, debounce time.Duration) *Notifier {
+	notifier := newNotifier(debounce)
+	notifier.backend = newPollingBackend(interval, notifier.changes, notifier.done)
+
+	go notifier.debounceLoop()
+
+	return notifier
+}
+
+func newNotifier(debounce time.Duration) *Notifier {
+	return &Notifier{
+		debounce: debounce,
+		changes:  make(chan string, 64),
+		events:   make(chan []string),
+		done:     make(chan bool),
+	}
+}
+
+func (notifier *Notifier) Add(path string) error {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+
+	if notifier.closed == true {
+		return NOTIFIER_CLOSED
+	}
+
+	return notifier.backend.add(path)
+}
+
+// Events delivers the debounced changes. It is closed by Close.
+func (notifier *Notifier) Events() <-chan []string {
+	return notifier.events
+}
+
+func (notifier *Notifier) Close() error {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+
+	if notifier.closed == true {
+		return nil
+	}
+
+	notifier.closed = true
+	close(notifier.done)
+
+	return notifier.backend.close()
+}
+
+func (notifier *Notifier) debounceLoop() {
+	defer close(notifier.events)
+
+	changedPaths := make(map[string]bool)
+	timer := time.NewTimer(notifier.debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case changedPath := <-notifier.changes:
+			changedPaths[changedPath] = true
+
+			if timer.Stop() == false {
+				// drain a timer that fired while we were receiving
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+
+			timer.Reset(notifier.debounce)
+
+		case <-timer.C:
+			paths := make([]string, 0, len(changedPaths))
+
+			for changedPath := range changedPaths {
+				paths = append(paths, changedPath)
+			}
+
+			sort.Strings(paths)
+			changedPaths = make(map[string]bool)
+
+			select {
+			case notifier.events <- paths:
+			case <-notifier.done:
+				return
+			}
+
+		case <-notifier.done:
+			return
+		}
+	}
+}
+
+type pollState struct {
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (pS pollState) equals(otherPS pollState) bool {
+	return pS.size == otherPS.size && pS.modTime.Equal(otherPS.modTime) == true && pS.isDir == otherPS.isDir
+}
+
+// pollingBackend compares the size and modification time of every watched
+// path, and of the entries of watched directories, on every tick.
+type pollingBackend struct {
+	lock     gosync.Mutex
+	watched  map[string]bool
+	states   map[string]pollState
+	changes  chan<- string
+	done     <-chan bool
+	interval time.Duration
+}
+
+func newPollingBackend(interval time.Duration, changes chan<- string, done <-chan bool) *pollingBackend {
+	backend := &pollingBackend{
+		watched:  make(map[string]bool),
+		states:   make(map[string]pollState),
+		changes:  changes,
+		done:     done,
+		interval: interval,
+	}
+
+	go backend.pollLoop()
+
+	return backend
+}
+
+func (pB *pollingBackend) add(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	pB.lock.Lock()
+	defer pB.lock.Unlock()
+
+	pB.watched[path] = true
+
+	for statePath, state := range pB.snapshot(path) {
+		pB.states[statePath] = state
+	}
+
+	return nil
+}
+
+func (pB *pollingBackend) close() error {
+	return nil
+}
+
+func (pB *pollingBackend) pollLoop() {
+	ticker := time.NewTicker(pB.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, changedPath := range pB.poll() {
+				select {
+				case pB.changes <- changedPath:
+				case <-pB.done:
+					return
+				}
+			}
+
+		case <-pB.done:
+			return
+		}
+	}
+}
+
+func (pB *pollingBackend) poll() []string {
+	pB.lock.Lock()
+	defer pB.lock.Unlock()
+
+	states := make(map[string]pollState)
+
+	for path := range pB.watched {
+		for statePath, state := range pB.snapshot(path) {
+			states[statePath] = state
+		}
+	}
+
+	changedPaths := make([]string, 0)
+
+	for path, state := range states {
+		if oldState, ok := pB.states[path]; ok == false || oldState.equals(state) == false {
+			changedPaths = append(changedPaths, path)
+		}
+	}
+
+	for path := range pB.states {
+		if _, ok := states[path]; ok == false {
+			changedPaths = append(changedPaths, path)
+		}
+	}
+
+	pB.states = states
+
+	return changedPaths
+}
+
+// snapshot returns the state of path and, if it is a directory, of its
+// entries. A path that does not exist has no state.
+func (pB *pollingBackend) snapshot(path string) map[string]pollState {
+	states := make(map[string]pollState)
+
+	fileInfo, err := os.Stat(path)
+
+	if err != nil {
+		return states
+	}
+
+	states[path] = pollState{fileInfo.Size(), fileInfo.ModTime(), fileInfo.IsDir()}
+
+	if fileInfo.IsDir() == false {
+		return states
+	}
+
+	entries, err := ioutil.ReadDir(path)
+
+	if err != nil {
+		return states
+	}
+
+	for _, entry := range entries {
+		states[filepath.Join(path, entry.Name())] = pollState{entry.Size(), entry.ModTime(), entry.IsDir()}
+	}
+
+	return states
+}
@@ -0,0 +1,115 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const INOTIFY_MASK = unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_ATTRIB |
+	unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+// inotifyBackend reads inotify events from a non-blocking descriptor that is
+// handed to the runtime poller, so closing the file ends a pending read.
+type inotifyBackend struct {
+	lock    gosync.Mutex
+	file    *os.File
+	fd      int
+	paths   map[int]string
+	changes chan<- string
+	done    <-chan bool
+}
+
+func newNativeBackend(changes chan<- string, done <-chan bool) (notifyBackend, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+
+	if err != nil {
+		return nil, err
+	}
+
+	backend := &inotifyBackend{
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		fd:      fd,
+		paths:   make(map[int]string),
+		changes: changes,
+		done:    done,
+	}
+
+	go backend.readLoop()
+
+	return backend, nil
+}
+
+func (iB *inotifyBackend) add(path string) error {
+	iB.lock.Lock()
+	defer iB.lock.Unlock()
+
+	watchDescriptor, err := unix.InotifyAddWatch(iB.fd, path, INOTIFY_MASK)
+
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+	}
+
+	iB.paths[watchDescriptor] = path
+
+	return nil
+}
+
+func (iB *inotifyBackend) close() error {
+	return iB.file.Close()
+}
+
+func (iB *inotifyBackend) readLoop() {
+	buffer := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+
+	for {
+		readBytes, err := iB.file.Read(buffer)
+
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= readBytes; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			offset = nameStart + int(event.Len)
+
+			changedPath := iB.path(int(event.Wd), event.Mask)
+
+			if len(changedPath) == 0 {
+				continue
+			}
+
+			if event.Len > 0 {
+				name := strings.TrimRight(string(buffer[nameStart:offset]), "\x00")
+				changedPath = filepath.Join(changedPath, name)
+			}
+
+			select {
+			case iB.changes <- changedPath:
+			case <-iB.done:
+				return
+			}
+		}
+	}
+}
+
+// path returns the watched path of a watch descriptor and forgets it once
+// the kernel dropped the watch.
+func (iB *inotifyBackend) path(watchDescriptor int, mask uint32) string {
+	iB.lock.Lock()
+	defer iB.lock.Unlock()
+
+	path := iB.paths[watchDescriptor]
+
+	if mask&unix.IN_IGNORED != 0 {
+		delete(iB.paths, watchDescriptor)
+	}
+
+	return path
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package sync
+
+func newNativeBackend(changes chan<- string, done <-chan bool) (notifyBackend, error) {
+	return nil, NOTIFY_UNSUPPORTED
+}
@@ -0,0 +1,25 @@
+package sync
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+var INVALID_PATH = errors.New("Path has to be relative and must not leave its root.")
+
+// NormalizePath cleans a slash separated path relative to a backup root and
+// rejects paths that are absolute, empty or point outside of the root.
+func NormalizePath(relativePath string) (string, error) {
+	if len(relativePath) == 0 || strings.HasPrefix(relativePath, "/") {
+		return "", INVALID_PATH
+	}
+
+	cleanedPath := path.Clean(relativePath)
+
+	if cleanedPath == "." || cleanedPath == ".." || strings.HasPrefix(cleanedPath, "../") {
+		return "", INVALID_PATH
+	}
+
+	return cleanedPath, nil
+}
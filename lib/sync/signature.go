@@ -0,0 +1,58 @@
+package sync
+
+import (
+	"io"
+
+	"github.com/FBreuer2/librsync-go"
+)
+
+// SignFile computes the metadata of input split into blocks of blockLength
+// bytes, the last block may be shorter. The checksums are the ones of
+// librsync's signatures, but every block keeps its weak checksum, even if
+// another block has the same one.
+func SignFile(input io.Reader, blockLength uint32, strongChecksumLength uint32) (*ExtendedFileMetadata, error) {
+	if blockLength == 0 {
+		return nil, INVALID_SIGNATURE
+	}
+
+	eFM := &ExtendedFileMetadata{
+		StrongChecksumLength: strongChecksumLength,
+		BlockLength:          blockLength,
+		WeakBlockSums:        make([]uint32, 0),
+		StrongBlockHashes:    make([][]byte, 0),
+	}
+
+	block := make([]byte, blockLength)
+
+	for {
+		readBytes, err := io.ReadFull(input, block)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+
+		strongHash, strongErr := librsync.CalcStrongSum(block[:readBytes], librsync.BLAKE2_SIG_MAGIC, strongChecksumLength)
+
+		if strongErr != nil {
+			return nil, strongErr
+		}
+
+		eFM.WeakBlockSums = append(eFM.WeakBlockSums, librsync.WeakChecksum(block[:readBytes]))
+		eFM.StrongBlockHashes = append(eFM.StrongBlockHashes, strongHash)
+		eFM.FileSize += uint64(readBytes)
+
+		// a short block is the last one
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	eFM.BlockAmount = uint64(len(eFM.StrongBlockHashes))
+	eFM.WeakBlockHashes = IndexWeakBlockSums(eFM.WeakBlockSums)
+
+	return eFM, nil
+}
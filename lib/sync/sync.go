@@ -1,20 +1,32 @@
 package sync
 
 import (
+	"bytes"
+	"errors"
 	"io"
 	"os"
+	"path/filepath"
+	gosync "sync"
 
 	"github.com/FBreuer2/librsync-go"
-	"github.com/sirupsen/logrus"
 
 	"golang.org/x/crypto/blake2b"
 )
 
+var BLOCK_NOT_FOUND = errors.New("Block is not part of the file.")
+var BLOCK_CHANGED = errors.New("Block changed since the metadata was computed.")
+var BLOCK_HASH_MISMATCH = errors.New("Block does not match its hash.")
+
+// FileWatcher computes and caches the metadata of a file. Once Watch was
+// called, the cache is reset whenever the file changes.
 type FileWatcher struct {
+	lock              gosync.Mutex
 	filePath          string
 	currentShortState *ShortFileMetadata
 	currentFullState  *ExtendedFileMetadata
+	currentChunking   ChunkLengths
 	changedCallback   func()
+	notifier          *Notifier
 }
 
 func NewFileWatcher(path string) (newFileWatcher *FileWatcher, err error) {
@@ -33,11 +45,91 @@ func NewFileWatcher(path string) (newFileWatcher *FileWatcher, err error) {
 }
 
 func (fileWatcher *FileWatcher) ResetCache() {
+	fileWatcher.lock.Lock()
+	defer fileWatcher.lock.Unlock()
+
 	fileWatcher.currentShortState = nil
 	fileWatcher.currentFullState = nil
 }
 
+// Watch resets the cache and runs callback whenever the file changed. The
+// directory of the file is watched, so replacing the file by renaming
+// another one over it, as many editors do, is noticed as well.
+func (fileWatcher *FileWatcher) Watch(callback func()) error {
+	notifier := NewNotifier(DEBOUNCE_INTERVAL)
+
+	if err := notifier.Add(filepath.Dir(fileWatcher.filePath)); err != nil {
+		notifier.Close()
+		return err
+	}
+
+	fileWatcher.lock.Lock()
+	fileWatcher.changedCallback = callback
+	fileWatcher.notifier = notifier
+	fileWatcher.lock.Unlock()
+
+	go func() {
+		for changedPaths := range notifier.Events() {
+			for _, changedPath := range changedPaths {
+				if changedPath == filepath.Clean(fileWatcher.filePath) {
+					fileWatcher.changed()
+					break
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (fileWatcher *FileWatcher) StopWatching() error {
+	fileWatcher.lock.Lock()
+	notifier := fileWatcher.notifier
+	fileWatcher.notifier = nil
+	fileWatcher.lock.Unlock()
+
+	if notifier == nil {
+		return nil
+	}
+
+	return notifier.Close()
+}
+
+func (fileWatcher *FileWatcher) changed() {
+	fileWatcher.ResetCache()
+
+	fileWatcher.lock.Lock()
+	callback := fileWatcher.changedCallback
+	fileWatcher.lock.Unlock()
+
+	if callback != nil {
+		callback()
+	}
+}
+
+// isCurrent reports whether the cached metadata still describes the file
+// with the given info, judged by size and modification time.
+func (fileWatcher *FileWatcher) isCurrent(fileInfo os.FileInfo) bool {
+	shortState := fileWatcher.cachedShortState()
+
+	return shortState != nil &&
+		shortState.FileSize == uint64(fileInfo.Size()) &&
+		shortState.LastChanged.Equal(fileInfo.ModTime()) == true
+}
+
+// cachedShortState returns the cached short metadata, which is nil after the
+// cache was reset.
+func (fileWatcher *FileWatcher) cachedShortState() *ShortFileMetadata {
+	fileWatcher.lock.Lock()
+	defer fileWatcher.lock.Unlock()
+
+	return fileWatcher.currentShortState
+}
+
 func (fileWatcher *FileWatcher) GetShortFileMetadata() (metadata *ShortFileMetadata, err error) {
+	fileWatcher.lock.Lock()
+	defer fileWatcher.lock.Unlock()
+
 	if fileWatcher.currentShortState != nil {
 		return fileWatcher.currentShortState, nil
 	}
@@ -78,7 +170,13 @@ func (fileWatcher *FileWatcher) GetShortFileMetadata() (metadata *ShortFileMetad
 }
 
 func (fileWatcher *FileWatcher) GetCompleteFileInformation(blockLength uint32, strongChecksumLength uint32) (metadata *ExtendedFileMetadata, err error) {
-	if fileWatcher.currentFullState != nil {
+	fileWatcher.lock.Lock()
+	defer fileWatcher.lock.Unlock()
+
+	if fileWatcher.currentFullState != nil &&
+		fileWatcher.currentFullState.IsChunked() == false &&
+		fileWatcher.currentFullState.BlockLength == blockLength &&
+		fileWatcher.currentFullState.StrongChecksumLength == strongChecksumLength {
 		return fileWatcher.currentFullState, nil
 	}
 
@@ -91,32 +189,116 @@ func (fileWatcher *FileWatcher) GetCompleteFileInformation(blockLength uint32, s
 
 	defer inputFile.Close()
 
-	fileInfo, statError := inputFile.Stat()
+	fullState, err := SignFile(inputFile, blockLength, strongChecksumLength)
 
-	if statError != nil {
-		return nil, statError
+	if err != nil {
+		return nil, err
 	}
 
-	signatureFile, err := os.OpenFile(fileWatcher.filePath+".sig", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0600))
-	if err != nil {
-		logrus.Fatal(err)
+	fileWatcher.currentFullState = fullState
+
+	return fileWatcher.currentFullState, nil
+}
+
+// GetChunkedFileInformation splits the file into content defined chunks,
+// see Chunker. The result is cached like GetCompleteFileInformation's.
+func (fileWatcher *FileWatcher) GetChunkedFileInformation(lengths ChunkLengths, strongChecksumLength uint32) (metadata *ExtendedFileMetadata, err error) {
+	fileWatcher.lock.Lock()
+	defer fileWatcher.lock.Unlock()
+
+	if fileWatcher.currentFullState != nil &&
+		fileWatcher.currentFullState.IsChunked() == true &&
+		fileWatcher.currentChunking == lengths &&
+		fileWatcher.currentFullState.StrongChecksumLength == strongChecksumLength {
+		return fileWatcher.currentFullState, nil
 	}
-	defer signatureFile.Close()
 
-	fileSignatureData, err := librsync.Signature(inputFile, signatureFile, blockLength, strongChecksumLength, librsync.BLAKE2_SIG_MAGIC)
+	inputFile, err := os.Open(fileWatcher.filePath)
 
 	if err != nil {
-		logrus.Fatal(err)
+		return nil, err
 	}
 
-	fileWatcher.currentFullState = &ExtendedFileMetadata{
-		FileSize:             uint64(fileInfo.Size()),
-		StrongChecksumLength: strongChecksumLength,
-		BlockLength:          blockLength,
-		BlockAmount:          uint64(len(fileSignatureData.GetStrongChecksums())),
-		WeakBlockHashes:      fileSignatureData.GetWeakRollsum(),
-		StrongBlockHashes:    fileSignatureData.GetStrongChecksums(),
+	defer inputFile.Close()
+
+	chunkedState, err := ChunkFile(inputFile, lengths, strongChecksumLength)
+
+	if err != nil {
+		return nil, err
 	}
 
+	fileWatcher.currentFullState = chunkedState
+	fileWatcher.currentChunking = lengths
+
 	return fileWatcher.currentFullState, nil
 }
+
+// ReadBlock reads the block with the given strong hash from the file, using
+// the layout of the last call to GetCompleteFileInformation or
+// GetChunkedFileInformation.
+func (fileWatcher *FileWatcher) ReadBlock(strongHash []byte) ([]byte, error) {
+	fileWatcher.lock.Lock()
+	fullState := fileWatcher.currentFullState
+	fileWatcher.lock.Unlock()
+
+	if fullState == nil {
+		return nil, BLOCK_NOT_FOUND
+	}
+
+	blockIndex := -1
+	for index := range fullState.StrongBlockHashes {
+		if bytes.Equal(fullState.StrongBlockHashes[index], strongHash) == true {
+			blockIndex = index
+			break
+		}
+	}
+
+	if blockIndex < 0 {
+		return nil, BLOCK_NOT_FOUND
+	}
+
+	inputFile, err := os.Open(fileWatcher.filePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer inputFile.Close()
+
+	blockOffset, blockLength := fullState.BlockRange(blockIndex)
+	block := make([]byte, blockLength)
+
+	readBytes, err := inputFile.ReadAt(block, blockOffset)
+
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	block = block[:readBytes]
+
+	if err := VerifyBlock(block, strongHash); err != nil {
+		if err == BLOCK_HASH_MISMATCH {
+			return nil, BLOCK_CHANGED
+		}
+
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// VerifyBlock checks that strongHash is the BLAKE2b strong checksum of the
+// block, truncated to the length of strongHash.
+func VerifyBlock(block []byte, strongHash []byte) error {
+	currentHash, err := librsync.CalcStrongSum(block, librsync.BLAKE2_SIG_MAGIC, uint32(len(strongHash)))
+
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(currentHash, strongHash) == false {
+		return BLOCK_HASH_MISMATCH
+	}
+
+	return nil
+}
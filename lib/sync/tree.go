@@ -0,0 +1,318 @@
+package sync
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	gosync "sync"
+)
+
+var NOT_A_DIRECTORY = errors.New("Root of a tree has to be a directory.")
+
+// TreeSyncer transfers the changes found by a TreeWatcher, usually to a
+// server. Paths are slash separated and relative to the root of the tree.
+type TreeSyncer interface {
+	SyncFile(relativePath string, fileWatcher *FileWatcher) error
+	RemoveFile(relativePath string) error
+	MoveFile(oldRelativePath string, newRelativePath string, fileWatcher *FileWatcher) error
+}
+
+// TreeChanges lists what changed in a tree since its last successful sync.
+// Changed holds added and modified files, Moved maps old to new paths.
+type TreeChanges struct {
+	Changed []string
+	Removed []string
+	Moved   map[string]string
+}
+
+func (tC *TreeChanges) IsEmpty() bool {
+	return len(tC.Changed) == 0 && len(tC.Removed) == 0 && len(tC.Moved) == 0
+}
+
+// TreeWatcher keeps a FileWatcher for every regular file below a root
+// directory and remembers which state of each file was synced last, so only
+// changes have to be sent. Deletions and renames are detected between scans
+// of a running watcher; a new watcher considers every file as added. Apart
+// from the callback passed to Watch, a TreeWatcher must not be used by
+// multiple goroutines at once.
+type TreeWatcher struct {
+	rootPath     string
+	files        map[string]*FileWatcher
+	states       map[string]*ShortFileMetadata
+	synced       map[string]*ShortFileMetadata
+	notifier     *Notifier
+	lock         gosync.Mutex
+	changedPaths map[string]bool
+}
+
+func NewTreeWatcher(rootPath string) (*TreeWatcher, error) {
+	rootInfo, err := os.Stat(rootPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if rootInfo.IsDir() == false {
+		return nil, NOT_A_DIRECTORY
+	}
+
+	return &TreeWatcher{
+		rootPath:     rootPath,
+		files:        make(map[string]*FileWatcher),
+		states:       make(map[string]*ShortFileMetadata),
+		synced:       make(map[string]*ShortFileMetadata),
+		changedPaths: make(map[string]bool),
+	}, nil
+}
+
+// Watch runs callback whenever something below the root changed, which
+// should trigger a Sync. Files reported as changed are hashed again by the
+// next scan, even if their size and modification time stayed the same.
+// Directories created later are watched once a scan found them.
+func (tW *TreeWatcher) Watch(callback func()) error {
+	notifier := NewNotifier(DEBOUNCE_INTERVAL)
+
+	err := filepath.Walk(tW.rootPath, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil || fileInfo.IsDir() == false {
+			return nil
+		}
+
+		return notifier.Add(filePath)
+	})
+
+	if err != nil {
+		notifier.Close()
+		return err
+	}
+
+	tW.notifier = notifier
+
+	go func() {
+		for changedPaths := range notifier.Events() {
+			tW.lock.Lock()
+			for _, changedPath := range changedPaths {
+				tW.changedPaths[changedPath] = true
+			}
+			tW.lock.Unlock()
+
+			callback()
+		}
+	}()
+
+	return nil
+}
+
+func (tW *TreeWatcher) StopWatching() error {
+	if tW.notifier == nil {
+		return nil
+	}
+
+	err := tW.notifier.Close()
+	tW.notifier = nil
+
+	return err
+}
+
+// Files returns the sorted paths of all files found by the last scan.
+func (tW *TreeWatcher) Files() []string {
+	paths := make([]string, 0, len(tW.files))
+
+	for path := range tW.files {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	return paths
+}
+
+func (tW *TreeWatcher) FileWatcher(relativePath string) *FileWatcher {
+	return tW.files[relativePath]
+}
+
+// Scan walks the tree and compares it to the last synced state. Files whose
+// size and modification time did not change are not hashed again. A removed
+// file is reported as moved if an added file has the same content.
+func (tW *TreeWatcher) Scan() (*TreeChanges, error) {
+	files := make(map[string]*FileWatcher)
+	states := make(map[string]*ShortFileMetadata)
+
+	tW.lock.Lock()
+	changedPaths := tW.changedPaths
+	tW.changedPaths = make(map[string]bool)
+	tW.lock.Unlock()
+
+	err := filepath.Walk(tW.rootPath, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			// files may vanish while we walk
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if fileInfo.IsDir() == true && tW.notifier != nil {
+			if err := tW.notifier.Add(filePath); err != nil && os.IsNotExist(err) == false {
+				return err
+			}
+		}
+
+		if fileInfo.Mode().IsRegular() == false {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(tW.rootPath, filePath)
+
+		if err != nil {
+			return err
+		}
+
+		relativePath, err = NormalizePath(filepath.ToSlash(relativePath))
+
+		if err != nil {
+			return err
+		}
+
+		fileWatcher := tW.files[relativePath]
+
+		if fileWatcher == nil {
+			fileWatcher = &FileWatcher{filePath: filePath}
+		} else if changedPaths[filePath] == true || fileWatcher.isCurrent(fileInfo) == false {
+			fileWatcher.ResetCache()
+		}
+
+		shortState, err := fileWatcher.GetShortFileMetadata()
+
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		files[relativePath] = fileWatcher
+		states[relativePath] = shortState
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	tW.files = files
+	tW.states = states
+
+	return tW.changes(), nil
+}
+
+func (tW *TreeWatcher) changes() *TreeChanges {
+	changes := &TreeChanges{
+		Changed: make([]string, 0),
+		Removed: make([]string, 0),
+		Moved:   make(map[string]string),
+	}
+
+	added := make([]string, 0)
+
+	for _, path := range tW.Files() {
+		syncedState := tW.synced[path]
+
+		if syncedState == nil {
+			added = append(added, path)
+			continue
+		}
+
+		if syncedState.Equals(tW.states[path]) == false {
+			changes.Changed = append(changes.Changed, path)
+		}
+	}
+
+	for path := range tW.synced {
+		if tW.files[path] == nil {
+			changes.Removed = append(changes.Removed, path)
+		}
+	}
+
+	sort.Strings(changes.Removed)
+
+	// a removed file that reappears with the same content was moved
+	removed := make([]string, 0, len(changes.Removed))
+
+	for _, oldPath := range changes.Removed {
+		movedTo := -1
+
+		for index, newPath := range added {
+			if tW.synced[oldPath].Equals(tW.states[newPath]) == true {
+				movedTo = index
+				break
+			}
+		}
+
+		if movedTo < 0 {
+			removed = append(removed, oldPath)
+			continue
+		}
+
+		changes.Moved[oldPath] = added[movedTo]
+		added = append(added[:movedTo], added[movedTo+1:]...)
+	}
+
+	changes.Removed = removed
+	changes.Changed = append(changes.Changed, added...)
+	sort.Strings(changes.Changed)
+
+	return changes
+}
+
+// Sync scans the tree and hands every change to the syncer. Changes that
+// fail are kept and retried by the next call, which returns the first error
+// after all changes were tried.
+func (tW *TreeWatcher) Sync(syncer TreeSyncer) error {
+	changes, err := tW.Scan()
+
+	if err != nil {
+		return err
+	}
+
+	var firstError error
+
+	for oldPath, newPath := range changes.Moved {
+		if err := syncer.MoveFile(oldPath, newPath, tW.files[newPath]); err != nil {
+			if firstError == nil {
+				firstError = err
+			}
+			continue
+		}
+
+		tW.synced[newPath] = tW.synced[oldPath]
+		delete(tW.synced, oldPath)
+	}
+
+	for _, path := range changes.Changed {
+		if err := syncer.SyncFile(path, tW.files[path]); err != nil {
+			if firstError == nil {
+				firstError = err
+			}
+			continue
+		}
+
+		tW.synced[path] = tW.states[path]
+	}
+
+	for _, path := range changes.Removed {
+		if err := syncer.RemoveFile(path); err != nil {
+			if firstError == nil {
+				firstError = err
+			}
+			continue
+		}
+
+		delete(tW.synced, path)
+	}
+
+	return firstError
+}
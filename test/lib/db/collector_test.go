@@ -0,0 +1,209 @@
+package db_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/FBreuer2/simple-sync/lib/db"
+	"github.com/FBreuer2/simple-sync/lib/sync"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// checkCollector stores three versions of a file, each with a block of its
+// own and one shared block, and checks that only the blocks of versions the
+// retention policy removes are collected.
+func checkCollector(t *testing.T, database db.FullDatabase) {
+	user := []byte("user")
+
+	if err := database.Register(user, []byte("password")); err != nil {
+		t.Fatalf("Register failed: %s", err.Error())
+	}
+
+	sharedBlock := []byte("shared")
+
+	for _, content := range versionContents {
+		if err := database.PutBlock([]byte(content), []byte(content)); err != nil {
+			t.Fatalf("PutBlock failed: %s", err.Error())
+		}
+
+		if err := database.PutBlock(sharedBlock, sharedBlock); err != nil {
+			t.Fatalf("PutBlock failed: %s", err.Error())
+		}
+
+		shortMetadata := &sync.ShortFileMetadata{FileSize: uint64(len(content)), FileHash: []byte(content), LastChanged: time.Now()}
+		extendedMetadata := &sync.ExtendedFileMetadata{FileSize: uint64(len(content)), BlockLength: 1024, StrongBlockHashes: [][]byte{[]byte(content), sharedBlock}}
+
+		if _, err := database.PutFileVersion(user, "a.txt", shortMetadata, extendedMetadata); err != nil {
+			t.Fatalf("PutFileVersion failed: %s", err.Error())
+		}
+	}
+
+	orphanedBlock := []byte("orphaned")
+	pinnedBlock := []byte("pinned")
+
+	for _, hash := range [][]byte{orphanedBlock, pinnedBlock} {
+		if err := database.PutBlock(hash, hash); err != nil {
+			t.Fatalf("PutBlock failed: %s", err.Error())
+		}
+	}
+
+	collector := db.NewBlockCollector(database)
+	collector.Pin([][]byte{pinnedBlock})
+
+	// without a policy only unreferenced blocks are collected
+	stats, err := collector.Collect(time.Now())
+	if err != nil {
+		t.Fatalf("Collect failed: %s", err.Error())
+	}
+
+	if stats.RemovedVersions != 0 || stats.RemovedBlocks != 1 || stats.KeptBlocks != 5 {
+		t.Errorf("Collect without a policy expected 0 versions and 1 block removed and 5 kept, actual %+v", *stats)
+	}
+
+	if database.HasBlock(orphanedBlock) == true || database.HasBlock(pinnedBlock) == false {
+		t.Errorf("Collect without a policy expected to remove only the unpinned orphaned block")
+	}
+
+	collector.Unpin([][]byte{pinnedBlock})
+	collector.SetUserRetention(user, &db.RetentionPolicy{KeepLast: 1})
+
+	stats, err = collector.Collect(time.Now())
+	if err != nil {
+		t.Fatalf("Collect failed: %s", err.Error())
+	}
+
+	if stats.RemovedVersions != 2 || stats.RemovedBlocks != 3 || stats.KeptBlocks != 2 {
+		t.Errorf("Collect keeping the last version expected 2 versions and 3 blocks removed and 2 kept, actual %+v", *stats)
+	}
+
+	for index, content := range versionContents {
+		expected := index == len(versionContents)-1
+
+		if database.HasBlock([]byte(content)) != expected {
+			t.Errorf("HasBlock(%s) after Collect expected %t", content, expected)
+		}
+	}
+
+	if database.HasBlock(sharedBlock) == false {
+		t.Errorf("Collect removed a block still referenced by the retained version")
+	}
+
+	versions, err := database.ListVersions(user, "a.txt")
+	if err != nil || len(versions) != 1 || string(versions[0].Metadata.FileHash) != "third" {
+		t.Errorf("ListVersions after Collect expected the newest version only, actual %v (%v)", versions, err)
+	}
+
+	if _, err := database.RetrieveFile(user, "a.txt"); err != nil {
+		t.Errorf("RetrieveFile after Collect failed: %s", err.Error())
+	}
+}
+
+func TestMemoryDBCollector(t *testing.T) {
+	memoryDB := db.NewMemoryDB()
+	memoryDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	checkCollector(t, memoryDB)
+}
+
+func TestDiskDBCollector(t *testing.T) {
+	path, err := ioutil.TempDir("", "simple-sync-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	diskDB, err := db.NewDiskDB(path)
+	if err != nil {
+		t.Fatalf("NewDiskDB failed: %s", err.Error())
+	}
+	defer diskDB.Close()
+
+	diskDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	checkCollector(t, diskDB)
+}
+
+// checkCollectorPinsReadVersions reads a version while pinning its blocks,
+// which survive the collection that removes the version until they are
+// unpinned.
+func checkCollectorPinsReadVersions(t *testing.T, database db.FullDatabase) {
+	user := []byte("user")
+
+	if err := database.Register(user, []byte("password")); err != nil {
+		t.Fatalf("Register failed: %s", err.Error())
+	}
+
+	versions := make([]*db.FileVersion, 0)
+
+	for _, content := range versionContents[:2] {
+		if err := database.PutBlock([]byte(content), []byte(content)); err != nil {
+			t.Fatalf("PutBlock failed: %s", err.Error())
+		}
+
+		shortMetadata := &sync.ShortFileMetadata{FileSize: uint64(len(content)), FileHash: []byte(content), LastChanged: time.Now()}
+		extendedMetadata := &sync.ExtendedFileMetadata{FileSize: uint64(len(content)), BlockLength: 1024, StrongBlockHashes: [][]byte{[]byte(content)}}
+
+		version, err := database.PutFileVersion(user, "a.txt", shortMetadata, extendedMetadata)
+		if err != nil {
+			t.Fatalf("PutFileVersion failed: %s", err.Error())
+		}
+
+		versions = append(versions, version)
+	}
+
+	collector := db.NewBlockCollector(database)
+	collector.SetUserRetention(user, &db.RetentionPolicy{KeepLast: 1})
+
+	if _, err := collector.PinMetadata(func() (*sync.ExtendedFileMetadata, error) {
+		return nil, db.VERSION_NOT_AVAILABLE
+	}); err != db.VERSION_NOT_AVAILABLE {
+		t.Errorf("PinMetadata with a failing lookup expected VERSION_NOT_AVAILABLE, actual %v", err)
+	}
+
+	eFM, err := collector.PinMetadata(func() (*sync.ExtendedFileMetadata, error) {
+		return database.RetrieveVersionExtendedMetadata(user, "a.txt", versions[0].ID)
+	})
+	if err != nil {
+		t.Fatalf("PinMetadata failed: %s", err.Error())
+	}
+
+	stats, err := collector.Collect(time.Now())
+	if err != nil {
+		t.Fatalf("Collect failed: %s", err.Error())
+	}
+
+	if stats.RemovedVersions != 1 || database.HasBlock([]byte(versionContents[0])) == false {
+		t.Errorf("Collect expected to remove the read version but keep its pinned block, actual %+v", *stats)
+	}
+
+	collector.Unpin(eFM.StrongBlockHashes)
+
+	if _, err := collector.Collect(time.Now()); err != nil {
+		t.Fatalf("Collect failed: %s", err.Error())
+	}
+
+	if database.HasBlock([]byte(versionContents[0])) == true {
+		t.Errorf("Collect after Unpin expected to remove the block of the removed version")
+	}
+}
+
+func TestMemoryDBCollectorPinsReadVersions(t *testing.T) {
+	memoryDB := db.NewMemoryDB()
+	memoryDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	checkCollectorPinsReadVersions(t, memoryDB)
+}
+
+func TestDiskDBCollectorPinsReadVersions(t *testing.T) {
+	diskDB, err := db.NewDiskDB(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDiskDB failed: %s", err.Error())
+	}
+	defer diskDB.Close()
+
+	diskDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	checkCollectorPinsReadVersions(t, diskDB)
+}
@@ -0,0 +1,104 @@
+package db_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/FBreuer2/simple-sync/lib/db"
+	"github.com/FBreuer2/simple-sync/lib/sync"
+)
+
+// checkCompressedBlocks stores a compressed block and checks that it is
+// returned decompressed by RetrieveBlock and as stored by
+// RetrieveStoredBlock, and that a block that does not decompress is found
+// by Scrub.
+func checkCompressedBlocks(t *testing.T, database db.FullDatabase) []byte {
+	block := bytes.Repeat([]byte("compressible "), 100)
+	hash := strongHash(t, block)
+	compression, data := sync.CompressBlock(block)
+
+	if err := database.PutStoredBlock(hash, compression, data); err != nil {
+		t.Fatalf("PutStoredBlock failed: %s", err.Error())
+	}
+
+	if database.HasBlock(hash) == false {
+		t.Errorf("HasBlock of the compressed block expected true")
+	}
+
+	blockReader, err := database.RetrieveBlock(hash)
+	if err != nil {
+		t.Fatalf("RetrieveBlock failed: %s", err.Error())
+	}
+
+	if retrievedBlock, _ := ioutil.ReadAll(blockReader); bytes.Equal(retrievedBlock, block) == false {
+		t.Errorf("RetrieveBlock expected the decompressed block, actual %d bytes", len(retrievedBlock))
+	}
+
+	if storedCompression, storedData, err := database.RetrieveStoredBlock(hash); err != nil || storedCompression != compression || bytes.Equal(storedData, data) == false {
+		t.Errorf("RetrieveStoredBlock expected the block as stored, actual %d with %d bytes (%v)", storedCompression, len(storedData), err)
+	}
+
+	// an uncompressed upload of the same block keeps the compressed one
+	if err := database.PutBlock(hash, block); err != nil {
+		t.Fatalf("PutBlock failed: %s", err.Error())
+	}
+
+	if storedCompression, _, _ := database.RetrieveStoredBlock(hash); storedCompression != compression {
+		t.Errorf("PutBlock of a stored block replaced it")
+	}
+
+	if hashes, err := database.ListBlocks(); err != nil || len(hashes) != 1 || bytes.Equal(hashes[0], hash) == false {
+		t.Errorf("ListBlocks expected the compressed block once, actual %x (%v)", hashes, err)
+	}
+
+	if err := database.PutStoredBlock(strongHash(t, []byte("unknown")), 255, []byte("unknown")); errors.Is(err, sync.UNKNOWN_COMPRESSION) == false {
+		t.Errorf("PutStoredBlock with an unknown algorithm expected UNKNOWN_COMPRESSION, actual %v", err)
+	}
+
+	brokenHash := strongHash(t, []byte("broken"))
+
+	if err := database.PutStoredBlock(brokenHash, sync.COMPRESSION_DEFLATE, []byte("not deflated")); err != nil {
+		t.Fatalf("PutStoredBlock failed: %s", err.Error())
+	}
+
+	report, err := db.Scrub(database)
+	if err != nil {
+		t.Fatalf("Scrub failed: %s", err.Error())
+	}
+
+	if len(report.CorruptedBlocks) != 1 || bytes.Equal(report.CorruptedBlocks[0], brokenHash) == false {
+		t.Errorf("Scrub expected the block that does not decompress, actual %+v", *report)
+	}
+
+	return hash
+}
+
+func TestMemoryDBCompressedBlocks(t *testing.T) {
+	checkCompressedBlocks(t, db.NewMemoryDB())
+}
+
+func TestDiskDBCompressedBlocks(t *testing.T) {
+	path, err := ioutil.TempDir("", "simple-sync-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	diskDB, err := db.NewDiskDB(path)
+	if err != nil {
+		t.Fatalf("NewDiskDB failed: %s", err.Error())
+	}
+	defer diskDB.Close()
+
+	hash := checkCompressedBlocks(t, diskDB)
+	encodedHash := hex.EncodeToString(hash)
+
+	if _, err := os.Stat(filepath.Join(path, db.DISK_DB_BLOCK_DIR, encodedHash[:2], encodedHash[2:4], encodedHash+".deflate")); err != nil {
+		t.Errorf("Compressed block expected in a .deflate file: %s", err.Error())
+	}
+}
@@ -0,0 +1,213 @@
+package db_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/FBreuer2/simple-sync/lib/db"
+	"github.com/FBreuer2/simple-sync/lib/sync"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	STRESS_GOROUTINES = 16
+	STRESS_ITERATIONS = 50
+)
+
+// stressDatabase hammers a database from many goroutines the way several
+// peers would. Run with -race to catch unsynchronized access.
+func stressDatabase(t *testing.T, database db.FullDatabase) {
+	users := [][]byte{[]byte("alice"), []byte("bob")}
+
+	for _, user := range users {
+		if err := database.Register(user, []byte("password")); err != nil {
+			t.Fatalf("Register failed: %s", err.Error())
+		}
+	}
+
+	token, err := database.GenerateToken(users[0], []byte("password"), "device")
+	if err != nil {
+		t.Fatalf("GenerateToken failed: %s", err.Error())
+	}
+
+	var tokenLock gosync.Mutex
+	var waitGroup gosync.WaitGroup
+
+	for worker := 0; worker < STRESS_GOROUTINES; worker++ {
+		waitGroup.Add(1)
+
+		go func(worker int) {
+			defer waitGroup.Done()
+
+			user := users[worker%len(users)]
+			path := fmt.Sprintf("worker-%d/file", worker)
+
+			for iteration := 0; iteration < STRESS_ITERATIONS; iteration++ {
+				// a few blocks are shared between all workers
+				hash := []byte(fmt.Sprintf("block-%d", iteration%8))
+				block := bytes.Repeat(hash, 4)
+
+				if err := database.PutBlock(hash, block); err != nil {
+					t.Errorf("PutBlock failed: %s", err.Error())
+					return
+				}
+
+				if database.HasBlock(hash) == false {
+					t.Errorf("HasBlock expected a just written block")
+					return
+				}
+
+				reader, err := database.RetrieveBlock(hash)
+				if err != nil {
+					t.Errorf("RetrieveBlock failed: %s", err.Error())
+					return
+				}
+
+				if content, _ := ioutil.ReadAll(reader); bytes.Equal(content, block) == false {
+					t.Errorf("RetrieveBlock expected %s, actual %s", block, content)
+					return
+				}
+
+				database.PutShortFileMetadata(user, path, &sync.ShortFileMetadata{
+					FileSize:    uint64(len(block)),
+					FileHash:    hash,
+					LastChanged: time.Now(),
+				})
+
+				database.PutExtendedFileMetadata(user, path, &sync.ExtendedFileMetadata{
+					FileSize:             uint64(len(block)),
+					StrongChecksumLength: uint32(len(hash)),
+					BlockLength:          uint32(len(block)),
+					BlockAmount:          1,
+					WeakBlockHashes:      map[uint32]int64{uint32(iteration): 0},
+					StrongBlockHashes:    [][]byte{hash},
+				})
+
+				if _, err := database.RetrieveShortFileMetadata(user, path); err != nil {
+					t.Errorf("RetrieveShortFileMetadata failed: %s", err.Error())
+					return
+				}
+
+				if _, err := database.RetrieveFile(user, path); err != nil {
+					t.Errorf("RetrieveFile failed: %s", err.Error())
+					return
+				}
+
+				if worker%4 == 0 {
+					tokenLock.Lock()
+					newToken, err := database.RotateToken(users[0], token)
+					if err == nil {
+						token = newToken
+					}
+					tokenLock.Unlock()
+
+					if err != nil {
+						t.Errorf("RotateToken failed: %s", err.Error())
+						return
+					}
+				} else if _, err := database.ListTokens(users[0]); err != nil {
+					t.Errorf("ListTokens failed: %s", err.Error())
+					return
+				}
+			}
+		}(worker)
+	}
+
+	waitGroup.Wait()
+}
+
+func TestMemoryDBConcurrentUse(t *testing.T) {
+	memoryDB := db.NewMemoryDB()
+	memoryDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	stressDatabase(t, memoryDB)
+}
+
+func TestDiskDBConcurrentUse(t *testing.T) {
+	path, err := ioutil.TempDir("", "simple-sync-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	diskDB, err := db.NewDiskDB(path)
+	if err != nil {
+		t.Fatalf("NewDiskDB failed: %s", err.Error())
+	}
+	defer diskDB.Close()
+
+	diskDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	stressDatabase(t, diskDB)
+}
+
+// TestDiskDBConcurrentBlockUploads stores the same block in both
+// compressions at once, only one of them may end up on disk.
+func TestDiskDBConcurrentBlockUploads(t *testing.T) {
+	path, err := ioutil.TempDir("", "simple-sync-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	diskDB, err := db.NewDiskDB(path)
+	if err != nil {
+		t.Fatalf("NewDiskDB failed: %s", err.Error())
+	}
+	defer diskDB.Close()
+
+	block := bytes.Repeat([]byte("compressible "), 100)
+	compression, compressedBlock := sync.CompressBlock(block)
+
+	if compression == sync.COMPRESSION_NONE {
+		t.Fatalf("CompressBlock expected to compress the block")
+	}
+
+	for iteration := 0; iteration < STRESS_ITERATIONS; iteration++ {
+		hash := []byte(fmt.Sprintf("hash%d", iteration))
+
+		var waitGroup gosync.WaitGroup
+
+		for worker := 0; worker < STRESS_GOROUTINES; worker++ {
+			waitGroup.Add(1)
+
+			go func(worker int) {
+				defer waitGroup.Done()
+
+				var err error
+
+				if worker%2 == 0 {
+					err = diskDB.PutStoredBlock(hash, compression, compressedBlock)
+				} else {
+					err = diskDB.PutBlock(hash, block)
+				}
+
+				if err != nil {
+					t.Errorf("PutStoredBlock failed: %s", err.Error())
+				}
+			}(worker)
+		}
+
+		waitGroup.Wait()
+	}
+
+	blockFiles := 0
+
+	filepath.Walk(filepath.Join(path, db.DISK_DB_BLOCK_DIR), func(_ string, fileInfo os.FileInfo, err error) error {
+		if err == nil && fileInfo.Mode().IsRegular() == true {
+			blockFiles += 1
+		}
+
+		return err
+	})
+
+	if blockFiles != STRESS_ITERATIONS {
+		t.Errorf("DiskDB expected %d block files, actual %d", STRESS_ITERATIONS, blockFiles)
+	}
+}
@@ -0,0 +1,102 @@
+package db_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/FBreuer2/simple-sync/lib/db"
+	"github.com/FBreuer2/simple-sync/lib/sync"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestDiskDBPersistence(t *testing.T) {
+	path, err := ioutil.TempDir("", "simple-sync-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	diskDB, err := db.NewDiskDB(path)
+	if err != nil {
+		t.Fatalf("NewDiskDB failed: %s", err.Error())
+	}
+
+	diskDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	if err := diskDB.Register([]byte("user"), []byte("password")); err != nil {
+		t.Fatalf("Register failed: %s", err.Error())
+	}
+
+	blocks := [][]byte{[]byte("first block "), []byte("second block")}
+	hashes := [][]byte{[]byte("hash1"), []byte("hash2")}
+
+	for index := range blocks {
+		if err := diskDB.PutBlock(hashes[index], blocks[index]); err != nil {
+			t.Fatalf("PutBlock failed: %s", err.Error())
+		}
+	}
+
+	shortFileMetadata := &sync.ShortFileMetadata{FileSize: 24, FileHash: []byte("filehash"), LastChanged: time.Now()}
+	extendedFileMetadata := &sync.ExtendedFileMetadata{
+		FileSize:             24,
+		StrongChecksumLength: 5,
+		BlockLength:          12,
+		BlockAmount:          2,
+		WeakBlockHashes:      map[uint32]int64{1: 0, 2: 1},
+		StrongBlockHashes:    hashes,
+	}
+
+	diskDB.PutShortFileMetadata([]byte("user"), "photos/file.bmp", shortFileMetadata)
+	diskDB.PutExtendedFileMetadata([]byte("user"), "photos/file.bmp", extendedFileMetadata)
+	diskDB.PutShortFileMetadata([]byte("user"), "notes.txt", shortFileMetadata)
+
+	if err := diskDB.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err.Error())
+	}
+
+	diskDB, err = db.NewDiskDB(path)
+	if err != nil {
+		t.Fatalf("Reopening NewDiskDB failed: %s", err.Error())
+	}
+	defer diskDB.Close()
+
+	if err := diskDB.Login([]byte("user"), []byte("password")); err != nil {
+		t.Errorf("Login after reopening failed: %s", err.Error())
+	}
+
+	files, err := diskDB.ListFiles([]byte("user"))
+	if err != nil || len(files) != 2 || files[0] != "notes.txt" || files[1] != "photos/file.bmp" {
+		t.Errorf("ListFiles after reopening expected [notes.txt photos/file.bmp], actual %v (%v)", files, err)
+	}
+
+	retrievedSFM, err := diskDB.RetrieveShortFileMetadata([]byte("user"), "photos/file.bmp")
+	if err != nil || retrievedSFM.Equals(shortFileMetadata) == false || retrievedSFM.LastChanged.Equal(shortFileMetadata.LastChanged) == false {
+		t.Errorf("RetrieveShortFileMetadata after reopening expected %v, actual %v (%v)", shortFileMetadata, retrievedSFM, err)
+	}
+
+	retrievedEFM, err := diskDB.RetrieveExtendedFileMetadata([]byte("user"), "photos/file.bmp")
+	if err != nil || retrievedEFM.Equals(extendedFileMetadata) == false {
+		t.Errorf("RetrieveExtendedFileMetadata after reopening expected %v, actual %v (%v)", extendedFileMetadata, retrievedEFM, err)
+	}
+
+	if _, err := diskDB.RetrieveExtendedFileMetadata([]byte("user"), "notes.txt"); err != db.FILE_NOT_AVAILABLE {
+		t.Errorf("RetrieveExtendedFileMetadata for another path expected %v, actual %v", db.FILE_NOT_AVAILABLE, err)
+	}
+
+	file, err := diskDB.RetrieveFile([]byte("user"), "photos/file.bmp")
+	if err != nil {
+		t.Fatalf("RetrieveFile failed: %s", err.Error())
+	}
+
+	content, _ := ioutil.ReadAll(file)
+	if bytes.Equal(content, bytes.Join(blocks, nil)) == false {
+		t.Errorf("RetrieveFile expected %s, actual %s", bytes.Join(blocks, nil), content)
+	}
+
+	if diskDB.HasBlock([]byte("missing")) == true {
+		t.Errorf("HasBlock for a missing block expected false")
+	}
+}
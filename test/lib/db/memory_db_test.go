@@ -0,0 +1,108 @@
+package db_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/FBreuer2/simple-sync/lib/db"
+	"github.com/FBreuer2/simple-sync/lib/sync"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTokenDB(t *testing.T) *db.MemoryDB {
+	memoryDB := db.NewMemoryDB()
+	memoryDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	if err := memoryDB.Register([]byte("user"), []byte("password")); err != nil {
+		t.Fatalf("Register failed: %s", err.Error())
+	}
+
+	return memoryDB
+}
+
+func TestTokenPerDeviceAndRevocation(t *testing.T) {
+	memoryDB := newTokenDB(t)
+
+	laptopToken, err := memoryDB.GenerateToken([]byte("user"), []byte("password"), "laptop")
+	if err != nil {
+		t.Fatalf("GenerateToken failed: %s", err.Error())
+	}
+
+	desktopToken, err := memoryDB.GenerateToken([]byte("user"), []byte("password"), "desktop")
+	if err != nil {
+		t.Fatalf("GenerateToken failed: %s", err.Error())
+	}
+
+	if _, err := memoryDB.GenerateToken([]byte("user"), []byte("wrong"), "tablet"); err == nil {
+		t.Errorf("GenerateToken with a wrong password expected an error")
+	}
+
+	tokenInfos, _ := memoryDB.ListTokens([]byte("user"))
+	if len(tokenInfos) != 2 {
+		t.Errorf("ListTokens expected 2 tokens, actual %d", len(tokenInfos))
+	}
+
+	if err := memoryDB.RevokeToken([]byte("user"), "laptop"); err != nil {
+		t.Errorf("RevokeToken failed: %s", err.Error())
+	}
+
+	if err := memoryDB.ValidateToken([]byte("user"), laptopToken); errors.Is(err, db.TOKEN_NOT_AVAILABLE) == false {
+		t.Errorf("ValidateToken for a revoked token expected TOKEN_NOT_AVAILABLE, actual %v", err)
+	}
+
+	if err := memoryDB.ValidateToken([]byte("user"), desktopToken); err != nil {
+		t.Errorf("ValidateToken for the other device failed: %s", err.Error())
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	memoryDB := newTokenDB(t)
+	memoryDB.SetTokenLifetime(10 * time.Millisecond)
+
+	token, _ := memoryDB.GenerateToken([]byte("user"), []byte("password"), "laptop")
+
+	time.Sleep(20 * time.Millisecond)
+
+	if err := memoryDB.ValidateToken([]byte("user"), token); errors.Is(err, db.TOKEN_EXPIRED) == false {
+		t.Errorf("ValidateToken for an expired token expected TOKEN_EXPIRED, actual %v", err)
+	}
+
+	if _, err := memoryDB.RotateToken([]byte("user"), token); err == nil {
+		t.Errorf("RotateToken for an expired token expected an error")
+	}
+}
+
+func TestMemoryDBRemoveAndMoveFile(t *testing.T) {
+	memoryDB := newTokenDB(t)
+	user := []byte("user")
+
+	memoryDB.PutShortFileMetadata(user, "a.txt", &sync.ShortFileMetadata{FileSize: 1, FileHash: []byte("a"), LastChanged: time.Now()})
+	memoryDB.PutExtendedFileMetadata(user, "a.txt", &sync.ExtendedFileMetadata{FileSize: 1})
+	memoryDB.PutShortFileMetadata(user, "b.txt", &sync.ShortFileMetadata{FileSize: 2, FileHash: []byte("b"), LastChanged: time.Now()})
+
+	if err := memoryDB.MoveFile(user, "a.txt", "dir/a.txt"); err != nil {
+		t.Fatalf("MoveFile failed: %s", err.Error())
+	}
+
+	if _, err := memoryDB.RetrieveExtendedFileMetadata(user, "dir/a.txt"); err != nil {
+		t.Errorf("RetrieveExtendedFileMetadata after MoveFile failed: %s", err.Error())
+	}
+
+	if err := memoryDB.RemoveFile(user, "b.txt"); err != nil {
+		t.Errorf("RemoveFile failed: %s", err.Error())
+	}
+
+	if err := memoryDB.RemoveFile(user, "b.txt"); err != db.FILE_NOT_AVAILABLE {
+		t.Errorf("RemoveFile for a removed file expected FILE_NOT_AVAILABLE, actual %v", err)
+	}
+
+	if err := memoryDB.MoveFile(user, "a.txt", "c.txt"); err != db.FILE_NOT_AVAILABLE {
+		t.Errorf("MoveFile for a moved file expected FILE_NOT_AVAILABLE, actual %v", err)
+	}
+
+	files, _ := memoryDB.ListFiles(user)
+	if len(files) != 1 || files[0] != "dir/a.txt" {
+		t.Errorf("ListFiles expected [dir/a.txt], actual %v", files)
+	}
+}
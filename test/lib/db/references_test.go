@@ -0,0 +1,151 @@
+package db_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/FBreuer2/simple-sync/lib/db"
+	"github.com/FBreuer2/simple-sync/lib/sync"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var referenceVersions = []struct {
+	user     string
+	path     string
+	metadata *sync.ExtendedFileMetadata
+}{
+	{"alice", "a.txt", &sync.ExtendedFileMetadata{FileSize: 8, BlockLength: 4, StrongBlockHashes: [][]byte{[]byte("shared"), []byte("a1")}}},
+	{"alice", "a.txt", &sync.ExtendedFileMetadata{FileSize: 6, BlockLength: 4, StrongBlockHashes: [][]byte{[]byte("shared"), []byte("a2")}}},
+	{"bob", "b.txt", &sync.ExtendedFileMetadata{FileSize: 12, BlockLength: 4, StrongBlockHashes: [][]byte{[]byte("shared"), []byte("b1"), []byte("shared")}}},
+	{"bob", "c.txt", &sync.ExtendedFileMetadata{FileSize: 7, StrongBlockHashes: [][]byte{[]byte("c1"), []byte("b1")}, BlockLengths: []uint32{3, 4}}},
+}
+
+func checkDedupStats(t *testing.T, name string, stats *db.DedupStats, err error, expected db.DedupStats) {
+	if err != nil {
+		t.Errorf("%s failed: %s", name, err.Error())
+		return
+	}
+
+	if *stats != expected {
+		t.Errorf("%s expected %+v, actual %+v", name, expected, *stats)
+	}
+}
+
+// checkReferences stores versions sharing blocks across files and users and
+// checks that removing all versions of one user keeps the blocks of the
+// other one.
+func checkReferences(t *testing.T, database db.FullDatabase) {
+	for _, user := range []string{"alice", "bob"} {
+		if err := database.Register([]byte(user), []byte("password")); err != nil {
+			t.Fatalf("Register failed: %s", err.Error())
+		}
+	}
+
+	for _, instance := range referenceVersions {
+		for _, hash := range instance.metadata.StrongBlockHashes {
+			if err := database.PutBlock(hash, hash); err != nil {
+				t.Fatalf("PutBlock failed: %s", err.Error())
+			}
+		}
+
+		shortMetadata := &sync.ShortFileMetadata{FileSize: instance.metadata.FileSize, FileHash: []byte(instance.path), LastChanged: time.Now()}
+
+		if _, err := database.PutFileVersion([]byte(instance.user), instance.path, shortMetadata, instance.metadata); err != nil {
+			t.Fatalf("PutFileVersion failed: %s", err.Error())
+		}
+	}
+
+	// stored blocks are not overwritten
+	if err := database.PutBlock([]byte("shared"), []byte("other")); err != nil {
+		t.Fatalf("PutBlock failed: %s", err.Error())
+	}
+
+	if blockReader, err := database.RetrieveBlock([]byte("shared")); err != nil {
+		t.Errorf("RetrieveBlock failed: %s", err.Error())
+	} else if block, _ := ioutil.ReadAll(blockReader); bytes.Equal(block, []byte("shared")) == false {
+		t.Errorf("PutBlock overwrote a stored block with %s", string(block))
+	}
+
+	for hash, expected := range map[string]uint64{"shared": 3, "a1": 1, "a2": 1, "b1": 2, "c1": 1, "unknown": 0} {
+		if references, err := database.BlockReferences([]byte(hash)); err != nil || references != expected {
+			t.Errorf("BlockReferences(%s) expected %d, actual %d (%v)", hash, expected, references, err)
+		}
+	}
+
+	stats, err := database.UserDedupStats([]byte("alice"))
+	checkDedupStats(t, "UserDedupStats(alice)", stats, err, db.DedupStats{LogicalBytes: 14, PhysicalBytes: 10, Blocks: 3})
+
+	stats, err = database.UserDedupStats([]byte("bob"))
+	checkDedupStats(t, "UserDedupStats(bob)", stats, err, db.DedupStats{LogicalBytes: 19, PhysicalBytes: 11, Blocks: 3})
+
+	stats, err = database.DedupStats()
+	checkDedupStats(t, "DedupStats", stats, err, db.DedupStats{LogicalBytes: 33, PhysicalBytes: 17, Blocks: 5})
+
+	if err := database.RemoveFile([]byte("alice"), "a.txt"); err != nil {
+		t.Fatalf("RemoveFile failed: %s", err.Error())
+	}
+
+	for _, id := range []uint64{1, 2} {
+		if err := database.RemoveVersion([]byte("alice"), "a.txt", id); err != nil {
+			t.Fatalf("RemoveVersion failed: %s", err.Error())
+		}
+	}
+
+	stats, err = database.UserDedupStats([]byte("alice"))
+	checkDedupStats(t, "UserDedupStats(alice) after RemoveVersion", stats, err, db.DedupStats{})
+
+	stats, err = database.DedupStats()
+	checkDedupStats(t, "DedupStats after RemoveVersion", stats, err, db.DedupStats{LogicalBytes: 19, PhysicalBytes: 11, Blocks: 3})
+
+	if err := database.RemoveBlock([]byte("shared")); errors.Is(err, db.BLOCK_REFERENCED) == false {
+		t.Errorf("RemoveBlock of a block referenced by another user expected BLOCK_REFERENCED, actual %v", err)
+	}
+
+	collectionStats, err := db.NewBlockCollector(database).Collect(time.Now())
+	if err != nil {
+		t.Fatalf("Collect failed: %s", err.Error())
+	}
+
+	if collectionStats.RemovedBlocks != 2 {
+		t.Errorf("Collect expected to remove the 2 blocks only alice referenced, actual %+v", *collectionStats)
+	}
+
+	for hash, expected := range map[string]bool{"shared": true, "a1": false, "a2": false, "b1": true, "c1": true} {
+		if database.HasBlock([]byte(hash)) != expected {
+			t.Errorf("HasBlock(%s) after Collect expected %t", hash, expected)
+		}
+	}
+
+	if _, err := database.RetrieveFile([]byte("bob"), "b.txt"); err != nil {
+		t.Errorf("RetrieveFile of the other user after Collect failed: %s", err.Error())
+	}
+}
+
+func TestMemoryDBReferences(t *testing.T) {
+	memoryDB := db.NewMemoryDB()
+	memoryDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	checkReferences(t, memoryDB)
+}
+
+func TestDiskDBReferences(t *testing.T) {
+	path, err := ioutil.TempDir("", "simple-sync-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	diskDB, err := db.NewDiskDB(path)
+	if err != nil {
+		t.Fatalf("NewDiskDB failed: %s", err.Error())
+	}
+	defer diskDB.Close()
+
+	diskDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	checkReferences(t, diskDB)
+}
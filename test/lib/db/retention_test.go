@@ -0,0 +1,104 @@
+package db_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/FBreuer2/simple-sync/lib/db"
+)
+
+var retentionNow = time.Date(2020, time.June, 15, 12, 0, 0, 0, time.UTC)
+
+// retentionVersions are stored every 12 hours over the ten days before
+// retentionNow, oldest first.
+func retentionVersions() []*db.FileVersion {
+	versions := make([]*db.FileVersion, 0, 20)
+
+	for index := 0; index < 20; index++ {
+		versions = append(versions, &db.FileVersion{
+			ID:       uint64(index + 1),
+			StoredAt: retentionNow.Add(-time.Duration(20-index) * 12 * time.Hour),
+		})
+	}
+
+	return versions
+}
+
+var retentionCombinations = []struct {
+	name       string
+	policy     db.RetentionPolicy
+	fileExists bool
+	keptIDs    []uint64
+}{
+	{"no rules", db.RetentionPolicy{}, true, []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}},
+	{"last", db.RetentionPolicy{KeepLast: 3}, true, []uint64{18, 19, 20}},
+	{"last of removed file", db.RetentionPolicy{KeepLast: 1}, false, []uint64{20}},
+	{"hourly", db.RetentionPolicy{KeepHourly: 2}, true, []uint64{19, 20}},
+	{"daily", db.RetentionPolicy{KeepDaily: 3}, true, []uint64{17, 19, 20}},
+	{"weekly", db.RetentionPolicy{KeepWeekly: 3}, true, []uint64{5, 19, 20}},
+	{"monthly", db.RetentionPolicy{KeepMonthly: 12}, true, []uint64{20}},
+	{"combined", db.RetentionPolicy{KeepLast: 3, KeepDaily: 3}, true, []uint64{17, 18, 19, 20}},
+	{"max age", db.RetentionPolicy{MaxAge: 48 * time.Hour}, true, []uint64{17, 18, 19, 20}},
+	{"max age overrides rules", db.RetentionPolicy{KeepLast: 10, MaxAge: 24 * time.Hour}, true, []uint64{19, 20}},
+	{"max age keeps current version", db.RetentionPolicy{MaxAge: time.Hour}, true, []uint64{20}},
+	{"max age of removed file", db.RetentionPolicy{MaxAge: time.Hour}, false, []uint64{}},
+}
+
+func TestRetentionPolicySelect(t *testing.T) {
+	for _, combination := range retentionCombinations {
+		versions := retentionVersions()
+		keep, remove := combination.policy.Select(versions, combination.fileExists, retentionNow)
+
+		if len(keep)+len(remove) != len(versions) {
+			t.Errorf("%s: Select expected %d versions in total, actual %d", combination.name, len(versions), len(keep)+len(remove))
+		}
+
+		if len(keep) != len(combination.keptIDs) {
+			t.Errorf("%s: Select expected to keep %v, actual %d versions", combination.name, combination.keptIDs, len(keep))
+			continue
+		}
+
+		for index, version := range keep {
+			if version.ID != combination.keptIDs[index] {
+				t.Errorf("%s: Select expected to keep %v, actual version %d at %d", combination.name, combination.keptIDs, version.ID, index)
+			}
+		}
+	}
+}
+
+var retentionSpecCombinations = []struct {
+	spec     string
+	expected *db.RetentionPolicy
+}{
+	{"", &db.RetentionPolicy{}},
+	{"last=10", &db.RetentionPolicy{KeepLast: 10}},
+	{"last=1, hourly=24,daily=7,weekly=4,monthly=12,max-age=8760h", &db.RetentionPolicy{KeepLast: 1, KeepHourly: 24, KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 12, MaxAge: 8760 * time.Hour}},
+	{"last", nil},
+	{"last=-1", nil},
+	{"yearly=2", nil},
+	{"max-age=forever", nil},
+}
+
+func TestParseRetentionPolicy(t *testing.T) {
+	for _, combination := range retentionSpecCombinations {
+		policy, err := db.ParseRetentionPolicy(combination.spec)
+
+		if combination.expected == nil {
+			if errors.Is(err, db.INVALID_RETENTION_POLICY) == false {
+				t.Errorf("ParseRetentionPolicy(%q) expected INVALID_RETENTION_POLICY, actual %v", combination.spec, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseRetentionPolicy(%q) failed: %s", combination.spec, err.Error())
+			continue
+		}
+
+		if *policy != *combination.expected {
+			t.Errorf("ParseRetentionPolicy(%q) expected %+v, actual %+v", combination.spec, *combination.expected, *policy)
+		}
+	}
+}
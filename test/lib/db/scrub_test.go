@@ -0,0 +1,133 @@
+package db_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/FBreuer2/librsync-go"
+	"github.com/FBreuer2/simple-sync/lib/db"
+	"github.com/FBreuer2/simple-sync/lib/sync"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func strongHash(t *testing.T, block []byte) []byte {
+	hash, err := librsync.CalcStrongSum(block, librsync.BLAKE2_SIG_MAGIC, 32)
+	if err != nil {
+		t.Fatalf("CalcStrongSum failed: %s", err.Error())
+	}
+
+	return hash
+}
+
+// checkScrub stores two intact blocks and one stored under the hash of other
+// content and checks that only the latter is quarantined, along with the
+// version referencing it, after which it can be stored again.
+func checkScrub(t *testing.T, database db.FullDatabase) []byte {
+	user := []byte("user")
+
+	if err := database.Register(user, []byte("password")); err != nil {
+		t.Fatalf("Register failed: %s", err.Error())
+	}
+
+	intactBlocks := [][]byte{[]byte("first"), []byte("second")}
+
+	for _, block := range intactBlocks {
+		if err := database.PutBlock(strongHash(t, block), block); err != nil {
+			t.Fatalf("PutBlock failed: %s", err.Error())
+		}
+	}
+
+	corruptedHash := strongHash(t, []byte("original"))
+
+	if err := database.PutBlock(corruptedHash, []byte("flipped!")); err != nil {
+		t.Fatalf("PutBlock failed: %s", err.Error())
+	}
+
+	versionBlocks := map[string][][]byte{
+		"intact.txt":  {strongHash(t, intactBlocks[0]), strongHash(t, intactBlocks[1])},
+		"damaged.txt": {strongHash(t, intactBlocks[0]), corruptedHash},
+	}
+
+	for path, strongHashes := range versionBlocks {
+		shortMetadata := &sync.ShortFileMetadata{FileHash: []byte(path), LastChanged: time.Now()}
+		extendedMetadata := &sync.ExtendedFileMetadata{BlockLength: 1024, StrongBlockHashes: strongHashes}
+
+		if _, err := database.PutFileVersion(user, path, shortMetadata, extendedMetadata); err != nil {
+			t.Fatalf("PutFileVersion failed: %s", err.Error())
+		}
+	}
+
+	report, err := db.Scrub(database)
+	if err != nil {
+		t.Fatalf("Scrub failed: %s", err.Error())
+	}
+
+	if report.CheckedBlocks != 3 || len(report.CorruptedBlocks) != 1 || bytes.Equal(report.CorruptedBlocks[0], corruptedHash) == false {
+		t.Errorf("Scrub expected 3 checked blocks and the corrupted one reported, actual %+v", *report)
+	}
+
+	if len(report.DamagedVersions) != 1 || report.DamagedVersions[0].Path != "damaged.txt" || bytes.Equal(report.DamagedVersions[0].User, user) == false {
+		t.Errorf("Scrub expected the version of \"damaged.txt\" reported, actual %v", report.DamagedVersions)
+	}
+
+	if database.HasBlock(corruptedHash) == true {
+		t.Errorf("HasBlock of the quarantined block expected false")
+	}
+
+	for _, block := range intactBlocks {
+		if database.HasBlock(strongHash(t, block)) == false {
+			t.Errorf("Scrub removed the intact block %s", string(block))
+		}
+	}
+
+	// the next upload heals the block
+	if err := database.PutBlock(corruptedHash, []byte("original")); err != nil {
+		t.Fatalf("PutBlock failed: %s", err.Error())
+	}
+
+	report, err = db.Scrub(database)
+	if err != nil {
+		t.Fatalf("Scrub failed: %s", err.Error())
+	}
+
+	if report.CheckedBlocks != 3 || len(report.CorruptedBlocks) != 0 || len(report.DamagedVersions) != 0 {
+		t.Errorf("Scrub after healing expected 3 intact blocks, actual %+v", *report)
+	}
+
+	return corruptedHash
+}
+
+func TestMemoryDBScrub(t *testing.T) {
+	memoryDB := db.NewMemoryDB()
+	memoryDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	checkScrub(t, memoryDB)
+}
+
+func TestDiskDBScrub(t *testing.T) {
+	path, err := ioutil.TempDir("", "simple-sync-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	diskDB, err := db.NewDiskDB(path)
+	if err != nil {
+		t.Fatalf("NewDiskDB failed: %s", err.Error())
+	}
+	defer diskDB.Close()
+
+	diskDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	corruptedHash := checkScrub(t, diskDB)
+
+	quarantined, err := ioutil.ReadFile(filepath.Join(path, db.DISK_DB_QUARANTINE_DIR, hex.EncodeToString(corruptedHash)))
+	if err != nil || bytes.Equal(quarantined, []byte("flipped!")) == false {
+		t.Errorf("Quarantined block expected in the quarantine directory, actual %q (%v)", quarantined, err)
+	}
+}
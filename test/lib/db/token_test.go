@@ -0,0 +1,93 @@
+package db_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/FBreuer2/simple-sync/lib/db"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func checkTokenRotation(t *testing.T, database db.FullDatabase) {
+	user := []byte("user")
+
+	if err := database.Register(user, []byte("password")); err != nil {
+		t.Fatalf("Register failed: %s", err.Error())
+	}
+
+	token, _ := database.GenerateToken(user, []byte("password"), "laptop")
+
+	rotatedToken, err := database.RotateToken(user, token)
+	if err != nil {
+		t.Fatalf("RotateToken failed: %s", err.Error())
+	}
+
+	if bytes.Equal(token, rotatedToken) == true {
+		t.Errorf("RotateToken expected a new token")
+	}
+
+	// the client may not have stored the successor yet
+	if err := database.ValidateToken(user, token); err != nil {
+		t.Errorf("ValidateToken for a token whose successor was not used failed: %s", err.Error())
+	}
+
+	if err := database.ValidateToken(user, rotatedToken); err != nil {
+		t.Errorf("ValidateToken for the successor failed: %s", err.Error())
+	}
+
+	// rotating the old token again replaces the unused successor
+	retriedToken, err := database.RotateToken(user, token)
+	if err != nil {
+		t.Fatalf("RotateToken of a token whose successor was not used failed: %s", err.Error())
+	}
+
+	if err := database.ValidateToken(user, rotatedToken); errors.Is(err, db.TOKEN_NOT_AVAILABLE) == false {
+		t.Errorf("ValidateToken for a replaced successor expected TOKEN_NOT_AVAILABLE, actual %v", err)
+	}
+
+	// using the successor revokes the old token
+	if _, err := database.RotateToken(user, retriedToken); err != nil {
+		t.Fatalf("RotateToken of the successor failed: %s", err.Error())
+	}
+
+	if err := database.ValidateToken(user, token); errors.Is(err, db.TOKEN_NOT_AVAILABLE) == false {
+		t.Errorf("ValidateToken for a rotated token expected TOKEN_NOT_AVAILABLE, actual %v", err)
+	}
+
+	if err := database.ValidateToken(user, retriedToken); err != nil {
+		t.Errorf("ValidateToken for the used successor failed: %s", err.Error())
+	}
+
+	tokenInfos, _ := database.ListTokens(user)
+	if len(tokenInfos) != 1 || tokenInfos[0].Label != "laptop" {
+		t.Errorf("ListTokens expected only the laptop token, actual %v", tokenInfos)
+	}
+}
+
+func TestMemoryDBTokenRotation(t *testing.T) {
+	memoryDB := db.NewMemoryDB()
+	memoryDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	checkTokenRotation(t, memoryDB)
+}
+
+func TestDiskDBTokenRotation(t *testing.T) {
+	path, err := ioutil.TempDir("", "simple-sync-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	diskDB, err := db.NewDiskDB(path)
+	if err != nil {
+		t.Fatalf("NewDiskDB failed: %s", err.Error())
+	}
+	defer diskDB.Close()
+
+	diskDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	checkTokenRotation(t, diskDB)
+}
@@ -0,0 +1,133 @@
+package db_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/FBreuer2/simple-sync/lib/db"
+	"github.com/FBreuer2/simple-sync/lib/sync"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var versionContents = []string{"first", "second", "third"}
+
+// checkVersions stores a few versions of a file and checks that older ones
+// stay available through removes and moves.
+func checkVersions(t *testing.T, database db.FullDatabase) {
+	user := []byte("user")
+
+	if err := database.Register(user, []byte("password")); err != nil {
+		t.Fatalf("Register failed: %s", err.Error())
+	}
+
+	if _, err := database.ListVersions(user, "a.txt"); errors.Is(err, db.FILE_NOT_AVAILABLE) == false {
+		t.Errorf("ListVersions without versions expected FILE_NOT_AVAILABLE, actual %v", err)
+	}
+
+	storedBetween := make([]time.Time, 0, len(versionContents))
+
+	for index, content := range versionContents {
+		shortMetadata := &sync.ShortFileMetadata{FileSize: uint64(len(content)), FileHash: []byte(content), LastChanged: time.Now()}
+		extendedMetadata := &sync.ExtendedFileMetadata{FileSize: uint64(len(content)), BlockLength: 1024, StrongBlockHashes: [][]byte{[]byte(content)}}
+
+		version, err := database.PutFileVersion(user, "a.txt", shortMetadata, extendedMetadata)
+		if err != nil {
+			t.Fatalf("PutFileVersion failed: %s", err.Error())
+		}
+
+		if version.ID != uint64(index+1) {
+			t.Errorf("PutFileVersion::ID expected %d, actual %d", index+1, version.ID)
+		}
+
+		time.Sleep(2 * time.Millisecond)
+		storedBetween = append(storedBetween, time.Now())
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	current, err := database.RetrieveShortFileMetadata(user, "a.txt")
+	if err != nil || string(current.FileHash) != "third" {
+		t.Errorf("RetrieveShortFileMetadata expected the newest version, actual %v (%v)", current, err)
+	}
+
+	versions, err := database.ListVersions(user, "a.txt")
+	if err != nil || len(versions) != len(versionContents) {
+		t.Fatalf("ListVersions expected %d versions, actual %v (%v)", len(versionContents), versions, err)
+	}
+
+	for index, version := range versions {
+		if version.ID != uint64(index+1) || string(version.Metadata.FileHash) != versionContents[index] {
+			t.Errorf("ListVersions[%d] expected %s, actual %d %s", index, versionContents[index], version.ID, string(version.Metadata.FileHash))
+		}
+
+		extendedMetadata, err := database.RetrieveVersionExtendedMetadata(user, "a.txt", version.ID)
+		if err != nil || string(extendedMetadata.StrongBlockHashes[0]) != versionContents[index] {
+			t.Errorf("RetrieveVersionExtendedMetadata(%d) expected %s, actual %v (%v)", version.ID, versionContents[index], extendedMetadata, err)
+		}
+	}
+
+	for index, at := range storedBetween {
+		version, err := database.RetrieveVersionAt(user, "a.txt", at)
+		if err != nil || version.ID != uint64(index+1) {
+			t.Errorf("RetrieveVersionAt expected version %d, actual %v (%v)", index+1, version, err)
+		}
+	}
+
+	if _, err := database.RetrieveVersionAt(user, "a.txt", versions[0].StoredAt.Add(-time.Second)); errors.Is(err, db.VERSION_NOT_AVAILABLE) == false {
+		t.Errorf("RetrieveVersionAt before the first version expected VERSION_NOT_AVAILABLE, actual %v", err)
+	}
+
+	if _, err := database.RetrieveVersion(user, "a.txt", 42); errors.Is(err, db.VERSION_NOT_AVAILABLE) == false {
+		t.Errorf("RetrieveVersion of an unknown id expected VERSION_NOT_AVAILABLE, actual %v", err)
+	}
+
+	// a move starts the history of the new path with the moved file
+	if err := database.MoveFile(user, "a.txt", "b.txt"); err != nil {
+		t.Fatalf("MoveFile failed: %s", err.Error())
+	}
+
+	movedVersions, err := database.ListVersions(user, "b.txt")
+	if err != nil || len(movedVersions) != 1 || string(movedVersions[0].Metadata.FileHash) != "third" {
+		t.Errorf("ListVersions after MoveFile expected the moved version, actual %v (%v)", movedVersions, err)
+	}
+
+	if err := database.RemoveFile(user, "b.txt"); err != nil {
+		t.Fatalf("RemoveFile failed: %s", err.Error())
+	}
+
+	version, err := database.RetrieveVersion(user, "a.txt", 1)
+	if err != nil || string(version.Metadata.FileHash) != "first" {
+		t.Errorf("RetrieveVersion after MoveFile and RemoveFile expected the first version, actual %v (%v)", version, err)
+	}
+
+	if _, err := database.ListVersions(user, "b.txt"); err != nil {
+		t.Errorf("ListVersions after RemoveFile failed: %s", err.Error())
+	}
+}
+
+func TestMemoryDBVersions(t *testing.T) {
+	memoryDB := db.NewMemoryDB()
+	memoryDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	checkVersions(t, memoryDB)
+}
+
+func TestDiskDBVersions(t *testing.T) {
+	path, err := ioutil.TempDir("", "simple-sync-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	diskDB, err := db.NewDiskDB(path)
+	if err != nil {
+		t.Fatalf("NewDiskDB failed: %s", err.Error())
+	}
+	defer diskDB.Close()
+
+	diskDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	checkVersions(t, diskDB)
+}
@@ -0,0 +1,399 @@
+package net_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/FBreuer2/simple-sync/lib/net"
+	"github.com/FBreuer2/simple-sync/lib/sync"
+	"golang.org/x/crypto/sha3"
+)
+
+// testServerCapabilities leave out compression, so the client answers with
+// plain blocks.
+const testServerCapabilities = net.SUPPORTED_CAPABILITIES &^ net.CAPABILITY_COMPRESSION
+
+func newTestCertificate(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err.Error())
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "simple-sync test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %s", err.Error())
+	}
+
+	fingerprint := sha3.Sum256(certificate)
+
+	return tls.Certificate{Certificate: [][]byte{certificate}, PrivateKey: key}, hex.EncodeToString(fingerprint[:])
+}
+
+// startTestServer accepts a single client, answers its hello and login like
+// a server would and hands the connection to the test.
+func startTestServer(t *testing.T) (string, string, <-chan *net.Codec) {
+	certificate, fingerprint := newTestCertificate(t)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err.Error())
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	codecs := make(chan *net.Codec, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		codec := net.NewCodec(conn, net.DEFAULT_PACKET_REGISTRY)
+		t.Cleanup(func() { codec.Close() })
+
+		if packet, err := codec.ReadPacket(); err != nil || packet.Type() != net.HELLO {
+			t.Errorf("Test server expected a hello, actual %v (%v)", packet, err)
+			return
+		}
+
+		codec.WritePacket(net.NewNegotiatedHelloPacket(net.CURRENT_VERSION, testServerCapabilities, net.DEFAULT_MAX_FRAME_LENGTH))
+		codec.SetReadFrameLength(net.DEFAULT_MAX_FRAME_LENGTH)
+		codec.SetWriteFrameLength(net.DEFAULT_MAX_FRAME_LENGTH)
+		codec.SetReadVersion(net.CURRENT_VERSION)
+		codec.SetWriteVersion(net.CURRENT_VERSION)
+
+		if packet, err := codec.ReadPacket(); err != nil || packet.Type() != net.LOGIN {
+			t.Errorf("Test server expected a login, actual %v (%v)", packet, err)
+			return
+		}
+
+		codec.WritePacket(net.NewReplyPacket(net.REPLY_OK, ""))
+		codecs <- codec
+	}()
+
+	return listener.Addr().String(), fingerprint, codecs
+}
+
+func readTestPacket(t *testing.T, codec *net.Codec, packetType uint16) net.EncapsulatablePacket {
+	packet, err := codec.ReadPacket()
+
+	if err != nil {
+		t.Fatalf("Reading packet of type %d failed: %s", packetType, err.Error())
+	}
+
+	if packet.Type() != packetType {
+		t.Fatalf("Expected packet of type %d, actual %d", packetType, packet.Type())
+	}
+
+	return packet
+}
+
+// TestClientAnswersRequests syncs a file to a test server that requests its
+// metadata and all of its blocks at once, like a server pulling a new file.
+func TestClientAnswersRequests(t *testing.T) {
+	address, fingerprint, codecs := startTestServer(t)
+
+	data := make([]byte, 3*net.DEFAULT_BLOCK_LENGTH+17)
+	rand.Read(data)
+
+	filePath := filepath.Join(t.TempDir(), "file.bin")
+
+	if err := ioutil.WriteFile(filePath, data, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %s", err.Error())
+	}
+
+	fileWatcher, err := sync.NewFileWatcher(filePath)
+
+	if err != nil {
+		t.Fatalf("NewFileWatcher failed: %s", err.Error())
+	}
+
+	client := net.NewClient(address, fingerprint, net.Credentials{Username: []byte("admin"), Password: []byte("123")})
+
+	if err := client.Start(); err != nil {
+		t.Fatalf("Start failed: %s", err.Error())
+	}
+
+	defer client.Stop()
+
+	synced := make(chan error, 1)
+
+	go func() {
+		synced <- client.SyncFile("photos/file.bin", fileWatcher)
+	}()
+
+	codec := <-codecs
+	sFMPacket := readTestPacket(t, codec, net.SHORT_FILE_METADATA).(*net.ShortFileMetadataPacket)
+
+	if string(sFMPacket.Path) != "photos/file.bin" || sFMPacket.FileSize != uint64(len(data)) {
+		t.Fatalf("Test server expected metadata of \"photos/file.bin\", actual \"%s\" with %d bytes", sFMPacket.Path, sFMPacket.FileSize)
+	}
+
+	codec.WritePacket(mustPacket(net.NewRequestExtendedFileMetadataPacket("photos/file.bin", net.DEFAULT_BLOCK_LENGTH, net.DEFAULT_STRONG_CHECKSUM_LENGTH)))
+
+	expectedEFM, err := sync.SignFile(bytes.NewReader(data), net.DEFAULT_BLOCK_LENGTH, net.DEFAULT_STRONG_CHECKSUM_LENGTH)
+
+	if err != nil {
+		t.Fatalf("SignFile failed: %s", err.Error())
+	}
+
+	eFM, err := readTestPacket(t, codec, net.EXTENDED_FILE_METADATA).(*net.ExtendedFileMetadataPacket).GetData()
+
+	if err != nil || eFM.Equals(expectedEFM) == false {
+		t.Fatalf("Client sent extended metadata %v (%v), expected %v", eFM, err, expectedEFM)
+	}
+
+	// the requests are answered concurrently, in any order
+	for _, strongHash := range expectedEFM.StrongBlockHashes {
+		requestBlockPacket, _ := net.NewRequestBlockPacket("photos/file.bin", strongHash)
+		codec.WritePacket(requestBlockPacket)
+	}
+
+	blocks := make(map[string][]byte)
+
+	for range expectedEFM.StrongBlockHashes {
+		blockPacket := readTestPacket(t, codec, net.BLOCK_PACKET).(*net.BlockPacket)
+		blocks[string(blockPacket.StrongChecksum)] = blockPacket.Data
+	}
+
+	for index, strongHash := range expectedEFM.StrongBlockHashes {
+		offset, length := expectedEFM.BlockRange(index)
+		end := offset + int64(length)
+
+		// the last block is shorter
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+
+		if bytes.Equal(blocks[string(strongHash)], data[offset:end]) == false {
+			t.Errorf("Client sent wrong data for block %d", index)
+		}
+	}
+
+	codec.WritePacket(net.NewReplyPacket(net.REPLY_OK, ""))
+
+	if err := <-synced; err != nil {
+		t.Errorf("SyncFile failed: %s", err.Error())
+	}
+}
+
+// TestClientReportsUnknownFiles requests a block of a file the client never
+// synced, which is reported instead of answered.
+func TestClientReportsUnknownFiles(t *testing.T) {
+	address, fingerprint, codecs := startTestServer(t)
+
+	client := net.NewClient(address, fingerprint, net.Credentials{Username: []byte("admin"), Password: []byte("123")})
+
+	if err := client.Start(); err != nil {
+		t.Fatalf("Start failed: %s", err.Error())
+	}
+
+	defer client.Stop()
+
+	codec := <-codecs
+	requestBlockPacket, _ := net.NewRequestBlockPacket("photos/unknown.bin", []byte("abcd"))
+	codec.WritePacket(requestBlockPacket)
+
+	// the server is told as well, so it does not wait for the block
+	if replyPacket := readTestPacket(t, codec, net.REPLY).(*net.ReplyPacket); replyPacket.ErrorCode != net.REPLY_FILE_NOT_AVAILABLE {
+		t.Errorf("Client expected to reply REPLY_FILE_NOT_AVAILABLE, actual %d", replyPacket.ErrorCode)
+	}
+
+	select {
+	case err := <-client.Errors():
+		if err == nil {
+			t.Errorf("Errors expected an error for the unknown file")
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Errorf("Errors expected an error for the unknown file, actual none")
+	}
+}
+
+// TestClientRejectsUnavailableRequests requests a block the file does not
+// have and the metadata of the file once it is removed, which the client
+// replies to instead of leaving the server waiting.
+func TestClientRejectsUnavailableRequests(t *testing.T) {
+	address, fingerprint, codecs := startTestServer(t)
+
+	filePath := filepath.Join(t.TempDir(), "file.bin")
+
+	if err := ioutil.WriteFile(filePath, []byte("data"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %s", err.Error())
+	}
+
+	fileWatcher, err := sync.NewFileWatcher(filePath)
+
+	if err != nil {
+		t.Fatalf("NewFileWatcher failed: %s", err.Error())
+	}
+
+	client := net.NewClient(address, fingerprint, net.Credentials{Username: []byte("admin"), Password: []byte("123")})
+
+	if err := client.Start(); err != nil {
+		t.Fatalf("Start failed: %s", err.Error())
+	}
+
+	defer client.Stop()
+
+	synced := make(chan error, 1)
+
+	go func() {
+		synced <- client.SyncFile("photos/file.bin", fileWatcher)
+	}()
+
+	codec := <-codecs
+	readTestPacket(t, codec, net.SHORT_FILE_METADATA)
+
+	codec.WritePacket(mustPacket(net.NewRequestBlockPacket("photos/file.bin", []byte("abcd"))))
+
+	if replyPacket := readTestPacket(t, codec, net.REPLY).(*net.ReplyPacket); replyPacket.ErrorCode != net.REPLY_BLOCK_NOT_AVAILABLE {
+		t.Errorf("Client expected to reply REPLY_BLOCK_NOT_AVAILABLE to an unknown block, actual %d", replyPacket.ErrorCode)
+	}
+
+	if err := os.Remove(filePath); err != nil {
+		t.Fatalf("Remove failed: %s", err.Error())
+	}
+
+	codec.WritePacket(mustPacket(net.NewRequestExtendedFileMetadataPacket("photos/file.bin", net.DEFAULT_BLOCK_LENGTH, net.DEFAULT_STRONG_CHECKSUM_LENGTH)))
+
+	if replyPacket := readTestPacket(t, codec, net.REPLY).(*net.ReplyPacket); replyPacket.ErrorCode != net.REPLY_FILE_NOT_AVAILABLE {
+		t.Errorf("Client expected to reply REPLY_FILE_NOT_AVAILABLE to metadata of a removed file, actual %d", replyPacket.ErrorCode)
+	}
+
+	codec.WritePacket(net.NewReplyPacket(net.REPLY_FILE_NOT_AVAILABLE, ""))
+
+	if err := <-synced; errors.Is(err, net.FILE_NOT_AVAILABLE) == false {
+		t.Errorf("SyncFile of a removed file expected FILE_NOT_AVAILABLE, actual %v", err)
+	}
+}
+
+// TestClientRetriesWhenBusy syncs a file to a test server that is busy at
+// first, the client sends the metadata again.
+func TestClientRetriesWhenBusy(t *testing.T) {
+	address, fingerprint, codecs := startTestServer(t)
+
+	filePath := filepath.Join(t.TempDir(), "file.bin")
+
+	if err := ioutil.WriteFile(filePath, []byte("data"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %s", err.Error())
+	}
+
+	fileWatcher, err := sync.NewFileWatcher(filePath)
+
+	if err != nil {
+		t.Fatalf("NewFileWatcher failed: %s", err.Error())
+	}
+
+	client := net.NewClient(address, fingerprint, net.Credentials{Username: []byte("admin"), Password: []byte("123")})
+
+	if err := client.Start(); err != nil {
+		t.Fatalf("Start failed: %s", err.Error())
+	}
+
+	defer client.Stop()
+
+	synced := make(chan error, 1)
+
+	go func() {
+		synced <- client.SyncFile("photos/file.bin", fileWatcher)
+	}()
+
+	codec := <-codecs
+	readTestPacket(t, codec, net.SHORT_FILE_METADATA)
+	codec.WritePacket(net.NewReplyPacket(net.REPLY_BUSY, ""))
+
+	readTestPacket(t, codec, net.SHORT_FILE_METADATA)
+	codec.WritePacket(net.NewReplyPacket(net.REPLY_OK, ""))
+
+	if err := <-synced; err != nil {
+		t.Errorf("SyncFile after a busy reply failed: %s", err.Error())
+	}
+}
+
+func TestClientStop(t *testing.T) {
+	address, fingerprint, codecs := startTestServer(t)
+
+	client := net.NewClient(address, fingerprint, net.Credentials{Username: []byte("admin"), Password: []byte("123")})
+
+	if err := client.Start(); err != nil {
+		t.Fatalf("Start failed: %s", err.Error())
+	}
+
+	codec := <-codecs
+	client.Stop()
+
+	if _, err := codec.ReadPacket(); err == nil {
+		t.Errorf("Reading from a stopped client expected an error")
+	}
+
+	if err := client.RemoveFile("photos/file.bin"); err == nil {
+		t.Errorf("RemoveFile on a stopped client expected an error")
+	}
+}
+
+// TestClientWithoutCredentials starts a client that has neither a password
+// nor a stored token, which fails before connecting.
+func TestClientWithoutCredentials(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "simple-sync.token")
+
+	for _, credentials := range []net.Credentials{
+		{Username: []byte("admin")},
+		{Username: []byte("admin"), TokenFile: tokenFile},
+	} {
+		client := net.NewClient("127.0.0.1:1", "", credentials)
+
+		if err := client.Start(); errors.Is(err, net.NO_CREDENTIALS) == false {
+			t.Errorf("Start with token file \"%s\" and without a password expected NO_CREDENTIALS, actual %v", credentials.TokenFile, err)
+		}
+	}
+}
+
+// TestClientReportsUnstoredTokens obtains a token it can not store, which
+// fails the start instead of losing the token.
+func TestClientReportsUnstoredTokens(t *testing.T) {
+	address, fingerprint, codecs := startTestServer(t)
+
+	tokenFile := filepath.Join(t.TempDir(), "missing", "simple-sync.token")
+	client := net.NewClient(address, fingerprint, net.Credentials{Username: []byte("admin"), Password: []byte("123"), TokenFile: tokenFile})
+
+	started := make(chan error, 1)
+
+	go func() {
+		started <- client.Start()
+	}()
+
+	codec := <-codecs
+	readTestPacket(t, codec, net.REQUEST_TOKEN)
+	codec.WritePacket(mustPacket(net.NewTokenPacket([]byte("abcdef"))))
+
+	if err := <-started; err == nil {
+		client.Stop()
+		t.Errorf("Start with an unwritable token file expected an error")
+	}
+}
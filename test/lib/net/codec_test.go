@@ -0,0 +1,280 @@
+package net_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	gonet "net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/FBreuer2/simple-sync/lib/net"
+	"github.com/FBreuer2/simple-sync/lib/sync"
+)
+
+const testPacketType = 30000
+
+// testPacket is a packet of an extension, unknown to the protocol.
+type testPacket struct {
+	Data []byte
+}
+
+func (tP *testPacket) Type() uint16 {
+	return testPacketType
+}
+
+func (tP *testPacket) MarshalBinary() ([]byte, error) {
+	return tP.Data, nil
+}
+
+func (tP *testPacket) UnmarshalBinary(data []byte) error {
+	tP.Data = append([]byte{}, data...)
+	return nil
+}
+
+func TestPacketRegistry(t *testing.T) {
+	registry := net.NewPacketRegistry()
+	newTestPacket := func() net.EncapsulatablePacket { return &testPacket{} }
+
+	if _, err := registry.New(testPacketType); errors.Is(err, net.UNKNOWN_PACKET_TYPE) == false {
+		t.Errorf("New of an unregistered type expected UNKNOWN_PACKET_TYPE, actual %v", err)
+	}
+
+	if err := registry.Register(testPacketType, newTestPacket); err != nil {
+		t.Fatalf("Register failed: %s", err.Error())
+	}
+
+	if packet, err := registry.New(testPacketType); err != nil || packet.Type() != testPacketType {
+		t.Errorf("New of a registered type expected a testPacket, actual %v (%v)", packet, err)
+	}
+
+	if err := registry.Register(testPacketType, newTestPacket); errors.Is(err, net.PACKET_TYPE_REGISTERED) == false {
+		t.Errorf("Register of a registered type expected PACKET_TYPE_REGISTERED, actual %v", err)
+	}
+
+	if err := registry.Register(testPacketType|net.FRAME_CONTINUED, newTestPacket); err == nil {
+		t.Errorf("Register of a type with the frame flag expected an error")
+	}
+
+	// the protocol packets can not be replaced
+	if err := net.RegisterPacket(net.BLOCK_PACKET, newTestPacket); errors.Is(err, net.PACKET_TYPE_REGISTERED) == false {
+		t.Errorf("RegisterPacket of BLOCK_PACKET expected PACKET_TYPE_REGISTERED, actual %v", err)
+	}
+
+	if packet, err := net.DEFAULT_PACKET_REGISTRY.New(net.COMPRESSED_BLOCK_PACKET); err != nil || packet.Type() != net.COMPRESSED_BLOCK_PACKET {
+		t.Errorf("DEFAULT_PACKET_REGISTRY expected COMPRESSED_BLOCK_PACKET, actual %v (%v)", packet, err)
+	}
+}
+
+// TestCodec sends an extension packet to a codec that does not know it,
+// which skips it and reads on.
+func TestCodec(t *testing.T) {
+	serverConn, clientConn := gonet.Pipe()
+	defer serverConn.Close()
+
+	extendedRegistry := net.NewPacketRegistry()
+	extendedRegistry.Register(testPacketType, func() net.EncapsulatablePacket { return &testPacket{} })
+
+	sender := net.NewCodec(clientConn, extendedRegistry)
+	sender.SetWriteFrameLength(net.MIN_MAX_FRAME_LENGTH)
+
+	blockPacket, _ := net.NewBlockPacket([]byte("abcd"), make([]byte, 3*net.MIN_MAX_FRAME_LENGTH))
+
+	go func() {
+		defer sender.Close()
+
+		sender.WritePacket(&testPacket{Data: []byte("unknown")})
+		sender.WritePacket(blockPacket)
+	}()
+
+	receiver := net.NewCodec(serverConn, net.DEFAULT_PACKET_REGISTRY)
+	receiver.SetReadFrameLength(net.MIN_MAX_FRAME_LENGTH)
+
+	if _, err := receiver.ReadPacket(); errors.Is(err, net.UNKNOWN_PACKET_TYPE) == false {
+		t.Fatalf("ReadPacket of an unregistered type expected UNKNOWN_PACKET_TYPE, actual %v", err)
+	}
+
+	packet, err := receiver.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket failed: %s", err.Error())
+	}
+
+	if receivedPacket, ok := packet.(*net.BlockPacket); ok == false || receivedPacket.Equals(blockPacket) == false {
+		t.Errorf("ReadPacket expected the block packet, actual %v", packet)
+	}
+
+	if _, err := receiver.ReadPacket(); err == nil {
+		t.Errorf("ReadPacket of a closed connection expected an error")
+	}
+}
+
+// TestCodecVersions sends short metadata in the layout of every version, a
+// receiver of the same version reads the exact modification time.
+func TestCodecVersions(t *testing.T) {
+	lastChanged := time.Unix(1600000000, 123456789).In(time.FixedZone("CEST", 2*60*60))
+	shortFileMetadata := &sync.ShortFileMetadata{FileSize: 12, FileHash: []byte("123"), LastChanged: lastChanged}
+
+	for _, version := range []uint16{net.VERSION_0_1, net.VERSION_0_2, net.VERSION_0_3} {
+		serverConn, clientConn := gonet.Pipe()
+
+		sender := net.NewCodec(clientConn, net.DEFAULT_PACKET_REGISTRY)
+		sender.SetWriteVersion(version)
+
+		go func() {
+			defer sender.Close()
+
+			sender.WritePacket(mustPacket(net.NewShortFileMetaDataPacket("photos/file.bmp", shortFileMetadata)))
+		}()
+
+		receiver := net.NewCodec(serverConn, net.DEFAULT_PACKET_REGISTRY)
+		receiver.SetReadVersion(version)
+
+		packet, err := receiver.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket of version %d failed: %s", version, err.Error())
+		}
+
+		retrieved, err := packet.(*net.ShortFileMetadataPacket).GetData()
+		if err != nil {
+			t.Fatalf("GetData of version %d failed: %s", version, err.Error())
+		}
+
+		if retrieved.LastChanged.Equal(lastChanged) == false {
+			t.Errorf("ReadPacket of version %d expected %s, actual %s", version, lastChanged, retrieved.LastChanged)
+		}
+
+		serverConn.Close()
+	}
+}
+
+// readSentPacket reads the first packet send writes, with received packets
+// limited to readPacketLength.
+func readSentPacket(readPacketLength uint64, send func(conn gonet.Conn)) (net.EncapsulatablePacket, error) {
+	serverConn, clientConn := gonet.Pipe()
+	defer serverConn.Close()
+
+	go func() {
+		defer clientConn.Close()
+
+		send(clientConn)
+	}()
+
+	receiver := net.NewCodec(serverConn, net.DEFAULT_PACKET_REGISTRY)
+	receiver.SetReadFrameLength(net.DEFAULT_MAX_FRAME_LENGTH)
+
+	if readPacketLength > 0 {
+		receiver.SetReadPacketLength(readPacketLength)
+	}
+
+	return receiver.ReadPacket()
+}
+
+func sendPacket(packet net.EncapsulatablePacket) func(conn gonet.Conn) {
+	return func(conn gonet.Conn) {
+		sender := net.NewCodec(conn, net.DEFAULT_PACKET_REGISTRY)
+		sender.SetWriteFrameLength(net.DEFAULT_MAX_FRAME_LENGTH)
+		sender.WritePacket(packet)
+	}
+}
+
+func sendFrames(frames ...[]byte) func(conn gonet.Conn) {
+	return func(conn gonet.Conn) {
+		conn.Write(bytes.Join(frames, nil))
+	}
+}
+
+// TestCodecLimits sends packets above the limits before and after the
+// receiver raised them like after an authentication.
+func TestCodecLimits(t *testing.T) {
+	blockPacket := mustPacket(net.NewBlockPacket([]byte("abcd"), make([]byte, net.MAX_CONTROL_PACKET_LENGTH)))
+
+	if _, err := readSentPacket(0, sendPacket(blockPacket)); errors.Is(err, net.PACKET_TOO_LARGE) == false {
+		t.Errorf("ReadPacket of a block before authentication expected PACKET_TOO_LARGE, actual %v", err)
+	}
+
+	if packet, err := readSentPacket(net.MAX_PACKET_LENGTH, sendPacket(blockPacket)); err != nil || packet.(*net.BlockPacket).Equals(blockPacket.(*net.BlockPacket)) == false {
+		t.Errorf("ReadPacket of a block after authentication expected the block, actual %v", err)
+	}
+
+	// packets without blocks keep their limit
+	replyPacket := net.NewReplyPacket(net.REPLY_MALFORMED_PACKET, string(make([]byte, net.MAX_CONTROL_PACKET_LENGTH)))
+
+	if _, err := readSentPacket(net.MAX_PACKET_LENGTH, sendPacket(replyPacket)); errors.Is(err, net.PACKET_TOO_LARGE) == false {
+		t.Errorf("ReadPacket of a long reply expected PACKET_TOO_LARGE, actual %v", err)
+	}
+
+	// a few bytes announcing 2^64-1 blocks are rejected before more arrive
+	extendedFileMetadata := make([]byte, 24)
+	binary.BigEndian.PutUint32(extendedFileMetadata[8:12], net.DEFAULT_STRONG_CHECKSUM_LENGTH)
+
+	for index := 16; index < 24; index++ {
+		extendedFileMetadata[index] = 0xff
+	}
+
+	frames := [][]byte{frameHeader(net.EXTENDED_FILE_METADATA|net.FRAME_CONTINUED, 24), extendedFileMetadata}
+
+	if _, err := readSentPacket(net.MAX_PACKET_LENGTH, sendFrames(frames...)); errors.Is(err, net.PACKET_TOO_LARGE) == false {
+		t.Errorf("ReadPacket of extended metadata with oversized block amount expected PACKET_TOO_LARGE, actual %v", err)
+	}
+}
+
+// TestCodecAnnouncedAmountsAreNotAllocated sends packets that announce as
+// many elements as the longest packet can hold, but end after their header.
+// The receiver must not allocate room for all of them up front.
+func TestCodecAnnouncedAmountsAreNotAllocated(t *testing.T) {
+	extendedFileMetadata := make([]byte, 24)
+	binary.BigEndian.PutUint32(extendedFileMetadata[8:12], net.DEFAULT_STRONG_CHECKSUM_LENGTH)
+	binary.BigEndian.PutUint64(extendedFileMetadata[16:24], (net.MAX_PACKET_LENGTH-24)/(8+4+net.DEFAULT_STRONG_CHECKSUM_LENGTH))
+
+	chunkedFileMetadata := make([]byte, 20)
+	binary.BigEndian.PutUint32(chunkedFileMetadata[8:12], net.DEFAULT_STRONG_CHECKSUM_LENGTH)
+	binary.BigEndian.PutUint64(chunkedFileMetadata[12:20], (net.MAX_PACKET_LENGTH-20)/(4+net.DEFAULT_STRONG_CHECKSUM_LENGTH))
+
+	versions := make([]byte, 6)
+	binary.BigEndian.PutUint32(versions[2:6], (net.MAX_PACKET_LENGTH-6)/34)
+
+	for packetType, data := range map[uint16][]byte{net.EXTENDED_FILE_METADATA: extendedFileMetadata, net.CHUNKED_FILE_METADATA: chunkedFileMetadata, net.VERSIONS: versions} {
+		var before, after runtime.MemStats
+
+		runtime.ReadMemStats(&before)
+		_, err := readSentPacket(net.MAX_PACKET_LENGTH, sendFrames(frameHeader(packetType, uint64(len(data))), data))
+		runtime.ReadMemStats(&after)
+
+		if errors.Is(err, net.INVALID_PACKET) == false {
+			t.Errorf("ReadPacket of type %d ending after its header expected INVALID_PACKET, actual %v", packetType, err)
+		}
+
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4*1024*1024 {
+			t.Errorf("ReadPacket of type %d ending after its header allocated %d bytes", packetType, allocated)
+		}
+	}
+
+	// hashes of another length are rejected before any block is read
+	binary.BigEndian.PutUint32(extendedFileMetadata[8:12], 0)
+
+	if _, err := readSentPacket(net.MAX_PACKET_LENGTH, sendFrames(frameHeader(net.EXTENDED_FILE_METADATA, 24), extendedFileMetadata)); errors.Is(err, net.INVALID_PACKET) == false {
+		t.Errorf("ReadPacket of extended metadata with empty strong hashes expected INVALID_PACKET, actual %v", err)
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	dispatcher := net.NewDispatcher()
+	handled := make([]uint16, 0)
+
+	dispatcher.Handle(testPacketType, func(packet net.EncapsulatablePacket) {
+		handled = append(handled, packet.Type())
+	})
+
+	if err := dispatcher.Dispatch(&testPacket{}); err != nil {
+		t.Errorf("Dispatch failed: %s", err.Error())
+	}
+
+	if err := dispatcher.Dispatch(net.NewHelloPacket()); errors.Is(err, net.UNKNOWN_PACKET_TYPE) == false {
+		t.Errorf("Dispatch without a handler expected UNKNOWN_PACKET_TYPE, actual %v", err)
+	}
+
+	if len(handled) != 1 || handled[0] != testPacketType {
+		t.Errorf("Dispatch expected the handler to be called once, actual %v", handled)
+	}
+}
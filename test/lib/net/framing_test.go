@@ -0,0 +1,263 @@
+package net_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"runtime"
+	"testing"
+
+	"github.com/FBreuer2/simple-sync/lib/net"
+)
+
+func frameHeader(packetType uint16, frameLength uint64) []byte {
+	header := make([]byte, net.FRAME_HEADER_LENGTH)
+
+	binary.BigEndian.PutUint16(header[:2], packetType)
+	binary.BigEndian.PutUint64(header[2:], frameLength)
+
+	return header
+}
+
+var frameCombinations = []struct {
+	maxFrameLength uint32
+	dataLength     int
+	frames         int
+}{
+	{0, 5000, 1},
+	{1024, 1000, 1},
+	// block packets are 16 bytes longer than their data
+	{1024, 1008, 1},
+	{1024, 1009, 2},
+	// the last frame is full, no empty one follows
+	{1024, 2032, 2},
+	{1024, 5000, 5},
+}
+
+func TestFrameWriterSplitsPackets(t *testing.T) {
+	for _, instance := range frameCombinations {
+		var connection bytes.Buffer
+
+		data := bytes.Repeat([]byte("x"), instance.dataLength)
+		blockPacket, _ := net.NewBlockPacket([]byte("abcd"), data)
+
+		frameWriter := net.NewFrameWriter(&connection)
+		frameWriter.SetMaxFrameLength(instance.maxFrameLength)
+
+		// a second packet checks that frames of packets stay apart
+		for _, packet := range []net.EncapsulatablePacket{blockPacket, net.NewReplyPacket(net.REPLY_OK, "")} {
+			if err := frameWriter.WritePacket(packet); err != nil {
+				t.Fatalf("WritePacket failed: %s", err.Error())
+			}
+		}
+
+		marshalled, _ := blockPacket.MarshalBinary()
+		frames := 0
+
+		for offset := 0; offset < len(marshalled); frames++ {
+			header := connection.Bytes()[offset+frames*net.FRAME_HEADER_LENGTH:]
+			packetType := binary.BigEndian.Uint16(header[:2])
+			frameLength := binary.BigEndian.Uint64(header[2:net.FRAME_HEADER_LENGTH])
+
+			if instance.maxFrameLength > 0 && frameLength > uint64(instance.maxFrameLength) {
+				t.Errorf("WritePacket with frames of %d wrote a frame of %d", instance.maxFrameLength, frameLength)
+			}
+
+			offset += int(frameLength)
+
+			if continued := packetType&net.FRAME_CONTINUED != 0; continued != (offset < len(marshalled)) {
+				t.Errorf("WritePacket marked frame %d as continued %t", frames, continued)
+			}
+		}
+
+		if frames != instance.frames {
+			t.Errorf("WritePacket of %d bytes in frames of %d expected %d frames, actual %d", len(marshalled), instance.maxFrameLength, instance.frames, frames)
+		}
+
+		frameReader := net.NewFrameReader(&connection)
+		frameReader.SetMaxFrameLength(instance.maxFrameLength)
+
+		packetType, packetData, err := frameReader.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket failed: %s", err.Error())
+		}
+
+		receivedPacket := net.BlockPacket{}
+		receivedPacket.UnmarshalBinary(packetData)
+
+		if packetType != net.BLOCK_PACKET || receivedPacket.Equals(blockPacket) == false {
+			t.Errorf("ReadPacket did not return the split packet")
+		}
+
+		if packetType, _, err := frameReader.ReadPacket(); err != nil || packetType != net.REPLY {
+			t.Errorf("ReadPacket expected the reply after the split packet, actual %d (%v)", packetType, err)
+		}
+	}
+}
+
+// TestFrameWriterStreamsPackets writes a long block in frames, which are
+// sent while the block is encoded instead of after marshalling it.
+func TestFrameWriterStreamsPackets(t *testing.T) {
+	blockPacket, _ := net.NewBlockPacket([]byte("abcd"), make([]byte, 8*1024*1024))
+
+	frameWriter := net.NewFrameWriter(ioutil.Discard)
+	frameWriter.SetMaxFrameLength(net.DEFAULT_MAX_FRAME_LENGTH)
+
+	var before, after runtime.MemStats
+
+	runtime.ReadMemStats(&before)
+	err := frameWriter.WritePacket(blockPacket)
+	runtime.ReadMemStats(&after)
+
+	if err != nil {
+		t.Fatalf("WritePacket failed: %s", err.Error())
+	}
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+		t.Errorf("WritePacket of a block of %d bytes allocated %d bytes", len(blockPacket.Data), allocated)
+	}
+}
+
+// TestFrameWriterRejectsLongPackets writes a packet above MAX_PACKET_LENGTH,
+// after which the reader still finds the next packet.
+func TestFrameWriterRejectsLongPackets(t *testing.T) {
+	deltaPacket := net.NewDeltaPacket(make([]byte, net.MAX_PACKET_LENGTH))
+
+	for _, maxFrameLength := range []uint32{0, net.DEFAULT_MAX_FRAME_LENGTH} {
+		var connection bytes.Buffer
+
+		frameWriter := net.NewFrameWriter(&connection)
+		frameWriter.SetMaxFrameLength(maxFrameLength)
+
+		if err := frameWriter.WritePacket(deltaPacket); errors.Is(err, net.PACKET_TOO_LARGE) == false {
+			t.Errorf("WritePacket of a long packet in frames of %d expected PACKET_TOO_LARGE, actual %v", maxFrameLength, err)
+		}
+
+		frameWriter.WritePacket(net.NewReplyPacket(net.REPLY_OK, ""))
+
+		frameReader := net.NewFrameReader(&connection)
+		frameReader.SetMaxFrameLength(maxFrameLength)
+
+		packetType, _, err := frameReader.ReadPacket()
+
+		// frames that were sent end with the rest of the cut off packet
+		if err == nil && packetType == net.DELTA {
+			packetType, _, err = frameReader.ReadPacket()
+		}
+
+		if err != nil || packetType != net.REPLY {
+			t.Errorf("ReadPacket after a long packet in frames of %d expected the reply, actual %d (%v)", maxFrameLength, packetType, err)
+		}
+	}
+}
+
+func TestFrameReaderSkipsUnreadPackets(t *testing.T) {
+	var connection bytes.Buffer
+
+	frameWriter := net.NewFrameWriter(&connection)
+	frameWriter.SetMaxFrameLength(1024)
+
+	blockPacket, _ := net.NewBlockPacket([]byte("abcd"), make([]byte, 4000))
+	frameWriter.WritePacket(blockPacket)
+	frameWriter.WritePacket(net.NewReplyPacket(net.REPLY_OK, ""))
+
+	frameReader := net.NewFrameReader(&connection)
+
+	if _, packetReader, err := frameReader.Next(); err != nil {
+		t.Fatalf("Next failed: %s", err.Error())
+	} else {
+		packetReader.Read(make([]byte, 100))
+	}
+
+	if packetType, _, err := frameReader.ReadPacket(); err != nil || packetType != net.REPLY {
+		t.Errorf("ReadPacket expected the reply after a partly read packet, actual %d (%v)", packetType, err)
+	}
+}
+
+func TestFrameReaderRejectsInvalidFrames(t *testing.T) {
+	invalidFrames := []struct {
+		name   string
+		frames [][]byte
+		err    error
+	}{
+		// nothing is allocated for a header claiming a terabyte
+		{"frame too large", [][]byte{frameHeader(net.BLOCK_PACKET, 1<<40)}, net.FRAME_TOO_LARGE},
+		{"frame above the negotiated length", [][]byte{frameHeader(net.BLOCK_PACKET, 2048), make([]byte, 2048)}, net.FRAME_TOO_LARGE},
+		{"continued with another type", [][]byte{frameHeader(net.BLOCK_PACKET|net.FRAME_CONTINUED, 16), make([]byte, 16), frameHeader(net.REPLY, 16), make([]byte, 16)}, net.INVALID_FRAME},
+	}
+
+	for _, instance := range invalidFrames {
+		frameReader := net.NewFrameReader(bytes.NewReader(bytes.Join(instance.frames, nil)))
+		frameReader.SetMaxFrameLength(1024)
+
+		if instance.name == "frame too large" {
+			frameReader.SetMaxFrameLength(0)
+		}
+
+		if _, _, err := frameReader.ReadPacket(); errors.Is(err, instance.err) == false {
+			t.Errorf("ReadPacket of %s expected %v, actual %v", instance.name, instance.err, err)
+		}
+	}
+
+	// frames of one packet together stay below MAX_PACKET_LENGTH
+	frames := [][]byte{frameHeader(net.BLOCK_PACKET|net.FRAME_CONTINUED, 16), make([]byte, 16), frameHeader(net.BLOCK_PACKET, net.MAX_PACKET_LENGTH)}
+	frameReader := net.NewFrameReader(bytes.NewReader(bytes.Join(frames, nil)))
+	frameReader.SetMaxFrameLength(0)
+
+	if _, _, err := frameReader.ReadPacket(); errors.Is(err, net.PACKET_TOO_LARGE) == false {
+		t.Errorf("ReadPacket of too many frames expected PACKET_TOO_LARGE, actual %v", err)
+	}
+
+	// until a frame length is negotiated frames are limited to the default
+	frames = [][]byte{frameHeader(net.BLOCK_PACKET, net.DEFAULT_MAX_FRAME_LENGTH+1), make([]byte, net.DEFAULT_MAX_FRAME_LENGTH+1)}
+	frameReader = net.NewFrameReader(bytes.NewReader(bytes.Join(frames, nil)))
+
+	if _, _, err := frameReader.ReadPacket(); errors.Is(err, net.FRAME_TOO_LARGE) == false {
+		t.Errorf("ReadPacket of a frame above the default length expected FRAME_TOO_LARGE, actual %v", err)
+	}
+
+	// a connection closed within a packet
+	frames = [][]byte{frameHeader(net.BLOCK_PACKET|net.FRAME_CONTINUED, 16), make([]byte, 16)}
+	frameReader = net.NewFrameReader(bytes.NewReader(bytes.Join(frames, nil)))
+
+	if _, packetReader, err := frameReader.Next(); err != nil {
+		t.Fatalf("Next failed: %s", err.Error())
+	} else if _, err := ioutil.ReadAll(packetReader); err == nil {
+		t.Errorf("Reading a packet cut off after a frame expected an error")
+	}
+}
+
+var maxFrameLengthCombinations = []struct {
+	own        uint32
+	peer       uint32
+	negotiated uint32
+}{
+	{net.DEFAULT_MAX_FRAME_LENGTH, 0, 0},
+	{net.DEFAULT_MAX_FRAME_LENGTH, net.MIN_MAX_FRAME_LENGTH - 1, 0},
+	{net.DEFAULT_MAX_FRAME_LENGTH, net.MIN_MAX_FRAME_LENGTH, net.MIN_MAX_FRAME_LENGTH},
+	{net.DEFAULT_MAX_FRAME_LENGTH, 1 << 30, net.DEFAULT_MAX_FRAME_LENGTH},
+}
+
+func TestMaxFrameLengthNegotiation(t *testing.T) {
+	for _, instance := range maxFrameLengthCombinations {
+		if negotiated := net.NegotiateMaxFrameLength(instance.own, instance.peer); negotiated != instance.negotiated {
+			t.Errorf("NegotiateMaxFrameLength(%d, %d) expected %d, actual %d", instance.own, instance.peer, instance.negotiated, negotiated)
+		}
+	}
+
+	// peers without framing send a hello without a frame length
+	helloPacket := net.HelloPacket{}
+	helloPacket.UnmarshalBinary([]byte{0, 0, 0, 3})
+
+	if helloPacket.Capabilities != 3 || helloPacket.MaxFrameLength != 0 {
+		t.Errorf("Unmarshaling a short HelloPacket expected no frame length, actual %+v", helloPacket)
+	}
+
+	marshalled, _ := net.NewHelloPacket().MarshalBinary()
+	helloPacket.UnmarshalBinary(marshalled)
+
+	if helloPacket.MaxFrameLength != net.DEFAULT_MAX_FRAME_LENGTH {
+		t.Errorf("Unmarshaling HelloPacket::MaxFrameLength expected %d, actual %d", net.DEFAULT_MAX_FRAME_LENGTH, helloPacket.MaxFrameLength)
+	}
+}
@@ -0,0 +1,227 @@
+package net_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/FBreuer2/simple-sync/lib/net"
+	"github.com/FBreuer2/simple-sync/lib/sync"
+)
+
+func mustPacket(packet net.EncapsulatablePacket, err error) net.EncapsulatablePacket {
+	if err != nil {
+		panic(err)
+	}
+
+	return packet
+}
+
+// packetSeeds holds a valid packet of every type, the fuzz targets start
+// from their encodings.
+var packetSeeds = []net.EncapsulatablePacket{
+	net.NewReplyPacket(net.REPLY_AUTH_FAILED, "wrong password"),
+	net.NewNegotiatedHelloPacket(net.CURRENT_VERSION, net.SUPPORTED_CAPABILITIES, net.DEFAULT_MAX_FRAME_LENGTH),
+	mustPacket(net.NewLoginPacket([]byte("admin"), []byte("123"))),
+	mustPacket(net.NewRequestTokenPacket([]byte("admin"), []byte("123"), "laptop")),
+	mustPacket(net.NewTokenPacket([]byte("abcdef"))),
+	mustPacket(net.NewTokenLoginPacket([]byte("admin"), []byte("abcdef"))),
+	mustPacket(net.NewShortFileMetaDataPacket("photos/file.bmp", &sync.ShortFileMetadata{FileSize: 12, FileHash: []byte("123"), LastChanged: time.Unix(0, 1000)})),
+	mustPacket(net.NewExtendedFileMetadataPacket("photos/file.bmp", deltaSignatureCombinations[1])),
+	mustPacket(net.NewBlockPacket([]byte("abcd"), []byte("dcefad"))),
+	mustPacket(net.NewCompressedBlockPacket([]byte("abcd"), sync.COMPRESSION_NONE, []byte("dcefad"))),
+	mustPacket(net.NewRequestBlockPacket("photos/file.bmp", []byte("abcd"))),
+	mustPacket(net.NewRequestExtendedFileMetadataPacket("photos/file.bmp", 1024, net.DEFAULT_STRONG_CHECKSUM_LENGTH)),
+	mustPacket(net.NewRemoveFilePacket("photos/file.bmp")),
+	mustPacket(net.NewMoveFilePacket("photos/file.bmp", "photos/other.bmp")),
+	mustPacket(net.NewRequestRestorePacket("photos/file.bmp")),
+	mustPacket(net.NewRequestDeltaRestorePacket("photos/file.bmp", deltaSignatureCombinations[1])),
+	net.NewDeltaPacket([]byte("delta")),
+	mustPacket(net.NewRequestVersionsPacket("photos/file.bmp")),
+	mustPacket(net.NewVersionsPacket("photos/file.bmp", versionCombinations[1])),
+	mustPacket(net.NewRequestVersionRestorePacket("photos/file.bmp", 3, time.Unix(0, 1500))),
+	mustPacket(net.NewRequestChunkedFileMetadataPacket("photos/file.bmp", sync.ChunkLengths{Minimum: net.DEFAULT_MIN_CHUNK_LENGTH, Average: net.DEFAULT_AVERAGE_CHUNK_LENGTH, Maximum: net.DEFAULT_MAX_CHUNK_LENGTH}, net.DEFAULT_STRONG_CHECKSUM_LENGTH)),
+	mustPacket(net.NewChunkedFileMetadataPacket("photos/file.bmp", chunkedFileMetadataCombinations[1])),
+}
+
+// newVersionedPacket returns an empty packet of packetType in the layout of
+// version, as the Codec would.
+func newVersionedPacket(packetType uint16, version uint16) net.EncapsulatablePacket {
+	packet, _ := net.DEFAULT_PACKET_REGISTRY.New(packetType)
+
+	if versionedPacket, ok := packet.(net.VersionedPacket); ok == true {
+		versionedPacket.SetVersion(version)
+	}
+
+	return packet
+}
+
+func marshalVersionedPacket(packet net.EncapsulatablePacket, version uint16) ([]byte, error) {
+	if versionedPacket, ok := packet.(net.VersionedPacket); ok == true {
+		versionedPacket.SetVersion(version)
+	}
+
+	return packet.MarshalBinary()
+}
+
+// fuzzPacket checks that packets of packetType either decode or return an
+// error wrapping INVALID_PACKET, and that decoded packets encode into data
+// that decodes again.
+func fuzzPacket(f *testing.F, packetType uint16) {
+	fuzzVersionedPacket(f, packetType, net.CURRENT_VERSION)
+}
+
+func fuzzVersionedPacket(f *testing.F, packetType uint16, version uint16) {
+	for _, seed := range packetSeeds {
+		if seed.Type() != packetType {
+			continue
+		}
+
+		data, err := marshalVersionedPacket(seed, version)
+
+		if err != nil {
+			f.Fatalf("Marshalling seed of type %d failed: %s", packetType, err.Error())
+		}
+
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet := newVersionedPacket(packetType, version)
+
+		if err := packet.UnmarshalBinary(data); err != nil {
+			if errors.Is(err, net.INVALID_PACKET) == false {
+				t.Fatalf("Unmarshalling packet of type %d returned unexpected error: %s", packetType, err.Error())
+			}
+
+			return
+		}
+
+		marshalled, err := packet.MarshalBinary()
+
+		if err != nil {
+			t.Fatalf("Marshalling decoded packet of type %d failed: %s", packetType, err.Error())
+		}
+
+		decoded := newVersionedPacket(packetType, version)
+
+		if err := decoded.UnmarshalBinary(marshalled); err != nil {
+			t.Fatalf("Unmarshalling marshalled packet of type %d failed: %s", packetType, err.Error())
+		}
+	})
+}
+
+func FuzzReplyPacket(f *testing.F) { fuzzPacket(f, net.REPLY) }
+
+func FuzzHelloPacket(f *testing.F) { fuzzPacket(f, net.HELLO) }
+
+func FuzzLoginPacket(f *testing.F) { fuzzPacket(f, net.LOGIN) }
+
+func FuzzRequestTokenPacket(f *testing.F) { fuzzPacket(f, net.REQUEST_TOKEN) }
+
+func FuzzTokenPacket(f *testing.F) { fuzzPacket(f, net.TOKEN) }
+
+func FuzzTokenLoginPacket(f *testing.F) { fuzzPacket(f, net.TOKEN_LOGIN) }
+
+func FuzzShortFileMetadataPacket(f *testing.F) { fuzzPacket(f, net.SHORT_FILE_METADATA) }
+
+func FuzzShortFileMetadataPacketVersion0_1(f *testing.F) {
+	fuzzVersionedPacket(f, net.SHORT_FILE_METADATA, net.VERSION_0_1)
+}
+
+func FuzzShortFileMetadataPacketVersion0_2(f *testing.F) {
+	fuzzVersionedPacket(f, net.SHORT_FILE_METADATA, net.VERSION_0_2)
+}
+
+func FuzzExtendedFileMetadataPacket(f *testing.F) { fuzzPacket(f, net.EXTENDED_FILE_METADATA) }
+
+func FuzzExtendedFileMetadataPacketVersion0_1(f *testing.F) {
+	fuzzVersionedPacket(f, net.EXTENDED_FILE_METADATA, net.VERSION_0_1)
+}
+
+func FuzzBlockPacket(f *testing.F) { fuzzPacket(f, net.BLOCK_PACKET) }
+
+func FuzzCompressedBlockPacket(f *testing.F) { fuzzPacket(f, net.COMPRESSED_BLOCK_PACKET) }
+
+func FuzzRequestBlockPacket(f *testing.F) { fuzzPacket(f, net.REQUEST_BLOCK_PACKET) }
+
+func FuzzRequestBlockPacketVersion0_1(f *testing.F) {
+	fuzzVersionedPacket(f, net.REQUEST_BLOCK_PACKET, net.VERSION_0_1)
+}
+
+func FuzzRequestExtendedFileMetadataPacket(f *testing.F) {
+	fuzzPacket(f, net.REQUEST_EXTENDED_FILE_METADATA)
+}
+
+func FuzzRemoveFilePacket(f *testing.F) { fuzzPacket(f, net.REMOVE_FILE) }
+
+func FuzzMoveFilePacket(f *testing.F) { fuzzPacket(f, net.MOVE_FILE) }
+
+func FuzzRequestRestorePacket(f *testing.F) { fuzzPacket(f, net.REQUEST_RESTORE) }
+
+func FuzzRequestDeltaRestorePacket(f *testing.F) { fuzzPacket(f, net.REQUEST_DELTA_RESTORE) }
+
+func FuzzDeltaPacket(f *testing.F) { fuzzPacket(f, net.DELTA) }
+
+func FuzzRequestVersionsPacket(f *testing.F) { fuzzPacket(f, net.REQUEST_VERSIONS) }
+
+func FuzzVersionsPacket(f *testing.F) { fuzzPacket(f, net.VERSIONS) }
+
+func FuzzRequestVersionRestorePacket(f *testing.F) { fuzzPacket(f, net.REQUEST_VERSION_RESTORE) }
+
+func FuzzRequestChunkedFileMetadataPacket(f *testing.F) {
+	fuzzPacket(f, net.REQUEST_CHUNKED_FILE_METADATA)
+}
+
+func FuzzChunkedFileMetadataPacket(f *testing.F) { fuzzPacket(f, net.CHUNKED_FILE_METADATA) }
+
+func TestTruncatedPacketsAreRejected(t *testing.T) {
+	for _, seed := range packetSeeds {
+		for _, version := range []uint16{net.VERSION_0_1, net.VERSION_0_2, net.VERSION_0_3} {
+			checkTruncatedPacket(t, seed, version)
+		}
+	}
+}
+
+func checkTruncatedPacket(t *testing.T, seed net.EncapsulatablePacket, version uint16) {
+	data, _ := marshalVersionedPacket(seed, version)
+
+	// hellos of later versions may be longer, ours has to be complete
+	minimumLength := len(data)
+	if seed.Type() == net.HELLO {
+		minimumLength = 4
+	}
+
+	for length := 0; length < minimumLength; length++ {
+		packet := newVersionedPacket(seed.Type(), version)
+
+		if err := packet.UnmarshalBinary(data[:length]); errors.Is(err, net.INVALID_PACKET) == false {
+			t.Errorf("Unmarshalling packet of type %d version %d truncated to %d bytes expected INVALID_PACKET, actual %v", seed.Type(), version, length, err)
+		}
+	}
+
+	if seed.Type() == net.HELLO {
+		return
+	}
+
+	packet := newVersionedPacket(seed.Type(), version)
+
+	if err := packet.UnmarshalBinary(append(data, 0)); errors.Is(err, net.INVALID_PACKET) == false {
+		t.Errorf("Unmarshalling packet of type %d version %d with a trailing byte expected INVALID_PACKET, actual %v", seed.Type(), version, err)
+	}
+}
+
+func TestOversizedAmountsAreRejected(t *testing.T) {
+	// a few bytes announcing 2^64-1 blocks must not allocate them
+	data := make([]byte, 24)
+	binary.BigEndian.PutUint32(data[8:12], net.DEFAULT_STRONG_CHECKSUM_LENGTH)
+
+	for index := 16; index < 24; index++ {
+		data[index] = 0xff
+	}
+
+	if err := (&net.ExtendedFileMetadataPacket{}).UnmarshalBinary(data); errors.Is(err, net.INVALID_PACKET) == false {
+		t.Errorf("Unmarshalling ExtendedFileMetadataPacket with oversized block amount expected INVALID_PACKET, actual %v", err)
+	}
+}
@@ -2,9 +2,15 @@ package net_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
 	"testing"
+	"testing/quick"
 	"time"
 
+	"github.com/FBreuer2/simple-sync/lib/db"
 	"github.com/FBreuer2/simple-sync/lib/net"
 	"github.com/FBreuer2/simple-sync/lib/sync"
 )
@@ -13,7 +19,7 @@ var helloCombinations = []struct {
 	Version      uint16
 	Capabilities uint16
 }{
-	{net.VERSION_0_1, net.CAPABILITY_LOGIN | net.CAPABILITY_SYNC | net.CAPABILITY_TOKEN},
+	{net.CURRENT_VERSION, net.SUPPORTED_CAPABILITIES},
 }
 
 func TestHelloMarshalling(t *testing.T) {
@@ -43,7 +49,7 @@ var loginCombinations = []struct {
 
 func TestLoginPacketMarshalling(t *testing.T) {
 	for _, instance := range loginCombinations {
-		loginPacket := net.NewLoginPacket(instance.username, instance.password)
+		loginPacket, _ := net.NewLoginPacket(instance.username, instance.password)
 
 		marshalled, _ := loginPacket.MarshalBinary()
 
@@ -96,13 +102,14 @@ func TestPacketMarshalling(t *testing.T) {
 }
 
 var shortFileMetadataCombinations = []*sync.ShortFileMetadata{
-	&sync.ShortFileMetadata{12, []byte("123"), time.Now()},
-	&sync.ShortFileMetadata{20, []byte("user"), time.Now()},
+	&sync.ShortFileMetadata{FileSize: 12, FileHash: []byte("123"), LastChanged: time.Now()},
+	&sync.ShortFileMetadata{FileSize: 20, FileHash: []byte("user"), LastChanged: time.Now()},
 }
 
 func TestShortFileMetadataPacketMarshalling(t *testing.T) {
 	for _, instance := range shortFileMetadataCombinations {
-		metaPacket := net.NewShortFileMetaDataPacket(instance)
+		metaPacket, _ := net.NewShortFileMetaDataPacket("photos/file.bmp", instance)
+		metaPacket.SetVersion(net.VERSION_0_2)
 
 		marshalled, _ := metaPacket.MarshalBinary()
 
@@ -121,6 +128,10 @@ func TestShortFileMetadataPacketMarshalling(t *testing.T) {
 			t.Errorf("Unmarshaling packet encapsulated ShortFileMetadataPaket::FileSize expected %d, actual %d", instance.FileSize, metaPacket.FileSize)
 		}
 
+		if string(metaPacket.Path) != "photos/file.bmp" {
+			t.Errorf("Unmarshaling packet encapsulated ShortFileMetadataPaket::Path expected %s, actual %s", "photos/file.bmp", string(metaPacket.Path))
+		}
+
 		if bytes.Equal(metaPacket.FileHash, instance.FileHash) != true {
 			t.Errorf("Unmarshaling packet encapsulated ShortFileMetadataPaket::FileHash expected %s, actual %s", string(instance.FileHash), string(metaPacket.FileHash))
 		}
@@ -136,6 +147,133 @@ func TestShortFileMetadataPacketMarshalling(t *testing.T) {
 	}
 }
 
+var lastChangedCombinations = []time.Time{
+	time.Unix(0, 0),
+	time.Unix(1600000000, 123456789),
+	time.Unix(1600000000, 1).In(time.FixedZone("CEST", 2*60*60)),
+	time.Unix(-1, 999999999).In(time.FixedZone("", -(9*60*60 + 30*60))),
+	time.Date(2020, 3, 29, 2, 30, 0, 1, time.FixedZone("XYZT", 13*60*60)),
+}
+
+func TestShortFileMetadataPacketTimestamp(t *testing.T) {
+	for _, instance := range lastChangedCombinations {
+		metaPacket, _ := net.NewShortFileMetaDataPacket("photos/file.bmp", &sync.ShortFileMetadata{FileSize: 12, FileHash: []byte("123"), LastChanged: instance})
+
+		marshalled, _ := metaPacket.MarshalBinary()
+
+		unmarshalled := &net.ShortFileMetadataPacket{}
+		unmarshalled.SetVersion(net.VERSION_0_3)
+
+		if err := unmarshalled.UnmarshalBinary(marshalled); err != nil {
+			t.Fatalf("Unmarshalling ShortFileMetadataPacket failed: %s", err.Error())
+		}
+
+		retrieved, err := unmarshalled.GetData()
+		if err != nil {
+			t.Fatalf("ShortFileMetadataPacket::GetData failed: %s", err.Error())
+		}
+
+		if retrieved.LastChanged.Equal(instance) == false {
+			t.Errorf("Unmarshaling ShortFileMetadataPacket::LastChanged expected %s, actual %s", instance, retrieved.LastChanged)
+		}
+
+		_, expectedOffset := instance.Zone()
+		_, offset := retrieved.LastChanged.Zone()
+
+		if offset != expectedOffset {
+			t.Errorf("Unmarshaling ShortFileMetadataPacket::TimezoneOffset expected %d, actual %d", expectedOffset, offset)
+		}
+
+		later := &sync.ShortFileMetadata{FileHash: []byte("456"), LastChanged: instance.Add(time.Nanosecond)}
+
+		if later.ShouldOverwrite(retrieved) == false || retrieved.ShouldOverwrite(later) == true {
+			t.Errorf("ShortFileMetadata::ShouldOverwrite does not order %s one nanosecond apart", instance)
+		}
+	}
+}
+
+func TestShortFileMetadataPacketVersions(t *testing.T) {
+	instance := &sync.ShortFileMetadata{FileSize: 12, FileHash: []byte("123"), LastChanged: time.Unix(1600000000, 42)}
+
+	for _, version := range []uint16{net.VERSION_0_1, net.VERSION_0_2, net.VERSION_0_3} {
+		metaPacket, _ := net.NewShortFileMetaDataPacket("photos/file.bmp", instance)
+		metaPacket.SetVersion(version)
+
+		marshalled, _ := metaPacket.MarshalBinary()
+
+		for _, otherVersion := range []uint16{net.VERSION_0_1, net.VERSION_0_2, net.VERSION_0_3} {
+			unmarshalled := &net.ShortFileMetadataPacket{}
+			unmarshalled.SetVersion(otherVersion)
+
+			err := unmarshalled.UnmarshalBinary(marshalled)
+
+			if otherVersion != version {
+				if err == nil {
+					t.Errorf("Unmarshalling ShortFileMetadataPacket of version %d as version %d expected an error", version, otherVersion)
+				}
+
+				continue
+			}
+
+			if err != nil {
+				t.Fatalf("Unmarshalling ShortFileMetadataPacket of version %d failed: %s", version, err.Error())
+			}
+
+			retrieved, err := unmarshalled.GetData()
+
+			if err != nil || retrieved.LastChanged.Equal(instance.LastChanged) == false {
+				t.Errorf("Unmarshaling ShortFileMetadataPacket of version %d expected %s, actual %v (%v)", version, instance.LastChanged, retrieved, err)
+			}
+
+			expectedPath := "photos/file.bmp"
+			if version == net.VERSION_0_1 {
+				expectedPath = net.DEFAULT_FILE_PATH
+			}
+
+			if string(unmarshalled.Path) != expectedPath {
+				t.Errorf("Unmarshaling ShortFileMetadataPacket of version %d expected path %s, actual %s", version, expectedPath, string(unmarshalled.Path))
+			}
+		}
+	}
+}
+
+// TestPathlessShortFileMetadataUsesDefaultPath decodes metadata in the
+// layout of the first protocol version, which describes the file at
+// DEFAULT_FILE_PATH.
+func TestPathlessShortFileMetadataUsesDefaultPath(t *testing.T) {
+	lastChanged := []byte(time.Unix(1600000000, 42).Format(net.LAST_CHANGED_FORMAT))
+	data := make([]byte, 8+8+3+8+len(lastChanged))
+
+	binary.BigEndian.PutUint64(data[:8], 12)
+	binary.BigEndian.PutUint64(data[8:16], 3)
+	copy(data[16:19], "123")
+	binary.BigEndian.PutUint64(data[19:27], uint64(len(lastChanged)))
+	copy(data[27:], lastChanged)
+
+	metaPacket := &net.ShortFileMetadataPacket{}
+	metaPacket.SetVersion(net.VERSION_0_1)
+
+	if err := metaPacket.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Unmarshalling ShortFileMetadataPacket without a path failed: %s", err.Error())
+	}
+
+	if string(metaPacket.Path) != net.DEFAULT_FILE_PATH || metaPacket.PathLength != uint16(len(net.DEFAULT_FILE_PATH)) {
+		t.Errorf("Unmarshalling ShortFileMetadataPacket without a path expected path %s, actual %s", net.DEFAULT_FILE_PATH, string(metaPacket.Path))
+	}
+
+	retrieved, err := metaPacket.GetData()
+
+	if err != nil || retrieved.FileSize != 12 || bytes.Equal(retrieved.FileHash, []byte("123")) == false {
+		t.Errorf("ShortFileMetadataPacket::GetData without a path expected size 12 and hash 123, actual %v (%v)", retrieved, err)
+	}
+
+	remarshalled, err := metaPacket.MarshalBinary()
+
+	if err != nil || bytes.Equal(remarshalled, data) == false {
+		t.Errorf("Marshalling ShortFileMetadataPacket of version %d did not restore the layout without a path", net.VERSION_0_1)
+	}
+}
+
 var errorCombinations = []struct {
 	errorCode         uint16
 	errorStringLength uint64
@@ -178,15 +316,16 @@ func TestReplyPacketMarshalling(t *testing.T) {
 }
 
 var extendedFileMetadataCombinations = []*sync.ExtendedFileMetadata{
-	&sync.ExtendedFileMetadata{12, 2, 3, 5, make(map[uint32]int64), make([][]byte, 5)},
-	&sync.ExtendedFileMetadata{342, 23, 3, 5, make(map[uint32]int64), make([][]byte, 5)},
+	&sync.ExtendedFileMetadata{FileSize: 12, StrongChecksumLength: net.DEFAULT_STRONG_CHECKSUM_LENGTH, BlockLength: 3, BlockAmount: 5, WeakBlockSums: make([]uint32, 5), WeakBlockHashes: make(map[uint32]int64), StrongBlockHashes: make([][]byte, 5)},
+	&sync.ExtendedFileMetadata{FileSize: 342, StrongChecksumLength: net.DEFAULT_STRONG_CHECKSUM_LENGTH, BlockLength: 4096, BlockAmount: 5, WeakBlockSums: make([]uint32, 5), WeakBlockHashes: make(map[uint32]int64), StrongBlockHashes: make([][]byte, 5)},
 }
 
 func TestExtendedFileMetadataPacketMarshalling(t *testing.T) {
 	for _, instance := range extendedFileMetadataCombinations {
 
 		for i := 0; uint64(i) < instance.BlockAmount; i++ {
-			instance.WeakBlockHashes[uint32(i)] = int64(i + 1)
+			instance.WeakBlockSums[i] = uint32(i + 1)
+			instance.WeakBlockHashes[uint32(i+1)] = int64(i)
 		}
 
 		for index := range instance.StrongBlockHashes {
@@ -197,7 +336,7 @@ func TestExtendedFileMetadataPacketMarshalling(t *testing.T) {
 			}
 		}
 
-		metaPacket, _ := net.NewExtendedFileMetadataPacket(instance)
+		metaPacket, _ := net.NewExtendedFileMetadataPacket("photos/file.bmp", instance)
 
 		marshalled, _ := metaPacket.MarshalBinary()
 
@@ -228,6 +367,10 @@ func TestExtendedFileMetadataPacketMarshalling(t *testing.T) {
 			t.Errorf("Unmarshaling packet encapsulated ExtendedFileMetadataPacket::BlockAmount expected %d, actual %d", instance.BlockAmount, metaPacket.BlockAmount)
 		}
 
+		if string(metaPacket.Path) != "photos/file.bmp" {
+			t.Errorf("Unmarshaling packet encapsulated ExtendedFileMetadataPacket::Path expected %s, actual %s", "photos/file.bmp", string(metaPacket.Path))
+		}
+
 		retrieved, _ := metaPacket.GetData()
 		if retrieved.Equals(instance) == false {
 			t.Errorf("ExtendedFileMetadataPacket::Equals failed")
@@ -235,9 +378,93 @@ func TestExtendedFileMetadataPacketMarshalling(t *testing.T) {
 	}
 }
 
+// extendedFileMetadataRoundTrip is the property that metadata of blocks
+// with the given weak checksums survives marshalling. Small weak checksums
+// make quick generate repeated ones, an empty slice is an empty file.
+func extendedFileMetadataRoundTrip(fileSize uint64, blockLength uint32, weakBlockSums []uint8, path string) bool {
+	instance := &sync.ExtendedFileMetadata{
+		FileSize:             fileSize,
+		StrongChecksumLength: net.DEFAULT_STRONG_CHECKSUM_LENGTH,
+		BlockLength:          blockLength,
+		BlockAmount:          uint64(len(weakBlockSums)),
+		WeakBlockSums:        make([]uint32, len(weakBlockSums)),
+		StrongBlockHashes:    make([][]byte, len(weakBlockSums)),
+	}
+
+	for index, weakBlockSum := range weakBlockSums {
+		instance.WeakBlockSums[index] = uint32(weakBlockSum)
+		instance.StrongBlockHashes[index] = bytes.Repeat([]byte{byte(index)}, int(instance.StrongChecksumLength))
+	}
+
+	instance.WeakBlockHashes = sync.IndexWeakBlockSums(instance.WeakBlockSums)
+
+	metaPacket, err := net.NewExtendedFileMetadataPacket(path, instance)
+	if err != nil {
+		return false
+	}
+
+	marshalled, err := metaPacket.MarshalBinary()
+	if err != nil {
+		return false
+	}
+
+	unmarshalled := &net.ExtendedFileMetadataPacket{}
+	unmarshalled.SetVersion(net.CURRENT_VERSION)
+
+	if err := unmarshalled.UnmarshalBinary(marshalled); err != nil {
+		return false
+	}
+
+	remarshalled, err := unmarshalled.MarshalBinary()
+	if err != nil || bytes.Equal(marshalled, remarshalled) == false {
+		return false
+	}
+
+	retrieved, _ := unmarshalled.GetData()
+
+	return retrieved.Equals(instance) == true && string(unmarshalled.Path) == path
+}
+
+func TestExtendedFileMetadataPacketRoundTrip(t *testing.T) {
+	if err := quick.Check(extendedFileMetadataRoundTrip, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+
+	// the edge cases quick may not pick
+	if extendedFileMetadataRoundTrip(0, 1024, []uint8{}, "") == false {
+		t.Errorf("ExtendedFileMetadataPacket of an empty file did not round-trip")
+	}
+
+	if extendedFileMetadataRoundTrip(9, 3, []uint8{7, 7, 7}, "photos/file.bmp") == false {
+		t.Errorf("ExtendedFileMetadataPacket with repeated weak checksums did not round-trip")
+	}
+}
+
+func TestExtendedFileMetadataPacketBlockOrder(t *testing.T) {
+	metaPacket, _ := net.NewExtendedFileMetadataPacket("photos/file.bmp", deltaSignatureCombinations[1])
+	marshalled, _ := metaPacket.MarshalBinary()
+
+	// swap the indices of both records
+	recordLength := 8 + 4 + int(metaPacket.StrongChecksumLength)
+	marshalled[24+7], marshalled[24+recordLength+7] = marshalled[24+recordLength+7], marshalled[24+7]
+
+	unmarshalled := &net.ExtendedFileMetadataPacket{}
+	unmarshalled.SetVersion(net.CURRENT_VERSION)
+
+	if err := unmarshalled.UnmarshalBinary(marshalled); errors.Is(err, net.INVALID_PACKET) == false {
+		t.Errorf("Unmarshalling ExtendedFileMetadataPacket with swapped blocks expected INVALID_PACKET, actual %v", err)
+	}
+
+	missingWeakSums := &sync.ExtendedFileMetadata{BlockAmount: 1, WeakBlockHashes: map[uint32]int64{7: 0}, StrongBlockHashes: [][]byte{{}}}
+
+	if _, err := net.NewExtendedFileMetadataPacket("photos/file.bmp", missingWeakSums); errors.Is(err, sync.INVALID_BLOCKS) == false {
+		t.Errorf("NewExtendedFileMetadataPacket without weak checksums expected INVALID_BLOCKS, actual %v", err)
+	}
+}
+
 var blockPacketCombinations = []*net.BlockPacket{
-	&net.BlockPacket{4, []byte("abcd"), 6, []byte("dcefad")},
-	&net.BlockPacket{5, []byte("abcda"), 7, []byte("dcesfad")},
+	&net.BlockPacket{StrongChecksumLength: 4, StrongChecksum: []byte("abcd"), BlockLength: 6, Data: []byte("dcefad")},
+	&net.BlockPacket{StrongChecksumLength: 5, StrongChecksum: []byte("abcda"), BlockLength: 7, Data: []byte("dcesfad")},
 }
 
 func TestBlockPacketMarshalling(t *testing.T) {
@@ -263,9 +490,57 @@ func TestBlockPacketMarshalling(t *testing.T) {
 	}
 }
 
+var compressedBlockPacketCombinations = []*net.CompressedBlockPacket{
+	&net.CompressedBlockPacket{Compression: sync.COMPRESSION_NONE, StrongChecksumLength: 4, StrongChecksum: []byte("abcd"), DataLength: 6, Data: []byte("dcefad")},
+	&net.CompressedBlockPacket{Compression: sync.COMPRESSION_DEFLATE, StrongChecksumLength: 5, StrongChecksum: []byte("abcda"), DataLength: 7, Data: []byte("dcesfad")},
+}
+
+func TestCompressedBlockPacketMarshalling(t *testing.T) {
+	for _, instance := range compressedBlockPacketCombinations {
+		metaPacket := instance
+
+		marshalled, _ := metaPacket.MarshalBinary()
+
+		newPacket, _ := net.NewEncapsulatedPacket(metaPacket)
+
+		marshalledPacket, _ := newPacket.MarshalBinary()
+
+		newPacket.UnmarshalBinary(marshalledPacket)
+		metaPacket.UnmarshalBinary(newPacket.Data)
+
+		if newPacket.PacketLength != uint64(len(marshalled)) {
+			t.Errorf("Unmarshaling packet encapsulated Packet::PacketLength expected %d, actual %d", len(marshalled), newPacket.PacketLength)
+		}
+
+		if metaPacket.Equals(instance) == false {
+			t.Errorf("CompressedBlockPacket::Equals failed")
+		}
+	}
+}
+
+func TestCompressedBlockPacketDecompress(t *testing.T) {
+	block := bytes.Repeat([]byte("abcd"), 1024)
+	compression, data := sync.CompressBlock(block)
+
+	compressedBlockPacket, _ := net.NewCompressedBlockPacket([]byte("abcd"), compression, data)
+
+	blockPacket, err := compressedBlockPacket.Decompress()
+	if err != nil || bytes.Equal(blockPacket.Data, block) == false || blockPacket.BlockLength != uint64(len(block)) {
+		t.Errorf("Decompress did not return the block (%v)", err)
+	}
+
+	// blocks longer than any chunk are rejected before they are inflated
+	compression, data = sync.CompressBlock(make([]byte, net.MAX_BLOCK_LENGTH+1))
+	compressedBlockPacket, _ = net.NewCompressedBlockPacket([]byte("abcd"), compression, data)
+
+	if _, err := compressedBlockPacket.Decompress(); errors.Is(err, sync.INVALID_COMPRESSED_BLOCK) == false {
+		t.Errorf("Decompress of a too long block expected INVALID_COMPRESSED_BLOCK, actual %v", err)
+	}
+}
+
 var requestBlockPacketCombinations = []*net.RequestBlockPacket{
-	&net.RequestBlockPacket{4, []byte("abcd")},
-	&net.RequestBlockPacket{5, []byte("abcda")},
+	&net.RequestBlockPacket{StrongChecksumLength: 4, StrongChecksum: []byte("abcd"), PathLength: 8, Path: []byte("file.bmp")},
+	&net.RequestBlockPacket{StrongChecksumLength: 5, StrongChecksum: []byte("abcda"), PathLength: 15, Path: []byte("photos/file.bmp")},
 }
 
 func TestRequestBlockPacketMarshalling(t *testing.T) {
@@ -290,3 +565,655 @@ func TestRequestBlockPacketMarshalling(t *testing.T) {
 		}
 	}
 }
+
+// TestPathlessPacketsUseDefaultPath sends extended metadata and block
+// requests in the layout of the first protocol version, which leaves out the
+// path, so they describe the file at DEFAULT_FILE_PATH.
+func TestPathlessPacketsUseDefaultPath(t *testing.T) {
+	metaPacket, _ := net.NewExtendedFileMetadataPacket("photos/file.bmp", deltaSignatureCombinations[1])
+	requestPacket, _ := net.NewRequestBlockPacket("photos/file.bmp", []byte("abcd"))
+
+	for _, packet := range []net.VersionedPacket{metaPacket, requestPacket} {
+		packet.SetVersion(net.VERSION_0_2)
+		withPath, _ := packet.MarshalBinary()
+
+		packet.SetVersion(net.VERSION_0_1)
+		marshalled, _ := packet.MarshalBinary()
+
+		if len(withPath)-len(marshalled) != 2+len("photos/file.bmp") {
+			t.Errorf("Marshalling packet of type %d and version %d expected no path, actual %d bytes instead of %d", packet.Type(), net.VERSION_0_1, len(marshalled), len(withPath))
+		}
+
+		if err := packet.UnmarshalBinary(marshalled); err != nil {
+			t.Fatalf("Unmarshalling packet of type %d and version %d failed: %s", packet.Type(), net.VERSION_0_1, err.Error())
+		}
+	}
+
+	if string(metaPacket.Path) != net.DEFAULT_FILE_PATH || string(requestPacket.Path) != net.DEFAULT_FILE_PATH {
+		t.Errorf("Unmarshalling packets without a path expected path %s, actual %s and %s", net.DEFAULT_FILE_PATH, string(metaPacket.Path), string(requestPacket.Path))
+	}
+
+	if bytes.Equal(requestPacket.StrongChecksum, []byte("abcd")) == false {
+		t.Errorf("Unmarshalling RequestBlockPacket without a path expected checksum abcd, actual %s", string(requestPacket.StrongChecksum))
+	}
+}
+
+var requestExtendedFileMetadataCombinations = []struct {
+	blockLength          uint32
+	strongChecksumLength uint32
+}{
+	{net.DEFAULT_BLOCK_LENGTH, net.DEFAULT_STRONG_CHECKSUM_LENGTH},
+	{512, 8},
+}
+
+func TestRequestExtendedFileMetadataPacketMarshalling(t *testing.T) {
+	for _, instance := range requestExtendedFileMetadataCombinations {
+		requestPacket, _ := net.NewRequestExtendedFileMetadataPacket("photos/file.bmp", instance.blockLength, instance.strongChecksumLength)
+
+		marshalled, _ := requestPacket.MarshalBinary()
+
+		newPacket, _ := net.NewEncapsulatedPacket(requestPacket)
+
+		marshalledPacket, _ := newPacket.MarshalBinary()
+
+		newPacket.UnmarshalBinary(marshalledPacket)
+		requestPacket.UnmarshalBinary(newPacket.Data)
+
+		if newPacket.PacketLength != uint64(len(marshalled)) {
+			t.Errorf("Unmarshaling packet encapsulated Packet::PacketLength expected %d, actual %d", len(marshalled), newPacket.PacketLength)
+		}
+
+		if requestPacket.BlockLength != instance.blockLength {
+			t.Errorf("Unmarshaling packet encapsulated RequestExtendedFileMetadataPacket::BlockLength expected %d, actual %d", instance.blockLength, requestPacket.BlockLength)
+		}
+
+		if requestPacket.StrongChecksumLength != instance.strongChecksumLength {
+			t.Errorf("Unmarshaling packet encapsulated RequestExtendedFileMetadataPacket::StrongChecksumLength expected %d, actual %d", instance.strongChecksumLength, requestPacket.StrongChecksumLength)
+		}
+	}
+}
+
+func TestReplyPacketError(t *testing.T) {
+	if err := net.NewReplyPacket(net.REPLY_OK, "").Error(); err != nil {
+		t.Errorf("ReplyPacket::Error expected nil for REPLY_OK, actual %s", err.Error())
+	}
+
+	err := net.NewReplyPacket(net.REPLY_AUTH_FAILED, "wrong password").Error()
+
+	if errors.Is(err, net.AUTH_FAILED) == false {
+		t.Errorf("ReplyPacket::Error expected to match AUTH_FAILED, actual %v", err)
+	}
+
+	if errors.Is(err, net.NOT_AUTHENTICATED) == true {
+		t.Errorf("ReplyPacket::Error expected not to match NOT_AUTHENTICATED")
+	}
+}
+
+func TestCapabilityNegotiation(t *testing.T) {
+	negotiated := net.NegotiateCapabilities(net.SUPPORTED_CAPABILITIES, net.CAPABILITY_LOGIN|net.CAPABILITY_SYNC)
+
+	helloPacket := net.NewNegotiatedHelloPacket(net.CURRENT_VERSION, negotiated, 0)
+
+	if helloPacket.HasCapability(net.CAPABILITY_LOGIN) == false || helloPacket.HasCapability(net.CAPABILITY_SYNC) == false {
+		t.Errorf("Negotiated capabilities expected login and sync, actual %d", negotiated)
+	}
+
+	if helloPacket.HasCapability(net.CAPABILITY_TOKEN) == true {
+		t.Errorf("Negotiated capabilities expected no token, actual %d", negotiated)
+	}
+
+	if net.RequiredCapability(net.SHORT_FILE_METADATA) != net.CAPABILITY_SYNC {
+		t.Errorf("RequiredCapability for SHORT_FILE_METADATA expected %d, actual %d", net.CAPABILITY_SYNC, net.RequiredCapability(net.SHORT_FILE_METADATA))
+	}
+
+	if net.RequiredCapability(net.HELLO) != 0 {
+		t.Errorf("RequiredCapability for HELLO expected 0, actual %d", net.RequiredCapability(net.HELLO))
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	version, err := net.NegotiateVersion(net.CURRENT_VERSION + 1)
+
+	if err != nil || version != net.CURRENT_VERSION {
+		t.Errorf("NegotiateVersion for a newer peer expected %d, actual %d (%v)", net.CURRENT_VERSION, version, err)
+	}
+
+	version, err = net.NegotiateVersion(net.MIN_SUPPORTED_VERSION)
+
+	if err != nil || version != net.MIN_SUPPORTED_VERSION {
+		t.Errorf("NegotiateVersion for the oldest peer expected %d, actual %d (%v)", net.MIN_SUPPORTED_VERSION, version, err)
+	}
+}
+
+func TestRequestTokenPacketMarshalling(t *testing.T) {
+	for _, instance := range loginCombinations {
+		requestTokenPacket, _ := net.NewRequestTokenPacket(instance.username, instance.password, "laptop")
+
+		marshalled, _ := requestTokenPacket.MarshalBinary()
+
+		newPacket, _ := net.NewEncapsulatedPacket(requestTokenPacket)
+
+		marshalledPacket, _ := newPacket.MarshalBinary()
+
+		newPacket.UnmarshalBinary(marshalledPacket)
+		requestTokenPacket.UnmarshalBinary(newPacket.Data)
+
+		if newPacket.PacketLength != uint64(len(marshalled)) {
+			t.Errorf("Unmarshaling packet encapsulated Packet::PacketLength expected %d, actual %d", len(marshalled), newPacket.PacketLength)
+		}
+
+		if bytes.Equal(requestTokenPacket.Username, instance.username) != true {
+			t.Errorf("Unmarshaling packet encapsulated RequestTokenPacket::user expected %s, actual %s", string(instance.username), string(requestTokenPacket.Username))
+		}
+
+		if bytes.Equal(requestTokenPacket.Password, instance.password) != true {
+			t.Errorf("Unmarshaling packet encapsulated RequestTokenPacket::password expected %s, actual %s", string(instance.password), string(requestTokenPacket.Password))
+		}
+
+		if string(requestTokenPacket.Label) != "laptop" {
+			t.Errorf("Unmarshaling packet encapsulated RequestTokenPacket::label expected %s, actual %s", "laptop", string(requestTokenPacket.Label))
+		}
+	}
+}
+
+var tokenCombinations = []struct {
+	username []byte
+	token    []byte
+}{
+	{[]byte("admin"), []byte("0123456789abcdefghij")},
+	{[]byte("user"), []byte("")},
+}
+
+func TestTokenPacketMarshalling(t *testing.T) {
+	for _, instance := range tokenCombinations {
+		tokenPacket, _ := net.NewTokenPacket(instance.token)
+
+		marshalled, _ := tokenPacket.MarshalBinary()
+
+		newPacket, _ := net.NewEncapsulatedPacket(tokenPacket)
+
+		marshalledPacket, _ := newPacket.MarshalBinary()
+
+		newPacket.UnmarshalBinary(marshalledPacket)
+		tokenPacket.UnmarshalBinary(newPacket.Data)
+
+		if newPacket.PacketLength != uint64(len(marshalled)) {
+			t.Errorf("Unmarshaling packet encapsulated Packet::PacketLength expected %d, actual %d", len(marshalled), newPacket.PacketLength)
+		}
+
+		if bytes.Equal(tokenPacket.Token, instance.token) != true {
+			t.Errorf("Unmarshaling packet encapsulated TokenPacket::token expected %x, actual %x", instance.token, tokenPacket.Token)
+		}
+	}
+}
+
+func TestTokenLoginPacketMarshalling(t *testing.T) {
+	for _, instance := range tokenCombinations {
+		tokenLoginPacket, _ := net.NewTokenLoginPacket(instance.username, instance.token)
+
+		marshalled, _ := tokenLoginPacket.MarshalBinary()
+
+		newPacket, _ := net.NewEncapsulatedPacket(tokenLoginPacket)
+
+		marshalledPacket, _ := newPacket.MarshalBinary()
+
+		newPacket.UnmarshalBinary(marshalledPacket)
+		tokenLoginPacket.UnmarshalBinary(newPacket.Data)
+
+		if newPacket.PacketLength != uint64(len(marshalled)) {
+			t.Errorf("Unmarshaling packet encapsulated Packet::PacketLength expected %d, actual %d", len(marshalled), newPacket.PacketLength)
+		}
+
+		if bytes.Equal(tokenLoginPacket.Username, instance.username) != true {
+			t.Errorf("Unmarshaling packet encapsulated TokenLoginPacket::user expected %s, actual %s", string(instance.username), string(tokenLoginPacket.Username))
+		}
+
+		if bytes.Equal(tokenLoginPacket.Token, instance.token) != true {
+			t.Errorf("Unmarshaling packet encapsulated TokenLoginPacket::token expected %x, actual %x", instance.token, tokenLoginPacket.Token)
+		}
+	}
+}
+
+var moveFileCombinations = []struct {
+	oldPath string
+	newPath string
+}{
+	{"file.bmp", "photos/file.bmp"},
+	{"a", ""},
+}
+
+func TestRemoveFilePacketMarshalling(t *testing.T) {
+	for _, instance := range moveFileCombinations {
+		removeFilePacket, _ := net.NewRemoveFilePacket(instance.oldPath)
+
+		marshalled, _ := removeFilePacket.MarshalBinary()
+
+		newPacket, _ := net.NewEncapsulatedPacket(removeFilePacket)
+
+		marshalledPacket, _ := newPacket.MarshalBinary()
+
+		newPacket.UnmarshalBinary(marshalledPacket)
+		removeFilePacket.UnmarshalBinary(newPacket.Data)
+
+		if newPacket.PacketLength != uint64(len(marshalled)) {
+			t.Errorf("Unmarshaling packet encapsulated Packet::PacketLength expected %d, actual %d", len(marshalled), newPacket.PacketLength)
+		}
+
+		if string(removeFilePacket.Path) != instance.oldPath {
+			t.Errorf("Unmarshaling packet encapsulated RemoveFilePacket::Path expected %s, actual %s", instance.oldPath, string(removeFilePacket.Path))
+		}
+	}
+}
+
+func TestMoveFilePacketMarshalling(t *testing.T) {
+	for _, instance := range moveFileCombinations {
+		moveFilePacket, _ := net.NewMoveFilePacket(instance.oldPath, instance.newPath)
+
+		marshalled, _ := moveFilePacket.MarshalBinary()
+
+		newPacket, _ := net.NewEncapsulatedPacket(moveFilePacket)
+
+		marshalledPacket, _ := newPacket.MarshalBinary()
+
+		newPacket.UnmarshalBinary(marshalledPacket)
+		moveFilePacket.UnmarshalBinary(newPacket.Data)
+
+		if newPacket.PacketLength != uint64(len(marshalled)) {
+			t.Errorf("Unmarshaling packet encapsulated Packet::PacketLength expected %d, actual %d", len(marshalled), newPacket.PacketLength)
+		}
+
+		if string(moveFilePacket.OldPath) != instance.oldPath {
+			t.Errorf("Unmarshaling packet encapsulated MoveFilePacket::OldPath expected %s, actual %s", instance.oldPath, string(moveFilePacket.OldPath))
+		}
+
+		if string(moveFilePacket.NewPath) != instance.newPath {
+			t.Errorf("Unmarshaling packet encapsulated MoveFilePacket::NewPath expected %s, actual %s", instance.newPath, string(moveFilePacket.NewPath))
+		}
+	}
+}
+
+func TestRequestRestorePacketMarshalling(t *testing.T) {
+	for _, instance := range moveFileCombinations {
+		requestRestorePacket, _ := net.NewRequestRestorePacket(instance.newPath)
+
+		marshalled, _ := requestRestorePacket.MarshalBinary()
+
+		newPacket, _ := net.NewEncapsulatedPacket(requestRestorePacket)
+
+		marshalledPacket, _ := newPacket.MarshalBinary()
+
+		newPacket.UnmarshalBinary(marshalledPacket)
+		requestRestorePacket.UnmarshalBinary(newPacket.Data)
+
+		if newPacket.PacketLength != uint64(len(marshalled)) {
+			t.Errorf("Unmarshaling packet encapsulated Packet::PacketLength expected %d, actual %d", len(marshalled), newPacket.PacketLength)
+		}
+
+		if string(requestRestorePacket.Path) != instance.newPath {
+			t.Errorf("Unmarshaling packet encapsulated RequestRestorePacket::Path expected %s, actual %s", instance.newPath, string(requestRestorePacket.Path))
+		}
+	}
+}
+
+// testStrongHash returns a strong hash of the length peers request, filled
+// with value.
+func testStrongHash(value byte) []byte {
+	return bytes.Repeat([]byte{value}, net.DEFAULT_STRONG_CHECKSUM_LENGTH)
+}
+
+var deltaSignatureCombinations = []*sync.ExtendedFileMetadata{
+	&sync.ExtendedFileMetadata{FileSize: 0, StrongChecksumLength: 32, BlockLength: 1024, BlockAmount: 0, WeakBlockSums: []uint32{}, WeakBlockHashes: map[uint32]int64{}, StrongBlockHashes: [][]byte{}},
+	&sync.ExtendedFileMetadata{FileSize: 5, StrongChecksumLength: net.DEFAULT_STRONG_CHECKSUM_LENGTH, BlockLength: 3, BlockAmount: 2, WeakBlockSums: []uint32{7, 9}, WeakBlockHashes: map[uint32]int64{7: 0, 9: 1}, StrongBlockHashes: [][]byte{testStrongHash('a'), testStrongHash('c')}},
+}
+
+func TestRequestDeltaRestorePacketMarshalling(t *testing.T) {
+	for _, instance := range deltaSignatureCombinations {
+		requestDeltaRestorePacket, _ := net.NewRequestDeltaRestorePacket("photos/file.bmp", instance)
+
+		marshalled, _ := requestDeltaRestorePacket.MarshalBinary()
+
+		newPacket, _ := net.NewEncapsulatedPacket(requestDeltaRestorePacket)
+
+		marshalledPacket, _ := newPacket.MarshalBinary()
+
+		newPacket.UnmarshalBinary(marshalledPacket)
+
+		unmarshalled := net.RequestDeltaRestorePacket{}
+		unmarshalled.UnmarshalBinary(newPacket.Data)
+
+		if newPacket.PacketLength != uint64(len(marshalled)) {
+			t.Errorf("Unmarshaling packet encapsulated Packet::PacketLength expected %d, actual %d", len(marshalled), newPacket.PacketLength)
+		}
+
+		if string(unmarshalled.Path) != "photos/file.bmp" {
+			t.Errorf("Unmarshaling packet encapsulated RequestDeltaRestorePacket::Path expected %s, actual %s", "photos/file.bmp", string(unmarshalled.Path))
+		}
+
+		signature, err := unmarshalled.GetSignature()
+		if err != nil || signature.Equals(instance) == false {
+			t.Errorf("RequestDeltaRestorePacket::GetSignature expected %v, actual %v (%v)", instance, signature, err)
+		}
+	}
+}
+
+func TestDeltaPacketMarshalling(t *testing.T) {
+	for _, instance := range [][]byte{[]byte{}, []byte("some delta")} {
+		deltaPacket := net.NewDeltaPacket(instance)
+
+		marshalled, _ := deltaPacket.MarshalBinary()
+
+		newPacket, _ := net.NewEncapsulatedPacket(deltaPacket)
+
+		marshalledPacket, _ := newPacket.MarshalBinary()
+
+		newPacket.UnmarshalBinary(marshalledPacket)
+
+		unmarshalled := net.DeltaPacket{}
+		unmarshalled.UnmarshalBinary(newPacket.Data)
+
+		if newPacket.PacketLength != uint64(len(marshalled)) {
+			t.Errorf("Unmarshaling packet encapsulated Packet::PacketLength expected %d, actual %d", len(marshalled), newPacket.PacketLength)
+		}
+
+		if bytes.Equal(unmarshalled.Data, instance) == false {
+			t.Errorf("Unmarshaling packet encapsulated DeltaPacket::Data expected %v, actual %v", instance, unmarshalled.Data)
+		}
+	}
+}
+
+var versionCombinations = [][]*db.FileVersion{
+	[]*db.FileVersion{},
+	[]*db.FileVersion{
+		&db.FileVersion{ID: 1, StoredAt: time.Unix(0, 1500), Metadata: &sync.ShortFileMetadata{FileSize: 12, FileHash: []byte("123"), LastChanged: time.Unix(0, 1000)}},
+		&db.FileVersion{ID: 2, StoredAt: time.Unix(0, 2500), Metadata: &sync.ShortFileMetadata{FileSize: 0, FileHash: []byte{}, LastChanged: time.Unix(0, 2000)}},
+	},
+}
+
+func TestVersionsPacketMarshalling(t *testing.T) {
+	for _, instance := range versionCombinations {
+		versionsPacket, _ := net.NewVersionsPacket("photos/file.bmp", instance)
+
+		marshalled, _ := versionsPacket.MarshalBinary()
+
+		newPacket, _ := net.NewEncapsulatedPacket(versionsPacket)
+
+		marshalledPacket, _ := newPacket.MarshalBinary()
+
+		newPacket.UnmarshalBinary(marshalledPacket)
+
+		unmarshalled := net.VersionsPacket{}
+		unmarshalled.UnmarshalBinary(newPacket.Data)
+
+		if newPacket.PacketLength != uint64(len(marshalled)) {
+			t.Errorf("Unmarshaling packet encapsulated Packet::PacketLength expected %d, actual %d", len(marshalled), newPacket.PacketLength)
+		}
+
+		if string(unmarshalled.Path) != "photos/file.bmp" {
+			t.Errorf("Unmarshaling packet encapsulated VersionsPacket::Path expected %s, actual %s", "photos/file.bmp", string(unmarshalled.Path))
+		}
+
+		if len(unmarshalled.Versions) != len(instance) {
+			t.Fatalf("Unmarshaling packet encapsulated VersionsPacket::Versions expected %d, actual %d", len(instance), len(unmarshalled.Versions))
+		}
+
+		for index, version := range unmarshalled.Versions {
+			if version.ID != instance[index].ID || version.StoredAt.Equal(instance[index].StoredAt) == false {
+				t.Errorf("Unmarshaling packet encapsulated VersionsPacket::Versions[%d] expected %v, actual %v", index, instance[index], version)
+			}
+
+			if version.Metadata.FileSize != instance[index].Metadata.FileSize ||
+				bytes.Equal(version.Metadata.FileHash, instance[index].Metadata.FileHash) == false ||
+				version.Metadata.LastChanged.Equal(instance[index].Metadata.LastChanged) == false {
+				t.Errorf("Unmarshaling packet encapsulated VersionsPacket::Versions[%d].Metadata expected %v, actual %v", index, instance[index].Metadata, version.Metadata)
+			}
+		}
+	}
+}
+
+func TestRequestVersionRestorePacketMarshalling(t *testing.T) {
+	storedBefore := time.Unix(1600000000, 42)
+
+	byID, _ := net.NewRequestVersionRestorePacket("photos/file.bmp", 3, time.Time{})
+	byTime, _ := net.NewRequestVersionRestorePacket("photos/file.bmp", 0, storedBefore)
+
+	for _, instance := range []*net.RequestVersionRestorePacket{byID, byTime} {
+		marshalled, _ := instance.MarshalBinary()
+
+		newPacket, _ := net.NewEncapsulatedPacket(instance)
+
+		marshalledPacket, _ := newPacket.MarshalBinary()
+
+		newPacket.UnmarshalBinary(marshalledPacket)
+
+		unmarshalled := net.RequestVersionRestorePacket{}
+		unmarshalled.UnmarshalBinary(newPacket.Data)
+
+		if newPacket.PacketLength != uint64(len(marshalled)) {
+			t.Errorf("Unmarshaling packet encapsulated Packet::PacketLength expected %d, actual %d", len(marshalled), newPacket.PacketLength)
+		}
+
+		if string(unmarshalled.Path) != "photos/file.bmp" || unmarshalled.VersionID != instance.VersionID || unmarshalled.StoredBefore != instance.StoredBefore {
+			t.Errorf("Unmarshaling packet encapsulated RequestVersionRestorePacket expected %v, actual %v", instance, unmarshalled)
+		}
+	}
+
+	if requestPacket, _ := net.NewRequestVersionRestorePacket("file", 0, storedBefore); requestPacket.GetStoredBefore().Equal(storedBefore) == false {
+		t.Errorf("RequestVersionRestorePacket::GetStoredBefore expected %s, actual %s", storedBefore, requestPacket.GetStoredBefore())
+	}
+}
+
+func TestRequestChunkedFileMetadataPacketMarshalling(t *testing.T) {
+	lengths := sync.ChunkLengths{Minimum: net.DEFAULT_MIN_CHUNK_LENGTH, Average: net.DEFAULT_AVERAGE_CHUNK_LENGTH, Maximum: net.DEFAULT_MAX_CHUNK_LENGTH}
+	requestPacket, _ := net.NewRequestChunkedFileMetadataPacket("photos/file.bmp", lengths, net.DEFAULT_STRONG_CHECKSUM_LENGTH)
+
+	marshalled, _ := requestPacket.MarshalBinary()
+
+	newPacket, _ := net.NewEncapsulatedPacket(requestPacket)
+
+	marshalledPacket, _ := newPacket.MarshalBinary()
+
+	newPacket.UnmarshalBinary(marshalledPacket)
+
+	unmarshalled := net.RequestChunkedFileMetadataPacket{}
+	unmarshalled.UnmarshalBinary(newPacket.Data)
+
+	if newPacket.PacketLength != uint64(len(marshalled)) {
+		t.Errorf("Unmarshaling packet encapsulated Packet::PacketLength expected %d, actual %d", len(marshalled), newPacket.PacketLength)
+	}
+
+	if unmarshalled.GetChunkLengths() != lengths {
+		t.Errorf("Unmarshaling packet encapsulated RequestChunkedFileMetadataPacket::GetChunkLengths expected %+v, actual %+v", lengths, unmarshalled.GetChunkLengths())
+	}
+
+	if unmarshalled.StrongChecksumLength != net.DEFAULT_STRONG_CHECKSUM_LENGTH {
+		t.Errorf("Unmarshaling packet encapsulated RequestChunkedFileMetadataPacket::StrongChecksumLength expected %d, actual %d", net.DEFAULT_STRONG_CHECKSUM_LENGTH, unmarshalled.StrongChecksumLength)
+	}
+
+	if string(unmarshalled.Path) != "photos/file.bmp" {
+		t.Errorf("Unmarshaling packet encapsulated RequestChunkedFileMetadataPacket::Path expected %s, actual %s", "photos/file.bmp", string(unmarshalled.Path))
+	}
+}
+
+var chunkedFileMetadataCombinations = []*sync.ExtendedFileMetadata{
+	&sync.ExtendedFileMetadata{FileSize: 0, StrongChecksumLength: 32, BlockAmount: 0, WeakBlockHashes: map[uint32]int64{}, StrongBlockHashes: [][]byte{}, BlockLengths: []uint32{}},
+	&sync.ExtendedFileMetadata{FileSize: 12, StrongChecksumLength: net.DEFAULT_STRONG_CHECKSUM_LENGTH, BlockAmount: 3, WeakBlockHashes: map[uint32]int64{}, StrongBlockHashes: [][]byte{testStrongHash('a'), testStrongHash('c'), testStrongHash('a')}, BlockLengths: []uint32{5, 3, 4}},
+}
+
+func TestChunkedFileMetadataPacketMarshalling(t *testing.T) {
+	for _, instance := range chunkedFileMetadataCombinations {
+		chunkedPacket, err := net.NewChunkedFileMetadataPacket("photos/file.bmp", instance)
+		if err != nil {
+			t.Fatalf("NewChunkedFileMetadataPacket failed: %s", err.Error())
+		}
+
+		marshalled, _ := chunkedPacket.MarshalBinary()
+
+		newPacket, _ := net.NewEncapsulatedPacket(chunkedPacket)
+
+		marshalledPacket, _ := newPacket.MarshalBinary()
+
+		newPacket.UnmarshalBinary(marshalledPacket)
+
+		unmarshalled := net.ChunkedFileMetadataPacket{}
+		unmarshalled.UnmarshalBinary(newPacket.Data)
+
+		if newPacket.PacketLength != uint64(len(marshalled)) {
+			t.Errorf("Unmarshaling packet encapsulated Packet::PacketLength expected %d, actual %d", len(marshalled), newPacket.PacketLength)
+		}
+
+		if string(unmarshalled.Path) != "photos/file.bmp" {
+			t.Errorf("Unmarshaling packet encapsulated ChunkedFileMetadataPacket::Path expected %s, actual %s", "photos/file.bmp", string(unmarshalled.Path))
+		}
+
+		retrieved, err := unmarshalled.GetData()
+		if err != nil || retrieved.IsChunked() == false || retrieved.Equals(instance) == false {
+			t.Errorf("ChunkedFileMetadataPacket::GetData expected %v, actual %v (%v)", instance, retrieved, err)
+		}
+	}
+
+	if _, err := net.NewChunkedFileMetadataPacket("photos/file.bmp", deltaSignatureCombinations[1]); errors.Is(err, sync.INVALID_CHUNKS) == false {
+		t.Errorf("NewChunkedFileMetadataPacket of fixed blocks expected INVALID_CHUNKS, actual %v", err)
+	}
+}
+
+// TestLongPaths checks that paths filling their length prefix are sent
+// completely and longer ones are rejected instead of truncated.
+func TestLongPaths(t *testing.T) {
+	longestPath := strings.Repeat("a", math.MaxUint16)
+	tooLongPath := longestPath + "a"
+
+	moveFilePacket, err := net.NewMoveFilePacket(longestPath, longestPath)
+	if err != nil {
+		t.Fatalf("NewMoveFilePacket with the longest paths failed: %s", err.Error())
+	}
+
+	marshalled, _ := moveFilePacket.MarshalBinary()
+	unmarshalled := &net.MoveFilePacket{}
+
+	if err := unmarshalled.UnmarshalBinary(marshalled); err != nil || string(unmarshalled.OldPath) != longestPath || string(unmarshalled.NewPath) != longestPath {
+		t.Errorf("Unmarshalling MoveFilePacket with the longest paths failed: %v", err)
+	}
+
+	sFM := &sync.ShortFileMetadata{FileSize: 12, FileHash: []byte("123"), LastChanged: time.Unix(0, 1000)}
+	lengths := sync.ChunkLengths{Minimum: net.DEFAULT_MIN_CHUNK_LENGTH, Average: net.DEFAULT_AVERAGE_CHUNK_LENGTH, Maximum: net.DEFAULT_MAX_CHUNK_LENGTH}
+
+	constructors := map[string]func(path string) error{
+		"NewShortFileMetaDataPacket": func(path string) error {
+			_, err := net.NewShortFileMetaDataPacket(path, sFM)
+			return err
+		},
+		"NewExtendedFileMetadataPacket": func(path string) error {
+			_, err := net.NewExtendedFileMetadataPacket(path, deltaSignatureCombinations[1])
+			return err
+		},
+		"NewRequestBlockPacket": func(path string) error {
+			_, err := net.NewRequestBlockPacket(path, []byte("abcd"))
+			return err
+		},
+		"NewRequestExtendedFileMetadataPacket": func(path string) error {
+			_, err := net.NewRequestExtendedFileMetadataPacket(path, 1024, net.DEFAULT_STRONG_CHECKSUM_LENGTH)
+			return err
+		},
+		"NewRemoveFilePacket": func(path string) error {
+			_, err := net.NewRemoveFilePacket(path)
+			return err
+		},
+		"NewMoveFilePacket with a long old path": func(path string) error {
+			_, err := net.NewMoveFilePacket(path, "photos/file.bmp")
+			return err
+		},
+		"NewMoveFilePacket with a long new path": func(path string) error {
+			_, err := net.NewMoveFilePacket("photos/file.bmp", path)
+			return err
+		},
+		"NewRequestRestorePacket": func(path string) error {
+			_, err := net.NewRequestRestorePacket(path)
+			return err
+		},
+		"NewRequestDeltaRestorePacket": func(path string) error {
+			_, err := net.NewRequestDeltaRestorePacket(path, deltaSignatureCombinations[1])
+			return err
+		},
+		"NewRequestVersionsPacket": func(path string) error {
+			_, err := net.NewRequestVersionsPacket(path)
+			return err
+		},
+		"NewVersionsPacket": func(path string) error {
+			_, err := net.NewVersionsPacket(path, versionCombinations[1])
+			return err
+		},
+		"NewRequestVersionRestorePacket": func(path string) error {
+			_, err := net.NewRequestVersionRestorePacket(path, 3, time.Time{})
+			return err
+		},
+		"NewRequestChunkedFileMetadataPacket": func(path string) error {
+			_, err := net.NewRequestChunkedFileMetadataPacket(path, lengths, net.DEFAULT_STRONG_CHECKSUM_LENGTH)
+			return err
+		},
+		"NewChunkedFileMetadataPacket": func(path string) error {
+			_, err := net.NewChunkedFileMetadataPacket(path, chunkedFileMetadataCombinations[1])
+			return err
+		},
+	}
+
+	for name, constructor := range constructors {
+		if err := constructor(longestPath); err != nil {
+			t.Errorf("%s with the longest path failed: %s", name, err.Error())
+		}
+
+		if err := constructor(tooLongPath); errors.Is(err, net.FIELD_TOO_LONG) == false {
+			t.Errorf("%s with a too long path expected FIELD_TOO_LONG, actual %v", name, err)
+		}
+	}
+}
+
+// TestLongCredentials checks that credentials filling their length prefix are
+// sent completely and longer ones are rejected instead of truncated.
+func TestLongCredentials(t *testing.T) {
+	longest := bytes.Repeat([]byte("a"), math.MaxUint16)
+
+	requestTokenPacket, err := net.NewRequestTokenPacket(longest, longest, string(longest))
+	if err != nil {
+		t.Fatalf("NewRequestTokenPacket with the longest fields failed: %s", err.Error())
+	}
+
+	marshalled, _ := requestTokenPacket.MarshalBinary()
+	unmarshalled := &net.RequestTokenPacket{}
+
+	if err := unmarshalled.UnmarshalBinary(marshalled); err != nil || bytes.Equal(unmarshalled.Password, longest) == false || bytes.Equal(unmarshalled.Label, longest) == false {
+		t.Errorf("Unmarshalling RequestTokenPacket with the longest fields failed: %v", err)
+	}
+
+	constructors := map[string]func(field []byte) error{
+		"NewLoginPacket with a long username": func(field []byte) error {
+			_, err := net.NewLoginPacket(field, []byte("123"))
+			return err
+		},
+		"NewLoginPacket with a long password": func(field []byte) error {
+			_, err := net.NewLoginPacket([]byte("admin"), field)
+			return err
+		},
+		"NewRequestTokenPacket with a long label": func(field []byte) error {
+			_, err := net.NewRequestTokenPacket([]byte("admin"), []byte("123"), string(field))
+			return err
+		},
+		"NewTokenPacket": func(field []byte) error {
+			_, err := net.NewTokenPacket(field)
+			return err
+		},
+		"NewTokenLoginPacket with a long token": func(field []byte) error {
+			_, err := net.NewTokenLoginPacket([]byte("admin"), field)
+			return err
+		},
+	}
+
+	for name, constructor := range constructors {
+		if err := constructor(longest); err != nil {
+			t.Errorf("%s with the longest field failed: %s", name, err.Error())
+		}
+
+		if err := constructor(append(longest, 'a')); errors.Is(err, net.FIELD_TOO_LONG) == false {
+			t.Errorf("%s with a too long field expected FIELD_TOO_LONG, actual %v", name, err)
+		}
+	}
+}
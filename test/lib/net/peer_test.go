@@ -0,0 +1,197 @@
+package net_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	gonet "net"
+	"testing"
+	"time"
+
+	"github.com/FBreuer2/simple-sync/lib/db"
+	"github.com/FBreuer2/simple-sync/lib/net"
+	"github.com/FBreuer2/simple-sync/lib/sync"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testPeerCapabilities leave out chunking and compression, so the peer
+// requests fixed length blocks and sends plain ones.
+const testPeerCapabilities = net.SUPPORTED_CAPABILITIES &^ (net.CAPABILITY_CHUNKING | net.CAPABILITY_COMPRESSION)
+
+// startTestPeer connects to a peer of a server, greets and logs in like a
+// client would and hands the connection to the test.
+func startTestPeer(t *testing.T) (*net.Codec, *db.MemoryDB) {
+	return startVersionedTestPeer(t, net.CURRENT_VERSION)
+}
+
+// startVersionedTestPeer connects like startTestPeer, but announces version
+// in its hello.
+func startVersionedTestPeer(t *testing.T, version uint16) (*net.Codec, *db.MemoryDB) {
+	memoryDB := db.NewMemoryDB()
+	memoryDB.SetPasswordHashCost(bcrypt.MinCost)
+
+	if err := memoryDB.Register([]byte("admin"), []byte("123")); err != nil {
+		t.Fatalf("Register failed: %s", err.Error())
+	}
+
+	serverConn, clientConn := gonet.Pipe()
+	peer := net.NewPeer(serverConn, make(chan string, 1), memoryDB, db.NewBlockCollector(memoryDB))
+
+	go peer.Start()
+
+	codec := net.NewCodec(clientConn, net.DEFAULT_PACKET_REGISTRY)
+	t.Cleanup(func() { codec.Close() })
+
+	codec.WritePacket(net.NewNegotiatedHelloPacket(version, testPeerCapabilities, net.DEFAULT_MAX_FRAME_LENGTH))
+	helloPacket := readTestPacket(t, codec, net.HELLO).(*net.HelloPacket)
+
+	if helloPacket.Version != version {
+		t.Fatalf("Peer negotiated version %d, expected %d", helloPacket.Version, version)
+	}
+
+	codec.SetReadFrameLength(helloPacket.MaxFrameLength)
+	codec.SetWriteFrameLength(helloPacket.MaxFrameLength)
+	codec.SetReadVersion(helloPacket.Version)
+	codec.SetWriteVersion(helloPacket.Version)
+	codec.SetReadPacketLength(net.MAX_PACKET_LENGTH)
+
+	codec.WritePacket(mustPacket(net.NewLoginPacket([]byte("admin"), []byte("123"))))
+	readTestReply(t, codec, net.REPLY_OK)
+
+	return codec, memoryDB
+}
+
+func readTestReply(t *testing.T, codec *net.Codec, code uint16) *net.ReplyPacket {
+	replyPacket := readTestPacket(t, codec, net.REPLY).(*net.ReplyPacket)
+
+	if replyPacket.ErrorCode != code {
+		t.Fatalf("Expected reply %d, actual %d (%s)", code, replyPacket.ErrorCode, replyPacket.ErrorString)
+	}
+
+	return replyPacket
+}
+
+// sendTestFile announces data as the file at path and returns the metadata
+// of its blocks once the peer requested it.
+func sendTestFile(t *testing.T, codec *net.Codec, path string, data []byte) *sync.ExtendedFileMetadata {
+	codec.WritePacket(mustPacket(net.NewShortFileMetaDataPacket(path, &sync.ShortFileMetadata{FileSize: uint64(len(data)), FileHash: []byte("123"), LastChanged: time.Unix(1600000000, 0)})))
+	readTestPacket(t, codec, net.REQUEST_EXTENDED_FILE_METADATA)
+
+	eFM, err := sync.SignFile(bytes.NewReader(data), net.DEFAULT_BLOCK_LENGTH, net.DEFAULT_STRONG_CHECKSUM_LENGTH)
+
+	if err != nil {
+		t.Fatalf("SignFile failed: %s", err.Error())
+	}
+
+	return eFM
+}
+
+// TestPeerRejectsInvalidMetadata answers a metadata request with metadata
+// of another file size, which fails the transfer right away.
+func TestPeerRejectsInvalidMetadata(t *testing.T) {
+	codec, memoryDB := startTestPeer(t)
+
+	data := make([]byte, net.DEFAULT_BLOCK_LENGTH+17)
+	rand.Read(data)
+
+	eFM := sendTestFile(t, codec, "photos/file.bin", data)
+	eFM.FileSize += 1
+
+	codec.WritePacket(mustPacket(net.NewExtendedFileMetadataPacket("photos/file.bin", eFM)))
+	readTestReply(t, codec, net.REPLY_MALFORMED_PACKET)
+
+	if _, err := memoryDB.RetrieveShortFileMetadata([]byte("admin"), "photos/file.bin"); errors.Is(err, db.FILE_NOT_AVAILABLE) == false {
+		t.Errorf("RetrieveShortFileMetadata of a failed transfer expected FILE_NOT_AVAILABLE, actual %v", err)
+	}
+}
+
+// answerTestBlocks answers the block requests of the peer with the blocks
+// of data.
+func answerTestBlocks(t *testing.T, codec *net.Codec, eFM *sync.ExtendedFileMetadata, data []byte) {
+	blocks := make(map[string][]byte)
+
+	for index, strongHash := range eFM.StrongBlockHashes {
+		offset, length := eFM.BlockRange(index)
+		end := offset + int64(length)
+
+		// the last block is shorter
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+
+		blocks[string(strongHash)] = data[offset:end]
+	}
+
+	for range blocks {
+		requestBlockPacket := readTestPacket(t, codec, net.REQUEST_BLOCK_PACKET).(*net.RequestBlockPacket)
+		codec.WritePacket(mustPacket(net.NewBlockPacket(requestBlockPacket.StrongChecksum, blocks[string(requestBlockPacket.StrongChecksum)])))
+	}
+}
+
+// TestPeerNormalizesMetadataPaths answers a metadata request with the path
+// in another form, which still belongs to the requested file.
+func TestPeerNormalizesMetadataPaths(t *testing.T) {
+	codec, memoryDB := startTestPeer(t)
+
+	data := make([]byte, net.DEFAULT_BLOCK_LENGTH+17)
+	rand.Read(data)
+
+	eFM := sendTestFile(t, codec, "photos/file.bin", data)
+
+	codec.WritePacket(mustPacket(net.NewExtendedFileMetadataPacket("./photos//file.bin", eFM)))
+	answerTestBlocks(t, codec, eFM, data)
+	readTestReply(t, codec, net.REPLY_OK)
+
+	if _, err := memoryDB.RetrieveShortFileMetadata([]byte("admin"), "photos/file.bin"); err != nil {
+		t.Errorf("RetrieveShortFileMetadata of a transferred file failed: %s", err.Error())
+	}
+}
+
+// TestPeerRepliesBusy announces a second file while the first one is still
+// transferred, which the peer asks to send again later.
+func TestPeerRepliesBusy(t *testing.T) {
+	codec, _ := startTestPeer(t)
+
+	data := make([]byte, net.DEFAULT_BLOCK_LENGTH+17)
+	rand.Read(data)
+
+	eFM := sendTestFile(t, codec, "photos/file.bin", data)
+
+	codec.WritePacket(mustPacket(net.NewShortFileMetaDataPacket("photos/other.bin", &sync.ShortFileMetadata{FileSize: 5, FileHash: []byte("123"), LastChanged: time.Unix(1600000000, 0)})))
+	readTestReply(t, codec, net.REPLY_BUSY)
+
+	codec.WritePacket(mustPacket(net.NewExtendedFileMetadataPacket("photos/file.bin", eFM)))
+	answerTestBlocks(t, codec, eFM, data)
+	readTestReply(t, codec, net.REPLY_OK)
+}
+
+// TestPeerFailsTransfersOnReplies answers a metadata request with a reply,
+// which ends the transfer with the reason of the client.
+func TestPeerFailsTransfersOnReplies(t *testing.T) {
+	codec, _ := startTestPeer(t)
+
+	sendTestFile(t, codec, "photos/file.bin", []byte("data"))
+
+	codec.WritePacket(net.NewReplyPacket(net.REPLY_FILE_NOT_AVAILABLE, "removed"))
+	readTestReply(t, codec, net.REPLY_FILE_NOT_AVAILABLE)
+}
+
+// TestPeerAcceptsPathlessMetadata sends a file like a client of the first
+// protocol version, whose metadata carries no path, which the peer stores
+// as the file at DEFAULT_FILE_PATH.
+func TestPeerAcceptsPathlessMetadata(t *testing.T) {
+	codec, memoryDB := startVersionedTestPeer(t, net.VERSION_0_1)
+
+	data := make([]byte, net.DEFAULT_BLOCK_LENGTH+17)
+	rand.Read(data)
+
+	eFM := sendTestFile(t, codec, "photos/file.bin", data)
+
+	codec.WritePacket(mustPacket(net.NewExtendedFileMetadataPacket("photos/file.bin", eFM)))
+	answerTestBlocks(t, codec, eFM, data)
+	readTestReply(t, codec, net.REPLY_OK)
+
+	if _, err := memoryDB.RetrieveShortFileMetadata([]byte("admin"), net.DEFAULT_FILE_PATH); err != nil {
+		t.Errorf("RetrieveShortFileMetadata of a file without a path failed: %s", err.Error())
+	}
+}
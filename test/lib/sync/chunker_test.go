@@ -0,0 +1,187 @@
+package sync_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/FBreuer2/simple-sync/lib/sync"
+)
+
+var testChunkLengths = sync.ChunkLengths{Minimum: 256, Average: 1024, Maximum: 4096}
+
+var chunkLengthCombinations = []struct {
+	lengths sync.ChunkLengths
+	valid   bool
+}{
+	{testChunkLengths, true},
+	{sync.ChunkLengths{Minimum: 1, Average: 2, Maximum: 2}, true},
+	{sync.ChunkLengths{Minimum: 0, Average: 1024, Maximum: 4096}, false},
+	{sync.ChunkLengths{Minimum: 1024, Average: 1024, Maximum: 4096}, false},
+	{sync.ChunkLengths{Minimum: 256, Average: 4096, Maximum: 1024}, false},
+}
+
+func TestChunkLengthsValidate(t *testing.T) {
+	for _, instance := range chunkLengthCombinations {
+		err := instance.lengths.Validate()
+
+		if instance.valid == true && err != nil {
+			t.Errorf("Validate(%+v) failed: %s", instance.lengths, err.Error())
+		}
+
+		if instance.valid == false && errors.Is(err, sync.INVALID_CHUNK_LENGTHS) == false {
+			t.Errorf("Validate(%+v) expected INVALID_CHUNK_LENGTHS, actual %v", instance.lengths, err)
+		}
+	}
+}
+
+func randomData(seed int64, length int) []byte {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(seed)).Read(data)
+
+	return data
+}
+
+func chunks(t *testing.T, data []byte) [][]byte {
+	chunker, err := sync.NewChunker(bytes.NewReader(data), testChunkLengths)
+	if err != nil {
+		t.Fatalf("NewChunker failed: %s", err.Error())
+	}
+
+	result := make([][]byte, 0)
+
+	for {
+		chunk, err := chunker.Next()
+
+		if err == io.EOF {
+			return result
+		}
+
+		if err != nil {
+			t.Fatalf("Next failed: %s", err.Error())
+		}
+
+		result = append(result, chunk)
+	}
+}
+
+func TestChunkerLengths(t *testing.T) {
+	data := randomData(1, 256*1024)
+	dataChunks := chunks(t, data)
+
+	if joined := bytes.Join(dataChunks, nil); bytes.Equal(joined, data) == false {
+		t.Fatalf("Chunks do not add up to the data")
+	}
+
+	for index, chunk := range dataChunks {
+		if len(chunk) > int(testChunkLengths.Maximum) || (len(chunk) < int(testChunkLengths.Minimum) && index != len(dataChunks)-1) {
+			t.Errorf("Chunk %d has length %d outside of %+v", index, len(chunk), testChunkLengths)
+		}
+	}
+
+	averageLength := len(data) / len(dataChunks)
+
+	if averageLength < int(testChunkLengths.Average)/2 || averageLength > int(testChunkLengths.Average)*2 {
+		t.Errorf("Chunks expected an average length around %d, actual %d", testChunkLengths.Average, averageLength)
+	}
+
+	if len(chunks(t, nil)) != 0 {
+		t.Errorf("Chunks of empty data expected none")
+	}
+}
+
+var chunkEditCombinations = []struct {
+	name string
+	edit func(data []byte) []byte
+}{
+	{"inserted at the start", func(data []byte) []byte { return append([]byte("inserted"), data...) }},
+	{"inserted in the middle", func(data []byte) []byte {
+		return append(append(append([]byte{}, data[:len(data)/2]...), []byte("inserted")...), data[len(data)/2:]...)
+	}},
+	{"removed in the middle", func(data []byte) []byte {
+		return append(append([]byte{}, data[:len(data)/2]...), data[len(data)/2+100:]...)
+	}},
+}
+
+// TestChunkerEdits checks that an edit only changes the chunks around it.
+func TestChunkerEdits(t *testing.T) {
+	data := randomData(2, 256*1024)
+	originalChunks := make(map[string]bool)
+
+	for _, chunk := range chunks(t, data) {
+		originalChunks[string(chunk)] = true
+	}
+
+	for _, instance := range chunkEditCombinations {
+		changedChunks := 0
+
+		for _, chunk := range chunks(t, instance.edit(data)) {
+			if originalChunks[string(chunk)] == false {
+				changedChunks += 1
+			}
+		}
+
+		if changedChunks == 0 || changedChunks > 3 {
+			t.Errorf("%s: expected 1 to 3 new chunks, actual %d", instance.name, changedChunks)
+		}
+	}
+}
+
+func TestReadChunkedBlock(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "simple-sync-chunker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootPath)
+
+	data := randomData(3, 64*1024)
+	filePath := filepath.Join(rootPath, "file")
+
+	if err := ioutil.WriteFile(filePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fileWatcher, err := sync.NewFileWatcher(filePath)
+	if err != nil {
+		t.Fatalf("NewFileWatcher failed: %s", err.Error())
+	}
+
+	eFM, err := fileWatcher.GetChunkedFileInformation(testChunkLengths, 32)
+	if err != nil {
+		t.Fatalf("GetChunkedFileInformation failed: %s", err.Error())
+	}
+
+	if eFM.FileSize != uint64(len(data)) || eFM.IsChunked() == false || eFM.CheckChunks(testChunkLengths) != nil {
+		t.Fatalf("GetChunkedFileInformation returned invalid chunks for %d bytes", len(data))
+	}
+
+	readData := make([]byte, 0, len(data))
+
+	for index, strongHash := range eFM.StrongBlockHashes {
+		block, err := fileWatcher.ReadBlock(strongHash)
+		if err != nil {
+			t.Fatalf("ReadBlock(%d) failed: %s", index, err.Error())
+		}
+
+		if len(block) != int(eFM.BlockLengths[index]) {
+			t.Errorf("ReadBlock(%d) expected %d bytes, actual %d", index, eFM.BlockLengths[index], len(block))
+		}
+
+		readData = append(readData, block...)
+	}
+
+	if bytes.Equal(readData, data) == false {
+		t.Errorf("ReadBlock of all chunks does not return the file")
+	}
+
+	eFM.FileSize += 1
+
+	if errors.Is(eFM.CheckChunks(testChunkLengths), sync.INVALID_CHUNKS) == false {
+		t.Errorf("CheckChunks with a wrong file size expected INVALID_CHUNKS")
+	}
+}
@@ -0,0 +1,50 @@
+package sync_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/FBreuer2/simple-sync/lib/sync"
+)
+
+func TestCompressBlock(t *testing.T) {
+	block := bytes.Repeat([]byte("2020-06-01 12:00:00 INFO request served\n"), 1000)
+
+	compression, data := sync.CompressBlock(block)
+
+	if compression != sync.COMPRESSION_DEFLATE || len(data) >= len(block)/5 {
+		t.Fatalf("CompressBlock of a log expected deflate at 5x, actual %d with %d of %d bytes", compression, len(data), len(block))
+	}
+
+	if decompressedBlock, err := sync.DecompressBlock(compression, data, len(block)); err != nil || bytes.Equal(decompressedBlock, block) == false {
+		t.Errorf("DecompressBlock did not return the block (%v)", err)
+	}
+
+	// a block can not be inflated beyond the limit
+	if _, err := sync.DecompressBlock(compression, data, len(block)-1); errors.Is(err, sync.INVALID_COMPRESSED_BLOCK) == false {
+		t.Errorf("DecompressBlock of a too long block expected INVALID_COMPRESSED_BLOCK, actual %v", err)
+	}
+
+	if _, err := sync.DecompressBlock(sync.COMPRESSION_DEFLATE, []byte("not deflated"), len(block)); errors.Is(err, sync.INVALID_COMPRESSED_BLOCK) == false {
+		t.Errorf("DecompressBlock of garbage expected INVALID_COMPRESSED_BLOCK, actual %v", err)
+	}
+
+	if _, err := sync.DecompressBlock(255, data, len(block)); errors.Is(err, sync.UNKNOWN_COMPRESSION) == false {
+		t.Errorf("DecompressBlock with an unknown algorithm expected UNKNOWN_COMPRESSION, actual %v", err)
+	}
+}
+
+func TestCompressIncompressibleBlock(t *testing.T) {
+	block := randomData(5, 4096)
+
+	compression, data := sync.CompressBlock(block)
+
+	if compression != sync.COMPRESSION_NONE || bytes.Equal(data, block) == false {
+		t.Errorf("CompressBlock of random data expected the block uncompressed, actual %d with %d bytes", compression, len(data))
+	}
+
+	if decompressedBlock, err := sync.DecompressBlock(compression, data, len(block)); err != nil || bytes.Equal(decompressedBlock, block) == false {
+		t.Errorf("DecompressBlock of an uncompressed block did not return it (%v)", err)
+	}
+}
@@ -0,0 +1,77 @@
+package sync_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/FBreuer2/librsync-go"
+	"github.com/FBreuer2/simple-sync/lib/sync"
+)
+
+const DELTA_BLOCK_LENGTH = 16
+
+const DELTA_TEXT = "Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua."
+
+var deltaCombinations = []struct {
+	name   string
+	basis  string
+	target string
+}{
+	{"identical", DELTA_TEXT, DELTA_TEXT},
+	{"appended", DELTA_TEXT, DELTA_TEXT + "appended"},
+	{"prepended", DELTA_TEXT, "prepended" + DELTA_TEXT},
+	{"changed", "the first block.the second one..the third block.", "the first block.THE SECOND ONE..the third block."},
+	{"short last block", "the first block.short", "something new...the first block.short"},
+	{"empty basis", "", "only new data"},
+	{"empty target", "the first block.", ""},
+}
+
+func TestDeltaPatch(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "simple-sync-delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootPath)
+
+	for _, instance := range deltaCombinations {
+		writeTreeFile(t, rootPath, "basis", instance.basis)
+
+		fileWatcher, err := sync.NewFileWatcher(filepath.Join(rootPath, "basis"))
+		if err != nil {
+			t.Fatalf("%s NewFileWatcher failed: %s", instance.name, err.Error())
+		}
+
+		signature, err := fileWatcher.GetCompleteFileInformation(DELTA_BLOCK_LENGTH, 32)
+		if err != nil {
+			t.Fatalf("%s GetCompleteFileInformation failed: %s", instance.name, err.Error())
+		}
+
+		delta := &bytes.Buffer{}
+
+		if err := sync.Delta(signature, strings.NewReader(instance.target), delta); err != nil {
+			t.Fatalf("%s Delta failed: %s", instance.name, err.Error())
+		}
+
+		if instance.name == "identical" && delta.Len() >= len(instance.target) {
+			t.Errorf("%s Delta expected less than %d bytes, actual %d", instance.name, len(instance.target), delta.Len())
+		}
+
+		patched := &bytes.Buffer{}
+
+		if err := librsync.Patch(bytes.NewReader([]byte(instance.basis)), delta, patched); err != nil {
+			t.Fatalf("%s Patch failed: %s", instance.name, err.Error())
+		}
+
+		if patched.String() != instance.target {
+			t.Errorf("%s Patch expected %q, actual %q", instance.name, instance.target, patched.String())
+		}
+	}
+
+	if err := sync.Delta(&sync.ExtendedFileMetadata{}, strings.NewReader("data"), ioutil.Discard); err != sync.INVALID_SIGNATURE {
+		t.Errorf("Delta without a block length expected INVALID_SIGNATURE, actual %v", err)
+	}
+}
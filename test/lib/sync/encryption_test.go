@@ -0,0 +1,220 @@
+package sync_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/FBreuer2/simple-sync/lib/sync"
+	"golang.org/x/crypto/blake2b"
+)
+
+var testEncryptedChunkLengths = sync.ChunkLengths{Minimum: 256, Average: 1024, Maximum: 4096}
+
+func newKeyring(t *testing.T, passphrase string, user string) *sync.Keyring {
+	keyring, err := sync.NewKeyring([]byte(passphrase), []byte(user))
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %s", err.Error())
+	}
+
+	return keyring
+}
+
+func TestKeyringBlocks(t *testing.T) {
+	keyring := newKeyring(t, "passphrase", "user")
+	block := []byte("some block of a file")
+
+	encryptedBlock := keyring.EncryptBlock(block)
+
+	if len(encryptedBlock) != len(block)+sync.ENCRYPTION_OVERHEAD || bytes.Contains(encryptedBlock, block) == true {
+		t.Fatalf("EncryptBlock returned %d bytes containing the block", len(encryptedBlock))
+	}
+
+	if bytes.Equal(keyring.EncryptBlock(block), encryptedBlock) == false {
+		t.Errorf("EncryptBlock of an equal block expected an equal ciphertext")
+	}
+
+	if decryptedBlock, err := keyring.DecryptBlock(encryptedBlock); err != nil || bytes.Equal(decryptedBlock, block) == false {
+		t.Errorf("DecryptBlock expected the block, actual %q (%v)", decryptedBlock, err)
+	}
+
+	for name, otherKeyring := range map[string]*sync.Keyring{
+		"other passphrase": newKeyring(t, "other passphrase", "user"),
+		"other user":       newKeyring(t, "passphrase", "other user"),
+	} {
+		if bytes.Equal(otherKeyring.EncryptBlock(block), encryptedBlock) == true {
+			t.Errorf("EncryptBlock with the %s expected another ciphertext", name)
+		}
+
+		if _, err := otherKeyring.DecryptBlock(encryptedBlock); errors.Is(err, sync.DECRYPTION_FAILED) == false {
+			t.Errorf("DecryptBlock with the %s expected DECRYPTION_FAILED, actual %v", name, err)
+		}
+	}
+
+	encryptedBlock[len(encryptedBlock)-1] ^= 1
+
+	if _, err := keyring.DecryptBlock(encryptedBlock); errors.Is(err, sync.DECRYPTION_FAILED) == false {
+		t.Errorf("DecryptBlock of a modified block expected DECRYPTION_FAILED, actual %v", err)
+	}
+}
+
+func TestKeyringPaths(t *testing.T) {
+	keyring := newKeyring(t, "passphrase", "user")
+
+	for _, path := range []string{"file.txt", "dir/file.txt", "dir/other.txt", "dir/sub/file.txt"} {
+		encryptedPath := keyring.EncryptPath(path)
+
+		if strings.Contains(encryptedPath, "file") == true || strings.Count(encryptedPath, "/") != strings.Count(path, "/") {
+			t.Errorf("EncryptPath(%s) returned %s", path, encryptedPath)
+		}
+
+		if normalizedPath, err := sync.NormalizePath(encryptedPath); err != nil || normalizedPath != encryptedPath {
+			t.Errorf("EncryptPath(%s) returned the invalid path %s", path, encryptedPath)
+		}
+
+		if decryptedPath, err := keyring.DecryptPath(encryptedPath); err != nil || decryptedPath != path {
+			t.Errorf("DecryptPath(EncryptPath(%s)) returned %s (%v)", path, decryptedPath, err)
+		}
+	}
+
+	// files of a directory stay in one directory
+	if strings.Split(keyring.EncryptPath("dir/file.txt"), "/")[0] != strings.Split(keyring.EncryptPath("dir/other.txt"), "/")[0] {
+		t.Errorf("EncryptPath of files in one directory expected the same directory")
+	}
+
+	if _, err := keyring.DecryptPath("not-encrypted"); errors.Is(err, sync.DECRYPTION_FAILED) == false {
+		t.Errorf("DecryptPath of a plain path expected DECRYPTION_FAILED, actual %v", err)
+	}
+}
+
+func encryptedBlocks(t *testing.T, encryptedFile *sync.EncryptedFile) (*sync.ExtendedFileMetadata, [][]byte) {
+	eFM, err := encryptedFile.GetChunkedFileInformation(testEncryptedChunkLengths, sync.ENCRYPTED_CHECKSUM_LENGTH)
+	if err != nil {
+		t.Fatalf("GetChunkedFileInformation failed: %s", err.Error())
+	}
+
+	if err := eFM.CheckChunks(testEncryptedChunkLengths); err != nil {
+		t.Fatalf("CheckChunks of the encrypted metadata failed: %s", err.Error())
+	}
+
+	blocks := make([][]byte, 0, len(eFM.StrongBlockHashes))
+
+	for index, strongHash := range eFM.StrongBlockHashes {
+		block, err := encryptedFile.ReadBlock(strongHash)
+		if err != nil {
+			t.Fatalf("ReadBlock(%d) failed: %s", index, err.Error())
+		}
+
+		if len(block) != int(eFM.BlockLengths[index]) || sync.VerifyBlock(block, strongHash) != nil {
+			t.Fatalf("ReadBlock(%d) returned a block not matching the metadata", index)
+		}
+
+		blocks = append(blocks, block)
+	}
+
+	return eFM, blocks
+}
+
+// TestEncryptedFile encrypts a file, decrypts its blocks again and checks
+// that an edit only changes the blocks around it and the header.
+func TestEncryptedFile(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "simple-sync-encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootPath)
+
+	data := randomData(4, 64*1024)
+	filePath := filepath.Join(rootPath, "file")
+
+	if err := ioutil.WriteFile(filePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fileWatcher, err := sync.NewFileWatcher(filePath)
+	if err != nil {
+		t.Fatalf("NewFileWatcher failed: %s", err.Error())
+	}
+
+	keyring := newKeyring(t, "passphrase", "user")
+
+	encryptedFile, err := sync.NewEncryptedFile(fileWatcher, keyring, testEncryptedChunkLengths)
+	if err != nil {
+		t.Fatalf("NewEncryptedFile failed: %s", err.Error())
+	}
+
+	sFM, err := encryptedFile.GetShortFileMetadata()
+	if err != nil {
+		t.Fatalf("GetShortFileMetadata failed: %s", err.Error())
+	}
+
+	eFM, blocks := encryptedBlocks(t, encryptedFile)
+
+	if sFM.FileSize != eFM.FileSize || sFM.FileSize == uint64(len(data)) {
+		t.Errorf("GetShortFileMetadata expected the size %d of the encrypted file, actual %d", eFM.FileSize, sFM.FileSize)
+	}
+
+	if plainHash := blake2b.Sum256(data); bytes.Equal(sFM.FileHash, plainHash[:]) == true {
+		t.Errorf("GetShortFileMetadata revealed the hash of the file")
+	}
+
+	if _, err := encryptedFile.GetCompleteFileInformation(1024, 32); errors.Is(err, sync.ENCRYPTION_NEEDS_CHUNKING) == false {
+		t.Errorf("GetCompleteFileInformation expected ENCRYPTION_NEEDS_CHUNKING, actual %v", err)
+	}
+
+	var decryptedData bytes.Buffer
+	fileDecrypter := sync.NewFileDecrypter(keyring, &decryptedData)
+
+	for index, block := range blocks {
+		if err := fileDecrypter.WriteBlock(block); err != nil {
+			t.Fatalf("WriteBlock(%d) failed: %s", index, err.Error())
+		}
+	}
+
+	if bytes.Equal(decryptedData.Bytes(), data) == false {
+		t.Errorf("FileDecrypter did not return the file")
+	}
+
+	plainSFM, _ := fileWatcher.GetShortFileMetadata()
+
+	if metadata := fileDecrypter.Metadata(); metadata == nil || metadata.FileSize != plainSFM.FileSize || bytes.Equal(metadata.FileHash, plainSFM.FileHash) == false || metadata.LastChanged.Equal(plainSFM.LastChanged) == false {
+		t.Errorf("FileDecrypter expected the metadata %+v, actual %+v", *plainSFM, metadata)
+	}
+
+	// a block in place of the header is rejected
+	if err := sync.NewFileDecrypter(keyring, ioutil.Discard).WriteBlock(blocks[1]); errors.Is(err, sync.INVALID_ENCRYPTED_HEADER) == false {
+		t.Errorf("WriteBlock of a block as header expected INVALID_ENCRYPTED_HEADER, actual %v", err)
+	}
+
+	originalBlocks := make(map[string]bool)
+
+	for _, strongHash := range eFM.StrongBlockHashes {
+		originalBlocks[string(strongHash)] = true
+	}
+
+	editedData := append(append(append([]byte{}, data[:len(data)/2]...), []byte("inserted")...), data[len(data)/2:]...)
+
+	if err := ioutil.WriteFile(filePath, editedData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fileWatcher.ResetCache()
+
+	editedEFM, _ := encryptedBlocks(t, encryptedFile)
+	changedBlocks := 0
+
+	for _, strongHash := range editedEFM.StrongBlockHashes {
+		if originalBlocks[string(strongHash)] == false {
+			changedBlocks += 1
+		}
+	}
+
+	// the header and the chunks around the edit
+	if changedBlocks < 2 || changedBlocks > 4 {
+		t.Errorf("Encrypting an edited file expected 2 to 4 new blocks, actual %d", changedBlocks)
+	}
+}
@@ -0,0 +1,107 @@
+package sync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/FBreuer2/simple-sync/lib/sync"
+)
+
+const NOTIFY_TIMEOUT = 5 * time.Second
+
+var notifierCombinations = []struct {
+	name        string
+	newNotifier func() *sync.Notifier
+}{
+	{"native", func() *sync.Notifier { return sync.NewNotifier(50 * time.Millisecond) }},
+	{"polling", func() *sync.Notifier { return sync.NewPollingNotifier(20*time.Millisecond, 50*time.Millisecond) }},
+}
+
+func TestNotifierDebounce(t *testing.T) {
+	for _, instance := range notifierCombinations {
+		rootPath, err := ioutil.TempDir("", "simple-sync-notify")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(rootPath)
+
+		notifier := instance.newNotifier()
+
+		if err := notifier.Add(rootPath); err != nil {
+			t.Fatalf("%s Notifier::Add failed: %s", instance.name, err.Error())
+		}
+
+		filePath := filepath.Join(rootPath, "file.txt")
+
+		// a burst of writes
+		for index := 0; index < 5; index++ {
+			writeTreeFile(t, rootPath, "file.txt", string(make([]byte, index+1)))
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		select {
+		case changedPaths := <-notifier.Events():
+			found := false
+			for _, changedPath := range changedPaths {
+				found = found || changedPath == filePath
+			}
+
+			if found == false {
+				t.Errorf("%s Notifier::Events expected %s, actual %v", instance.name, filePath, changedPaths)
+			}
+
+		case <-time.After(NOTIFY_TIMEOUT):
+			t.Errorf("%s Notifier::Events expected a change", instance.name)
+		}
+
+		select {
+		case changedPaths := <-notifier.Events():
+			t.Errorf("%s Notifier::Events expected one debounced event, actual another %v", instance.name, changedPaths)
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		notifier.Close()
+
+		if _, ok := <-notifier.Events(); ok == true {
+			t.Errorf("%s Notifier::Events expected to be closed", instance.name)
+		}
+	}
+}
+
+func TestFileWatcherWatch(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "simple-sync-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootPath)
+
+	writeTreeFile(t, rootPath, "file.txt", "before")
+
+	fileWatcher, err := sync.NewFileWatcher(filepath.Join(rootPath, "file.txt"))
+	if err != nil {
+		t.Fatalf("NewFileWatcher failed: %s", err.Error())
+	}
+
+	changed := make(chan bool, 1)
+
+	if err := fileWatcher.Watch(func() { changed <- true }); err != nil {
+		t.Fatalf("FileWatcher::Watch failed: %s", err.Error())
+	}
+	defer fileWatcher.StopWatching()
+
+	writeTreeFile(t, rootPath, "file.txt", "after the change")
+
+	select {
+	case <-changed:
+	case <-time.After(NOTIFY_TIMEOUT):
+		t.Fatalf("FileWatcher::Watch expected the callback to run")
+	}
+
+	shortFileMetadata, err := fileWatcher.GetShortFileMetadata()
+	if err != nil || shortFileMetadata.FileSize != uint64(len("after the change")) {
+		t.Errorf("GetShortFileMetadata after a change expected size %d, actual %v (%v)", len("after the change"), shortFileMetadata, err)
+	}
+}
@@ -0,0 +1,36 @@
+package sync_test
+
+import (
+	"testing"
+
+	"github.com/FBreuer2/simple-sync/lib/sync"
+)
+
+var normalizePathCombinations = []struct {
+	path       string
+	normalized string
+	err        error
+}{
+	{"file.bmp", "file.bmp", nil},
+	{"photos/./2020//file.bmp", "photos/2020/file.bmp", nil},
+	{"photos/../file.bmp", "file.bmp", nil},
+	{"", "", sync.INVALID_PATH},
+	{".", "", sync.INVALID_PATH},
+	{"/etc/passwd", "", sync.INVALID_PATH},
+	{"../file.bmp", "", sync.INVALID_PATH},
+	{"photos/../../file.bmp", "", sync.INVALID_PATH},
+}
+
+func TestNormalizePath(t *testing.T) {
+	for _, instance := range normalizePathCombinations {
+		normalized, err := sync.NormalizePath(instance.path)
+
+		if err != instance.err {
+			t.Errorf("NormalizePath(%q) expected error %v, actual %v", instance.path, instance.err, err)
+		}
+
+		if normalized != instance.normalized {
+			t.Errorf("NormalizePath(%q) expected %q, actual %q", instance.path, instance.normalized, normalized)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package sync_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/FBreuer2/librsync-go"
+	"github.com/FBreuer2/simple-sync/lib/sync"
+)
+
+var signatureCombinations = []struct {
+	name string
+	data string
+}{
+	{"empty", ""},
+	{"short", "short"},
+	{"full blocks", "the first block.the second one.."},
+	{"short last block", "the first block.short"},
+	{"repeated blocks", "the same block..the same block..the same block.."},
+}
+
+func TestSignFile(t *testing.T) {
+	for _, instance := range signatureCombinations {
+		signature, err := sync.SignFile(strings.NewReader(instance.data), DELTA_BLOCK_LENGTH, 32)
+		if err != nil {
+			t.Fatalf("%s SignFile failed: %s", instance.name, err.Error())
+		}
+
+		expected, err := librsync.Signature(strings.NewReader(instance.data), ioutil.Discard, DELTA_BLOCK_LENGTH, 32, librsync.BLAKE2_SIG_MAGIC)
+		if err != nil {
+			t.Fatalf("%s Signature failed: %s", instance.name, err.Error())
+		}
+
+		if signature.FileSize != uint64(len(instance.data)) {
+			t.Errorf("%s SignFile::FileSize expected %d, actual %d", instance.name, len(instance.data), signature.FileSize)
+		}
+
+		if signature.BlockAmount != uint64(len(expected.GetStrongChecksums())) || signature.CheckBlocks() != nil || signature.CheckFixedBlocks() != nil {
+			t.Fatalf("%s SignFile::BlockAmount expected %d, actual %d", instance.name, len(expected.GetStrongChecksums()), signature.BlockAmount)
+		}
+
+		for index, strongHash := range expected.GetStrongChecksums() {
+			if bytes.Equal(signature.StrongBlockHashes[index], strongHash) == false {
+				t.Errorf("%s SignFile::StrongBlockHashes[%d] expected %x, actual %x", instance.name, index, strongHash, signature.StrongBlockHashes[index])
+			}
+		}
+
+		if len(signature.WeakBlockHashes) != len(expected.GetWeakRollsum()) {
+			t.Errorf("%s SignFile::WeakBlockHashes expected %v, actual %v", instance.name, expected.GetWeakRollsum(), signature.WeakBlockHashes)
+		}
+
+		for weakBlockSum, index := range expected.GetWeakRollsum() {
+			if signature.WeakBlockHashes[weakBlockSum] != index || signature.WeakBlockSums[index] != weakBlockSum {
+				t.Errorf("%s SignFile::WeakBlockHashes[%d] expected %d, actual %d", instance.name, weakBlockSum, index, signature.WeakBlockHashes[weakBlockSum])
+			}
+		}
+	}
+
+	if _, err := sync.SignFile(strings.NewReader("data"), 0, 32); err != sync.INVALID_SIGNATURE {
+		t.Errorf("SignFile without a block length expected INVALID_SIGNATURE, actual %v", err)
+	}
+}
+
+func TestSignFileKeepsRepeatedWeakSums(t *testing.T) {
+	signature, err := sync.SignFile(strings.NewReader("the same block..the same block.."), DELTA_BLOCK_LENGTH, 32)
+	if err != nil {
+		t.Fatalf("SignFile failed: %s", err.Error())
+	}
+
+	if len(signature.WeakBlockSums) != 2 || signature.WeakBlockSums[0] != signature.WeakBlockSums[1] {
+		t.Fatalf("SignFile::WeakBlockSums expected two equal sums, actual %v", signature.WeakBlockSums)
+	}
+
+	if len(signature.WeakBlockHashes) != 1 || signature.WeakBlockHashes[signature.WeakBlockSums[0]] != 1 {
+		t.Errorf("SignFile::WeakBlockHashes expected the last block, actual %v", signature.WeakBlockHashes)
+	}
+}
+
+// TestCheckFixedBlocks changes the block amount of a signature, which then
+// no longer covers the file exactly.
+func TestCheckFixedBlocks(t *testing.T) {
+	signature, err := sync.SignFile(strings.NewReader("the first block.short"), DELTA_BLOCK_LENGTH, 32)
+	if err != nil {
+		t.Fatalf("SignFile failed: %s", err.Error())
+	}
+
+	for _, blockAmount := range []uint64{0, 1, 3} {
+		changed := *signature
+		changed.BlockAmount = blockAmount
+
+		if err := changed.CheckFixedBlocks(); err != sync.INVALID_BLOCKS {
+			t.Errorf("CheckFixedBlocks with %d blocks of a %d byte file expected INVALID_BLOCKS, actual %v", blockAmount, signature.FileSize, err)
+		}
+	}
+
+	changed := *signature
+	changed.BlockLength = 0
+
+	if err := changed.CheckFixedBlocks(); err != sync.INVALID_BLOCKS {
+		t.Errorf("CheckFixedBlocks without a block length expected INVALID_BLOCKS, actual %v", err)
+	}
+}
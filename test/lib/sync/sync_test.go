@@ -0,0 +1,27 @@
+package sync_test
+
+import (
+	"testing"
+
+	"github.com/FBreuer2/librsync-go"
+	"github.com/FBreuer2/simple-sync/lib/sync"
+)
+
+func TestVerifyBlock(t *testing.T) {
+	block := []byte("some block of a file")
+
+	strongHash, err := librsync.CalcStrongSum(block, librsync.BLAKE2_SIG_MAGIC, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sync.VerifyBlock(block, strongHash); err != nil {
+		t.Errorf("VerifyBlock for a matching block failed: %s", err.Error())
+	}
+
+	block[0] = 'S'
+
+	if err := sync.VerifyBlock(block, strongHash); err != sync.BLOCK_HASH_MISMATCH {
+		t.Errorf("VerifyBlock for a changed block expected BLOCK_HASH_MISMATCH, actual %v", err)
+	}
+}
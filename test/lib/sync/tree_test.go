@@ -0,0 +1,117 @@
+package sync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/FBreuer2/simple-sync/lib/sync"
+)
+
+// recordingSyncer remembers every call of a TreeWatcher.
+type recordingSyncer struct {
+	synced  []string
+	removed []string
+	moved   map[string]string
+}
+
+func newRecordingSyncer() *recordingSyncer {
+	return &recordingSyncer{moved: make(map[string]string)}
+}
+
+func (rS *recordingSyncer) SyncFile(relativePath string, fileWatcher *sync.FileWatcher) error {
+	rS.synced = append(rS.synced, relativePath)
+	return nil
+}
+
+func (rS *recordingSyncer) RemoveFile(relativePath string) error {
+	rS.removed = append(rS.removed, relativePath)
+	return nil
+}
+
+func (rS *recordingSyncer) MoveFile(oldRelativePath string, newRelativePath string, fileWatcher *sync.FileWatcher) error {
+	rS.moved[oldRelativePath] = newRelativePath
+	return nil
+}
+
+func writeTreeFile(t *testing.T, rootPath string, relativePath string, content string) {
+	filePath := filepath.Join(rootPath, filepath.FromSlash(relativePath))
+
+	if err := os.MkdirAll(filepath.Dir(filePath), os.FileMode(0700)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filePath, []byte(content), os.FileMode(0600)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTreeWatcherSync(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "simple-sync-tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootPath)
+
+	writeTreeFile(t, rootPath, "a.txt", "first file")
+	writeTreeFile(t, rootPath, "dir/b.txt", "second file")
+	writeTreeFile(t, rootPath, "dir/sub/c.txt", "third file")
+	writeTreeFile(t, rootPath, "d.txt", "fourth file")
+
+	treeWatcher, err := sync.NewTreeWatcher(rootPath)
+	if err != nil {
+		t.Fatalf("NewTreeWatcher failed: %s", err.Error())
+	}
+
+	syncer := newRecordingSyncer()
+
+	if err := treeWatcher.Sync(syncer); err != nil {
+		t.Fatalf("Sync failed: %s", err.Error())
+	}
+
+	expected := []string{"a.txt", "d.txt", "dir/b.txt", "dir/sub/c.txt"}
+	if reflect.DeepEqual(syncer.synced, expected) == false {
+		t.Errorf("Sync of a new tree expected %v, actual %v", expected, syncer.synced)
+	}
+
+	changes, err := treeWatcher.Scan()
+	if err != nil || changes.IsEmpty() == false {
+		t.Errorf("Scan of an unchanged tree expected no changes, actual %v (%v)", changes, err)
+	}
+
+	writeTreeFile(t, rootPath, "a.txt", "first file, changed")
+	writeTreeFile(t, rootPath, "e.txt", "fifth file")
+	os.Remove(filepath.Join(rootPath, "d.txt"))
+	os.Rename(filepath.Join(rootPath, "dir", "sub", "c.txt"), filepath.Join(rootPath, "c.txt"))
+
+	syncer = newRecordingSyncer()
+
+	if err := treeWatcher.Sync(syncer); err != nil {
+		t.Fatalf("Sync failed: %s", err.Error())
+	}
+
+	sort.Strings(syncer.synced)
+
+	expected = []string{"a.txt", "e.txt"}
+	if reflect.DeepEqual(syncer.synced, expected) == false {
+		t.Errorf("Sync of changed files expected %v, actual %v", expected, syncer.synced)
+	}
+
+	expected = []string{"d.txt"}
+	if reflect.DeepEqual(syncer.removed, expected) == false {
+		t.Errorf("Sync of removed files expected %v, actual %v", expected, syncer.removed)
+	}
+
+	expectedMoves := map[string]string{"dir/sub/c.txt": "c.txt"}
+	if reflect.DeepEqual(syncer.moved, expectedMoves) == false {
+		t.Errorf("Sync of moved files expected %v, actual %v", expectedMoves, syncer.moved)
+	}
+
+	expected = []string{"a.txt", "c.txt", "dir/b.txt", "e.txt"}
+	if reflect.DeepEqual(treeWatcher.Files(), expected) == false {
+		t.Errorf("Files expected %v, actual %v", expected, treeWatcher.Files())
+	}
+}